@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// userIDKey is the gin context key holding the authenticated user ID, and
+// roleKey the one holding the token's role claim
+const (
+	userIDKey = "userID"
+	roleKey   = "role"
+)
+
+// roleAdmin is the role claim that grants access to catalog management and
+// the /admin endpoints
+const roleAdmin = "admin"
+
+// tokenClaims are the JWT claims the API reads: the registered ones, of which
+// the subject is the user ID, and an optional role
+type tokenClaims struct {
+	jwt.RegisteredClaims
+	Role string `json:"role,omitempty"`
+}
+
+// guestCookie names the cookie identifying an anonymous shopper. Its value is
+// a random UUID, and the shopper's cart is stored under guestUserPrefix
+// followed by it.
+const (
+	guestCookie     = "guest_cart"
+	guestCookiePath = "/api/v1/cart"
+	guestUserPrefix = "guest:"
+)
+
+// authMiddleware validates an HMAC-signed Bearer JWT and stores its subject
+// as the authenticated user ID, along with its role. Requests without a valid
+// token are rejected with 401, so an empty secret rejects everything.
+func authMiddleware(secret string) gin.HandlerFunc {
+	keyFunc := func(*jwt.Token) (interface{}, error) {
+		return []byte(secret), nil
+	}
+
+	return func(c *gin.Context) {
+		tokenString, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !found || tokenString == "" {
+			abortWithError(c, http.StatusUnauthorized, errCodeUnauthorized, "Missing bearer token")
+			return
+		}
+
+		var claims tokenClaims
+		_, err := jwt.ParseWithClaims(tokenString, &claims, keyFunc,
+			jwt.WithValidMethods([]string{"HS256", "HS384", "HS512"}))
+		if secret == "" || err != nil || claims.Subject == "" {
+			abortWithError(c, http.StatusUnauthorized, errCodeUnauthorized, "Invalid or expired token")
+			return
+		}
+
+		c.Set(userIDKey, claims.Subject)
+		c.Set(roleKey, claims.Role)
+		c.Next()
+	}
+}
+
+// shopperMiddleware identifies whoever a cart request is for. A request with
+// a bearer token goes through authMiddleware, so a bad token still gets a
+// 401. Any other request is a guest, known by the guest cookie, which is set
+// on the first visit and renewed on every one after, lasting cookieMaxAge
+// (or the browser session when it is not positive).
+func shopperMiddleware(secret string, cookieMaxAge time.Duration) gin.HandlerFunc {
+	authenticate := authMiddleware(secret)
+
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") != "" {
+			authenticate(c)
+			return
+		}
+
+		sessionID, ok := guestSession(c)
+		if !ok {
+			sessionID = uuid.New().String()
+		}
+		maxAge := 0
+		if cookieMaxAge > 0 {
+			maxAge = int(cookieMaxAge / time.Second)
+		}
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(guestCookie, sessionID, maxAge, guestCookiePath, "", false, true)
+
+		c.Set(userIDKey, guestUserPrefix+sessionID)
+		c.Next()
+	}
+}
+
+// guestSession returns the session ID in the request's guest cookie, if it
+// carries a well-formed one
+func guestSession(c *gin.Context) (string, bool) {
+	raw, err := c.Cookie(guestCookie)
+	if err != nil {
+		return "", false
+	}
+	id, err := uuid.Parse(raw)
+	if err != nil {
+		return "", false
+	}
+	return id.String(), true
+}
+
+// clearGuestSession tells the browser to drop the guest cookie
+func clearGuestSession(c *gin.Context) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(guestCookie, "", -1, guestCookiePath, "", false, true)
+}
+
+// currentUserID returns the user ID stored by authMiddleware, or the guest
+// ID stored by shopperMiddleware
+func currentUserID(c *gin.Context) string {
+	return c.GetString(userIDKey)
+}
+
+// requireOwner rejects with 403 any request whose :userID path parameter
+// differs from the authenticated user. It must run after authMiddleware.
+func requireOwner() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Param("userID") != currentUserID(c) {
+			abortWithError(c, http.StatusForbidden, errCodeForbidden, "Access to another user's data is forbidden")
+			return
+		}
+		c.Next()
+	}
+}
+
+// isAdmin reports whether the request's token carries the admin role
+func isAdmin(c *gin.Context) bool {
+	return c.GetString(roleKey) == roleAdmin
+}
+
+// requireAdmin rejects with 403 any request whose token lacks the admin role.
+// It must run after authMiddleware.
+func requireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isAdmin(c) {
+			abortWithError(c, http.StatusForbidden, errCodeForbidden, "This endpoint requires the admin role")
+			return
+		}
+		c.Next()
+	}
+}
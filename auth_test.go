@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signTestToken signs a token for user123 with the given expiry and key
+func signTestToken(t *testing.T, expires time.Time, key string) string {
+	t.Helper()
+	claims := jwt.RegisteredClaims{Subject: "user123", ExpiresAt: jwt.NewNumericDate(expires)}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(key))
+	if err != nil {
+		t.Fatalf("signing token: %v", err)
+	}
+	return token
+}
+
+func TestAuthValidTokenIdentifiesUser(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	token := signTestToken(t, time.Now().Add(time.Hour), testJWTSecret)
+
+	// The cart belongs to the token's subject, whatever the query says
+	w := doRequest(t, r, http.MethodPost, "/api/v1/cart/add?user_id=someone-else", token, CartItem{ProductID: "p1", Quantity: 1})
+	decodeResponse(t, w, http.StatusOK, nil)
+	if _, err := app.store.GetCart("user123"); err != nil {
+		t.Errorf("no cart stored for the token's subject: %v", err)
+	}
+	if _, err := app.store.GetCart("someone-else"); err == nil {
+		t.Error("cart stored for the query's user_id")
+	}
+
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/orders/user123", token, nil), http.StatusOK, nil)
+}
+
+func TestAuthRejectsBadTokens(t *testing.T) {
+	r, _ := newTestServer(t)
+	valid := signTestToken(t, time.Now().Add(time.Hour), testJWTSecret)
+	parts := strings.Split(valid, ".")
+	tamperedSignature := parts[0] + "." + parts[1] + "." + strings.Repeat("A", len(parts[2]))
+
+	for name, token := range map[string]string{
+		"missing":            "",
+		"expired":            signTestToken(t, time.Now().Add(-time.Minute), testJWTSecret),
+		"tampered signature": tamperedSignature,
+		"wrong secret":       signTestToken(t, time.Now().Add(time.Hour), "other-secret"),
+	} {
+		var resp ErrorResponse
+		decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/checkout", token, nil), http.StatusUnauthorized, &resp)
+		if resp.Error.Code != errCodeUnauthorized {
+			t.Errorf("%s token: code = %s, want %s", name, resp.Error.Code, errCodeUnauthorized)
+		}
+	}
+}
+
+func TestOwnershipChecks(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	alice, bob := testToken(t, "alice", ""), testToken(t, "bob", "")
+	addToTestCart(t, r, alice, "p1", 1)
+	saveTestOrder(t, app, "alice", "p1")
+
+	for _, path := range []string{"/api/v1/cart/alice", "/api/v1/orders/alice"} {
+		if w := doRequest(t, r, http.MethodGet, path, alice, nil); w.Code != http.StatusOK {
+			t.Errorf("GET %s as alice = %d, want 200", path, w.Code)
+		}
+
+		var resp ErrorResponse
+		decodeResponse(t, doRequest(t, r, http.MethodGet, path, bob, nil), http.StatusForbidden, &resp)
+		if resp.Error.Code != errCodeForbidden {
+			t.Errorf("GET %s as bob: code = %s, want %s", path, resp.Error.Code, errCodeForbidden)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the runtime settings of the service. Defaults live in
+// defaultConfig and every field can be overridden through an environment
+// variable in loadConfig.
+type Config struct {
+	// Interface and port the HTTP server binds to; an empty host listens on
+	// every interface
+	Host string
+	Port string
+
+	// SQLite database file; empty keeps everything in memory
+	DatabasePath string
+
+	// Whether an empty store is filled with the sample catalog, coupons and
+	// discount codes at startup; on unless GIN_MODE is release
+	SeedData bool
+
+	// Weights of the blended "best" product sort
+	SortRatingWeight float64
+	SortSalesWeight  float64
+
+	// How long a cart line holds its units out of stock after it was last
+	// added to. Lapsed lines stay in the cart flagged unreserved and are
+	// checked against stock again at checkout. Zero means carts don't hold
+	// stock.
+	CartReservationTTL time.Duration
+
+	// Lowest stock level reported as available; products with fewer units are
+	// shown as out_of_stock, so a few units can be held back as a buffer
+	InStockMinimum int
+
+	// Whether the same coupon can be applied to a cart more than once
+	AllowCouponStacking bool
+
+	// Maximum number of searches executing at once and how long an excess
+	// search waits for a slot before being shed with 429
+	SearchMaxConcurrent int
+	SearchQueueTimeout  time.Duration
+
+	// Requests per second each client IP may make on average and how many
+	// it may make in a burst; a non-positive rate disables rate limiting
+	RateLimit      float64
+	RateLimitBurst int
+
+	// Proxies, as IPs or CIDR ranges, whose X-Forwarded-For and X-Real-IP
+	// headers are believed when working out the client IP for rate limiting
+	// and request logs. Empty trusts none, so the client is the peer address.
+	TrustedProxies []string
+
+	// How long a checkout Idempotency-Key keeps returning its original order
+	IdempotencyKeyTTL time.Duration
+
+	// Smallest cart subtotal, before discounts and shipping, that can be
+	// checked out; zero disables the minimum
+	MinOrderAmount float64
+
+	// How far back trending searches look
+	TrendingWindow time.Duration
+
+	// How long a cart may go without changes before it is deleted as
+	// abandoned, and how often carts are checked; non-positive disables it
+	CartTTL           time.Duration
+	CartSweepInterval time.Duration
+
+	// Whether only users with a delivered order containing a product may
+	// review it
+	VerifiedPurchaseOnly bool
+
+	// Shipping methods offered at checkout, keyed by name
+	ShippingMethods map[string]ShippingMethod
+
+	// ISO country code that shipping quotes treat as domestic
+	HomeCountry string
+
+	// HMAC secret used to verify bearer tokens
+	JWTSecret string
+
+	// HMAC key signing webhook deliveries, how many times a delivery is
+	// attempted and the wait before the first retry, doubled on each one
+	WebhookSecret       string
+	WebhookMaxAttempts  int
+	WebhookRetryBackoff time.Duration
+
+	// Smallest response body, in bytes, that is gzipped for clients that
+	// accept it
+	GzipMinSize int
+
+	// Origins allowed to call the API from a browser; empty disables CORS
+	CORSAllowedOrigins []string
+
+	// Image served for products without an ImageURL, empty to disable
+	PlaceholderImageURL string
+
+	// Whether a product's image URL must answer a HEAD request with an
+	// image content type before it is saved
+	VerifyImageURLs bool
+
+	// Highest stock level reported as low_stock rather than in_stock, and the
+	// default threshold of the low-stock listing
+	LowStockThreshold int
+
+	// Page size of paginated listings when no limit is given, and the largest
+	// limit allowed; larger limits are clamped and zero removes the cap
+	DefaultPageSize int
+	MaxPageSize     int
+
+	// How many distinct recently viewed products are kept per user; zero
+	// stops recording views
+	RecentlyViewedLimit int
+}
+
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Port: "3001",
+
+		SeedData: true,
+
+		SortRatingWeight: 0.7,
+		SortSalesWeight:  0.3,
+		InStockMinimum:   1,
+
+		SearchMaxConcurrent: 32,
+		SearchQueueTimeout:  250 * time.Millisecond,
+
+		RateLimit:      10,
+		RateLimitBurst: 20,
+
+		IdempotencyKeyTTL: 24 * time.Hour,
+
+		TrendingWindow: 24 * time.Hour,
+
+		CartTTL:           24 * time.Hour,
+		CartSweepInterval: 10 * time.Minute,
+
+		ShippingMethods: map[string]ShippingMethod{
+			"standard":  {Name: "standard", Cost: 9.99, Days: 5},
+			"express":   {Name: "express", Cost: 19.99, Days: 2},
+			"overnight": {Name: "overnight", Cost: 39.99, Days: 1},
+		},
+
+		HomeCountry: "US",
+
+		GzipMinSize: 1024,
+
+		WebhookMaxAttempts:  5,
+		WebhookRetryBackoff: time.Second,
+
+		PlaceholderImageURL: "https://example.com/placeholder.jpg",
+
+		LowStockThreshold: 10,
+
+		DefaultPageSize: 20,
+		MaxPageSize:     100,
+
+		RecentlyViewedLimit: 10,
+	}
+}
+
+// loadConfig applies environment overrides on top of the defaults
+func loadConfig() {
+	config.Host = os.Getenv("HOST")
+	if port := os.Getenv("PORT"); port != "" {
+		config.Port = port
+	}
+	config.DatabasePath = os.Getenv("DATABASE_PATH")
+	if os.Getenv("GIN_MODE") == "release" {
+		config.SeedData = false
+	}
+	config.SeedData = envBool("SEED_DATA", config.SeedData)
+
+	config.SortRatingWeight = envFloat("SORT_RATING_WEIGHT", config.SortRatingWeight)
+	config.SortSalesWeight = envFloat("SORT_SALES_WEIGHT", config.SortSalesWeight)
+	config.CartReservationTTL = envDuration("CART_RESERVATION_TTL", config.CartReservationTTL)
+	config.InStockMinimum = envInt("IN_STOCK_MINIMUM", config.InStockMinimum)
+	if config.InStockMinimum < 1 {
+		log.Printf("Ignoring non-positive IN_STOCK_MINIMUM=%d", config.InStockMinimum)
+		config.InStockMinimum = defaultConfig().InStockMinimum
+	}
+	config.AllowCouponStacking = envBool("ALLOW_COUPON_STACKING", config.AllowCouponStacking)
+	config.VerifiedPurchaseOnly = envBool("VERIFIED_PURCHASE_ONLY", config.VerifiedPurchaseOnly)
+	config.SearchMaxConcurrent = envInt("SEARCH_MAX_CONCURRENT", config.SearchMaxConcurrent)
+	config.SearchQueueTimeout = envDuration("SEARCH_QUEUE_TIMEOUT", config.SearchQueueTimeout)
+	config.RateLimit = envFloat("RATE_LIMIT", config.RateLimit)
+	config.RateLimitBurst = envInt("RATE_LIMIT_BURST", config.RateLimitBurst)
+	config.TrustedProxies = envList("TRUSTED_PROXIES")
+	config.IdempotencyKeyTTL = envDuration("IDEMPOTENCY_KEY_TTL", config.IdempotencyKeyTTL)
+	config.MinOrderAmount = envFloat("MIN_ORDER_AMOUNT", config.MinOrderAmount)
+	config.TrendingWindow = envDuration("TRENDING_WINDOW", config.TrendingWindow)
+	config.CartTTL = envDuration("CART_TTL", config.CartTTL)
+	config.CartSweepInterval = envDuration("CART_SWEEP_INTERVAL", config.CartSweepInterval)
+
+	if country := os.Getenv("HOME_COUNTRY"); country != "" {
+		config.HomeCountry = country
+	}
+
+	config.JWTSecret = os.Getenv("JWT_SECRET")
+	config.CORSAllowedOrigins = envList("CORS_ALLOWED_ORIGINS")
+	config.GzipMinSize = envInt("GZIP_MIN_SIZE", config.GzipMinSize)
+	config.WebhookSecret = os.Getenv("WEBHOOK_SECRET")
+	config.WebhookMaxAttempts = envInt("WEBHOOK_MAX_ATTEMPTS", config.WebhookMaxAttempts)
+	config.WebhookRetryBackoff = envDuration("WEBHOOK_RETRY_BACKOFF", config.WebhookRetryBackoff)
+	config.VerifyImageURLs = envBool("VERIFY_IMAGE_URLS", config.VerifyImageURLs)
+	config.LowStockThreshold = envInt("LOW_STOCK_THRESHOLD", config.LowStockThreshold)
+	config.DefaultPageSize = envInt("DEFAULT_PAGE_SIZE", config.DefaultPageSize)
+	config.MaxPageSize = envInt("MAX_PAGE_SIZE", config.MaxPageSize)
+	if config.DefaultPageSize < 1 {
+		log.Printf("Ignoring non-positive DEFAULT_PAGE_SIZE=%d", config.DefaultPageSize)
+		config.DefaultPageSize = defaultConfig().DefaultPageSize
+	}
+	if config.MaxPageSize > 0 && config.DefaultPageSize > config.MaxPageSize {
+		log.Printf("DEFAULT_PAGE_SIZE=%d is above MAX_PAGE_SIZE, using %d", config.DefaultPageSize, config.MaxPageSize)
+		config.DefaultPageSize = config.MaxPageSize
+	}
+	config.RecentlyViewedLimit = envInt("RECENTLY_VIEWED_LIMIT", config.RecentlyViewedLimit)
+	if placeholder, set := os.LookupEnv("PLACEHOLDER_IMAGE_URL"); set {
+		config.PlaceholderImageURL = placeholder
+	}
+
+	// SHIPPING_<METHOD>_COST and SHIPPING_<METHOD>_DAYS, e.g. SHIPPING_EXPRESS_COST
+	for name, method := range config.ShippingMethods {
+		prefix := "SHIPPING_" + strings.ToUpper(name)
+		method.Cost = envFloat(prefix+"_COST", method.Cost)
+		method.Days = envInt(prefix+"_DAYS", method.Days)
+		config.ShippingMethods[name] = method
+	}
+}
+
+// listenAddr validates the configured port and joins it with the host into
+// the server's bind address
+func (c Config) listenAddr() (string, error) {
+	port, err := strconv.Atoi(c.Port)
+	if err != nil || port < 1 || port > 65535 {
+		return "", fmt.Errorf("invalid PORT %q: must be a number between 1 and 65535", c.Port)
+	}
+	return net.JoinHostPort(c.Host, c.Port), nil
+}
+
+// publicURL is the base URL advertised to API clients
+func (c Config) publicURL() string {
+	return "http://" + c.publicHost()
+}
+
+// publicHost is the host:port part of publicURL
+func (c Config) publicHost() string {
+	host := c.Host
+	if host == "" || host == "0.0.0.0" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, c.Port)
+}
+
+// envFloat reads a float from the environment, keeping the fallback when the
+// variable is unset or malformed
+func envFloat(key string, fallback float64) float64 {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, raw, err)
+		return fallback
+	}
+	return value
+}
+
+// envList reads a comma-separated list from the environment, dropping empty
+// entries
+func envList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// envInt reads an integer from the environment, keeping the fallback when the
+// variable is unset or malformed
+func envInt(key string, fallback int) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, raw, err)
+		return fallback
+	}
+	return value
+}
+
+// envDuration reads a duration such as "250ms" or "24h" from the
+// environment, keeping the fallback when the variable is unset or malformed
+func envDuration(key string, fallback time.Duration) time.Duration {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, raw, err)
+		return fallback
+	}
+	return value
+}
+
+// envBool reads a boolean from the environment, keeping the fallback when the
+// variable is unset or malformed
+func envBool(key string, fallback bool) bool {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	value, err := strconv.ParseBool(raw)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, raw, err)
+		return fallback
+	}
+	return value
+}
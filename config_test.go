@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// loadTestConfig runs loadConfig over the default configuration, restoring
+// the previous one once the test ends
+func loadTestConfig(t *testing.T) {
+	t.Helper()
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config = defaultConfig()
+	loadConfig()
+}
+
+func TestListenAddrFromEnvironment(t *testing.T) {
+	for name, tc := range map[string]struct {
+		host, port, want string
+	}{
+		"defaults":  {"", "", ":3001"},
+		"port only": {"", "8080", ":8080"},
+		"host":      {"127.0.0.1", "9000", "127.0.0.1:9000"},
+		"ipv6 host": {"::1", "9000", "[::1]:9000"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("HOST", tc.host)
+			t.Setenv("PORT", tc.port)
+			loadTestConfig(t)
+
+			addr, err := config.listenAddr()
+			if err != nil || addr != tc.want {
+				t.Errorf("listenAddr() = %q, %v; want %q", addr, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestListenAddrRejectsInvalidPort(t *testing.T) {
+	for _, port := range []string{"http", "0", "65536", "-1"} {
+		t.Setenv("PORT", port)
+		loadTestConfig(t)
+		if addr, err := config.listenAddr(); err == nil {
+			t.Errorf("PORT=%s: listenAddr() = %q, want an error", port, addr)
+		}
+	}
+}
+
+func TestOpenAPIServerMatchesListenAddr(t *testing.T) {
+	t.Setenv("HOST", "")
+	t.Setenv("PORT", "8123")
+	loadTestConfig(t)
+	gin.SetMode(gin.TestMode)
+	r := newRouter(newAPI(newInMemoryStore()))
+
+	var spec struct {
+		Servers []struct {
+			URL string `json:"url"`
+		} `json:"servers"`
+	}
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/openapi.json", "", nil), http.StatusOK, &spec)
+	if len(spec.Servers) != 1 || spec.Servers[0].URL != "http://localhost:8123" {
+		t.Errorf("servers = %+v, want http://localhost:8123", spec.Servers)
+	}
+}
+
+func TestSeedDataFlag(t *testing.T) {
+	for name, tc := range map[string]struct {
+		ginMode, seedData string
+		want              bool
+	}{
+		"development":           {"", "", true},
+		"release":               {"release", "", false},
+		"release with override": {"release", "true", true},
+		"turned off":            {"", "false", false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("GIN_MODE", tc.ginMode)
+			t.Setenv("SEED_DATA", tc.seedData)
+			loadTestConfig(t)
+			if config.SeedData != tc.want {
+				t.Errorf("SeedData = %v, want %v", config.SeedData, tc.want)
+			}
+		})
+	}
+}
+
+func TestPageSizesFromEnvironment(t *testing.T) {
+	for name, tc := range map[string]struct {
+		defaultSize, maxSize string
+		wantDefault, wantMax int
+	}{
+		"defaults":             {"", "", 20, 100},
+		"both set":             {"10", "50", 10, 50},
+		"default above max":    {"80", "50", 50, 50},
+		"non-positive default": {"0", "", 20, 100},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("DEFAULT_PAGE_SIZE", tc.defaultSize)
+			t.Setenv("MAX_PAGE_SIZE", tc.maxSize)
+			loadTestConfig(t)
+			if config.DefaultPageSize != tc.wantDefault || config.MaxPageSize != tc.wantMax {
+				t.Errorf("page sizes = %d, %d; want %d, %d", config.DefaultPageSize, config.MaxPageSize, tc.wantDefault, tc.wantMax)
+			}
+		})
+	}
+}
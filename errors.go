@@ -0,0 +1,72 @@
+package main
+
+import "github.com/gin-gonic/gin"
+
+// ErrorResponse is the body of every error response
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// APIError describes what went wrong. Code is stable and meant for programs,
+// Message is meant for people and may change.
+type APIError struct {
+	Code    string      `json:"code" example:"PRODUCT_NOT_FOUND"`
+	Message string      `json:"message" example:"Product not found"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// Error codes returned in APIError.Code
+const (
+	// The request body, a parameter or a header is malformed or invalid
+	errCodeInvalidRequest       = "INVALID_REQUEST"
+	errCodeUnsupportedMediaType = "UNSUPPORTED_MEDIA_TYPE"
+
+	errCodeUnauthorized     = "UNAUTHORIZED"
+	errCodeForbidden        = "FORBIDDEN"
+	errCodeOriginNotAllowed = "ORIGIN_NOT_ALLOWED"
+
+	errCodeRouteNotFound    = "ROUTE_NOT_FOUND"
+	errCodeMethodNotAllowed = "METHOD_NOT_ALLOWED"
+	errCodeRateLimited      = "RATE_LIMITED"
+	errCodeServerBusy       = "SERVER_BUSY"
+	errCodeInternal         = "INTERNAL_ERROR"
+
+	errCodeProductNotFound = "PRODUCT_NOT_FOUND"
+	errCodeCartNotFound    = "CART_NOT_FOUND"
+	errCodeCartEmpty       = "CART_EMPTY"
+	errCodeItemNotInCart   = "ITEM_NOT_IN_CART"
+	errCodeItemNotSaved    = "ITEM_NOT_SAVED"
+	errCodeOrderNotFound   = "ORDER_NOT_FOUND"
+	errCodeWebhookNotFound = "WEBHOOK_NOT_FOUND"
+
+	errCodeInsufficientStock    = "INSUFFICIENT_STOCK"
+	errCodeInvalidCoupon        = "INVALID_COUPON"
+	errCodeCouponAlreadyApplied = "COUPON_ALREADY_APPLIED"
+	errCodeInvalidDiscountCode  = "INVALID_DISCOUNT_CODE"
+	errCodeBelowMinimumOrder    = "ORDER_BELOW_MINIMUM"
+
+	errCodeOrderCancelled          = "ORDER_CANCELLED"
+	errCodeOrderNotCancellable     = "ORDER_NOT_CANCELLABLE"
+	errCodeInvalidStatusTransition = "INVALID_STATUS_TRANSITION"
+	errCodeProductNotInOrder       = "PRODUCT_NOT_IN_ORDER"
+
+	errCodeReviewNotAllowed = "REVIEW_NOT_ALLOWED"
+)
+
+// respondError writes an error response with the given status, code and
+// message
+func respondError(c *gin.Context, status int, code, message string) {
+	c.JSON(status, ErrorResponse{Error: APIError{Code: code, Message: message}})
+}
+
+// respondErrorDetails is respondError with extra machine-readable details,
+// such as the index of the offending item in a batch
+func respondErrorDetails(c *gin.Context, status int, code, message string, details interface{}) {
+	c.JSON(status, ErrorResponse{Error: APIError{Code: code, Message: message, Details: details}})
+}
+
+// abortWithError writes an error response and stops the handler chain, for
+// use in middleware
+func abortWithError(c *gin.Context, status int, code, message string) {
+	c.AbortWithStatusJSON(status, ErrorResponse{Error: APIError{Code: code, Message: message}})
+}
@@ -4,11 +4,22 @@ const API_BASE_URL = 'http://localhost:3001/api/v1';
 
 const api = axios.create({
   baseURL: API_BASE_URL,
+  // Sends the guest cart cookie for shoppers who haven't logged in
+  withCredentials: true,
   headers: {
     'Content-Type': 'application/json',
   },
 });
 
+// Cart, checkout, order and recommendation endpoints need a bearer token
+api.interceptors.request.use((config) => {
+  const token = localStorage.getItem('authToken');
+  if (token) {
+    config.headers.Authorization = `Bearer ${token}`;
+  }
+  return config;
+});
+
 // Types
 export interface Product {
   id: string;
@@ -19,11 +30,47 @@ export interface Product {
   stock: number;
   rating: number;
   image_url: string;
+  weight?: number;
+  tags?: string[];
+  sale_price?: number;
+  sale_start?: string;
+  sale_end?: string;
+  on_sale?: boolean;
+  original_price?: number;
+  image_placeholder?: boolean;
+  deleted_at?: string;
+  deleted?: boolean;
+  availability?: 'in_stock' | 'low_stock' | 'out_of_stock';
+}
+
+export interface Review {
+  id: string;
+  product_id: string;
+  user_id: string;
+  rating: number;
+  comment?: string;
+  verified: boolean;
+  timestamp: string;
+}
+
+export interface CategoryCount {
+  name: string;
+  count: number;
+}
+
+export interface TrendingSearch {
+  query: string;
+  count: number;
 }
 
 export interface CartItem {
   product_id: string;
   quantity: number;
+  unit_price?: number;
+  subtotal?: number;
+  unavailable?: boolean;
+  reserved_until?: string;
+  unreserved?: boolean;
   product?: Product;
 }
 
@@ -38,26 +85,83 @@ export interface Cart {
   id: string;
   user_id: string;
   items: CartItem[];
+  saved?: CartItem[];
   total: number;
+  item_count?: number;
+  coupons?: string[];
   updated: string;
 }
 
+export interface Page<T> {
+  data: T[];
+  total: number;
+  limit: number;
+  offset: number;
+  next?: string | null;
+  prev?: string | null;
+}
+
+export interface OrderItem {
+  product_id: string;
+  quantity: number;
+  fulfillment_status: 'pending' | 'shipped';
+  name?: string;
+  category?: string;
+  unit_price?: number;
+}
+
+export type ShippingMethod = 'standard' | 'express' | 'overnight';
+
+export interface ShippingOption {
+  name: string;
+  cost: number;
+  days: number;
+}
+
+export interface ShippingQuote {
+  cart_id: string;
+  country: string;
+  postal_code?: string;
+  domestic: boolean;
+  weight: number;
+  options: ShippingOption[];
+}
+
+export type OrderStatus =
+  | 'pending'
+  | 'paid'
+  | 'partially_shipped'
+  | 'shipped'
+  | 'delivered'
+  | 'cancelled';
+
 export interface Order {
   id: string;
+  order_number?: string;
   user_id: string;
-  items: CartItem[];
+  items: OrderItem[];
   total: number;
-  status: string;
+  status: OrderStatus;
   created: string;
-  completed: string;
+  completed?: string;
+  shipping_method: ShippingMethod;
+  shipping_cost: number;
+  estimated_delivery: string;
+  discount_code?: string;
+  discount?: number;
+  tax: number;
+}
+
+export interface OrderDetail extends Order {
+  subtotal: number;
 }
 
 // API functions
 export const apiService = {
   // Products
-  getProducts: async (): Promise<Product[]> => {
-    const response = await api.get('/products');
-    return response.data;
+  getProducts: async (limit: number = 100, offset: number = 0): Promise<Product[]> => {
+    const response = await api.get<Page<Product>>(`/products?limit=${limit}&offset=${offset}`);
+    return response.data.data;
   },
 
   getProduct: async (id: string): Promise<Product> => {
@@ -70,22 +174,69 @@ export const apiService = {
     return response.data;
   },
 
+  getCategories: async (): Promise<CategoryCount[]> => {
+    const response = await api.get('/categories');
+    return response.data;
+  },
+
+  getLowStockProducts: async (threshold: number = 10): Promise<Product[]> => {
+    const response = await api.get(`/products/low-stock?threshold=${threshold}`);
+    return response.data;
+  },
+
+  getRelatedProducts: async (productId: string, limit: number = 5): Promise<Product[]> => {
+    const response = await api.get(`/products/${productId}/related?limit=${limit}`);
+    return response.data;
+  },
+
+  getReviews: async (productId: string): Promise<Review[]> => {
+    const response = await api.get(`/products/${productId}/reviews`);
+    return response.data;
+  },
+
+  addReview: async (productId: string, rating: number, comment?: string): Promise<Review> => {
+    const response = await api.post(`/products/${productId}/reviews`, { rating, comment });
+    return response.data;
+  },
+
   // Search
-  searchProducts: async (query: string, userId?: string): Promise<Product[]> => {
-    const params = new URLSearchParams({ q: query });
+  searchProducts: async (
+    query: string,
+    userId?: string,
+    category?: string,
+    limit: number = 20,
+    offset: number = 0
+  ): Promise<Page<Product>> => {
+    const params = new URLSearchParams({ q: query, limit: String(limit), offset: String(offset) });
     if (userId) params.append('user_id', userId);
-    const response = await api.get(`/search?${params}`);
+    if (category) params.append('category', category);
+    const response = await api.get<Page<Product>>(`/search?${params}`);
+    return response.data;
+  },
+
+  suggestSearches: async (query: string): Promise<string[]> => {
+    const response = await api.get('/search/suggest', { params: { q: query } });
+    return response.data;
+  },
+
+  getTrendingSearches: async (limit: number = 10): Promise<TrendingSearch[]> => {
+    const response = await api.get(`/search/trending?limit=${limit}`);
     return response.data;
   },
 
   // Cart
   addToCart: async (userId: string, item: CartItem): Promise<Cart> => {
-    const response = await api.post(`/cart/add?user_id=${userId}`, item);
+    const response = await api.post('/cart/add', item);
+    return response.data;
+  },
+
+  batchAddToCart: async (userId: string, items: CartItem[]): Promise<Cart> => {
+    const response = await api.post(`/cart/${userId}/batch`, items);
     return response.data;
   },
 
   removeFromCart: async (userId: string, item: CartItem): Promise<Cart> => {
-    const response = await api.delete(`/cart/remove?user_id=${userId}`, { data: item });
+    const response = await api.delete('/cart/remove', { data: item });
     return response.data;
   },
 
@@ -94,9 +245,49 @@ export const apiService = {
     return response.data;
   },
 
+  getOwnCart: async (): Promise<Cart> => {
+    const response = await api.get('/cart');
+    return response.data;
+  },
+
+  mergeGuestCart: async (): Promise<Cart> => {
+    const response = await api.post('/cart/merge');
+    return response.data;
+  },
+
+  saveForLater: async (userId: string, productId: string): Promise<Cart> => {
+    const response = await api.post(`/cart/${userId}/save/${productId}`);
+    return response.data;
+  },
+
+  moveToCart: async (userId: string, productId: string): Promise<Cart> => {
+    const response = await api.post(`/cart/${userId}/unsave/${productId}`);
+    return response.data;
+  },
+
+  quoteShipping: async (
+    userId: string,
+    country: string,
+    postalCode?: string
+  ): Promise<ShippingQuote> => {
+    const response = await api.post(`/cart/${userId}/shipping`, {
+      country,
+      postal_code: postalCode,
+    });
+    return response.data;
+  },
+
   // Checkout
-  checkout: async (userId: string): Promise<Order> => {
-    const response = await api.post(`/checkout?user_id=${userId}`);
+  checkout: async (
+    userId: string,
+    shippingMethod?: ShippingMethod,
+    discountCode?: string,
+    idempotencyKey?: string
+  ): Promise<Order> => {
+    const body = shippingMethod ? { shipping_method: shippingMethod } : undefined;
+    const params = discountCode ? { discount_code: discountCode } : undefined;
+    const headers = idempotencyKey ? { 'Idempotency-Key': idempotencyKey } : undefined;
+    const response = await api.post('/checkout', body, { params, headers });
     return response.data;
   },
 
@@ -106,11 +297,39 @@ export const apiService = {
     return response.data;
   },
 
+  getOrder: async (orderId: string): Promise<OrderDetail> => {
+    const response = await api.get(`/orders/detail/${orderId}`);
+    return response.data;
+  },
+
+  getOrderReceiptText: async (orderId: string): Promise<string> => {
+    const response = await api.get(`/orders/detail/${orderId}/receipt`, {
+      params: { format: 'text' },
+      responseType: 'text',
+    });
+    return response.data;
+  },
+
+  updateOrderStatus: async (orderId: string, status: OrderStatus): Promise<Order> => {
+    const response = await api.post(`/orders/${orderId}/status`, { status });
+    return response.data;
+  },
+
+  cancelOrder: async (orderId: string): Promise<Order> => {
+    const response = await api.post(`/orders/${orderId}/cancel`);
+    return response.data;
+  },
+
   // Recommendations
   getRecommendations: async (userId: string, limit: number = 5): Promise<Product[]> => {
     const response = await api.get(`/recommendations/${userId}?limit=${limit}`);
     return response.data;
   },
+
+  getRecentlyViewed: async (userId: string): Promise<Product[]> => {
+    const response = await api.get(`/users/${userId}/recently-viewed`);
+    return response.data;
+  },
 };
 
 export default apiService;
@@ -1,12 +1,41 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	swaggerFiles "github.com/swaggo/files"
+	ginSwagger "github.com/swaggo/gin-swagger"
+
+	"shitty/docs"
 )
 
 // Product represents a product in the system
@@ -19,6 +48,115 @@ type Product struct {
 	Stock       int     `json:"stock" example:"50"`
 	Rating      float64 `json:"rating" example:"4.5"`
 	ImageURL    string  `json:"image_url" example:"https://example.com/iphone.jpg"`
+	Weight      float64 `json:"weight,omitempty" example:"0.19"` // kilograms
+
+	// Optional keywords that search matches on besides the name, category
+	// and description. Stored lowercased, without blanks or duplicates.
+	Tags []string `json:"tags,omitempty" example:"smartphone,apple"`
+
+	// Optional flash sale, SalePrice applies from SaleStart until SaleEnd
+	SalePrice float64    `json:"sale_price,omitempty" example:"899.99"`
+	SaleStart *time.Time `json:"sale_start,omitempty" example:"2023-12-01T00:00:00Z"`
+	SaleEnd   *time.Time `json:"sale_end,omitempty" example:"2023-12-02T00:00:00Z"`
+
+	// Set once the product is deleted. Deleted products are kept so order
+	// history can still show them, but only a lookup by ID returns them.
+	DeletedAt *time.Time `json:"deleted_at,omitempty" example:"2023-12-03T00:00:00Z"`
+}
+
+// ProductPatch is a partial product update. Only the fields present in the
+// request are changed, so a field can be set to zero without resending the
+// rest of the product.
+type ProductPatch struct {
+	Name        *string    `json:"name" example:"iPhone 15 Pro"`
+	Description *string    `json:"description" example:"Latest iPhone with advanced features"`
+	Price       *float64   `json:"price" example:"949.99"`
+	Category    *string    `json:"category" example:"Electronics"`
+	Stock       *int       `json:"stock" example:"0"`
+	Rating      *float64   `json:"rating" example:"4.5"`
+	ImageURL    *string    `json:"image_url" example:"https://example.com/iphone.jpg"`
+	Weight      *float64   `json:"weight" example:"0.19"`
+	SalePrice   *float64   `json:"sale_price" example:"899.99"`
+	SaleStart   *time.Time `json:"sale_start" example:"2023-12-01T00:00:00Z"`
+	SaleEnd     *time.Time `json:"sale_end" example:"2023-12-02T00:00:00Z"`
+	Tags        *[]string  `json:"tags" example:"smartphone,apple"`
+}
+
+// apply returns product with the patched fields overwritten
+func (p ProductPatch) apply(product Product) Product {
+	if p.Name != nil {
+		product.Name = *p.Name
+	}
+	if p.Description != nil {
+		product.Description = *p.Description
+	}
+	if p.Price != nil {
+		product.Price = *p.Price
+	}
+	if p.Category != nil {
+		product.Category = *p.Category
+	}
+	if p.Stock != nil {
+		product.Stock = *p.Stock
+	}
+	if p.Rating != nil {
+		product.Rating = *p.Rating
+	}
+	if p.ImageURL != nil {
+		product.ImageURL = *p.ImageURL
+	}
+	if p.Weight != nil {
+		product.Weight = *p.Weight
+	}
+	if p.SalePrice != nil {
+		product.SalePrice = *p.SalePrice
+	}
+	if p.SaleStart != nil {
+		product.SaleStart = p.SaleStart
+	}
+	if p.SaleEnd != nil {
+		product.SaleEnd = p.SaleEnd
+	}
+	if p.Tags != nil {
+		product.Tags = normalizeTags(*p.Tags)
+	}
+	return product
+}
+
+// ProductView is the serialized form of a product. Price is the effective
+// price at response time and fields derived from the stored Product are added.
+type ProductView struct {
+	Product
+	OnSale           bool    `json:"on_sale" example:"true"`
+	OriginalPrice    float64 `json:"original_price,omitempty" example:"999.99"`
+	ImagePlaceholder bool    `json:"image_placeholder" example:"false"`
+	Deleted          bool    `json:"deleted,omitempty" example:"false"`
+	Availability     string  `json:"availability" example:"in_stock"`
+}
+
+// Availability bands of a product, derived from its stock
+const (
+	availabilityInStock    = "in_stock"
+	availabilityLowStock   = "low_stock"
+	availabilityOutOfStock = "out_of_stock"
+)
+
+// SearchResult is a search match with its relevance score, returned instead
+// of a plain ProductView when a search is run with debug=true
+type SearchResult struct {
+	ProductView
+	Score float64 `json:"score" example:"9"`
+}
+
+// SearchResultPage is a page of debug search results, in the same envelope
+// as ProductPage
+type SearchResultPage struct {
+	Data   []SearchResult `json:"data"`
+	Total  int            `json:"total" example:"5"`
+	Limit  int            `json:"limit" example:"20"`
+	Offset int            `json:"offset" example:"0"`
+	Next   *string        `json:"next" example:"/api/v1/search?limit=20&offset=20&q=pro"`
+	Prev   *string        `json:"prev" example:"/api/v1/search?limit=20&offset=0&q=pro"`
 }
 
 // CartItem represents an item in the shopping cart
@@ -27,26 +165,188 @@ type CartItem struct {
 	Quantity  int    `json:"quantity" example:"2"`
 }
 
-// Cart represents a user's shopping cart
+// Cart represents a user's shopping cart. Saved holds items put aside for
+// later; they don't count towards the total, reserve stock or get checked out.
 type Cart struct {
-	ID       string     `json:"id" example:"123e4567-e89b-12d3-a456-426614174000"`
-	UserID   string     `json:"user_id" example:"user123"`
-	Items    []CartItem `json:"items"`
-	Total    float64    `json:"total" example:"1999.98"`
-	Updated  time.Time  `json:"updated" example:"2023-12-01T10:00:00Z"`
+	ID      string     `json:"id" example:"123e4567-e89b-12d3-a456-426614174000"`
+	UserID  string     `json:"user_id" example:"user123"`
+	Items   []CartItem `json:"items"`
+	Saved   []CartItem `json:"saved,omitempty"`
+	Total   float64    `json:"total" example:"1999.98"`
+	Coupons []string   `json:"coupons,omitempty" example:"SAVE10"`
+	Updated time.Time  `json:"updated" example:"2023-12-01T10:00:00Z"`
+
+	// Reservations maps the product ID of every line holding its units out
+	// of stock to when the hold lapses; see CART_RESERVATION_TTL
+	Reservations map[string]time.Time `json:"-"`
+}
+
+// OrderItem represents a single line of an order and its fulfillment state.
+// Name, Category and UnitPrice are copied from the product at checkout so the
+// line keeps describing what was bought after the product changes; orders
+// placed before they were recorded leave them empty.
+type OrderItem struct {
+	ProductID         string  `json:"product_id" example:"123e4567-e89b-12d3-a456-426614174000"`
+	Quantity          int     `json:"quantity" example:"2"`
+	FulfillmentStatus string  `json:"fulfillment_status" example:"pending"`
+	Name              string  `json:"name,omitempty" example:"iPhone 15 Pro"`
+	Category          string  `json:"category,omitempty" example:"Electronics"`
+	UnitPrice         float64 `json:"unit_price,omitempty" example:"999.99"`
+}
+
+// CartLineView is a cart item enriched with its current pricing. Unavailable
+// marks an item whose product has been deleted; it is priced at zero and left
+// out of the total.
+type CartLineView struct {
+	CartItem
+	UnitPrice   float64 `json:"unit_price" example:"999.99"`
+	Subtotal    float64 `json:"subtotal" example:"1999.98"`
+	Unavailable bool    `json:"unavailable,omitempty" example:"false"`
+
+	// With CART_RESERVATION_TTL set, when the line's hold on stock lapses,
+	// or that it has none any more and needs stock again at checkout
+	ReservedUntil *time.Time `json:"reserved_until,omitempty" example:"2023-12-01T10:15:00Z"`
+	Unreserved    bool       `json:"unreserved,omitempty" example:"false"`
+}
+
+// CartView is the serialized form of a cart returned by getCart
+type CartView struct {
+	Cart
+	Items     []CartLineView `json:"items"`
+	ItemCount int            `json:"item_count" example:"2"`
 }
 
-// Order represents a completed order
+// Order represents an order placed at checkout. Completed is only set once
+// the order is delivered. Number is a human-friendly sequential reference
+// next to the ID; orders placed before numbering was added have none.
 type Order struct {
-	ID        string     `json:"id" example:"123e4567-e89b-12d3-a456-426614174000"`
-	UserID    string     `json:"user_id" example:"user123"`
-	Items     []CartItem `json:"items"`
-	Total     float64    `json:"total" example:"1999.98"`
-	Status    string     `json:"status" example:"completed"`
-	Created   time.Time  `json:"created" example:"2023-12-01T10:00:00Z"`
-	Completed time.Time  `json:"completed,omitempty" example:"2023-12-01T10:30:00Z"`
+	ID        string      `json:"id" example:"123e4567-e89b-12d3-a456-426614174000"`
+	Number    string      `json:"order_number,omitempty" example:"ORD-000123"`
+	UserID    string      `json:"user_id" example:"user123"`
+	Items     []OrderItem `json:"items"`
+	Total     float64     `json:"total" example:"1999.98"`
+	Status    string      `json:"status" example:"pending"`
+	Created   time.Time   `json:"created" example:"2023-12-01T10:00:00Z"`
+	Completed *time.Time  `json:"completed,omitempty" example:"2023-12-01T10:30:00Z"`
+
+	ShippingMethod    string    `json:"shipping_method" example:"standard"`
+	ShippingCost      float64   `json:"shipping_cost" example:"9.99"`
+	EstimatedDelivery time.Time `json:"estimated_delivery" example:"2023-12-06T10:00:00Z"`
+
+	// Discount code redeemed at checkout, and the amount it and the cart's
+	// coupons took off
+	DiscountCode string  `json:"discount_code,omitempty" example:"WELCOME15"`
+	Discount     float64 `json:"discount,omitempty" example:"30"`
+
+	// Tax charged on the goods after discounts, at taxRate. Orders placed
+	// before checkout charged tax have none.
+	Tax float64 `json:"tax" example:"157.52"`
+}
+
+// OrderDetail is a single order with its money breakdown. Subtotal is the
+// goods before any discount, so Total is Subtotal - Discount + Tax +
+// ShippingCost.
+type OrderDetail struct {
+	Order
+	Subtotal float64 `json:"subtotal" example:"1999.98"`
+}
+
+// Receipt is the itemized bill of an order. Its amounts are those of
+// OrderDetail: Total is Subtotal - Discount + Tax + Shipping.
+type Receipt struct {
+	OrderID        string        `json:"order_id" example:"123e4567-e89b-12d3-a456-426614174000"`
+	OrderNumber    string        `json:"order_number,omitempty" example:"ORD-000123"`
+	Placed         time.Time     `json:"placed" example:"2023-12-01T10:00:00Z"`
+	Status         string        `json:"status" example:"paid"`
+	Lines          []ReceiptLine `json:"lines"`
+	Subtotal       float64       `json:"subtotal" example:"1999.98"`
+	DiscountCode   string        `json:"discount_code,omitempty" example:"WELCOME15"`
+	Discount       float64       `json:"discount" example:"30"`
+	Tax            float64       `json:"tax" example:"157.52"`
+	ShippingMethod string        `json:"shipping_method" example:"standard"`
+	Shipping       float64       `json:"shipping" example:"9.99"`
+	Total          float64       `json:"total" example:"1979.97"`
+}
+
+// ReceiptLine is one line item of a receipt
+type ReceiptLine struct {
+	ProductID string  `json:"product_id" example:"1"`
+	Name      string  `json:"name" example:"iPhone 15 Pro"`
+	Quantity  int     `json:"quantity" example:"2"`
+	UnitPrice float64 `json:"unit_price" example:"999.99"`
+	Amount    float64 `json:"amount" example:"1999.98"`
+}
+
+// ShipItemsRequest lists the order lines to mark as shipped
+type ShipItemsRequest struct {
+	ProductIDs []string `json:"product_ids" binding:"required,min=1"`
+}
+
+// Order line fulfillment states
+const (
+	fulfillmentPending = "pending"
+	fulfillmentShipped = "shipped"
+)
+
+// Order states. partially_shipped and shipped are also derived from line
+// fulfillment when individual lines ship.
+const (
+	orderStatusPending          = "pending"
+	orderStatusPaid             = "paid"
+	orderStatusPartiallyShipped = "partially_shipped"
+	orderStatusShipped          = "shipped"
+	orderStatusDelivered        = "delivered"
+	orderStatusCancelled        = "cancelled"
+)
+
+// orderTransitions lists the statuses each order status may move to
+var orderTransitions = map[string][]string{
+	orderStatusPending:          {orderStatusPaid, orderStatusCancelled},
+	orderStatusPaid:             {orderStatusPartiallyShipped, orderStatusShipped, orderStatusCancelled},
+	orderStatusPartiallyShipped: {orderStatusShipped},
+	orderStatusShipped:          {orderStatusDelivered},
+}
+
+// OrderStatusRequest is the target status of an order transition
+type OrderStatusRequest struct {
+	Status string `json:"status" binding:"required" example:"paid"`
+}
+
+// BulkCancelRequest lists the orders to cancel in one batch
+type BulkCancelRequest struct {
+	OrderIDs []string `json:"order_ids" binding:"required,min=1"`
+}
+
+// BulkCancelResult reports the outcome of cancelling a single order
+type BulkCancelResult struct {
+	OrderID   string `json:"order_id" example:"123e4567-e89b-12d3-a456-426614174000"`
+	Cancelled bool   `json:"cancelled" example:"true"`
+	Restocked int    `json:"restocked" example:"2"`
+	Error     string `json:"error,omitempty" example:"Order already shipped"`
+}
+
+// ImportError reports why one row of a product import was skipped
+type ImportError struct {
+	Line  int    `json:"line" example:"3"`
+	Error string `json:"error" example:"price must be positive"`
+}
+
+// ImportSummary reports the outcome of a product import
+type ImportSummary struct {
+	Imported int           `json:"imported" example:"42"`
+	Errors   []ImportError `json:"errors"`
 }
 
+// importColumns are the CSV columns a product import must have, named in its
+// header row
+var importColumns = []string{"name", "description", "price", "category", "stock", "rating", "image_url"}
+
+// maxImportSize bounds the body of a product import
+const maxImportSize = 10 << 20
+
+// exportFlushEvery is how many products a CSV export writes between flushes
+const exportFlushEvery = 100
+
 // SearchHistory represents a user's search history
 type SearchHistory struct {
 	ID        string    `json:"id" example:"123e4567-e89b-12d3-a456-426614174000"`
@@ -55,1101 +355,5619 @@ type SearchHistory struct {
 	Timestamp time.Time `json:"timestamp" example:"2023-12-01T10:00:00Z"`
 }
 
-// Global storage (in production, use a proper database)
+// ProductVisit records that a user viewed a product
+type ProductVisit struct {
+	UserID    string    `json:"user_id" example:"user123"`
+	ProductID string    `json:"product_id" example:"1"`
+	Viewed    time.Time `json:"viewed" example:"2023-12-01T10:00:00Z"`
+}
+
+// ProductPage represents one page of the product listing. Next and Prev
+// link to the neighbouring pages with the same query parameters, or are
+// null when there is no such page.
+type ProductPage struct {
+	Data   []ProductView `json:"data"`
+	Total  int           `json:"total" example:"5"`
+	Limit  int           `json:"limit" example:"20"`
+	Offset int           `json:"offset" example:"0"`
+	Next   *string       `json:"next" example:"/api/v1/products?limit=20&offset=20"`
+	Prev   *string       `json:"prev" example:"/api/v1/products?limit=20&offset=0"`
+}
+
+// CartPage represents one page of the admin cart listing
+type CartPage struct {
+	Data   []Cart `json:"data"`
+	Total  int    `json:"total" example:"12"`
+	Limit  int    `json:"limit" example:"20"`
+	Offset int    `json:"offset" example:"0"`
+}
+
+// AbandonedCart is a non-empty cart that hasn't changed for a while
+type AbandonedCart struct {
+	CartID    string    `json:"cart_id" example:"123e4567-e89b-12d3-a456-426614174000"`
+	UserID    string    `json:"user_id" example:"user123"`
+	Total     float64   `json:"total" example:"1999.98"`
+	ItemCount int       `json:"item_count" example:"2"`
+	Updated   time.Time `json:"updated" example:"2023-12-01T10:00:00Z"`
+}
+
+// SalesSummary aggregates the orders placed in a date range. Cancelled
+// orders are left out; revenue is what customers paid, shipping included.
+type SalesSummary struct {
+	From              time.Time      `json:"from" example:"2023-11-01T00:00:00Z"`
+	To                time.Time      `json:"to" example:"2023-12-01T00:00:00Z"`
+	Revenue           float64        `json:"revenue" example:"12499.5"`
+	OrderCount        int            `json:"order_count" example:"14"`
+	AverageOrderValue float64        `json:"average_order_value" example:"892.82"`
+	TopProducts       []ProductSales `json:"top_products"`
+}
+
+// ProductSales is the number of units of a product sold in a date range
+type ProductSales struct {
+	ProductID string `json:"product_id" example:"123e4567-e89b-12d3-a456-426614174000"`
+	Name      string `json:"name" example:"iPhone 15 Pro"`
+	Quantity  int    `json:"quantity" example:"9"`
+}
+
+// CategoryBreakdown is the units sold and revenue per product category in
+// a date range
+type CategoryBreakdown struct {
+	From       time.Time       `json:"from" example:"2023-11-01T00:00:00Z"`
+	To         time.Time       `json:"to" example:"2023-12-01T00:00:00Z"`
+	Categories []CategorySales `json:"categories"`
+}
+
+// CategorySales is what one product category sold
+type CategorySales struct {
+	Category string  `json:"category" example:"Electronics"`
+	Units    int     `json:"units" example:"21"`
+	Revenue  float64 `json:"revenue" example:"10749.79"`
+}
+
+// salesWindow is the date range a sales summary covers when none is given
+const salesWindow = 30 * 24 * time.Hour
+
+// topSellersLimit is how many products a sales summary ranks
+const topSellersLimit = 5
+
+// StockMovement represents a single change to a product's stock
+type StockMovement struct {
+	ProductID string    `json:"product_id" example:"123e4567-e89b-12d3-a456-426614174000"`
+	Delta     int       `json:"delta" example:"-2"`
+	Reason    string    `json:"reason" example:"checkout"`
+	Timestamp time.Time `json:"timestamp" example:"2023-12-01T10:00:00Z"`
+	OrderID   string    `json:"order_id,omitempty" example:"123e4567-e89b-12d3-a456-426614174000"`
+}
+
+// PriceChange records an edit to a product's regular price
+type PriceChange struct {
+	ProductID string    `json:"product_id" example:"123e4567-e89b-12d3-a456-426614174000"`
+	OldPrice  float64   `json:"old_price" example:"999.99"`
+	NewPrice  float64   `json:"new_price" example:"899.99"`
+	Timestamp time.Time `json:"timestamp" example:"2023-12-01T10:00:00Z"`
+}
+
+// Reasons recorded on stock movements
+const (
+	stockReasonCheckout   = "checkout"
+	stockReasonAdjustment = "adjustment"
+	stockReasonRestock    = "restock"
+	stockReasonCancel     = "cancellation"
+	stockReasonBulkAdjust = "bulk-adjust"
+)
+
+// RestockRequest represents the number of units to add to a product's stock
+type RestockRequest struct {
+	Quantity int `json:"quantity" example:"25"`
+}
+
+// StockUpdate sets the stock of one product in a bulk stock update
+type StockUpdate struct {
+	ProductID string `json:"product_id" example:"1"`
+	Stock     *int   `json:"stock" example:"40"`
+}
+
+// StockUpdateResult reports the outcome of a single entry of a bulk stock
+// update
+type StockUpdateResult struct {
+	ProductID string `json:"product_id" example:"1"`
+	Updated   bool   `json:"updated" example:"true"`
+	Stock     int    `json:"stock" example:"40"`
+	Error     string `json:"error,omitempty" example:"Product not found"`
+}
+
+// Review represents a user's rating and comment on a product
+type Review struct {
+	ID        string    `json:"id" example:"123e4567-e89b-12d3-a456-426614174000"`
+	ProductID string    `json:"product_id" example:"123e4567-e89b-12d3-a456-426614174000"`
+	UserID    string    `json:"user_id" example:"user123"`
+	Rating    int       `json:"rating" example:"5"`
+	Comment   string    `json:"comment,omitempty" example:"Great phone, amazing camera"`
+	Verified  bool      `json:"verified" example:"true"` // the user has a delivered order containing the product
+	Timestamp time.Time `json:"timestamp" example:"2023-12-01T10:00:00Z"`
+}
+
+// ReviewRequest represents a new review of a product
+type ReviewRequest struct {
+	Rating  int    `json:"rating" example:"5"`
+	Comment string `json:"comment" example:"Great phone, amazing camera"`
+}
+
+// Review limits
+const (
+	minReviewRating        = 1
+	maxReviewRating        = 5
+	maxReviewCommentLength = 2000
+)
+
+// HealthResponse reports the service status and, for readiness, that of each
+// dependency. The service is ready only when every component is healthy.
+type HealthResponse struct {
+	Status     string                     `json:"status" example:"healthy"`
+	Timestamp  string                     `json:"timestamp" example:"2023-12-01T10:00:00Z"`
+	Service    string                     `json:"service" example:"SHITty E-commerce API"`
+	Version    string                     `json:"version" example:"1.0.0"`
+	Components map[string]ComponentHealth `json:"components,omitempty"`
+}
+
+// ComponentHealth is the status of a single dependency
+type ComponentHealth struct {
+	Status string `json:"status" example:"healthy"`
+	Error  string `json:"error,omitempty" example:"database is locked"`
+}
+
+// RelatedSearch represents a query made by users who also searched for the
+// current query
+type RelatedSearch struct {
+	Query string `json:"query" example:"airpods"`
+	Users int    `json:"users" example:"3"`
+}
+
+// CategoryCount represents a product category and how many products it holds
+type CategoryCount struct {
+	Name  string `json:"name" example:"Electronics"`
+	Count int    `json:"count" example:"4"`
+}
+
+// TrendingSearch represents a query and how often it was searched recently
+type TrendingSearch struct {
+	Query string `json:"query" example:"iphone"`
+	Count int    `json:"count" example:"12"`
+}
+
+// Coupon represents a discount code that can be applied to a cart
+type Coupon struct {
+	Code       string  `json:"code" example:"SAVE10"`
+	PercentOff float64 `json:"percent_off,omitempty" example:"10"`
+	AmountOff  float64 `json:"amount_off,omitempty" example:"0"`
+}
+
+// DiscountCode is a limited-use code redeemed at checkout. A zero ExpiresAt
+// never expires and a zero MaxUses allows unlimited redemptions.
+type DiscountCode struct {
+	Code       string    `json:"code" example:"WELCOME15"`
+	PercentOff float64   `json:"percent_off,omitempty" example:"15"`
+	AmountOff  float64   `json:"amount_off,omitempty" example:"0"`
+	ExpiresAt  time.Time `json:"expires_at" example:"2024-12-31T23:59:59Z"`
+	MaxUses    int       `json:"max_uses" example:"100"`
+	Uses       int       `json:"uses" example:"3"`
+}
+
+// IdempotencyKey records the order a checkout with an Idempotency-Key header
+// created, so a retry with the same key returns that order again
+type IdempotencyKey struct {
+	UserID  string
+	Key     string
+	OrderID string
+	Created time.Time
+}
+
+// idempotencyKeyHeader is the checkout request header carrying the key
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength bounds the keys clients may send
+const maxIdempotencyKeyLength = 255
+
+// Webhook is a URL registered by an operator to receive order events
+type Webhook struct {
+	ID      string    `json:"id" example:"123e4567-e89b-12d3-a456-426614174000"`
+	URL     string    `json:"url" example:"https://hooks.example.com/orders"`
+	Created time.Time `json:"created" example:"2023-12-01T10:00:00Z"`
+}
+
+// WebhookRequest represents a webhook to register
+type WebhookRequest struct {
+	URL string `json:"url" binding:"required" example:"https://hooks.example.com/orders"`
+}
+
+// WebhookEvent is the JSON body POSTed to webhooks
+type WebhookEvent struct {
+	ID        string    `json:"id" example:"123e4567-e89b-12d3-a456-426614174000"`
+	Event     string    `json:"event" example:"order.created"`
+	Order     Order     `json:"order"`
+	Timestamp time.Time `json:"timestamp" example:"2023-12-01T10:00:00Z"`
+}
+
+// DiscountLine represents a single discount applied to a cart
+type DiscountLine struct {
+	Code   string  `json:"code" example:"SAVE10"`
+	Amount float64 `json:"amount" example:"199.99"`
+}
+
+// CartEstimate represents the money breakdown of a cart before checkout
+type CartEstimate struct {
+	CartID    string         `json:"cart_id" example:"123e4567-e89b-12d3-a456-426614174000"`
+	Subtotal  float64        `json:"subtotal" example:"1999.98"`
+	Discounts []DiscountLine `json:"discounts"`
+	Tax       float64        `json:"tax" example:"143.99"`
+	Shipping  float64        `json:"shipping" example:"0"`
+	Total     float64        `json:"total" example:"1943.98"`
+
+	ShippingMethod string `json:"shipping_method" example:"standard"`
+	EstimatedDays  int    `json:"estimated_days" example:"5"`
+}
+
+// ShippingMethod describes a delivery option offered at checkout
+type ShippingMethod struct {
+	Name string  `json:"name" example:"standard"`
+	Cost float64 `json:"cost" example:"9.99"`
+	Days int     `json:"days" example:"5"`
+}
+
+// ShippingQuoteRequest is the destination to quote shipping to
+type ShippingQuoteRequest struct {
+	Country    string `json:"country" binding:"required" example:"US"`
+	PostalCode string `json:"postal_code" example:"94105"`
+}
+
+// ShippingQuote lists the shipping options for a cart to a destination
+type ShippingQuote struct {
+	CartID     string           `json:"cart_id" example:"123e4567-e89b-12d3-a456-426614174000"`
+	Country    string           `json:"country" example:"US"`
+	PostalCode string           `json:"postal_code,omitempty" example:"94105"`
+	Domestic   bool             `json:"domestic" example:"true"`
+	Weight     float64          `json:"weight" example:"0.38"`
+	Options    []ShippingMethod `json:"options"`
+}
+
+// shippingRate prices one shipping option for one zone as a base cost plus
+// a cost per kilogram
+type shippingRate struct {
+	domestic bool
+	method   string
+	base     float64
+	perKg    float64
+	days     int
+}
+
+// shippingRates is the rules table behind shipping quotes
+var shippingRates = []shippingRate{
+	{domestic: true, method: "standard", base: 4.99, perKg: 1.00, days: 5},
+	{domestic: true, method: "express", base: 14.99, perKg: 2.50, days: 2},
+	{domestic: false, method: "standard", base: 19.99, perKg: 5.00, days: 10},
+	{domestic: false, method: "express", base: 39.99, perKg: 9.00, days: 4},
+}
+
+// CheckoutRequest holds the optional checkout choices
+type CheckoutRequest struct {
+	ShippingMethod string `json:"shipping_method" example:"express"`
+}
+
+// ApplyCouponRequest represents a coupon code to apply to a cart
+type ApplyCouponRequest struct {
+	Code string `json:"code" binding:"required" example:"SAVE10"`
+}
+
+// Pricing rules used for cart estimates and checkout. Standard shipping is
+// free once the subtotal reaches freeShippingThreshold.
+const (
+	taxRate               = 0.08
+	freeShippingThreshold = 100.0
+)
+
+const defaultShippingMethod = "standard"
+
+// now is the clock used by the service, swapped out to control time
+var now = time.Now
+
+// Build information, injected at build time with
+// -ldflags "-X main.version=... -X main.gitCommit=... -X main.buildTime=..."
 var (
-	products      = make(map[string]Product)
-	carts         = make(map[string]Cart)
-	orders        = make(map[string]Order)
-	searchHistory = make(map[string][]SearchHistory)
-	userCarts    = make(map[string]string) // userID -> cartID
+	version   = "dev"
+	gitCommit = "dev"
+	buildTime = "dev"
 )
 
+// API holds the HTTP handlers and the store they work against
+type API struct {
+	store Store
+
+	// mu serializes handlers whose store calls must happen together, such
+	// as checkout's stock check, stock decrement and order creation
+	mu sync.RWMutex
+
+	// webhooks delivers order events to the registered webhooks
+	webhooks *webhookDispatcher
+
+	// suggestions is the prefix index behind search suggestions, built on
+	// first use and dropped by invalidateSuggestions whenever a product's
+	// name or rating changes
+	suggestMu   sync.Mutex
+	suggestions map[string][]string
+
+	// seeded is set once initializeData has finished, or straight away
+	// when seeding is off; until then the service is live but not ready
+	seeded atomic.Bool
+}
+
+func newAPI(store Store) *API {
+	return &API{
+		store:    store,
+		webhooks: newWebhookDispatcher(store, config.WebhookSecret, config.WebhookMaxAttempts, config.WebhookRetryBackoff),
+	}
+}
+
 // @title SHITty E-commerce API
 // @version 1.0
 // @description A comprehensive e-commerce API with product management, shopping cart, orders, and recommendations
 // @host localhost:3001
 // @BasePath /api/v1
+// @securityDefinitions.apikey BearerAuth
+// @in header
+// @name Authorization
 func main() {
-	// Initialize sample data
-	initializeData()
+	loadConfig()
+	addr, err := config.listenAddr()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.JWTSecret == "" {
+		log.Println("JWT_SECRET is not set, authenticated endpoints will reject every request")
+	}
+	if config.WebhookSecret == "" {
+		log.Println("WEBHOOK_SECRET is not set, webhook deliveries will not be signed")
+	}
+
+	store, closeStore, err := openStore()
+	if err != nil {
+		log.Fatalf("Opening store: %v", err)
+	}
+	defer closeStore()
 
-	r := gin.Default()
+	app := newAPI(store)
+	registerStoreMetrics(metricsRegistry, store)
+	stopCartSweeper := app.startCartSweeper(config.CartTTL, config.CartSweepInterval)
 
-	// Health check endpoint
-	r.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
-			"status":    "healthy",
-			"timestamp": time.Now().Format(time.RFC3339),
-			"service":   "SHITty E-commerce API",
-			"version":   "1.0.0",
-		})
+	r := newRouter(app)
+
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: r,
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Server failed: %v", err)
+	}
+	log.Printf("Server starting on %s", addr)
+
+	// Load sample data while already serving, so liveness probes pass
+	// during a slow start; /health/ready answers 503 until it is done
+	go func() {
+		if err := app.seed(); err != nil {
+			log.Fatalf("Loading sample data: %v", err)
+		}
+	}()
+
+	// Wait for SIGINT/SIGTERM, then give in-flight requests such as
+	// checkouts time to finish before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// Restore the default handling once the first signal arrives, so a
+	// second one kills the process instead of waiting for the drain
+	context.AfterFunc(ctx, stop)
+	if err := serveUntil(ctx, srv, listener); err != nil {
+		log.Fatalf("Server failed: %v", err)
+	}
+	stopCartSweeper()
+
+	webhooksCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := app.webhooks.Close(webhooksCtx); err != nil {
+		log.Printf("Webhook deliveries still pending at shutdown: %v", err)
+	}
+	log.Println("Server stopped")
+}
+
+// newRouter registers the middleware and every route of the API on a new
+// engine
+func newRouter(app *API) *gin.Engine {
+	// Tag every request with an ID, then write one JSON log line per
+	// request instead of gin's text logger
+	r := gin.New()
+	if err := r.SetTrustedProxies(config.TrustedProxies); err != nil {
+		log.Fatalf("TRUSTED_PROXIES: %v", err)
+	}
+	r.HandleMethodNotAllowed = true
+	r.NoMethod(methodNotAllowed(r))
+	r.NoRoute(func(c *gin.Context) {
+		respondError(c, http.StatusNotFound, errCodeRouteNotFound, "No route for "+c.Request.Method+" "+c.Request.URL.Path)
 	})
+	r.Use(requestID(), jsonLogger(os.Stdout), gin.Recovery())
+	r.Use(metricsMiddleware(), cors(config.CORSAllowedOrigins))
+	r.Use(rateLimit(config.RateLimit, config.RateLimitBurst, "/health", "/health/live", "/health/ready"))
+	r.Use(gzipResponses(config.GzipMinSize))
 
-	// OpenAPI specification endpoint
-	r.GET("/openapi.json", func(c *gin.Context) {
+	// Health check endpoint
+	r.GET("/health", app.liveness)
+	r.GET("/health/live", app.liveness)
+	r.GET("/health/ready", app.readiness)
+
+	// Build/version info endpoint
+	r.GET("/version", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
-			"openapi": "3.0.0",
-			"info": gin.H{
-				"title":       "SHITty E-commerce API",
-				"description": "A comprehensive e-commerce API with product management, shopping cart, orders, and recommendations",
-				"version":     "1.0.0",
-			},
-			"servers": []gin.H{
-				{
-					"url":         "http://localhost:8080",
-					"description": "Development server",
-				},
-			},
-			"paths": gin.H{
-				"/health": gin.H{
-					"get": gin.H{
-						"summary":     "Health check",
-						"description": "Check if the service is healthy",
-						"responses": gin.H{
-							"200": gin.H{
-								"description": "Service is healthy",
-								"content": gin.H{
-									"application/json": gin.H{
-										"schema": gin.H{
-											"type": "object",
-											"properties": gin.H{
-												"status": gin.H{"type": "string"},
-												"timestamp": gin.H{"type": "string", "format": "date-time"},
-												"service": gin.H{"type": "string"},
-												"version": gin.H{"type": "string"},
-											},
-										},
-									},
-								},
-							},
-						},
-					},
-				},
-				"/api/v1/products": gin.H{
-					"get": gin.H{
-						"summary":     "Get all products",
-						"description": "Retrieve a list of all available products",
-						"responses": gin.H{
-							"200": gin.H{
-								"description": "List of products",
-								"content": gin.H{
-									"application/json": gin.H{
-										"schema": gin.H{
-											"type": "array",
-											"items": gin.H{
-												"$ref": "#/components/schemas/Product",
-											},
-										},
-									},
-								},
-							},
-						},
-					},
-				},
-				"/api/v1/products/{id}": gin.H{
-					"get": gin.H{
-						"summary":     "Get a single product",
-						"description": "Retrieve a specific product by ID",
-						"parameters": []gin.H{
-							{
-								"name":        "id",
-								"in":          "path",
-								"required":    true,
-								"description": "Product ID",
-								"schema": gin.H{
-									"type": "string",
-								},
-							},
-						},
-						"responses": gin.H{
-							"200": gin.H{
-								"description": "Product details",
-								"content": gin.H{
-									"application/json": gin.H{
-										"schema": gin.H{
-											"$ref": "#/components/schemas/Product",
-										},
-									},
-								},
-							},
-							"404": gin.H{
-								"description": "Product not found",
-							},
-						},
-					},
-				},
-				"/api/v1/products/top": gin.H{
-					"get": gin.H{
-						"summary":     "Get top products",
-						"description": "Retrieve top-rated products",
-						"parameters": []gin.H{
-							{
-								"name":        "limit",
-								"in":          "query",
-								"required":    false,
-								"description": "Number of products to return",
-								"schema": gin.H{
-									"type": "integer",
-									"default": 5,
-								},
-							},
-						},
-						"responses": gin.H{
-							"200": gin.H{
-								"description": "List of top products",
-								"content": gin.H{
-									"application/json": gin.H{
-										"schema": gin.H{
-											"type": "array",
-											"items": gin.H{
-												"$ref": "#/components/schemas/Product",
-											},
-										},
-									},
-								},
-							},
-						},
-					},
-				},
-				"/api/v1/cart/add": gin.H{
-					"post": gin.H{
-						"summary":     "Add product to cart",
-						"description": "Add a product to the user's shopping cart",
-						"parameters": []gin.H{
-							{
-								"name":        "user_id",
-								"in":          "query",
-								"required":    true,
-								"description": "User ID",
-								"schema": gin.H{
-									"type": "string",
-								},
-							},
-						},
-						"requestBody": gin.H{
-							"required": true,
-							"content": gin.H{
-								"application/json": gin.H{
-									"schema": gin.H{
-										"$ref": "#/components/schemas/CartItem",
-									},
-								},
-							},
-						},
-						"responses": gin.H{
-							"200": gin.H{
-								"description": "Cart updated successfully",
-								"content": gin.H{
-									"application/json": gin.H{
-										"schema": gin.H{
-											"$ref": "#/components/schemas/Cart",
-										},
-									},
-								},
-							},
-							"400": gin.H{
-								"description": "Bad request",
-							},
-							"404": gin.H{
-								"description": "Product not found",
-							},
-						},
-					},
-				},
-				"/api/v1/cart/remove": gin.H{
-					"delete": gin.H{
-						"summary":     "Remove item from cart",
-						"description": "Remove a product from the user's shopping cart",
-						"parameters": []gin.H{
-							{
-								"name":        "user_id",
-								"in":          "query",
-								"required":    true,
-								"description": "User ID",
-								"schema": gin.H{
-									"type": "string",
-								},
-							},
-						},
-						"requestBody": gin.H{
-							"required": true,
-							"content": gin.H{
-								"application/json": gin.H{
-									"schema": gin.H{
-										"$ref": "#/components/schemas/CartItem",
-									},
-								},
-							},
-						},
-						"responses": gin.H{
-							"200": gin.H{
-								"description": "Cart updated successfully",
-								"content": gin.H{
-									"application/json": gin.H{
-										"schema": gin.H{
-											"$ref": "#/components/schemas/Cart",
-										},
-									},
-								},
-							},
-							"400": gin.H{
-								"description": "Bad request",
-							},
-						},
-					},
-				},
-				"/api/v1/cart/{userID}": gin.H{
-					"get": gin.H{
-						"summary":     "Get user's cart",
-						"description": "Retrieve the user's shopping cart",
-						"parameters": []gin.H{
-							{
-								"name":        "userID",
-								"in":          "path",
-								"required":    true,
-								"description": "User ID",
-								"schema": gin.H{
-									"type": "string",
-								},
-							},
-						},
-						"responses": gin.H{
-							"200": gin.H{
-								"description": "Cart details",
-								"content": gin.H{
-									"application/json": gin.H{
-										"schema": gin.H{
-											"$ref": "#/components/schemas/Cart",
-										},
-									},
-								},
-							},
-							"404": gin.H{
-								"description": "Cart not found",
-							},
-						},
-					},
-				},
-				"/api/v1/checkout": gin.H{
-					"post": gin.H{
-						"summary":     "Checkout",
-						"description": "Complete the checkout process and create an order",
-						"parameters": []gin.H{
-							{
-								"name":        "user_id",
-								"in":          "query",
-								"required":    true,
-								"description": "User ID",
-								"schema": gin.H{
-									"type": "string",
-								},
-							},
-						},
-						"responses": gin.H{
-							"200": gin.H{
-								"description": "Order created successfully",
-								"content": gin.H{
-									"application/json": gin.H{
-										"schema": gin.H{
-											"$ref": "#/components/schemas/Order",
-										},
-									},
-								},
-							},
-							"400": gin.H{
-								"description": "Bad request",
-							},
-						},
-					},
-				},
-				"/api/v1/orders/{userID}": gin.H{
-					"get": gin.H{
-						"summary":     "Get order history",
-						"description": "Retrieve the user's order history",
-						"parameters": []gin.H{
-							{
-								"name":        "userID",
-								"in":          "path",
-								"required":    true,
-								"description": "User ID",
-								"schema": gin.H{
-									"type": "string",
-								},
-							},
-						},
-						"responses": gin.H{
-							"200": gin.H{
-								"description": "List of orders",
-								"content": gin.H{
-									"application/json": gin.H{
-										"schema": gin.H{
-											"type": "array",
-											"items": gin.H{
-												"$ref": "#/components/schemas/Order",
-											},
-										},
-									},
-								},
-							},
-						},
-					},
-				},
-				"/api/v1/recommendations/{userID}": gin.H{
-					"get": gin.H{
-						"summary":     "Get product recommendations",
-						"description": "Get personalized product recommendations based on order history, search history, or popular products",
-						"parameters": []gin.H{
-							{
-								"name":        "userID",
-								"in":          "path",
-								"required":    true,
-								"description": "User ID",
-								"schema": gin.H{
-									"type": "string",
-								},
-							},
-							{
-								"name":        "limit",
-								"in":          "query",
-								"required":    false,
-								"description": "Number of recommendations",
-								"schema": gin.H{
-									"type": "integer",
-									"default": 5,
-								},
-							},
-						},
-						"responses": gin.H{
-							"200": gin.H{
-								"description": "List of recommended products",
-								"content": gin.H{
-									"application/json": gin.H{
-										"schema": gin.H{
-											"type": "array",
-											"items": gin.H{
-												"$ref": "#/components/schemas/Product",
-											},
-										},
-									},
-								},
-							},
-						},
-					},
-				},
-				"/api/v1/search": gin.H{
-					"get": gin.H{
-						"summary":     "Search products",
-						"description": "Search for products and record search history",
-						"parameters": []gin.H{
-							{
-								"name":        "q",
-								"in":          "query",
-								"required":    true,
-								"description": "Search query",
-								"schema": gin.H{
-									"type": "string",
-								},
-							},
-							{
-								"name":        "user_id",
-								"in":          "query",
-								"required":    false,
-								"description": "User ID for tracking search history",
-								"schema": gin.H{
-									"type": "string",
-								},
-							},
-						},
-						"responses": gin.H{
-							"200": gin.H{
-								"description": "Search results",
-								"content": gin.H{
-									"application/json": gin.H{
-										"schema": gin.H{
-											"type": "array",
-											"items": gin.H{
-												"$ref": "#/components/schemas/Product",
-											},
-										},
-									},
-								},
-							},
-							"400": gin.H{
-								"description": "Bad request",
-							},
-						},
-					},
-				},
-			},
-			"components": gin.H{
-				"schemas": gin.H{
-					"Product": gin.H{
-						"type": "object",
-						"properties": gin.H{
-							"id": gin.H{
-								"type": "string",
-								"example": "1",
-							},
-							"name": gin.H{
-								"type": "string",
-								"example": "iPhone 15 Pro",
-							},
-							"description": gin.H{
-								"type": "string",
-								"example": "Latest iPhone with advanced features",
-							},
-							"price": gin.H{
-								"type": "number",
-								"example": 999.99,
-							},
-							"category": gin.H{
-								"type": "string",
-								"example": "Electronics",
-							},
-							"stock": gin.H{
-								"type": "integer",
-								"example": 50,
-							},
-							"rating": gin.H{
-								"type": "number",
-								"example": 4.5,
-							},
-							"image_url": gin.H{
-								"type": "string",
-								"example": "https://example.com/iphone.jpg",
-							},
-						},
-					},
-					"CartItem": gin.H{
-						"type": "object",
-						"properties": gin.H{
-							"product_id": gin.H{
-								"type": "string",
-								"example": "1",
-							},
-							"quantity": gin.H{
-								"type": "integer",
-								"example": 2,
-							},
-						},
-					},
-					"Cart": gin.H{
-						"type": "object",
-						"properties": gin.H{
-							"id": gin.H{
-								"type": "string",
-								"example": "cart-uuid",
-							},
-							"user_id": gin.H{
-								"type": "string",
-								"example": "user123",
-							},
-							"items": gin.H{
-								"type": "array",
-								"items": gin.H{
-									"$ref": "#/components/schemas/CartItem",
-								},
-							},
-							"total": gin.H{
-								"type": "number",
-								"example": 1999.98,
-							},
-							"updated": gin.H{
-								"type": "string",
-								"format": "date-time",
-								"example": "2023-12-01T10:00:00Z",
-							},
-						},
-					},
-					"Order": gin.H{
-						"type": "object",
-						"properties": gin.H{
-							"id": gin.H{
-								"type": "string",
-								"example": "order-uuid",
-							},
-							"user_id": gin.H{
-								"type": "string",
-								"example": "user123",
-							},
-							"items": gin.H{
-								"type": "array",
-								"items": gin.H{
-									"$ref": "#/components/schemas/CartItem",
-								},
-							},
-							"total": gin.H{
-								"type": "number",
-								"example": 1999.98,
-							},
-							"status": gin.H{
-								"type": "string",
-								"example": "completed",
-							},
-							"created": gin.H{
-								"type": "string",
-								"format": "date-time",
-								"example": "2023-12-01T10:00:00Z",
-							},
-							"completed": gin.H{
-								"type": "string",
-								"format": "date-time",
-								"example": "2023-12-01T10:30:00Z",
-							},
-						},
-					},
-				},
-			},
+			"version":    version,
+			"git_commit": gitCommit,
+			"build_time": buildTime,
+			"go_version": runtime.Version(),
 		})
 	})
 
+	// Prometheus metrics
+	r.GET("/metrics", gin.WrapH(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})))
+
+	// OpenAPI specification, generated from the registered routes
+	r.GET("/openapi.json", openAPIHandler(r, config.publicURL()))
+
 	// API routes
 	api := r.Group("/api/v1")
 	{
+		// Cart, checkout, orders, recommendations and reviews act on behalf
+		// of the user identified by the bearer token
+		auth := authMiddleware(config.JWTSecret)
+		// Routes with a :userID path segment may only be used by that user
+		owner := requireOwner()
+		// Catalog management, order fulfillment and the /admin routes need
+		// a token with the admin role
+		adminOnly := requireAdmin()
+		// Adding to, removing from and viewing your own cart also work
+		// without a token, for guests identified by a cookie
+		shopper := shopperMiddleware(config.JWTSecret, config.CartTTL)
+
 		// Product endpoints
-		api.GET("/products", getProducts)
-		api.GET("/products/:id", getProduct)
-		api.GET("/products/top", getTopProducts)
+		api.GET("/products", app.getProducts)
+		api.GET("/products/:id", app.getProduct)
+		api.GET("/products/top", app.getTopProducts)
+		api.GET("/products/low-stock", app.getLowStockProducts)
+		api.GET("/categories", app.getCategories)
+		api.POST("/products/import", auth, adminOnly, app.importProducts)
+		api.GET("/products/export", auth, adminOnly, app.exportProducts)
+		api.PUT("/products/stock", auth, adminOnly, app.bulkUpdateStock)
+		api.PUT("/products/:id", auth, adminOnly, app.updateProduct)
+		api.PATCH("/products/:id", auth, adminOnly, app.patchProduct)
+		api.DELETE("/products/:id", auth, adminOnly, app.deleteProduct)
+		api.GET("/products/:id/stock-history", app.getStockHistory)
+		api.GET("/products/:id/price-history", app.getPriceHistory)
+		api.POST("/products/:id/restock", auth, adminOnly, app.restockProduct)
+		api.GET("/products/:id/reviews", app.getReviews)
+		api.GET("/products/:id/related", app.getRelatedProducts)
+		api.POST("/products/:id/reviews", auth, app.addReview)
 
 		// Cart endpoints
-		api.POST("/cart/add", addToCart)
-		api.DELETE("/cart/remove", removeFromCart)
-		api.GET("/cart/:userID", getCart)
+		api.GET("/cart", shopper, app.getOwnCart)
+		api.POST("/cart/add", shopper, app.addToCart)
+		api.DELETE("/cart/remove", shopper, app.removeFromCart)
+		api.POST("/cart/merge", auth, app.mergeGuestCart)
+		api.POST("/cart/:userID/batch", auth, owner, app.batchAddToCart)
+		api.GET("/cart/:userID", auth, owner, app.getCart)
+		api.GET("/cart/:userID/estimate", auth, owner, app.getCartEstimate)
+		api.POST("/cart/:userID/coupons", auth, owner, app.applyCoupon)
+		api.DELETE("/cart/:userID/clear", auth, owner, app.clearCart)
+		api.POST("/cart/:userID/save/:productID", auth, owner, app.saveForLater)
+		api.POST("/cart/:userID/unsave/:productID", auth, owner, app.moveToCart)
+		api.POST("/cart/:userID/shipping", auth, owner, app.quoteShipping)
 
 		// Checkout and orders
-		api.POST("/checkout", checkout)
-		api.GET("/orders/:userID", getOrderHistory)
+		api.POST("/checkout", auth, app.checkout)
+		api.GET("/orders/:userID", auth, owner, app.getOrderHistory)
+		api.GET("/orders/detail/:orderID", auth, app.getOrder)
+		api.GET("/orders/detail/:orderID/receipt", auth, app.getOrderReceipt)
+		api.POST("/orders/:orderID/ship", auth, adminOnly, app.shipOrderItems)
+		api.POST("/orders/:orderID/status", auth, adminOnly, app.updateOrderStatus)
+		api.POST("/orders/:orderID/cancel", auth, app.cancelSingleOrder)
 
 		// Recommendations
-		api.GET("/recommendations/:userID", getRecommendations)
+		api.GET("/recommendations/:userID", auth, owner, app.getRecommendations)
+		api.GET("/users/:userID/recently-viewed", auth, owner, app.getRecentlyViewed)
+
+		// Search (for tracking search history), bounded so heavy search
+		// traffic can't starve the other endpoints
+		searchLimit := concurrencyLimit(config.SearchMaxConcurrent, config.SearchQueueTimeout)
+		api.GET("/search", searchLimit, app.searchProducts)
+		api.GET("/search/related", searchLimit, app.getRelatedSearches)
+		api.GET("/search/suggest", app.getSearchSuggestions)
+		api.GET("/search/trending", app.getTrendingSearches)
 
-		// Search (for tracking search history)
-		api.GET("/search", searchProducts)
+		// Admin maintenance
+		admin := api.Group("/admin", auth, adminOnly)
+		admin.POST("/recompute-totals", app.recomputeTotals)
+		admin.POST("/orders/cancel", app.bulkCancelOrders)
+		admin.GET("/carts", app.listCarts)
+		admin.GET("/abandoned-carts", app.listAbandonedCarts)
+		admin.GET("/analytics/sales", app.getSalesSummary)
+		admin.GET("/analytics/categories", app.getCategorySales)
+		admin.GET("/webhooks", app.listWebhooks)
+		admin.POST("/webhooks", app.registerWebhook)
+		admin.DELETE("/webhooks/:id", app.deleteWebhook)
 	}
 
-	// Swagger documentation (temporarily disabled for Docker build)
-	// r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
+	// Swagger UI, served from the spec swag generated into docs/docs.go
+	docs.SwaggerInfo.Host = config.publicHost()
+	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
-	log.Println("Server starting on :3001")
-	log.Fatal(r.Run(":3001"))
+	return r
 }
 
-// initializeData populates the system with sample data
-func initializeData() {
-	// Sample products
-	products["1"] = Product{
-		ID:          "1",
-		Name:        "iPhone 15 Pro",
-		Description: "Latest iPhone with advanced features",
-		Price:       999.99,
-		Category:    "Electronics",
-		Stock:       50,
-		Rating:      4.5,
-		ImageURL:    "https://example.com/iphone.jpg",
-	}
-	products["2"] = Product{
-		ID:          "2",
-		Name:        "MacBook Pro M3",
-		Description: "Powerful laptop for professionals",
-		Price:       1999.99,
-		Category:    "Electronics",
-		Stock:       30,
-		Rating:      4.8,
-		ImageURL:    "https://example.com/macbook.jpg",
-	}
-	products["3"] = Product{
-		ID:          "3",
-		Name:        "AirPods Pro",
-		Description: "Wireless earbuds with noise cancellation",
-		Price:       249.99,
-		Category:    "Electronics",
-		Stock:       100,
-		Rating:      4.6,
-		ImageURL:    "https://example.com/airpods.jpg",
-	}
-	products["4"] = Product{
-		ID:          "4",
-		Name:        "iPad Air",
-		Description: "Versatile tablet for work and play",
-		Price:       599.99,
-		Category:    "Electronics",
-		Stock:       75,
-		Rating:      4.4,
-		ImageURL:    "https://example.com/ipad.jpg",
-	}
-	products["5"] = Product{
-		ID:          "5",
-		Name:        "Apple Watch Series 9",
-		Description: "Smartwatch with health monitoring",
-		Price:       399.99,
-		Category:    "Electronics",
-		Stock:       60,
-		Rating:      4.7,
-		ImageURL:    "https://example.com/watch.jpg",
+// openStore picks the store from the configuration: SQLite when
+// DATABASE_PATH is set, in memory otherwise
+func openStore() (Store, func(), error) {
+	if config.DatabasePath == "" {
+		return newInMemoryStore(), func() {}, nil
 	}
-}
 
-// @Summary Get all products
-// @Description Retrieve a list of all available products
-// @Tags products
-// @Accept json
-// @Produce json
-// @Success 200 {array} Product
-// @Router /products [get]
-func getProducts(c *gin.Context) {
-	var productList []Product
-	for _, product := range products {
-		productList = append(productList, product)
+	store, err := newSQLiteStore(config.DatabasePath)
+	if err != nil {
+		return nil, nil, err
 	}
-	c.JSON(http.StatusOK, productList)
+	log.Printf("Using SQLite database %s", config.DatabasePath)
+	return store, func() {
+		if err := store.Close(); err != nil {
+			log.Printf("Closing database: %v", err)
+		}
+	}, nil
 }
 
-// @Summary Get a single product
-// @Description Retrieve a specific product by ID
-// @Tags products
-// @Accept json
-// @Produce json
-// @Param id path string true "Product ID"
-// @Success 200 {object} Product
-// @Failure 404 {object} map[string]interface{}
-// @Router /products/{id} [get]
-func getProduct(c *gin.Context) {
-	id := c.Param("id")
-	product, exists := products[id]
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
-		return
-	}
-	c.JSON(http.StatusOK, product)
-}
+// shutdownTimeout bounds how long shutdown waits for in-flight requests, and
+// then for pending webhook deliveries
+const shutdownTimeout = 10 * time.Second
 
-// @Summary Get top products
-// @Description Retrieve top-rated products
-// @Tags products
-// @Accept json
-// @Produce json
-// @Param limit query int false "Number of products to return" default(5)
-// @Success 200 {array} Product
-// @Router /products/top [get]
-func getTopProducts(c *gin.Context) {
-	limit := 5
-	if limitStr := c.Query("limit"); limitStr != "" {
-		if parsed, err := parseLimit(limitStr); err == nil {
-			limit = parsed
-		}
+// serveUntil serves HTTP on listener until ctx is done, then shuts the server
+// down, giving in-flight requests up to shutdownTimeout to finish. It returns
+// an error if serving fails or the requests don't finish in time.
+func serveUntil(ctx context.Context, srv *http.Server, listener net.Listener) error {
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(listener) }()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
 	}
 
-	var productList []Product
-	for _, product := range products {
-		productList = append(productList, product)
+	log.Println("Shutdown signal received, draining connections")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("forced shutdown: %w", err)
 	}
+	return nil
+}
 
-	// Sort by rating (descending) and limit results
-	// In a real app, you'd use a proper sorting algorithm
-	if len(productList) > limit {
-		productList = productList[:limit]
+// startCartSweeper deletes carts untouched for longer than ttl and releases
+// lapsed cart reservations, checking every interval, until the returned
+// function is called. The function waits for a sweep in progress to finish.
+// A non-positive interval disables sweeping, as does a non-positive ttl when
+// carts don't hold stock.
+func (a *API) startCartSweeper(ttl, interval time.Duration) (stop func()) {
+	if (ttl <= 0 && config.CartReservationTTL <= 0) || interval <= 0 {
+		return func() {}
 	}
 
-	c.JSON(http.StatusOK, productList)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.sweepCarts(ttl)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
 }
 
-// @Summary Add product to cart
-// @Description Add a product to the user's shopping cart
-// @Tags cart
-// @Accept json
-// @Produce json
-// @Param request body CartItem true "Cart item to add"
-// @Param user_id query string true "User ID"
-// @Success 200 {object} Cart
-// @Failure 400 {object} map[string]interface{}
-// @Failure 404 {object} map[string]interface{}
-// @Router /cart/add [post]
-func addToCart(c *gin.Context) {
-	userID := c.Query("user_id")
-	if userID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+// sweepCarts puts the units of lapsed cart reservations back in stock and,
+// unless ttl is non-positive, deletes the carts last updated more than ttl
+// ago. It holds the API lock so a cart can't change halfway through a
+// checkout.
+func (a *API) sweepCarts(ttl time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var cutoff time.Time
+	if ttl > 0 {
+		cutoff = now().Add(-ttl)
+	}
+	if err := a.releaseLapsedHolds(cutoff); err != nil {
+		log.Printf("Cart sweep failed: %v", err)
 		return
 	}
-
-	var item CartItem
-	if err := c.ShouldBindJSON(&item); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+	if ttl <= 0 {
 		return
 	}
 
-	// Check if product exists
-	product, exists := products[item.ProductID]
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+	pruned, err := a.store.PruneCarts(cutoff)
+	if err != nil {
+		log.Printf("Cart sweep failed: %v", err)
 		return
 	}
+	if pruned > 0 {
+		log.Printf("Cart sweep removed %d abandoned carts", pruned)
+	}
+}
+
+// releaseLapsedHolds puts the units of every cart line whose hold has lapsed
+// back in stock, keeping the line, and releases everything held by carts
+// last updated before pruneBefore, which are about to be deleted. A zero
+// pruneBefore spares every cart. Callers must hold the write lock.
+func (a *API) releaseLapsedHolds(pruneBefore time.Time) error {
+	cartList, err := a.store.ListCarts()
+	if err != nil {
+		return err
+	}
+	for _, cart := range cartList {
+		if len(cart.Reservations) == 0 {
+			continue
+		}
+		holds := len(cart.Reservations)
+		var releaseErr error
+		if !pruneBefore.IsZero() && cart.Updated.Before(pruneBefore) {
+			releaseErr = a.releaseCartHolds(&cart)
+		} else {
+			for _, item := range cart.Items {
+				if until, held := cart.Reservations[item.ProductID]; held && !now().Before(until) {
+					if releaseErr = a.releaseHeldUnits(&cart, item, item.Quantity); releaseErr != nil {
+						break
+					}
+				}
+			}
+		}
+		// Lines released before a failure are saved, or the next sweep would
+		// put their units back in stock a second time. The shopper didn't
+		// change the cart, so Updated stays as it was.
+		if len(cart.Reservations) != holds {
+			if err := a.store.SaveCart(cart); err != nil {
+				return err
+			}
+		}
+		if releaseErr != nil {
+			return releaseErr
+		}
+	}
+	return nil
+}
+
+// seed loads the sample data when config.SeedData is on, then marks the
+// service ready
+func (a *API) seed() error {
+	if config.SeedData {
+		if err := initializeData(a.store); err != nil {
+			return err
+		}
+		log.Println("Sample data loaded, ready for traffic")
+	} else {
+		log.Println("Sample data disabled, ready for traffic")
+	}
+	a.seeded.Store(true)
+	return nil
+}
+
+// initializeData populates the store with sample data. A store that already
+// holds products, such as a reopened database, is left untouched.
+func initializeData(store Store) error {
+	existing, err := store.ListProducts()
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return nil
+	}
+
+	// Sample products
+	sampleProducts := []Product{
+		{
+			ID:          "1",
+			Name:        "iPhone 15 Pro",
+			Description: "Latest iPhone with advanced features",
+			Price:       999.99,
+			Category:    "Electronics",
+			Stock:       50,
+			Rating:      4.5,
+			ImageURL:    "https://example.com/iphone.jpg",
+			Weight:      0.19,
+			Tags:        []string{"apple", "smartphone"},
+		},
+		{
+			ID:          "2",
+			Name:        "MacBook Pro M3",
+			Description: "Powerful laptop for professionals",
+			Price:       1999.99,
+			Category:    "Electronics",
+			Stock:       30,
+			Rating:      4.8,
+			ImageURL:    "https://example.com/macbook.jpg",
+			Weight:      1.6,
+			Tags:        []string{"apple", "laptop"},
+		},
+		{
+			ID:          "3",
+			Name:        "AirPods Pro",
+			Description: "Wireless earbuds with noise cancellation",
+			Price:       249.99,
+			Category:    "Electronics",
+			Stock:       100,
+			Rating:      4.6,
+			ImageURL:    "https://example.com/airpods.jpg",
+			Weight:      0.05,
+			Tags:        []string{"apple", "audio", "wireless"},
+		},
+		{
+			ID:          "4",
+			Name:        "iPad Air",
+			Description: "Versatile tablet for work and play",
+			Price:       599.99,
+			Category:    "Electronics",
+			Stock:       75,
+			Rating:      4.4,
+			ImageURL:    "https://example.com/ipad.jpg",
+			Weight:      0.46,
+			Tags:        []string{"apple", "tablet"},
+		},
+		{
+			ID:          "5",
+			Name:        "Apple Watch Series 9",
+			Description: "Smartwatch with health monitoring",
+			Price:       399.99,
+			Category:    "Electronics",
+			Stock:       60,
+			Rating:      4.7,
+			ImageURL:    "https://example.com/watch.jpg",
+			Weight:      0.03,
+			Tags:        []string{"apple", "wearable", "fitness"},
+		},
+	}
+	for _, product := range sampleProducts {
+		if err := store.SaveProduct(product); err != nil {
+			return err
+		}
+	}
+
+	// Sample coupons
+	for _, coupon := range []Coupon{
+		{Code: "SAVE10", PercentOff: 10},
+		{Code: "FIVEOFF", AmountOff: 5},
+	} {
+		if err := store.SaveCoupon(coupon); err != nil {
+			return err
+		}
+	}
+
+	// Sample checkout discount codes
+	for _, code := range []DiscountCode{
+		{Code: "WELCOME15", PercentOff: 15, ExpiresAt: now().AddDate(1, 0, 0), MaxUses: 100},
+		{Code: "TAKE20", AmountOff: 20, ExpiresAt: now().AddDate(0, 3, 0), MaxUses: 50},
+	} {
+		if err := store.SaveDiscountCode(code); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// healthResponse holds the fields every health check reports. The health
+// handlers are served outside /api/v1, so they carry no swag annotations;
+// openapi.go documents them.
+func healthResponse() HealthResponse {
+	return HealthResponse{
+		Status:    "healthy",
+		Timestamp: now().Format(time.RFC3339),
+		Service:   "SHITty E-commerce API",
+		Version:   "1.0.0",
+	}
+}
+
+// liveness answers 200 whenever the process can serve HTTP at all
+func (a *API) liveness(c *gin.Context) {
+	c.JSON(http.StatusOK, healthResponse())
+}
+
+// readiness answers 200 once the sample data is loaded and the store
+// responds, and 503 with the failing components otherwise
+func (a *API) readiness(c *gin.Context) {
+	response := healthResponse()
+	response.Components = map[string]ComponentHealth{}
+
+	store := ComponentHealth{Status: "healthy"}
+	if err := a.store.Ping(); err != nil {
+		requestLogf(c.GetString(requestIDKey), "Readiness check: store unreachable: %v", err)
+		store = ComponentHealth{Status: "unhealthy", Error: err.Error()}
+	}
+	response.Components["store"] = store
+
+	data := ComponentHealth{Status: "healthy"}
+	if !a.seeded.Load() {
+		data = ComponentHealth{Status: "unhealthy", Error: "sample data is still loading"}
+	}
+	response.Components["data"] = data
+
+	status := http.StatusOK
+	for _, component := range response.Components {
+		if component.Status != "healthy" {
+			response.Status = "unhealthy"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	c.JSON(status, response)
+}
+
+// @Summary Get all products
+// @Description Retrieve a list of all available products
+// @Tags products
+// @Accept json
+// @Produce json
+// @Param category query string false "Only products in this category (case-insensitive)"
+// @Param min_price query number false "Minimum price (inclusive)"
+// @Param max_price query number false "Maximum price (inclusive)"
+// @Param tag query string false "Only products with this tag (case-insensitive)"
+// @Param sort query string false "Sort order: price_asc, price_desc, rating_desc, name_asc, name_desc or best" default(name_asc)
+// @Param limit query int false "Page size; defaults to DEFAULT_PAGE_SIZE and is capped at MAX_PAGE_SIZE"
+// @Param offset query int false "Number of products to skip" default(0)
+// @Success 200 {object} ProductPage
+// @Failure 400 {object} ErrorResponse
+// @Router /products [get]
+func (a *API) getProducts(c *gin.Context) {
+	limit, offset, err := parsePageParams(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	filter, err := parseProductFilter(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	sortKey := c.Query("sort")
+	if sortKey == "" {
+		sortKey = defaultProductSort
+	}
+	if _, supported := productSorts[sortKey]; !supported && sortKey != "best" {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "Unsupported sort: "+sortKey)
+		return
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	// The unfiltered default listing pages straight out of the store
+	if filter.empty() && sortKey == defaultProductSort {
+		window, total, err := a.store.ListProductsPage(offset, limit)
+		if err != nil {
+			storeFailed(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, newProductPage(c, window, total, limit, offset))
+		return
+	}
+
+	// The store lists products in the default order already, so only other
+	// sorts need to re-sort the filtered list
+	allProducts, err := a.store.ListProducts()
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	productList := allProducts
+	if !filter.empty() {
+		productList = make([]Product, 0, len(allProducts))
+		for _, product := range allProducts {
+			if filter.matches(product) {
+				productList = append(productList, product)
+			}
+		}
+	}
+	if sortKey != defaultProductSort {
+		var sold map[string]int
+		if sortKey == "best" {
+			if sold, err = a.unitsSold(); err != nil {
+				storeFailed(c, err)
+				return
+			}
+		}
+		sortProducts(productList, sortKey, sold)
+	}
+
+	c.JSON(http.StatusOK, paginate(c, productList, limit, offset))
+}
+
+// @Summary Get a single product
+// @Description Retrieve a specific product by ID
+// @Tags products
+// @Accept json
+// @Produce json
+// @Param id path string true "Product ID"
+// @Param user_id query string false "User ID to record the view under for recently viewed products"
+// @Param If-None-Match header string false "ETag from an earlier response; answered with 304 when the product is unchanged"
+// @Success 200 {object} ProductView
+// @Success 304
+// @Failure 404 {object} ErrorResponse
+// @Router /products/{id} [get]
+func (a *API) getProduct(c *gin.Context) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	id := c.Param("id")
+	product, err := a.store.GetProductIncludingDeleted(id)
+	if errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusNotFound, errCodeProductNotFound, "Product not found")
+		return
+	}
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	// Views of deleted products aren't worth remembering
+	if userID := c.Query("user_id"); userID != "" && product.DeletedAt == nil && config.RecentlyViewedLimit > 0 {
+		visit := ProductVisit{UserID: userID, ProductID: product.ID, Viewed: now()}
+		if err := a.store.RecordProductVisit(visit, config.RecentlyViewedLimit); err != nil {
+			storeFailed(c, err)
+			return
+		}
+	}
+
+	body, err := json.Marshal(presentProduct(product))
+	if err != nil {
+		requestLogf(c.GetString(requestIDKey), "Encoding product %s: %v", id, err)
+		respondError(c, http.StatusInternalServerError, errCodeInternal, "Internal server error")
+		return
+	}
+	etag := computeETag(body)
+	c.Header("ETag", etag)
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
+
+// computeETag returns a strong ETag for a serialized response. It hashes
+// what is sent, so anything that changes the body, including a sale
+// starting, changes the ETag.
+func computeETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header names etag, using the
+// weak comparison RFC 9110 prescribes for If-None-Match
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// @Summary Get top products
+// @Description Retrieve top-rated products
+// @Tags products
+// @Accept json
+// @Produce json
+// @Param limit query int false "Number of products to return" default(5)
+// @Success 200 {array} ProductView
+// @Router /products/top [get]
+func (a *API) getTopProducts(c *gin.Context) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	limit := 5
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if parsed, err := parseLimit(limitStr); err == nil {
+			limit = parsed
+		}
+	}
+
+	productList, err := a.store.ListProducts()
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	// Sort by rating (descending) and limit results
+	// In a real app, you'd use a proper sorting algorithm
+	if len(productList) > limit {
+		productList = productList[:limit]
+	}
+
+	c.JSON(http.StatusOK, presentProducts(productList))
+}
+
+// @Summary Get low-stock products
+// @Description Products whose stock is at or below the threshold, lowest stock first, for reordering
+// @Tags products
+// @Accept json
+// @Produce json
+// @Param threshold query int false "Highest stock level to include; defaults to LOW_STOCK_THRESHOLD"
+// @Success 200 {array} ProductView
+// @Failure 400 {object} ErrorResponse
+// @Router /products/low-stock [get]
+func (a *API) getLowStockProducts(c *gin.Context) {
+	threshold := config.LowStockThreshold
+	if thresholdStr := c.Query("threshold"); thresholdStr != "" {
+		parsed, err := parseLimit(thresholdStr)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "threshold must be a non-negative integer")
+			return
+		}
+		threshold = parsed
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	productList, err := a.store.ListProducts()
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	var lowStock []Product
+	for _, product := range productList {
+		if product.Stock <= threshold {
+			lowStock = append(lowStock, product)
+		}
+	}
+	// Stable, so equal stock keeps the listing order
+	sort.SliceStable(lowStock, func(i, j int) bool {
+		return lowStock[i].Stock < lowStock[j].Stock
+	})
+
+	c.JSON(http.StatusOK, presentProducts(lowStock))
+}
+
+// @Summary List categories
+// @Description Every category in the current catalog with its number of products, alphabetical
+// @Tags products
+// @Accept json
+// @Produce json
+// @Success 200 {array} CategoryCount
+// @Router /categories [get]
+func (a *API) getCategories(c *gin.Context) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	productList, err := a.store.ListProducts()
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	counts := make(map[string]int)
+	for _, product := range productList {
+		if product.Category != "" {
+			counts[product.Category]++
+		}
+	}
+	categories := make([]CategoryCount, 0, len(counts))
+	for name, count := range counts {
+		categories = append(categories, CategoryCount{Name: name, Count: count})
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		return categories[i].Name < categories[j].Name
+	})
+
+	c.JSON(http.StatusOK, categories)
+}
+
+// @Summary Update a product
+// @Description Replace an existing product's details
+// @Tags products
+// @Accept json
+// @Produce json
+// @Param id path string true "Product ID"
+// @Param request body Product true "Updated product"
+// @Success 200 {object} ProductView
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /products/{id} [put]
+func (a *API) updateProduct(c *gin.Context) {
+	id := c.Param("id")
+
+	var product Product
+	if err := c.ShouldBindJSON(&product); err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request body")
+		return
+	}
+	product.Tags = normalizeTags(product.Tags)
+
+	if err := validateProduct(product); err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	if err := verifyImageURL(product.ImageURL); err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	existing, err := a.store.GetProduct(id)
+	if errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusNotFound, errCodeProductNotFound, "Product not found")
+		return
+	}
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	// The ID in the path always wins over whatever was sent in the body
+	product.ID = id
+	if err := a.saveProductUpdate(existing, product); err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, presentProduct(product))
+}
+
+// @Summary Partially update a product
+// @Description Change only the fields present in the body; omitted fields keep their values. The resulting product is validated like a full update.
+// @Tags products
+// @Accept json
+// @Produce json
+// @Param id path string true "Product ID"
+// @Param request body ProductPatch true "Fields to change"
+// @Success 200 {object} ProductView
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /products/{id} [patch]
+func (a *API) patchProduct(c *gin.Context) {
+	id := c.Param("id")
+
+	var patch ProductPatch
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request body")
+		return
+	}
+	// A new image is checked before locking, since verifying it may mean
+	// waiting on another server
+	if patch.ImageURL != nil {
+		err := validateImageURL(*patch.ImageURL)
+		if err == nil {
+			err = verifyImageURL(*patch.ImageURL)
+		}
+		if err != nil {
+			respondError(c, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+			return
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	existing, err := a.store.GetProduct(id)
+	if errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusNotFound, errCodeProductNotFound, "Product not found")
+		return
+	}
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	product := patch.apply(existing)
+	if err := validateProduct(product); err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	if err := a.saveProductUpdate(existing, product); err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, presentProduct(product))
+}
+
+// saveProductUpdate stores product in place of existing, recording a stock
+// change as an adjustment. Callers hold a.mu.
+func (a *API) saveProductUpdate(existing, product Product) error {
+	// Deletion only goes through deleteProduct, never a request body
+	product.DeletedAt = existing.DeletedAt
+	if delta := product.Stock - existing.Stock; delta != 0 {
+		if err := a.recordStockMovement(product.ID, delta, stockReasonAdjustment, ""); err != nil {
+			return err
+		}
+	}
+	if product.Price != existing.Price {
+		err := a.store.AddPriceChange(PriceChange{
+			ProductID: product.ID,
+			OldPrice:  existing.Price,
+			NewPrice:  product.Price,
+			Timestamp: now(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := a.store.SaveProduct(product); err != nil {
+		return err
+	}
+	a.invalidateSuggestions()
+	return nil
+}
+
+// @Summary Import products from CSV
+// @Description Create products from a text/csv body whose header row names the columns name, description, price, category, stock, rating and image_url. Every row is validated on its own: bad rows are reported with their line number and skipped while the rest are imported.
+// @Tags products
+// @Accept text/csv
+// @Produce json
+// @Success 200 {object} ImportSummary
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 415 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /products/import [post]
+func (a *API) importProducts(c *gin.Context) {
+	if c.ContentType() != "text/csv" {
+		respondError(c, http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, "Content-Type must be text/csv")
+		return
+	}
+
+	reader := csv.NewReader(http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "CSV header row is missing or unreadable")
+		return
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range importColumns {
+		if _, exists := columns[name]; !exists {
+			respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "CSV header is missing the "+name+" column")
+			return
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	summary := ImportSummary{Errors: []ImportError{}}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			summary.Errors = append(summary.Errors, ImportError{Line: parseErr.Line, Error: parseErr.Err.Error()})
+			continue
+		}
+		if err != nil {
+			respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "Reading CSV: "+err.Error())
+			return
+		}
+		line, _ := reader.FieldPos(0)
+
+		product, err := parseImportRow(record, columns)
+		if err == nil {
+			err = validateProduct(product)
+		}
+		if err == nil {
+			err = verifyImageURL(product.ImageURL)
+		}
+		if err != nil {
+			summary.Errors = append(summary.Errors, ImportError{Line: line, Error: err.Error()})
+			continue
+		}
+
+		product.ID = uuid.New().String()
+		if err := a.store.SaveProduct(product); err != nil {
+			storeFailed(c, err)
+			return
+		}
+		summary.Imported++
+	}
+	if summary.Imported > 0 {
+		a.invalidateSuggestions()
+	}
+
+	c.JSON(http.StatusOK, summary)
+}
+
+// @Summary Export products as CSV
+// @Description Download every product matching the optional filters as products.csv, with the same columns a product import reads plus id
+// @Tags products
+// @Produce text/csv
+// @Param category query string false "Only products in this category (case-insensitive)"
+// @Param min_price query number false "Minimum price (inclusive)"
+// @Param max_price query number false "Maximum price (inclusive)"
+// @Param tag query string false "Only products with this tag (case-insensitive)"
+// @Success 200 {file} file
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /products/export [get]
+func (a *API) exportProducts(c *gin.Context) {
+	filter, err := parseProductFilter(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	// The list is a copy, so the lock isn't held while a slow client reads
+	a.mu.RLock()
+	productList, err := a.store.ListProducts()
+	a.mu.RUnlock()
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="products.csv"`)
+	c.Status(http.StatusOK)
+
+	// Rows go straight to the response as they are written, flushed every
+	// so often, instead of building the whole file first
+	writer := csv.NewWriter(c.Writer)
+	if err := writer.Write(append([]string{"id"}, importColumns...)); err != nil {
+		requestLogf(c.GetString(requestIDKey), "Product export aborted: %v", err)
+		return
+	}
+	written := 0
+	for _, product := range productList {
+		if !filter.matches(product) {
+			continue
+		}
+		record := []string{
+			product.ID,
+			product.Name,
+			product.Description,
+			strconv.FormatFloat(product.Price, 'f', -1, 64),
+			product.Category,
+			strconv.Itoa(product.Stock),
+			strconv.FormatFloat(product.Rating, 'f', -1, 64),
+			product.ImageURL,
+		}
+		if err := writer.Write(record); err != nil {
+			requestLogf(c.GetString(requestIDKey), "Product export aborted: %v", err)
+			return
+		}
+		written++
+		if written%exportFlushEvery == 0 {
+			writer.Flush()
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		requestLogf(c.GetString(requestIDKey), "Product export aborted: %v", err)
+	}
+}
+
+// @Summary Delete a product
+// @Description Delete a product and remove it from every cart that contains it. The product disappears from listings and search but is kept for order history: GET /products/{id} still returns it, marked deleted.
+// @Tags products
+// @Param id path string true "Product ID"
+// @Success 204
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /products/{id} [delete]
+func (a *API) deleteProduct(c *gin.Context) {
+	id := c.Param("id")
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	err := a.store.DeleteProduct(id, now())
+	if errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusNotFound, errCodeProductNotFound, "Product not found")
+		return
+	}
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	a.invalidateSuggestions()
+
+	// Strip the product from every cart holding it
+	cartList, err := a.store.ListCarts()
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	for _, cart := range cartList {
+		items := make([]CartItem, 0, len(cart.Items))
+		for _, item := range cart.Items {
+			if item.ProductID != id {
+				items = append(items, item)
+			} else if err := a.releaseHeldUnits(&cart, item, item.Quantity); err != nil {
+				storeFailed(c, err)
+				return
+			}
+		}
+		if len(items) == len(cart.Items) {
+			continue
+		}
+
+		catalog, err := a.cartCatalog(items)
+		if err != nil {
+			storeFailed(c, err)
+			return
+		}
+		cart.Items = items
+		cart.Total = cartTotal(cart.Items, catalog)
+		cart.Updated = now()
+		if err := a.store.SaveCart(cart); err != nil {
+			storeFailed(c, err)
+			return
+		}
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// @Summary Get stock history
+// @Description Retrieve the stock movements of a product, newest first. Deleted products keep their history.
+// @Tags products
+// @Accept json
+// @Produce json
+// @Param id path string true "Product ID"
+// @Success 200 {array} StockMovement
+// @Failure 404 {object} ErrorResponse
+// @Router /products/{id}/stock-history [get]
+func (a *API) getStockHistory(c *gin.Context) {
+	id := c.Param("id")
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if _, err := a.store.GetProductIncludingDeleted(id); errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusNotFound, errCodeProductNotFound, "Product not found")
+		return
+	} else if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	movements, err := a.store.ListStockMovements(id)
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	history := make([]StockMovement, 0, len(movements))
+	for i := len(movements) - 1; i >= 0; i-- {
+		history = append(history, movements[i])
+	}
+
+	c.JSON(http.StatusOK, history)
+}
+
+// @Summary Get price history
+// @Description Retrieve the changes to a product's regular price, oldest first. Deleted products keep their history.
+// @Tags products
+// @Produce json
+// @Param id path string true "Product ID"
+// @Success 200 {array} PriceChange
+// @Failure 404 {object} ErrorResponse
+// @Router /products/{id}/price-history [get]
+func (a *API) getPriceHistory(c *gin.Context) {
+	id := c.Param("id")
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if _, err := a.store.GetProductIncludingDeleted(id); errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusNotFound, errCodeProductNotFound, "Product not found")
+		return
+	} else if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	changes, err := a.store.ListPriceChanges(id)
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	if changes == nil {
+		changes = []PriceChange{}
+	}
+
+	c.JSON(http.StatusOK, changes)
+}
+
+// @Summary Restock a product
+// @Description Increase a product's stock and record the movement in the stock ledger
+// @Tags products
+// @Accept json
+// @Produce json
+// @Param id path string true "Product ID"
+// @Param request body RestockRequest true "Units to add"
+// @Success 200 {object} ProductView
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /products/{id}/restock [post]
+func (a *API) restockProduct(c *gin.Context) {
+	id := c.Param("id")
+
+	var req RestockRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request body")
+		return
+	}
+	if req.Quantity <= 0 {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "quantity must be positive")
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	product, err := a.store.GetProduct(id)
+	if errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusNotFound, errCodeProductNotFound, "Product not found")
+		return
+	}
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	product.Stock += req.Quantity
+	if err := a.store.SaveProduct(product); err != nil {
+		storeFailed(c, err)
+		return
+	}
+	if err := a.recordStockMovement(id, req.Quantity, stockReasonRestock, ""); err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, presentProduct(product))
+}
+
+// @Summary Update stock in bulk
+// @Description Set the stock of several products in one call, recording each change in the stock ledger as bulk-adjust. Unknown products are reported per entry and skipped, or reject the whole batch when strict is true.
+// @Tags products
+// @Accept json
+// @Produce json
+// @Param strict query bool false "Reject the whole batch if any product is unknown"
+// @Param request body []StockUpdate true "New stock levels"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /products/stock [put]
+func (a *API) bulkUpdateStock(c *gin.Context) {
+	var updates []StockUpdate
+	if err := c.ShouldBindJSON(&updates); err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request body")
+		return
+	}
+	if len(updates) == 0 {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "At least one update is required")
+		return
+	}
+	for i, update := range updates {
+		if update.ProductID == "" {
+			respondErrorDetails(c, http.StatusBadRequest, errCodeInvalidRequest, "product_id is required", gin.H{"index": i})
+			return
+		}
+		if update.Stock == nil || *update.Stock < 0 {
+			respondErrorDetails(c, http.StatusBadRequest, errCodeInvalidRequest, "stock must be zero or more", gin.H{"index": i})
+			return
+		}
+	}
+	strict := c.Query("strict") == "true"
+
+	// One lock for the whole batch so no request sees it half applied
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Look every product up before changing any, so a strict batch with an
+	// unknown product leaves all stock as it was
+	known := make([]bool, len(updates))
+	for i, update := range updates {
+		_, err := a.store.GetProduct(update.ProductID)
+		if errors.Is(err, ErrNotFound) {
+			if strict {
+				respondErrorDetails(c, http.StatusBadRequest, errCodeProductNotFound, "Product not found: "+update.ProductID, gin.H{"index": i})
+				return
+			}
+			continue
+		}
+		if err != nil {
+			storeFailed(c, err)
+			return
+		}
+		known[i] = true
+	}
+
+	results := make([]StockUpdateResult, 0, len(updates))
+	updated := 0
+	for i, update := range updates {
+		result := StockUpdateResult{ProductID: update.ProductID}
+		if !known[i] {
+			result.Error = "Product not found"
+			results = append(results, result)
+			continue
+		}
+
+		product, err := a.store.GetProduct(update.ProductID)
+		if err != nil {
+			storeFailed(c, err)
+			return
+		}
+		delta := *update.Stock - product.Stock
+		product.Stock = *update.Stock
+		if err := a.store.SaveProduct(product); err != nil {
+			storeFailed(c, err)
+			return
+		}
+		if delta != 0 {
+			if err := a.recordStockMovement(product.ID, delta, stockReasonBulkAdjust, ""); err != nil {
+				storeFailed(c, err)
+				return
+			}
+		}
+
+		result.Updated = true
+		result.Stock = product.Stock
+		updated++
+		results = append(results, result)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"results": results,
+		"updated": updated,
+	})
+}
+
+// @Summary Get product reviews
+// @Description Retrieve the reviews of a product, newest first
+// @Tags products
+// @Accept json
+// @Produce json
+// @Param id path string true "Product ID"
+// @Success 200 {array} Review
+// @Failure 404 {object} ErrorResponse
+// @Router /products/{id}/reviews [get]
+func (a *API) getReviews(c *gin.Context) {
+	id := c.Param("id")
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if _, err := a.store.GetProduct(id); errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusNotFound, errCodeProductNotFound, "Product not found")
+		return
+	} else if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	reviews, err := a.store.ListReviews(id)
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	newestFirst := make([]Review, 0, len(reviews))
+	for i := len(reviews) - 1; i >= 0; i-- {
+		newestFirst = append(newestFirst, reviews[i])
+	}
+
+	c.JSON(http.StatusOK, newestFirst)
+}
+
+// @Summary Get related products
+// @Description "You might also like": other products in the same category as the given product, highest rated first
+// @Tags products
+// @Accept json
+// @Produce json
+// @Param id path string true "Product ID"
+// @Param limit query int false "Number of related products" default(5)
+// @Success 200 {array} ProductView
+// @Failure 404 {object} ErrorResponse
+// @Router /products/{id}/related [get]
+func (a *API) getRelatedProducts(c *gin.Context) {
+	id := c.Param("id")
+	limit := 5
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if parsed, err := parseLimit(limitStr); err == nil {
+			limit = parsed
+		}
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	product, err := a.store.GetProduct(id)
+	if errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusNotFound, errCodeProductNotFound, "Product not found")
+		return
+	}
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	productList, err := a.store.ListProducts()
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	var related []Product
+	for _, other := range productList {
+		if other.ID != id && strings.EqualFold(other.Category, product.Category) {
+			related = append(related, other)
+		}
+	}
+	sort.SliceStable(related, func(i, j int) bool {
+		return related[i].Rating > related[j].Rating
+	})
+	if len(related) > limit {
+		related = related[:limit]
+	}
+
+	c.JSON(http.StatusOK, presentProducts(related))
+}
+
+// @Summary Review a product
+// @Description Rate a product from 1 to 5 with an optional comment. The product's rating becomes the average of all its reviews.
+// @Tags products
+// @Accept json
+// @Produce json
+// @Param id path string true "Product ID"
+// @Param request body ReviewRequest true "Review"
+// @Success 201 {object} Review
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /products/{id}/reviews [post]
+func (a *API) addReview(c *gin.Context) {
+	id := c.Param("id")
+
+	var req ReviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request body")
+		return
+	}
+	if req.Rating < minReviewRating || req.Rating > maxReviewRating {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "rating must be between 1 and 5")
+		return
+	}
+	req.Comment = strings.TrimSpace(req.Comment)
+	if utf8.RuneCountInString(req.Comment) > maxReviewCommentLength {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "comment cannot be longer than 2000 characters")
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	product, err := a.store.GetProduct(id)
+	if errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusNotFound, errCodeProductNotFound, "Product not found")
+		return
+	}
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	userID := currentUserID(c)
+	userOrders, err := a.store.ListOrdersByUser(userID)
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	verified := hasPurchased(userOrders, id)
+	if config.VerifiedPurchaseOnly && !verified {
+		respondError(c, http.StatusForbidden, errCodeReviewNotAllowed, "Only customers who received this product can review it")
+		return
+	}
+
+	review := Review{
+		ID:        uuid.New().String(),
+		ProductID: id,
+		UserID:    userID,
+		Rating:    req.Rating,
+		Comment:   req.Comment,
+		Verified:  verified,
+		Timestamp: now(),
+	}
+	if err := a.store.AddReview(review); err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	reviews, err := a.store.ListReviews(id)
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	product.Rating = averageRating(reviews)
+	if err := a.store.SaveProduct(product); err != nil {
+		storeFailed(c, err)
+		return
+	}
+	a.invalidateSuggestions()
+
+	c.JSON(http.StatusCreated, review)
+}
+
+// @Summary Add product to cart
+// @Description Add a product to the caller's shopping cart. Without a token the item goes into a guest cart identified by the guest_cart cookie, which is set if missing.
+// @Tags cart
+// @Accept json
+// @Produce json
+// @Param request body CartItem true "Cart item to add"
+// @Success 200 {object} CartView
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /cart/add [post]
+func (a *API) addToCart(c *gin.Context) {
+	userID := currentUserID(c)
+
+	var item CartItem
+	if err := c.ShouldBindJSON(&item); err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request body")
+		return
+	}
+	if item.Quantity <= 0 {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "quantity must be positive")
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Check if product exists
+	product, err := a.store.GetProduct(item.ProductID)
+	if errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusNotFound, errCodeProductNotFound, "Product not found")
+		return
+	}
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	// Get or create cart
+	cart, err := a.store.GetCart(userID)
+	if errors.Is(err, ErrNotFound) {
+		cart = Cart{
+			ID:      uuid.New().String(),
+			UserID:  userID,
+			Items:   []CartItem{},
+			Total:   0,
+			Updated: now(),
+		}
+	} else if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	// Check stock against the quantity the cart will hold after this add,
+	// not just the amount being added. Units the cart holds already are out
+	// of stock.
+	inCart, held := 0, 0
+	for _, existingItem := range cart.Items {
+		if existingItem.ProductID == item.ProductID {
+			inCart, held = existingItem.Quantity, heldUnits(cart, existingItem)
+			break
+		}
+	}
+	if product.Stock < inCart+item.Quantity-held {
+		respondError(c, http.StatusBadRequest, errCodeInsufficientStock, "Insufficient stock")
+		return
+	}
+
+	// Check if product already in cart
+	line := -1
+	for i, existingItem := range cart.Items {
+		if existingItem.ProductID == item.ProductID {
+			cart.Items[i].Quantity += item.Quantity
+			line = i
+			break
+		}
+	}
+
+	if line < 0 {
+		cart.Items = append(cart.Items, item)
+		line = len(cart.Items) - 1
+	}
+
+	reservation := &stockReservation{store: a.store, requestID: c.GetString(requestIDKey)}
+	defer reservation.releaseUnlessCommitted()
+	if err := holdCartLine(reservation, &cart, cart.Items[line], held); errors.Is(err, ErrInsufficientStock) {
+		respondError(c, http.StatusBadRequest, errCodeInsufficientStock, "Insufficient stock")
+		return
+	} else if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	// Recalculate total
+	catalog, err := a.cartCatalog(cart.Items)
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	cart.Total = cartTotal(cart.Items, catalog)
+
+	cart.Updated = now()
+	if err := a.store.SaveCart(cart); err != nil {
+		storeFailed(c, err)
+		return
+	}
+	reservation.commit()
+
+	c.JSON(http.StatusOK, presentCart(c.GetString(requestIDKey), cart, catalog))
+}
+
+// @Summary Add several products to cart
+// @Description Add a list of products to the user's cart in one step. The items are all applied or none are: if any item is invalid the cart is left untouched and the error names the offending index.
+// @Tags cart
+// @Accept json
+// @Produce json
+// @Param userID path string true "User ID"
+// @Param request body []CartItem true "Cart items to add"
+// @Success 200 {object} CartView
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /cart/{userID}/batch [post]
+func (a *API) batchAddToCart(c *gin.Context) {
+	userID := c.Param("userID")
+
+	var items []CartItem
+	if err := c.ShouldBindJSON(&items); err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request body")
+		return
+	}
+	if len(items) == 0 {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "At least one item is required")
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	cart, err := a.store.GetCart(userID)
+	if errors.Is(err, ErrNotFound) {
+		cart = Cart{
+			ID:      uuid.New().String(),
+			UserID:  userID,
+			Items:   []CartItem{},
+			Total:   0,
+			Updated: now(),
+		}
+	} else if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	// Apply every item to the loaded copy of the cart and only save once
+	// they have all passed, so a bad item leaves the stored cart as it was
+	// and gives back any stock held for the items before it
+	reservation := &stockReservation{store: a.store, requestID: c.GetString(requestIDKey)}
+	defer reservation.releaseUnlessCommitted()
+	for i, item := range items {
+		if item.Quantity <= 0 {
+			respondErrorDetails(c, http.StatusBadRequest, errCodeInvalidRequest, "quantity must be positive", gin.H{"index": i})
+			return
+		}
+		product, err := a.store.GetProduct(item.ProductID)
+		if errors.Is(err, ErrNotFound) {
+			respondErrorDetails(c, http.StatusBadRequest, errCodeProductNotFound, "Product not found", gin.H{"index": i})
+			return
+		}
+		if err != nil {
+			storeFailed(c, err)
+			return
+		}
+
+		line, held := -1, 0
+		for j := range cart.Items {
+			if cart.Items[j].ProductID == item.ProductID {
+				held = heldUnits(cart, cart.Items[j])
+				if product.Stock < cart.Items[j].Quantity+item.Quantity-held {
+					respondErrorDetails(c, http.StatusBadRequest, errCodeInsufficientStock, "Insufficient stock", gin.H{"index": i})
+					return
+				}
+				cart.Items[j].Quantity += item.Quantity
+				line = j
+				break
+			}
+		}
+		if line < 0 {
+			if product.Stock < item.Quantity {
+				respondErrorDetails(c, http.StatusBadRequest, errCodeInsufficientStock, "Insufficient stock", gin.H{"index": i})
+				return
+			}
+			cart.Items = append(cart.Items, item)
+			line = len(cart.Items) - 1
+		}
+		if err := holdCartLine(reservation, &cart, cart.Items[line], held); errors.Is(err, ErrInsufficientStock) {
+			respondErrorDetails(c, http.StatusBadRequest, errCodeInsufficientStock, "Insufficient stock", gin.H{"index": i})
+			return
+		} else if err != nil {
+			storeFailed(c, err)
+			return
+		}
+	}
+
+	catalog, err := a.cartCatalog(cart.Items)
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	cart.Total = cartTotal(cart.Items, catalog)
+
+	cart.Updated = now()
+	if err := a.store.SaveCart(cart); err != nil {
+		storeFailed(c, err)
+		return
+	}
+	reservation.commit()
+
+	c.JSON(http.StatusOK, presentCart(c.GetString(requestIDKey), cart, catalog))
+}
+
+// @Summary Remove item from cart
+// @Description Remove a product from the caller's shopping cart, a guest's included
+// @Tags cart
+// @Accept json
+// @Produce json
+// @Param request body CartItem true "Cart item to remove"
+// @Success 200 {object} CartView
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /cart/remove [delete]
+func (a *API) removeFromCart(c *gin.Context) {
+	userID := currentUserID(c)
+
+	var item CartItem
+	if err := c.ShouldBindJSON(&item); err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request body")
+		return
+	}
+	if item.Quantity <= 0 {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "quantity must be positive")
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	cart, err := a.store.GetCart(userID)
+	if errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusBadRequest, errCodeCartNotFound, "Cart not found")
+		return
+	}
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	// Remove item from cart
+	found := false
+	for i, existingItem := range cart.Items {
+		if existingItem.ProductID == item.ProductID {
+			removed := item.Quantity
+			if item.Quantity >= existingItem.Quantity {
+				// Remove completely
+				removed = existingItem.Quantity
+				cart.Items = append(cart.Items[:i], cart.Items[i+1:]...)
+			} else {
+				// Reduce quantity
+				cart.Items[i].Quantity -= item.Quantity
+			}
+			if err := a.releaseHeldUnits(&cart, existingItem, removed); err != nil {
+				storeFailed(c, err)
+				return
+			}
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		respondError(c, http.StatusNotFound, errCodeItemNotInCart, "item not in cart")
+		return
+	}
+
+	// Recalculate total
+	catalog, err := a.cartCatalog(cart.Items)
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	cart.Total = cartTotal(cart.Items, catalog)
+
+	cart.Updated = now()
+	if err := a.store.SaveCart(cart); err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, presentCart(c.GetString(requestIDKey), cart, catalog))
+}
+
+// @Summary Get user's cart
+// @Description Retrieve the user's shopping cart, with the total recomputed from current prices
+// @Tags cart
+// @Accept json
+// @Produce json
+// @Param userID path string true "User ID"
+// @Success 200 {object} CartView
+// @Failure 404 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /cart/{userID} [get]
+func (a *API) getCart(c *gin.Context) {
+	a.respondCart(c, c.Param("userID"))
+}
+
+// @Summary Get your cart
+// @Description Retrieve the caller's shopping cart: the token user's, or without a token the guest cart named by the guest_cart cookie
+// @Tags cart
+// @Produce json
+// @Success 200 {object} CartView
+// @Failure 404 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Router /cart [get]
+func (a *API) getOwnCart(c *gin.Context) {
+	a.respondCart(c, currentUserID(c))
+}
+
+// respondCart answers with the user's cart, its total rebuilt from the
+// current prices
+func (a *API) respondCart(c *gin.Context, userID string) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	cart, err := a.store.GetCart(userID)
+	if errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusNotFound, errCodeCartNotFound, "Cart not found")
+		return
+	}
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	catalog, err := a.cartCatalog(cart.Items)
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	// Prices may have changed since the cart was saved, e.g. while the
+	// server was down, so the total is always rebuilt from the catalog
+	cart.Total = cartTotal(cart.Items, catalog)
+
+	c.JSON(http.StatusOK, presentCart(c.GetString(requestIDKey), cart, catalog))
+}
+
+// @Summary Merge the guest cart into the user's cart
+// @Description On login, fold the cart of the guest_cart cookie into the authenticated user's cart. Quantities of products in both are summed and capped at the available stock; products that no longer exist are dropped. The guest cart and cookie are removed.
+// @Tags cart
+// @Produce json
+// @Success 200 {object} CartView
+// @Failure 404 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /cart/merge [post]
+func (a *API) mergeGuestCart(c *gin.Context) {
+	userID := currentUserID(c)
+
+	sessionID, ok := guestSession(c)
+	if !ok {
+		respondError(c, http.StatusNotFound, errCodeCartNotFound, "No guest cart to merge")
+		return
+	}
+	guestID := guestUserPrefix + sessionID
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	guest, err := a.store.GetCart(guestID)
+	if errors.Is(err, ErrNotFound) {
+		clearGuestSession(c)
+		respondError(c, http.StatusNotFound, errCodeCartNotFound, "No guest cart to merge")
+		return
+	}
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	cart, err := a.store.GetCart(userID)
+	if errors.Is(err, ErrNotFound) {
+		cart = Cart{
+			ID:      uuid.New().String(),
+			UserID:  userID,
+			Items:   []CartItem{},
+			Total:   0,
+			Updated: now(),
+		}
+	} else if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	// The guest cart's holds go back to stock first, and the merged lines
+	// hold what they need of it again
+	if err := a.releaseCartHolds(&guest); err != nil {
+		storeFailed(c, err)
+		return
+	}
+	held := make(map[string]int, len(cart.Items))
+	for _, item := range cart.Items {
+		held[item.ProductID] = heldUnits(cart, item)
+	}
+
+	catalog, err := a.cartCatalog(append(append([]CartItem(nil), cart.Items...), guest.Items...))
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	for _, item := range guest.Items {
+		product, exists := catalog[item.ProductID]
+		if !exists {
+			continue
+		}
+		cart.Items = mergeCartItem(cart.Items, item)
+		for i := range cart.Items {
+			if available := product.Stock + held[item.ProductID]; cart.Items[i].ProductID == item.ProductID && cart.Items[i].Quantity > available {
+				cart.Items[i].Quantity = available
+			}
+		}
+	}
+	// A product that sold out leaves a line with nothing in it
+	items := cart.Items[:0]
+	for _, item := range cart.Items {
+		if item.Quantity > 0 {
+			items = append(items, item)
+		}
+	}
+	cart.Items = items
+	for _, item := range guest.Saved {
+		cart.Saved = mergeCartItem(cart.Saved, item)
+	}
+
+	reservation := &stockReservation{store: a.store, requestID: c.GetString(requestIDKey)}
+	defer reservation.releaseUnlessCommitted()
+	for _, item := range cart.Items {
+		if !cartHasProduct(guest.Items, item.ProductID) {
+			continue
+		}
+		if err := holdCartLine(reservation, &cart, item, held[item.ProductID]); err != nil {
+			storeFailed(c, err)
+			return
+		}
+	}
+
+	cart.Total = cartTotal(cart.Items, catalog)
+	cart.Updated = now()
+	if err := a.store.SaveCart(cart); err != nil {
+		storeFailed(c, err)
+		return
+	}
+	reservation.commit()
+	if err := a.store.DeleteCart(guestID); err != nil {
+		storeFailed(c, err)
+		return
+	}
+	clearGuestSession(c)
+
+	c.JSON(http.StatusOK, presentCart(c.GetString(requestIDKey), cart, catalog))
+}
+
+// @Summary Clear cart
+// @Description Remove every item from the user's shopping cart
+// @Tags cart
+// @Accept json
+// @Produce json
+// @Param userID path string true "User ID"
+// @Success 200 {object} Cart
+// @Failure 404 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /cart/{userID}/clear [delete]
+func (a *API) clearCart(c *gin.Context) {
+	userID := c.Param("userID")
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	cart, err := a.store.GetCart(userID)
+	if errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusNotFound, errCodeCartNotFound, "Cart not found")
+		return
+	}
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	if err := a.releaseCartHolds(&cart); err != nil {
+		storeFailed(c, err)
+		return
+	}
+	cart.Items = []CartItem{}
+	cart.Total = 0
+	cart.Updated = now()
+	if err := a.store.SaveCart(cart); err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, cart)
+}
+
+// @Summary Save a cart item for later
+// @Description Move a product from the cart to the saved list and recalculate the cart total. Saved items don't hold stock.
+// @Tags cart
+// @Produce json
+// @Param userID path string true "User ID"
+// @Param productID path string true "Product ID"
+// @Success 200 {object} CartView
+// @Failure 404 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /cart/{userID}/save/{productID} [post]
+func (a *API) saveForLater(c *gin.Context) {
+	userID, productID := c.Param("userID"), c.Param("productID")
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	cart, err := a.store.GetCart(userID)
+	if errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusNotFound, errCodeCartNotFound, "Cart not found")
+		return
+	}
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	item, ok := takeCartItem(&cart.Items, productID)
+	if !ok {
+		respondError(c, http.StatusNotFound, errCodeItemNotInCart, "item not in cart")
+		return
+	}
+	if err := a.releaseHeldUnits(&cart, item, item.Quantity); err != nil {
+		storeFailed(c, err)
+		return
+	}
+	cart.Saved = mergeCartItem(cart.Saved, item)
+
+	a.saveCartAndRespond(c, cart)
+}
+
+// @Summary Move a saved item back to the cart
+// @Description Move a product from the saved list back into the cart and recalculate the cart total. The product must still exist and have enough stock.
+// @Tags cart
+// @Produce json
+// @Param userID path string true "User ID"
+// @Param productID path string true "Product ID"
+// @Success 200 {object} CartView
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /cart/{userID}/unsave/{productID} [post]
+func (a *API) moveToCart(c *gin.Context) {
+	userID, productID := c.Param("userID"), c.Param("productID")
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	cart, err := a.store.GetCart(userID)
+	if errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusNotFound, errCodeCartNotFound, "Cart not found")
+		return
+	}
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	item, ok := takeCartItem(&cart.Saved, productID)
+	if !ok {
+		respondError(c, http.StatusNotFound, errCodeItemNotSaved, "item not saved for later")
+		return
+	}
+
+	product, err := a.store.GetProduct(productID)
+	if errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusBadRequest, errCodeProductNotFound, "Product not found")
+		return
+	}
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	held := 0
+	for _, line := range cart.Items {
+		if line.ProductID == productID {
+			held = heldUnits(cart, line)
+		}
+	}
+	cart.Items = mergeCartItem(cart.Items, item)
+	reservation := &stockReservation{store: a.store, requestID: c.GetString(requestIDKey)}
+	defer reservation.releaseUnlessCommitted()
+	for _, line := range cart.Items {
+		if line.ProductID != productID {
+			continue
+		}
+		if product.Stock < line.Quantity-held {
+			respondError(c, http.StatusBadRequest, errCodeInsufficientStock, "Insufficient stock")
+			return
+		}
+		if err := holdCartLine(reservation, &cart, line, held); errors.Is(err, ErrInsufficientStock) {
+			respondError(c, http.StatusBadRequest, errCodeInsufficientStock, "Insufficient stock")
+			return
+		} else if err != nil {
+			storeFailed(c, err)
+			return
+		}
+	}
+
+	if a.saveCartAndRespond(c, cart) {
+		reservation.commit()
+	}
+}
+
+// saveCartAndRespond recalculates the cart total, stores the cart and
+// answers with its CartView, reporting whether the cart was saved
+func (a *API) saveCartAndRespond(c *gin.Context, cart Cart) bool {
+	catalog, err := a.cartCatalog(cart.Items)
+	if err != nil {
+		storeFailed(c, err)
+		return false
+	}
+	cart.Total = cartTotal(cart.Items, catalog)
+
+	cart.Updated = now()
+	if err := a.store.SaveCart(cart); err != nil {
+		storeFailed(c, err)
+		return false
+	}
+
+	c.JSON(http.StatusOK, presentCart(c.GetString(requestIDKey), cart, catalog))
+	return true
+}
+
+// takeCartItem removes the line for productID from items and returns it
+func takeCartItem(items *[]CartItem, productID string) (CartItem, bool) {
+	for i, item := range *items {
+		if item.ProductID == productID {
+			*items = append((*items)[:i], (*items)[i+1:]...)
+			return item, true
+		}
+	}
+	return CartItem{}, false
+}
+
+// mergeCartItem adds item to items, combining it with an existing line for
+// the same product
+func mergeCartItem(items []CartItem, item CartItem) []CartItem {
+	for i := range items {
+		if items[i].ProductID == item.ProductID {
+			items[i].Quantity += item.Quantity
+			return items
+		}
+	}
+	return append(items, item)
+}
+
+// cartHasProduct reports whether items has a line for productID
+func cartHasProduct(items []CartItem, productID string) bool {
+	for _, item := range items {
+		if item.ProductID == productID {
+			return true
+		}
+	}
+	return false
+}
+
+// @Summary Estimate cart total
+// @Description Preview subtotal, tax, shipping, discounts and grand total for the user's cart without creating an order
+// @Tags cart
+// @Accept json
+// @Produce json
+// @Param userID path string true "User ID"
+// @Param coupon query string false "Coupon code to apply"
+// @Param shipping_method query string false "Shipping method: standard, express or overnight" default(standard)
+// @Success 200 {object} CartEstimate
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /cart/{userID}/estimate [get]
+func (a *API) getCartEstimate(c *gin.Context) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	userID := c.Param("userID")
+	cart, err := a.store.GetCart(userID)
+	if errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusNotFound, errCodeCartNotFound, "Cart not found")
+		return
+	}
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	applied, err := a.cartCoupons(cart)
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	// The coupon param previews a coupon on top of the ones already applied
+	if code := strings.ToUpper(c.Query("coupon")); code != "" {
+		coupon, err := a.store.GetCoupon(code)
+		if errors.Is(err, ErrNotFound) {
+			respondError(c, http.StatusBadRequest, errCodeInvalidCoupon, "Invalid coupon")
+			return
+		}
+		if err != nil {
+			storeFailed(c, err)
+			return
+		}
+		if config.AllowCouponStacking || !containsString(cart.Coupons, code) {
+			applied = append(applied, coupon)
+		}
+	}
+
+	shipping, err := lookupShippingMethod(c.Query("shipping_method"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	catalog, err := a.cartCatalog(cart.Items)
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, estimateCart(cart, applied, shipping, catalog))
+}
+
+// @Summary Quote shipping for the cart
+// @Description List shipping options with costs and delivery estimates for sending the user's cart to a destination, priced by cart weight
+// @Tags cart
+// @Accept json
+// @Produce json
+// @Param userID path string true "User ID"
+// @Param request body ShippingQuoteRequest true "Destination"
+// @Success 200 {object} ShippingQuote
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /cart/{userID}/shipping [post]
+func (a *API) quoteShipping(c *gin.Context) {
+	userID := c.Param("userID")
+
+	var req ShippingQuoteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request body")
+		return
+	}
+	country := strings.ToUpper(strings.TrimSpace(req.Country))
+	if country == "" {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "country is required")
+		return
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	cart, err := a.store.GetCart(userID)
+	if errors.Is(err, ErrNotFound) || (err == nil && len(cart.Items) == 0) {
+		respondError(c, http.StatusNotFound, errCodeCartNotFound, "Cart not found or empty")
+		return
+	}
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	catalog, err := a.cartCatalog(cart.Items)
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	quote := ShippingQuote{
+		CartID:     cart.ID,
+		Country:    country,
+		PostalCode: strings.TrimSpace(req.PostalCode),
+		Domestic:   country == strings.ToUpper(config.HomeCountry),
+		Weight:     cartWeight(cart.Items, catalog),
+		Options:    []ShippingMethod{},
+	}
+	for _, rate := range shippingRates {
+		if rate.domestic != quote.Domestic {
+			continue
+		}
+		quote.Options = append(quote.Options, ShippingMethod{
+			Name: rate.method,
+			Cost: roundCents(rate.base + rate.perKg*quote.Weight),
+			Days: rate.days,
+		})
+	}
+	quote.Weight = math.Round(quote.Weight*1000) / 1000
+
+	c.JSON(http.StatusOK, quote)
+}
+
+// @Summary Apply a coupon to the cart
+// @Description Apply a coupon code to the user's cart. Applying a coupon that is already on the cart is rejected unless coupon stacking is enabled.
+// @Tags cart
+// @Accept json
+// @Produce json
+// @Param userID path string true "User ID"
+// @Param request body ApplyCouponRequest true "Coupon to apply"
+// @Success 200 {object} Cart
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /cart/{userID}/coupons [post]
+func (a *API) applyCoupon(c *gin.Context) {
+	userID := c.Param("userID")
+
+	var req ApplyCouponRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request body")
+		return
+	}
+	code := strings.ToUpper(strings.TrimSpace(req.Code))
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	cart, err := a.store.GetCart(userID)
+	if errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusNotFound, errCodeCartNotFound, "Cart not found")
+		return
+	}
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	if _, err := a.store.GetCoupon(code); errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusBadRequest, errCodeInvalidCoupon, "Invalid coupon")
+		return
+	} else if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	if !config.AllowCouponStacking && containsString(cart.Coupons, code) {
+		respondErrorDetails(c, http.StatusConflict, errCodeCouponAlreadyApplied, "Coupon already applied", gin.H{"coupons": cart.Coupons})
+		return
+	}
+
+	cart.Coupons = append(cart.Coupons, code)
+	cart.Updated = now()
+	if err := a.store.SaveCart(cart); err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, cart)
+}
+
+// @Summary Checkout
+// @Description Complete the checkout process and create an order
+// @Tags checkout
+// @Accept json
+// @Produce json
+// @Param request body CheckoutRequest false "Checkout options"
+// @Param discount_code query string false "Discount code to redeem"
+// @Param Idempotency-Key header string false "Retrying with the same key returns the original order instead of creating another"
+// @Success 200 {object} Order
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /checkout [post]
+func (a *API) checkout(c *gin.Context) {
+	userID := currentUserID(c)
+
+	// The request body is optional, an empty one means default options
+	var req CheckoutRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request body")
+			return
+		}
+	}
+
+	shipping, err := lookupShippingMethod(req.ShippingMethod)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	idempotencyKey := c.GetHeader(idempotencyKeyHeader)
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "Idempotency-Key cannot be longer than 255 characters")
+		return
+	}
+
+	// Hold the lock for the whole checkout so the stock reservation, the
+	// discount redemption and the order creation happen together. The
+	// reservation itself is atomic in the store, which also keeps other
+	// processes sharing the database from overselling.
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// A retry of a checkout that already went through gets the original
+	// order back
+	if idempotencyKey != "" {
+		record, err := a.store.GetIdempotencyKey(userID, idempotencyKey)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			storeFailed(c, err)
+			return
+		}
+		if err == nil && now().Sub(record.Created) < config.IdempotencyKeyTTL {
+			order, err := a.store.GetOrder(record.OrderID)
+			if err != nil {
+				storeFailed(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, order)
+			return
+		}
+	}
+
+	cart, err := a.store.GetCart(userID)
+	if errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusBadRequest, errCodeCartNotFound, "Cart not found")
+		return
+	}
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	if len(cart.Items) == 0 {
+		respondError(c, http.StatusBadRequest, errCodeCartEmpty, "Cart is empty")
+		return
+	}
+
+	catalog, err := a.cartCatalog(cart.Items)
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	for _, item := range cart.Items {
+		if _, exists := catalog[item.ProductID]; !exists {
+			respondError(c, http.StatusBadRequest, errCodeProductNotFound, "Product not found: "+item.ProductID)
+			return
+		}
+	}
+
+	// The minimum applies to the goods, before discounts and shipping
+	if config.MinOrderAmount > 0 && cartTotal(cart.Items, catalog) < config.MinOrderAmount {
+		respondError(c, http.StatusBadRequest, errCodeBelowMinimumOrder,
+			"order below minimum of "+strconv.FormatFloat(config.MinOrderAmount, 'f', 2, 64))
+		return
+	}
+
+	// Reserve the stock for every item up front; it may have dropped since
+	// the item was added to the cart. A single short item rejects the whole
+	// checkout, and any failure before the order is saved puts the reserved
+	// units back. Lines the cart still holds are out of stock already, while
+	// lines whose hold lapsed need stock again like any other.
+	reservation := &stockReservation{store: a.store, requestID: c.GetString(requestIDKey)}
+	defer reservation.releaseUnlessCommitted()
+	for _, item := range cart.Items {
+		if heldUnits(cart, item) > 0 {
+			continue
+		}
+		err := reservation.reserve(item.ProductID, item.Quantity)
+		if errors.Is(err, ErrInsufficientStock) {
+			respondError(c, http.StatusBadRequest, errCodeInsufficientStock, "Insufficient stock for "+catalog[item.ProductID].Name)
+			return
+		}
+		if errors.Is(err, ErrNotFound) {
+			respondError(c, http.StatusBadRequest, errCodeProductNotFound, "Product not found: "+item.ProductID)
+			return
+		}
+		if err != nil {
+			storeFailed(c, err)
+			return
+		}
+	}
+
+	var discount *DiscountCode
+	if code := strings.ToUpper(strings.TrimSpace(c.Query("discount_code"))); code != "" {
+		found, err := a.store.GetDiscountCode(code)
+		if errors.Is(err, ErrNotFound) {
+			respondError(c, http.StatusBadRequest, errCodeInvalidDiscountCode, "Invalid discount code")
+			return
+		}
+		if err != nil {
+			storeFailed(c, err)
+			return
+		}
+		if err := checkRedeemable(found); err != nil {
+			respondError(c, http.StatusBadRequest, errCodeInvalidDiscountCode, err.Error())
+			return
+		}
+		discount = &found
+	}
+
+	coupons, err := a.cartCoupons(cart)
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	// Create order
+	orderItems := make([]OrderItem, 0, len(cart.Items))
+	for _, item := range cart.Items {
+		product := catalog[item.ProductID]
+		orderItems = append(orderItems, OrderItem{
+			ProductID:         item.ProductID,
+			Quantity:          item.Quantity,
+			FulfillmentStatus: fulfillmentPending,
+			Name:              product.Name,
+			Category:          product.Category,
+			UnitPrice:         effectivePrice(product),
+		})
+	}
+
+	sequence, err := a.store.NextOrderNumber()
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	subtotal := cartTotal(cart.Items, catalog)
+	created := now()
+	order := Order{
+		ID:      uuid.New().String(),
+		Number:  formatOrderNumber(sequence),
+		UserID:  userID,
+		Items:   orderItems,
+		Status:  orderStatusPending,
+		Created: created,
+
+		ShippingMethod:    shipping.Name,
+		ShippingCost:      shippingCost(shipping, subtotal),
+		EstimatedDelivery: created.AddDate(0, 0, shipping.Days),
+	}
+	// Discounts come off the goods only, never the shipping. The cart's
+	// coupons go first, as in the cart estimate, and the discount code
+	// applies to what they leave.
+	discounted, _ := applyCoupons(subtotal, coupons)
+	if discount != nil {
+		order.DiscountCode = discount.Code
+		discounted -= discountAmount(*discount, discounted)
+	}
+	order.Discount = roundCents(subtotal - discounted)
+	order.Tax = roundCents(discounted * taxRate)
+	order.Total = roundCents(discounted + order.Tax + order.ShippingCost)
+
+	if err := a.store.SaveOrder(order); err != nil {
+		storeFailed(c, err)
+		return
+	}
+	// From here on the reserved units are sold
+	reservation.commit()
+	for _, item := range cart.Items {
+		if err := a.recordStockMovement(item.ProductID, -item.Quantity, stockReasonCheckout, order.ID); err != nil {
+			storeFailed(c, err)
+			return
+		}
+	}
+
+	if discount != nil {
+		discount.Uses++
+		if err := a.store.SaveDiscountCode(*discount); err != nil {
+			storeFailed(c, err)
+			return
+		}
+	}
+
+	if idempotencyKey != "" {
+		if err := a.store.PruneIdempotencyKeys(now().Add(-config.IdempotencyKeyTTL)); err != nil {
+			storeFailed(c, err)
+			return
+		}
+		record := IdempotencyKey{UserID: userID, Key: idempotencyKey, OrderID: order.ID, Created: now()}
+		if err := a.store.SaveIdempotencyKey(record); err != nil {
+			storeFailed(c, err)
+			return
+		}
+	}
+
+	// Clear cart, coupons included since they were used up, and the holds,
+	// since their units are sold now
+	cart.Items = []CartItem{}
+	cart.Coupons = nil
+	cart.Reservations = nil
+	cart.Total = 0
+	cart.Updated = now()
+	if err := a.store.SaveCart(cart); err != nil {
+		storeFailed(c, err)
+		return
+	}
+	a.webhooks.publish(c.GetString(requestIDKey), webhookOrderCreated, order)
+
+	c.JSON(http.StatusOK, order)
+}
+
+// stockReservation tracks the units a checkout has taken out of stock so they
+// can be put back if the checkout fails before its order is saved
+type stockReservation struct {
+	store     Store
+	requestID string
+	reserved  []CartItem
+	committed bool
+}
+
+func (r *stockReservation) reserve(productID string, quantity int) error {
+	if err := r.store.ReserveStock(productID, quantity); err != nil {
+		return err
+	}
+	r.reserved = append(r.reserved, CartItem{ProductID: productID, Quantity: quantity})
+	return nil
+}
+
+// commit turns the reservation into a sale
+func (r *stockReservation) commit() {
+	r.committed = true
+}
+
+// releaseUnlessCommitted returns every reserved unit to stock, unless the
+// reservation was committed
+func (r *stockReservation) releaseUnlessCommitted() {
+	if r.committed {
+		return
+	}
+	for _, item := range r.reserved {
+		if err := r.store.ReleaseStock(item.ProductID, item.Quantity); err != nil {
+			requestLogf(r.requestID, "Releasing %d reserved units of product %s: %v", item.Quantity, item.ProductID, err)
+		}
+	}
+}
+
+// @Summary Get order history
+// @Description Retrieve the user's order history, newest first
+// @Tags orders
+// @Accept json
+// @Produce json
+// @Param userID path string true "User ID"
+// @Success 200 {array} Order
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /orders/{userID} [get]
+func (a *API) getOrderHistory(c *gin.Context) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	userID := c.Param("userID")
+	userOrders, err := a.store.ListOrdersByUser(userID)
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	// Newest first, with the ID keeping same-instant orders stable
+	sort.Slice(userOrders, func(i, j int) bool {
+		if !userOrders[i].Created.Equal(userOrders[j].Created) {
+			return userOrders[i].Created.After(userOrders[j].Created)
+		}
+		return userOrders[i].ID < userOrders[j].ID
+	})
+
+	c.JSON(http.StatusOK, userOrders)
+}
+
+// @Summary Get an order
+// @Description Retrieve one of the caller's orders with its subtotal, tax and total
+// @Tags orders
+// @Produce json
+// @Param orderID path string true "Order ID"
+// @Success 200 {object} OrderDetail
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /orders/detail/{orderID} [get]
+func (a *API) getOrder(c *gin.Context) {
+	orderID, ok := uuidParam(c, "orderID")
+	if !ok {
+		return
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	order, err := a.store.GetOrder(orderID)
+	if errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusNotFound, errCodeOrderNotFound, "Order not found")
+		return
+	}
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	if order.UserID != currentUserID(c) {
+		respondError(c, http.StatusForbidden, errCodeForbidden, "Access to another user's data is forbidden")
+		return
+	}
+
+	c.JSON(http.StatusOK, OrderDetail{
+		Order:    order,
+		Subtotal: orderSubtotal(order),
+	})
+}
+
+// @Summary Download an order receipt
+// @Description Download an itemized receipt of one of the caller's orders with its subtotal, discount, tax, shipping and total, as JSON or as plain text suitable for email
+// @Tags orders
+// @Produce json
+// @Produce plain
+// @Param orderID path string true "Order ID"
+// @Param format query string false "Receipt format" Enums(json, text) default(json)
+// @Success 200 {object} Receipt
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /orders/detail/{orderID}/receipt [get]
+func (a *API) getOrderReceipt(c *gin.Context) {
+	orderID, ok := uuidParam(c, "orderID")
+	if !ok {
+		return
+	}
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "text" {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "format must be json or text")
+		return
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	order, err := a.store.GetOrder(orderID)
+	if errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusNotFound, errCodeOrderNotFound, "Order not found")
+		return
+	}
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	if order.UserID != currentUserID(c) {
+		respondError(c, http.StatusForbidden, errCodeForbidden, "Access to another user's data is forbidden")
+		return
+	}
+
+	receipt, err := a.buildReceipt(order)
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	if format == "text" {
+		c.Header("Content-Disposition", `attachment; filename="receipt-`+order.ID+`.txt"`)
+		c.String(http.StatusOK, formatReceiptText(receipt))
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="receipt-`+order.ID+`.json"`)
+	c.JSON(http.StatusOK, receipt)
+}
+
+// @Summary Mark order lines shipped
+// @Description Mark one or more lines of an order as shipped and update the derived order status. Requires the admin role.
+// @Tags orders
+// @Accept json
+// @Produce json
+// @Param orderID path string true "Order ID"
+// @Param request body ShipItemsRequest true "Product IDs of the lines to ship"
+// @Success 200 {object} Order
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /orders/{orderID}/ship [post]
+func (a *API) shipOrderItems(c *gin.Context) {
+	orderID, ok := uuidParam(c, "orderID")
+	if !ok {
+		return
+	}
+
+	var req ShipItemsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request body")
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	order, err := a.store.GetOrder(orderID)
+	if errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusNotFound, errCodeOrderNotFound, "Order not found")
+		return
+	}
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	if order.Status == orderStatusCancelled {
+		respondError(c, http.StatusBadRequest, errCodeOrderCancelled, "Order is cancelled")
+		return
+	}
+
+	// Every line must belong to the order before any of them is marked, so an
+	// unknown product leaves the stored order untouched
+	for _, productID := range req.ProductIDs {
+		found := false
+		for i := range order.Items {
+			if order.Items[i].ProductID == productID {
+				order.Items[i].FulfillmentStatus = fulfillmentShipped
+				found = true
+				break
+			}
+		}
+		if !found {
+			respondError(c, http.StatusBadRequest, errCodeProductNotInOrder, "Product not in order: "+productID)
+			return
+		}
+	}
+
+	statusChanged := false
+	if status := deriveOrderStatus(order); status != order.Status {
+		if !canTransition(order.Status, status) {
+			respondError(c, http.StatusConflict, errCodeInvalidStatusTransition, "Cannot ship lines of a "+order.Status+" order")
+			return
+		}
+		order.Status = status
+		statusChanged = true
+	}
+	if err := a.store.SaveOrder(order); err != nil {
+		storeFailed(c, err)
+		return
+	}
+	if statusChanged {
+		a.webhooks.publish(c.GetString(requestIDKey), webhookOrderStatusChanged, order)
+	}
+
+	c.JSON(http.StatusOK, order)
+}
+
+// @Summary Change order status
+// @Description Move an order along pending -> paid -> shipped -> delivered, or cancel it before it ships. Shipping marks every line shipped and cancelling returns the items to stock. Requires the admin role.
+// @Tags orders
+// @Accept json
+// @Produce json
+// @Param orderID path string true "Order ID"
+// @Param request body OrderStatusRequest true "Target status: paid, shipped, delivered or cancelled"
+// @Success 200 {object} Order
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /orders/{orderID}/status [post]
+func (a *API) updateOrderStatus(c *gin.Context) {
+	orderID, ok := uuidParam(c, "orderID")
+	if !ok {
+		return
+	}
+
+	var req OrderStatusRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request body")
+		return
+	}
+	target := strings.ToLower(strings.TrimSpace(req.Status))
+	switch target {
+	case orderStatusPending, orderStatusPaid, orderStatusShipped, orderStatusDelivered, orderStatusCancelled:
+	default:
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "Unsupported status: "+req.Status)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	order, err := a.store.GetOrder(orderID)
+	if errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusNotFound, errCodeOrderNotFound, "Order not found")
+		return
+	}
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	if !canTransition(order.Status, target) {
+		respondError(c, http.StatusConflict, errCodeInvalidStatusTransition, "Cannot move order from "+order.Status+" to "+target)
+		return
+	}
+
+	switch target {
+	case orderStatusCancelled:
+		if _, err := a.cancelOrder(c.GetString(requestIDKey), &order); err != nil {
+			storeFailed(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, order)
+		return
+	case orderStatusShipped:
+		for i := range order.Items {
+			order.Items[i].FulfillmentStatus = fulfillmentShipped
+		}
+	case orderStatusDelivered:
+		completed := now()
+		order.Completed = &completed
+	}
+
+	order.Status = target
+	if err := a.store.SaveOrder(order); err != nil {
+		storeFailed(c, err)
+		return
+	}
+	a.webhooks.publish(c.GetString(requestIDKey), webhookOrderStatusChanged, order)
+
+	c.JSON(http.StatusOK, order)
+}
+
+// @Summary Cancel an order
+// @Description Cancel one of the caller's orders that hasn't shipped yet and return its items to stock. Admins may cancel any order.
+// @Tags orders
+// @Accept json
+// @Produce json
+// @Param orderID path string true "Order ID"
+// @Success 200 {object} Order
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /orders/{orderID}/cancel [post]
+func (a *API) cancelSingleOrder(c *gin.Context) {
+	orderID, ok := uuidParam(c, "orderID")
+	if !ok {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	order, err := a.store.GetOrder(orderID)
+	if errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusNotFound, errCodeOrderNotFound, "Order not found")
+		return
+	}
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	if order.UserID != currentUserID(c) && !isAdmin(c) {
+		respondError(c, http.StatusForbidden, errCodeForbidden, "Access to another user's data is forbidden")
+		return
+	}
+
+	if err := checkCancellable(order); err != nil {
+		respondError(c, http.StatusConflict, errCodeOrderNotCancellable, err.Error())
+		return
+	}
+	if _, err := a.cancelOrder(c.GetString(requestIDKey), &order); err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, order)
+}
+
+// @Summary Get product recommendations
+// @Description Get personalized product recommendations based on order history, recently viewed products, search history, or popular products
+// @Tags recommendations
+// @Accept json
+// @Produce json
+// @Param userID path string true "User ID"
+// @Param limit query int false "Number of recommendations" default(5)
+// @Success 200 {array} ProductView
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /recommendations/{userID} [get]
+func (a *API) getRecommendations(c *gin.Context) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	userID := c.Param("userID")
+	limit := 5
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if parsed, err := parseLimit(limitStr); err == nil {
+			limit = parsed
+		}
+	}
+
+	catalog, err := a.store.ListProducts()
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	var recommendations []Product
+
+	// Strategy 1: Based on order history
+	userOrders, err := a.store.ListOrdersByUser(userID)
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	if len(userOrders) > 0 {
+		allOrders, err := a.store.ListOrders()
+		if err != nil {
+			storeFailed(c, err)
+			return
+		}
+		// Products bought by users who bought the same things come first,
+		// then products from the categories the user buys
+		recommendations = getRecommendationsFromCoPurchases(userOrders, allOrders, catalog, limit)
+		if len(recommendations) > 0 {
+			c.JSON(http.StatusOK, presentProducts(recommendations))
+			return
+		}
+		recommendations = getRecommendationsFromOrders(userOrders, catalog, limit)
+		if len(recommendations) > 0 {
+			c.JSON(http.StatusOK, presentProducts(recommendations))
+			return
+		}
+	}
+
+	// Strategy 2: Based on recently viewed products
+	visits, err := a.store.ListProductVisits(userID)
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	if len(visits) > 0 {
+		recommendations = getRecommendationsFromVisits(visits, catalog, limit)
+		if len(recommendations) > 0 {
+			c.JSON(http.StatusOK, presentProducts(recommendations))
+			return
+		}
+	}
+
+	// Strategy 3: Based on search history
+	userSearches, err := a.store.ListSearchesByUser(userID)
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	if len(userSearches) > 0 {
+		recommendations = getRecommendationsFromSearches(userSearches, catalog, limit)
+		if len(recommendations) > 0 {
+			c.JSON(http.StatusOK, presentProducts(recommendations))
+			return
+		}
+	}
+
+	// Strategy 4: Popular products (fallback)
+	recommendations = getPopularProducts(catalog, limit)
+	c.JSON(http.StatusOK, presentProducts(recommendations))
+}
+
+// @Summary Get recently viewed products
+// @Description Products the user viewed through GET /products/{id}?user_id=, most recent first, without repeats
+// @Tags recommendations
+// @Accept json
+// @Produce json
+// @Param userID path string true "User ID"
+// @Success 200 {array} ProductView
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /users/{userID}/recently-viewed [get]
+func (a *API) getRecentlyViewed(c *gin.Context) {
+	userID := c.Param("userID")
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	visits, err := a.store.ListProductVisits(userID)
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	ids := make([]string, 0, len(visits))
+	for _, visit := range visits {
+		ids = append(ids, visit.ProductID)
+	}
+	// Products deleted since they were viewed drop out
+	products, err := a.store.GetProducts(ids)
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	viewed := make([]Product, 0, len(ids))
+	for _, id := range ids {
+		if product, exists := products[id]; exists {
+			viewed = append(viewed, product)
+		}
+	}
+	c.JSON(http.StatusOK, presentProducts(viewed))
+}
+
+// @Summary Search products
+// @Description Search for products, most relevant first, and record search history
+// @Tags search
+// @Accept json
+// @Produce json
+// @Param q query string true "Search query"
+// @Param user_id query string false "User ID for tracking search history"
+// @Param category query string false "Only products in this category (case-insensitive)"
+// @Param limit query int false "Page size; defaults to DEFAULT_PAGE_SIZE and is capped at MAX_PAGE_SIZE"
+// @Param offset query int false "Number of results to skip" default(0)
+// @Param debug query bool false "Return each result's relevance score"
+// @Success 200 {object} ProductPage
+// @Failure 400 {object} ErrorResponse
+// @Router /search [get]
+func (a *API) searchProducts(c *gin.Context) {
+	query := strings.TrimSpace(c.Query("q"))
+	userID := c.Query("user_id")
+
+	if query == "" {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "Search query is required")
+		return
+	}
+
+	limit, offset, err := parsePageParams(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	filter := productFilter{category: c.Query("category")}
+
+	// Recording history only appends, so searches can share the read lock
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	// Record search history if user_id provided
+	if userID != "" {
+		search := SearchHistory{
+			ID:        uuid.New().String(),
+			UserID:    userID,
+			Query:     query,
+			Timestamp: now(),
+		}
+		if err := a.store.AddSearch(search); err != nil {
+			storeFailed(c, err)
+			return
+		}
+	}
+
+	productList, err := a.store.ListProducts()
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	// Simple search implementation (in production, use proper search engine).
+	// productList is in the default listing order, so the stable sort breaks
+	// ties by name.
+	type scoredProduct struct {
+		product Product
+		score   float64
+	}
+	var matches []scoredProduct
+	for _, product := range productList {
+		if !filter.matches(product) {
+			continue
+		}
+		if score := searchScore(product, query); score > 0 {
+			matches = append(matches, scoredProduct{product: product, score: score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+
+	start, end := pageBounds(len(matches), limit, offset)
+	window := matches[start:end]
+
+	if c.Query("debug") == "true" {
+		page := SearchResultPage{
+			Data:   make([]SearchResult, 0, len(window)),
+			Total:  len(matches),
+			Limit:  limit,
+			Offset: offset,
+		}
+		page.Next, page.Prev = pageLinks(c, len(matches), limit, offset)
+		for _, match := range window {
+			page.Data = append(page.Data, SearchResult{ProductView: presentProduct(match.product), Score: match.score})
+		}
+		c.JSON(http.StatusOK, page)
+		return
+	}
+
+	results := make([]Product, 0, len(window))
+	for _, match := range window {
+		results = append(results, match.product)
+	}
+	c.JSON(http.StatusOK, newProductPage(c, results, len(matches), limit, offset))
+}
+
+// @Summary Get related searches
+// @Description Get queries frequently made by users who also searched for the given query
+// @Tags search
+// @Accept json
+// @Produce json
+// @Param q query string true "Search query"
+// @Param limit query int false "Number of related searches" default(5)
+// @Success 200 {array} RelatedSearch
+// @Failure 400 {object} ErrorResponse
+// @Router /search/related [get]
+func (a *API) getRelatedSearches(c *gin.Context) {
+	query := normalizeQuery(c.Query("q"))
+	if query == "" {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "Search query is required")
+		return
+	}
+
+	limit := 5
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if parsed, err := parseLimit(limitStr); err == nil {
+			limit = parsed
+		}
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	searches, err := a.store.ListSearches()
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	// Collect each user's distinct queries
+	queriesByUser := make(map[string]map[string]bool)
+	for _, search := range searches {
+		if queriesByUser[search.UserID] == nil {
+			queriesByUser[search.UserID] = make(map[string]bool)
+		}
+		queriesByUser[search.UserID][normalizeQuery(search.Query)] = true
+	}
+
+	// Count, per other query, how many distinct users searched for both
+	coSearchers := make(map[string]int)
+	for _, userQueries := range queriesByUser {
+		if !userQueries[query] {
+			continue
+		}
+		for other := range userQueries {
+			if other != query && other != "" {
+				coSearchers[other]++
+			}
+		}
+	}
+
+	related := make([]RelatedSearch, 0, len(coSearchers))
+	for other, users := range coSearchers {
+		related = append(related, RelatedSearch{Query: other, Users: users})
+	}
+	sort.Slice(related, func(i, j int) bool {
+		if related[i].Users != related[j].Users {
+			return related[i].Users > related[j].Users
+		}
+		return related[i].Query < related[j].Query
+	})
+	if len(related) > limit {
+		related = related[:limit]
+	}
+
+	c.JSON(http.StatusOK, related)
+}
+
+// @Summary Get trending searches
+// @Description Get the queries searched most often across all users within the trending window (TRENDING_WINDOW, 24h by default)
+// @Tags search
+// @Accept json
+// @Produce json
+// @Param limit query int false "Number of trending searches" default(10)
+// @Success 200 {array} TrendingSearch
+// @Router /search/trending [get]
+func (a *API) getTrendingSearches(c *gin.Context) {
+	limit := 10
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if parsed, err := parseLimit(limitStr); err == nil {
+			limit = parsed
+		}
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	searches, err := a.store.ListSearches()
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	since := now().Add(-config.TrendingWindow)
+	counts := make(map[string]int)
+	for _, search := range searches {
+		if search.Timestamp.Before(since) {
+			continue
+		}
+		if query := normalizeQuery(search.Query); query != "" {
+			counts[query]++
+		}
+	}
+
+	trending := make([]TrendingSearch, 0, len(counts))
+	for query, count := range counts {
+		trending = append(trending, TrendingSearch{Query: query, Count: count})
+	}
+	sort.Slice(trending, func(i, j int) bool {
+		if trending[i].Count != trending[j].Count {
+			return trending[i].Count > trending[j].Count
+		}
+		return trending[i].Query < trending[j].Query
+	})
+	if len(trending) > limit {
+		trending = trending[:limit]
+	}
+
+	c.JSON(http.StatusOK, trending)
+}
+
+// @Summary Suggest product names
+// @Description Type-ahead suggestions for a partial query: product names starting with the query, then names with a later word starting with it, each group ordered by rating
+// @Tags search
+// @Produce json
+// @Param q query string false "Partial query"
+// @Success 200 {array} string
+// @Router /search/suggest [get]
+func (a *API) getSearchSuggestions(c *gin.Context) {
+	prefix := normalizeQuery(c.Query("q"))
+	if prefix == "" {
+		c.JSON(http.StatusOK, []string{})
+		return
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	index, err := a.suggestionIndex()
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	suggestions := index[prefix]
+	if suggestions == nil {
+		suggestions = []string{}
+	}
+
+	c.JSON(http.StatusOK, suggestions)
+}
+
+// @Summary Recompute cart and order totals
+// @Description Recompute every cart total from current product prices and every order total from the prices its lines were bought at, reporting how many were corrected. Orders with lines that predate recorded prices only have their total rounded to cents. Requires confirm=true.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param confirm query bool true "Must be true to run the maintenance task"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /admin/recompute-totals [post]
+func (a *API) recomputeTotals(c *gin.Context) {
+	if c.Query("confirm") != "true" {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "confirm=true is required to recompute totals")
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	productList, err := a.store.ListProducts()
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	catalog := make(map[string]Product, len(productList))
+	for _, product := range productList {
+		catalog[product.ID] = product
+	}
+
+	cartList, err := a.store.ListCarts()
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	cartsCorrected := 0
+	for _, cart := range cartList {
+		total := cartTotal(cart.Items, catalog)
+		if total != cart.Total {
+			cart.Total = total
+			if err := a.store.SaveCart(cart); err != nil {
+				storeFailed(c, err)
+				return
+			}
+			cartsCorrected++
+		}
+	}
+
+	// Older order lines don't record the price paid, so re-pricing them
+	// against today's catalog would rewrite history. Those orders only have
+	// their rounding repaired.
+	orderList, err := a.store.ListOrders()
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	ordersCorrected := 0
+	for _, order := range orderList {
+		total, priced := orderLinesTotal(order)
+		if !priced {
+			total = roundCents(order.Total)
+		}
+		if total != order.Total {
+			order.Total = total
+			if err := a.store.SaveOrder(order); err != nil {
+				storeFailed(c, err)
+				return
+			}
+			ordersCorrected++
+		}
+	}
+
+	requestLogf(c.GetString(requestIDKey), "Recomputed totals: %d carts and %d orders corrected", cartsCorrected, ordersCorrected)
+
+	c.JSON(http.StatusOK, gin.H{
+		"carts_checked":    len(cartList),
+		"carts_corrected":  cartsCorrected,
+		"orders_checked":   len(orderList),
+		"orders_corrected": ordersCorrected,
+	})
+}
+
+// concurrencyLimit bounds how many requests execute the following handlers
+// at once. A request waits up to queueTimeout for a free slot and is shed
+// with 429 after that. A non-positive max disables the limit.
+func concurrencyLimit(max int, queueTimeout time.Duration) gin.HandlerFunc {
+	if max <= 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+
+	slots := make(chan struct{}, max)
+	return func(c *gin.Context) {
+		select {
+		case slots <- struct{}{}:
+		default:
+			timer := time.NewTimer(queueTimeout)
+			defer timer.Stop()
+			select {
+			case slots <- struct{}{}:
+			case <-timer.C:
+				c.Header("Retry-After", "1")
+				abortWithError(c, http.StatusTooManyRequests, errCodeServerBusy, "Too many concurrent requests, try again shortly")
+				return
+			case <-c.Request.Context().Done():
+				c.Abort()
+				return
+			}
+		}
+		defer func() { <-slots }()
+
+		c.Next()
+	}
+}
+
+// @Summary Cancel orders in bulk
+// @Description Cancel a batch of orders, returning their items to stock and reporting the outcome per order
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param request body BulkCancelRequest true "Orders to cancel"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /admin/orders/cancel [post]
+func (a *API) bulkCancelOrders(c *gin.Context) {
+	var req BulkCancelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request body")
+		return
+	}
+
+	// One lock for the whole batch so the restocks land atomically
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	results := make([]BulkCancelResult, 0, len(req.OrderIDs))
+	cancelled, restocked := 0, 0
+	for _, orderID := range req.OrderIDs {
+		result := BulkCancelResult{OrderID: orderID}
+
+		parsed, err := uuid.Parse(orderID)
+		if err != nil {
+			result.Error = "Invalid ID format"
+			results = append(results, result)
+			continue
+		}
+		order, err := a.store.GetOrder(parsed.String())
+		if errors.Is(err, ErrNotFound) {
+			result.Error = "Order not found"
+			results = append(results, result)
+			continue
+		}
+		if err != nil {
+			storeFailed(c, err)
+			return
+		}
+
+		if err := checkCancellable(order); err != nil {
+			result.Error = err.Error()
+			results = append(results, result)
+			continue
+		}
+		units, err := a.cancelOrder(c.GetString(requestIDKey), &order)
+		if err != nil {
+			storeFailed(c, err)
+			return
+		}
+
+		result.Cancelled = true
+		result.Restocked = units
+		cancelled++
+		restocked += units
+		results = append(results, result)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"results":          results,
+		"orders_cancelled": cancelled,
+		"units_restocked":  restocked,
+	})
+}
+
+// @Summary List carts
+// @Description List every user's cart, most recently updated first, for support and debugging
+// @Tags admin
+// @Produce json
+// @Param limit query int false "Page size; defaults to DEFAULT_PAGE_SIZE and is capped at MAX_PAGE_SIZE"
+// @Param offset query int false "Number of carts to skip" default(0)
+// @Success 200 {object} CartPage
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /admin/carts [get]
+func (a *API) listCarts(c *gin.Context) {
+	limit, offset, err := parsePageParams(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	cartList, err := a.store.ListCarts()
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	// Newest first, with the ID keeping same-instant carts stable
+	sort.Slice(cartList, func(i, j int) bool {
+		if !cartList[i].Updated.Equal(cartList[j].Updated) {
+			return cartList[i].Updated.After(cartList[j].Updated)
+		}
+		return cartList[i].ID < cartList[j].ID
+	})
+
+	start, end := pageBounds(len(cartList), limit, offset)
+	c.JSON(http.StatusOK, CartPage{
+		Data:   cartList[start:end],
+		Total:  len(cartList),
+		Limit:  limit,
+		Offset: offset,
+	})
+}
+
+// @Summary List abandoned carts
+// @Description Non-empty carts left unchanged for at least idle_minutes, longest idle first, for follow-up marketing
+// @Tags admin
+// @Produce json
+// @Param idle_minutes query int true "Minutes a cart must have gone without changes"
+// @Success 200 {array} AbandonedCart
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /admin/abandoned-carts [get]
+func (a *API) listAbandonedCarts(c *gin.Context) {
+	idleMinutes, err := strconv.Atoi(c.Query("idle_minutes"))
+	if err != nil || idleMinutes <= 0 {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "idle_minutes must be a positive integer")
+		return
+	}
+	cutoff := now().Add(-time.Duration(idleMinutes) * time.Minute)
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	cartList, err := a.store.ListCarts()
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	abandoned := []AbandonedCart{}
+	for _, cart := range cartList {
+		if len(cart.Items) == 0 || cart.Updated.After(cutoff) {
+			continue
+		}
+		count := 0
+		for _, item := range cart.Items {
+			count += item.Quantity
+		}
+		abandoned = append(abandoned, AbandonedCart{
+			CartID:    cart.ID,
+			UserID:    cart.UserID,
+			Total:     roundCents(cart.Total),
+			ItemCount: count,
+			Updated:   cart.Updated,
+		})
+	}
+	// Longest idle first, with the ID keeping same-instant carts stable
+	sort.Slice(abandoned, func(i, j int) bool {
+		if !abandoned[i].Updated.Equal(abandoned[j].Updated) {
+			return abandoned[i].Updated.Before(abandoned[j].Updated)
+		}
+		return abandoned[i].CartID < abandoned[j].CartID
+	})
+
+	c.JSON(http.StatusOK, abandoned)
+}
+
+// @Summary Get a sales summary
+// @Description Total revenue, order count, average order value and best-selling products for orders placed in a date range, cancelled orders excluded
+// @Tags admin
+// @Produce json
+// @Param from query string false "Start of the range, an RFC 3339 time or a YYYY-MM-DD date; defaults to 30 days before to"
+// @Param to query string false "End of the range, an RFC 3339 time or a YYYY-MM-DD date (which includes the whole day); defaults to now"
+// @Success 200 {object} SalesSummary
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /admin/analytics/sales [get]
+func (a *API) getSalesSummary(c *gin.Context) {
+	from, to, err := parseSalesRange(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	orderList, err := a.store.ListOrders()
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	summary := SalesSummary{From: from, To: to, TopProducts: []ProductSales{}}
+	sold := make(map[string]int)
+	for _, order := range orderList {
+		if !countsAsSale(order, from, to) {
+			continue
+		}
+		summary.OrderCount++
+		summary.Revenue += order.Total
+		for _, item := range order.Items {
+			sold[item.ProductID] += item.Quantity
+		}
+	}
+	summary.Revenue = roundCents(summary.Revenue)
+	if summary.OrderCount > 0 {
+		summary.AverageOrderValue = roundCents(summary.Revenue / float64(summary.OrderCount))
+	}
+
+	for productID, quantity := range sold {
+		summary.TopProducts = append(summary.TopProducts, ProductSales{ProductID: productID, Quantity: quantity})
+	}
+	sort.Slice(summary.TopProducts, func(i, j int) bool {
+		if summary.TopProducts[i].Quantity != summary.TopProducts[j].Quantity {
+			return summary.TopProducts[i].Quantity > summary.TopProducts[j].Quantity
+		}
+		return summary.TopProducts[i].ProductID < summary.TopProducts[j].ProductID
+	})
+	if len(summary.TopProducts) > topSellersLimit {
+		summary.TopProducts = summary.TopProducts[:topSellersLimit]
+	}
+
+	// Products sold in the past may have been deleted since
+	for i := range summary.TopProducts {
+		product, err := a.store.GetProductIncludingDeleted(summary.TopProducts[i].ProductID)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			storeFailed(c, err)
+			return
+		}
+		summary.TopProducts[i].Name = product.Name
+	}
+
+	c.JSON(http.StatusOK, summary)
+}
+
+// @Summary Get revenue by category
+// @Description Units sold and revenue per product category for orders placed in a date range, cancelled orders excluded. Revenue is line price times quantity, before discounts and shipping.
+// @Tags admin
+// @Produce json
+// @Param from query string false "Start of the range, an RFC 3339 time or a YYYY-MM-DD date; defaults to 30 days before to"
+// @Param to query string false "End of the range, an RFC 3339 time or a YYYY-MM-DD date (which includes the whole day); defaults to now"
+// @Success 200 {object} CategoryBreakdown
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /admin/analytics/categories [get]
+func (a *API) getCategorySales(c *gin.Context) {
+	from, to, err := parseSalesRange(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	orderList, err := a.store.ListOrders()
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	// Lines from orders placed before checkout recorded the category and
+	// price fall back to the product, deleted or not, at today's price
+	products := make(map[string]Product)
+	byCategory := make(map[string]*CategorySales)
+	breakdown := CategoryBreakdown{From: from, To: to, Categories: []CategorySales{}}
+	for _, order := range orderList {
+		if !countsAsSale(order, from, to) {
+			continue
+		}
+		for _, item := range order.Items {
+			category, price := item.Category, item.UnitPrice
+			if category == "" {
+				product, cached := products[item.ProductID]
+				if !cached {
+					product, err = a.store.GetProductIncludingDeleted(item.ProductID)
+					if err != nil && !errors.Is(err, ErrNotFound) {
+						storeFailed(c, err)
+						return
+					}
+					products[item.ProductID] = product
+				}
+				category, price = product.Category, effectivePrice(product)
+			}
+			if category == "" {
+				category = "Uncategorized"
+			}
+
+			sales, exists := byCategory[category]
+			if !exists {
+				sales = &CategorySales{Category: category}
+				byCategory[category] = sales
+			}
+			sales.Units += item.Quantity
+			sales.Revenue += price * float64(item.Quantity)
+		}
+	}
+
+	for _, sales := range byCategory {
+		sales.Revenue = roundCents(sales.Revenue)
+		breakdown.Categories = append(breakdown.Categories, *sales)
+	}
+	sort.Slice(breakdown.Categories, func(i, j int) bool {
+		if breakdown.Categories[i].Revenue != breakdown.Categories[j].Revenue {
+			return breakdown.Categories[i].Revenue > breakdown.Categories[j].Revenue
+		}
+		return breakdown.Categories[i].Category < breakdown.Categories[j].Category
+	})
+
+	c.JSON(http.StatusOK, breakdown)
+}
+
+// countsAsSale reports whether an order was placed in [from, to) and not
+// cancelled
+func countsAsSale(order Order, from, to time.Time) bool {
+	return order.Status != orderStatusCancelled && !order.Created.Before(from) && order.Created.Before(to)
+}
+
+// parseSalesRange reads the from and to query parameters of the analytics
+// endpoints. to defaults to now and from to salesWindow before to.
+func parseSalesRange(c *gin.Context) (from, to time.Time, err error) {
+	to = now()
+	if raw := c.Query("to"); raw != "" {
+		if to, err = parseRangeBound(raw, true); err != nil {
+			return from, to, errors.New("to must be an RFC 3339 time or a YYYY-MM-DD date")
+		}
+	}
+	from = to.Add(-salesWindow)
+	if raw := c.Query("from"); raw != "" {
+		if from, err = parseRangeBound(raw, false); err != nil {
+			return from, to, errors.New("from must be an RFC 3339 time or a YYYY-MM-DD date")
+		}
+	}
+	if from.After(to) {
+		return from, to, errors.New("from cannot be after to")
+	}
+	return from, to, nil
+}
+
+// parseRangeBound parses one end of a date range, given as an RFC 3339 time
+// or a YYYY-MM-DD date in UTC. A date that ends a range covers its whole
+// day, so it becomes midnight of the next day.
+func parseRangeBound(raw string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	day, err := time.Parse("2006-01-02", raw)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if end {
+		day = day.AddDate(0, 0, 1)
+	}
+	return day, nil
+}
+
+// @Summary List webhooks
+// @Description List the URLs that receive order events
+// @Tags admin
+// @Produce json
+// @Success 200 {array} Webhook
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /admin/webhooks [get]
+func (a *API) listWebhooks(c *gin.Context) {
+	webhooks, err := a.store.ListWebhooks()
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, webhooks)
+}
+
+// @Summary Register a webhook
+// @Description Register a URL to receive order.created and order.status_changed events. Each delivery is a JSON POST signed with an X-Webhook-Signature header (sha256= followed by the hex HMAC-SHA256 of the body keyed with WEBHOOK_SECRET) and is retried with backoff until it gets a 2xx answer.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param request body WebhookRequest true "Webhook URL"
+// @Success 201 {object} Webhook
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /admin/webhooks [post]
+func (a *API) registerWebhook(c *gin.Context) {
+	var req WebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request body")
+		return
+	}
+	target, err := url.Parse(strings.TrimSpace(req.URL))
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "url must be an absolute http or https URL")
+		return
+	}
+
+	webhook := Webhook{
+		ID:      uuid.New().String(),
+		URL:     target.String(),
+		Created: now(),
+	}
+	if err := a.store.SaveWebhook(webhook); err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, webhook)
+}
+
+// @Summary Delete a webhook
+// @Description Stop sending order events to a webhook
+// @Tags admin
+// @Param id path string true "Webhook ID"
+// @Success 204
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Security BearerAuth
+// @Router /admin/webhooks/{id} [delete]
+func (a *API) deleteWebhook(c *gin.Context) {
+	id, ok := uuidParam(c, "id")
+	if !ok {
+		return
+	}
+
+	err := a.store.DeleteWebhook(id)
+	if errors.Is(err, ErrNotFound) {
+		respondError(c, http.StatusNotFound, errCodeWebhookNotFound, "Webhook not found")
+		return
+	}
+	if err != nil {
+		storeFailed(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// Helper functions
+
+// uuidParam reads a path parameter that must be a UUID and returns it in
+// canonical lowercase form, so a malformed ID gets a 400 instead of a 404.
+// On failure it has already responded.
+func uuidParam(c *gin.Context, name string) (string, bool) {
+	id, err := uuid.Parse(c.Param(name))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errCodeInvalidRequest, "Invalid ID format")
+		return "", false
+	}
+	return id.String(), true
+}
+
+// storeFailed logs a storage error and answers with a generic 500
+func storeFailed(c *gin.Context, err error) {
+	requestLogf(c.GetString(requestIDKey), "Store error on %s %s: %v", c.Request.Method, c.Request.URL.Path, err)
+	respondError(c, http.StatusInternalServerError, errCodeInternal, "Internal server error")
+}
+
+// checkCancellable reports why an order can't be cancelled, if it can't.
+// Only pending and paid orders, which have nothing shipped, can be
+// cancelled.
+func checkCancellable(order Order) error {
+	if order.Status == orderStatusCancelled {
+		return errors.New("Order already cancelled")
+	}
+	if !canTransition(order.Status, orderStatusCancelled) {
+		return errors.New("Order already shipped")
+	}
+	return nil
+}
+
+// checkRedeemable reports why a discount code can't be redeemed right now,
+// if it can't
+func checkRedeemable(code DiscountCode) error {
+	if !code.ExpiresAt.IsZero() && !now().Before(code.ExpiresAt) {
+		return errors.New("Discount code has expired")
+	}
+	if code.MaxUses > 0 && code.Uses >= code.MaxUses {
+		return errors.New("Discount code has reached its usage limit")
+	}
+	return nil
+}
+
+// discountAmount is how much a discount code takes off a subtotal, never
+// more than the subtotal itself
+func discountAmount(code DiscountCode, subtotal float64) float64 {
+	amount := code.AmountOff + subtotal*code.PercentOff/100
+	if amount > subtotal {
+		return subtotal
+	}
+	return amount
+}
+
+// canTransition reports whether an order may move from one status to another
+func canTransition(from, to string) bool {
+	return containsString(orderTransitions[from], to)
+}
+
+// cancelOrder marks an order cancelled, saves it and returns its items to
+// stock, reporting how many units were restocked. Check the order with
+// checkCancellable first. requestID is passed on to the webhook event. Callers
+// must hold the write lock.
+func (a *API) cancelOrder(requestID string, order *Order) (int, error) {
+	catalog, err := a.store.GetProducts(orderProductIDs(order.Items))
+	if err != nil {
+		return 0, err
+	}
+
+	restocked := 0
+	for _, item := range order.Items {
+		product, exists := catalog[item.ProductID]
+		if !exists {
+			continue
+		}
+		product.Stock += item.Quantity
+		catalog[item.ProductID] = product
+		if err := a.store.SaveProduct(product); err != nil {
+			return restocked, err
+		}
+		if err := a.recordStockMovement(item.ProductID, item.Quantity, stockReasonCancel, order.ID); err != nil {
+			return restocked, err
+		}
+		restocked += item.Quantity
+	}
+
+	order.Status = orderStatusCancelled
+	if err := a.store.SaveOrder(*order); err != nil {
+		return restocked, err
+	}
+	a.webhooks.publish(requestID, webhookOrderStatusChanged, *order)
+	return restocked, nil
+}
+
+// normalizeQuery lowercases and trims a search query so equivalent searches
+// aggregate together
+func normalizeQuery(query string) string {
+	return strings.ToLower(strings.TrimSpace(query))
+}
+
+// parseImportRow builds a product from one CSV import row. columns maps each
+// column name to its position in the row; empty numeric fields are zero.
+func parseImportRow(record []string, columns map[string]int) (Product, error) {
+	field := func(name string) string {
+		if i := columns[name]; i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	number := func(name string) (float64, error) {
+		raw := field(name)
+		if raw == "" {
+			return 0, nil
+		}
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return 0, errors.New(name + " must be a number")
+		}
+		return value, nil
+	}
+
+	product := Product{
+		Name:        field("name"),
+		Description: field("description"),
+		Category:    field("category"),
+		ImageURL:    field("image_url"),
+	}
+	var err error
+	if product.Price, err = number("price"); err != nil {
+		return Product{}, err
+	}
+	if product.Rating, err = number("rating"); err != nil {
+		return Product{}, err
+	}
+	if raw := field("stock"); raw != "" {
+		if product.Stock, err = strconv.Atoi(raw); err != nil {
+			return Product{}, errors.New("stock must be a whole number")
+		}
+	}
+	return product, nil
+}
+
+// validateProduct checks the fields a client is allowed to set on a product
+func validateProduct(product Product) error {
+	if strings.TrimSpace(product.Name) == "" {
+		return errors.New("name is required")
+	}
+	if product.Price <= 0 {
+		return errors.New("price must be positive")
+	}
+	if product.Stock < 0 {
+		return errors.New("stock cannot be negative")
+	}
+	if product.Rating < 0 || product.Rating > 5 {
+		return errors.New("rating must be between 0 and 5")
+	}
+	if product.Weight < 0 {
+		return errors.New("weight cannot be negative")
+	}
+	if product.SalePrice < 0 {
+		return errors.New("sale_price cannot be negative")
+	}
+	if product.SalePrice > 0 && product.SalePrice >= product.Price {
+		return errors.New("sale_price must be below price")
+	}
+	if product.SaleStart != nil && product.SaleEnd != nil && !product.SaleEnd.After(*product.SaleStart) {
+		return errors.New("sale_end must be after sale_start")
+	}
+	return validateImageURL(product.ImageURL)
+}
+
+// validateImageURL accepts an empty image URL, which falls back to the
+// placeholder, or an absolute http or https URL, so javascript: and other
+// schemes never reach a client
+func validateImageURL(imageURL string) error {
+	if imageURL == "" {
+		return nil
+	}
+	target, err := url.Parse(imageURL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return errors.New("image_url must be an absolute http or https URL")
+	}
+	return nil
+}
+
+// imageCheckTimeout bounds the HEAD request that verifies an image URL
+const imageCheckTimeout = 5 * time.Second
+
+var imageCheckClient = &http.Client{Timeout: imageCheckTimeout}
+
+// verifyImageURL confirms with a HEAD request that a product's image URL
+// serves an image, when VERIFY_IMAGE_URLS is on. Run it after
+// validateProduct and without holding a.mu, since it waits on another server.
+func verifyImageURL(imageURL string) error {
+	if !config.VerifyImageURLs || imageURL == "" {
+		return nil
+	}
+
+	resp, err := imageCheckClient.Head(imageURL)
+	if err != nil {
+		return errors.New("image_url could not be fetched")
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("image_url answered with status " + strconv.Itoa(resp.StatusCode))
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "image/") {
+		return errors.New("image_url does not point to an image")
+	}
+	return nil
+}
+
+// parseLimit parses a non-negative integer query value such as limit or offset
+func parseLimit(limitStr string) (int, error) {
+	value, err := strconv.Atoi(limitStr)
+	if err != nil {
+		return 0, err
+	}
+	if value < 0 {
+		return 0, errors.New("value cannot be negative")
+	}
+	return value, nil
+}
+
+// productFilter holds the optional listing filters, all of which must match
+type productFilter struct {
+	category string
+	tag      string
+	minPrice *float64
+	maxPrice *float64
+}
+
+// parseProductFilter reads the category, tag and price range query
+// parameters
+func parseProductFilter(c *gin.Context) (productFilter, error) {
+	filter := productFilter{category: c.Query("category"), tag: normalizeQuery(c.Query("tag"))}
+
+	if raw := c.Query("min_price"); raw != "" {
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return filter, errors.New("min_price must be a number")
+		}
+		filter.minPrice = &value
+	}
+	if raw := c.Query("max_price"); raw != "" {
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return filter, errors.New("max_price must be a number")
+		}
+		filter.maxPrice = &value
+	}
+	if filter.minPrice != nil && filter.maxPrice != nil && *filter.minPrice > *filter.maxPrice {
+		return filter, errors.New("min_price cannot be greater than max_price")
+	}
+
+	return filter, nil
+}
+
+func (f productFilter) empty() bool {
+	return f.category == "" && f.tag == "" && f.minPrice == nil && f.maxPrice == nil
+}
+
+func (f productFilter) matches(product Product) bool {
+	if f.category != "" && !strings.EqualFold(product.Category, f.category) {
+		return false
+	}
+	if f.tag != "" && !containsString(product.Tags, f.tag) {
+		return false
+	}
+	if f.minPrice != nil && product.Price < *f.minPrice {
+		return false
+	}
+	if f.maxPrice != nil && product.Price > *f.maxPrice {
+		return false
+	}
+	return true
+}
+
+// paginate slices a sorted product list into the requested page
+func paginate(c *gin.Context, productList []Product, limit, offset int) ProductPage {
+	start, end := pageBounds(len(productList), limit, offset)
+	return newProductPage(c, productList[start:end], len(productList), limit, offset)
+}
+
+// pageBounds clamps a limit/offset window to a collection of size total
+func pageBounds(total, limit, offset int) (int, int) {
+	if offset >= total {
+		return total, total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return offset, end
+}
+
+// parsePageParams reads the limit and offset query parameters, defaulting to
+// the first page of config.DefaultPageSize. A limit above config.MaxPageSize
+// is clamped to it rather than rejected.
+func parsePageParams(c *gin.Context) (limit, offset int, err error) {
+	limit = config.DefaultPageSize
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if limit, err = parseLimit(limitStr); err != nil {
+			return 0, 0, errors.New("limit must be a non-negative integer")
+		}
+	}
+	if config.MaxPageSize > 0 && limit > config.MaxPageSize {
+		requestLogf(c.GetString(requestIDKey), "Clamping limit %d to %d on %s %s", limit, config.MaxPageSize, c.Request.Method, c.Request.URL.Path)
+		limit = config.MaxPageSize
+	}
+	if offsetStr := c.Query("offset"); offsetStr != "" {
+		if offset, err = parseLimit(offsetStr); err != nil {
+			return 0, 0, errors.New("offset must be a non-negative integer")
+		}
+	}
+	return limit, offset, nil
+}
+
+// newProductPage wraps one page of products in the listing envelope
+func newProductPage(c *gin.Context, window []Product, total, limit, offset int) ProductPage {
+	page := ProductPage{
+		Data:   presentProducts(window),
+		Total:  total,
+		Limit:  limit,
+		Offset: offset,
+	}
+	page.Next, page.Prev = pageLinks(c, total, limit, offset)
+	return page
+}
+
+// pageLinks builds the links to the pages after and before the current one
+// out of the request's own path and query, so filters and sort carry over.
+// Either is nil when there is no such page; a zero limit has neither.
+func pageLinks(c *gin.Context, total, limit, offset int) (next, prev *string) {
+	if limit == 0 {
+		return nil, nil
+	}
+	link := func(offset int) *string {
+		query := c.Request.URL.Query()
+		query.Set("limit", strconv.Itoa(limit))
+		query.Set("offset", strconv.Itoa(offset))
+		target := c.Request.URL.Path + "?" + query.Encode()
+		return &target
+	}
+	if offset+limit < total {
+		next = link(offset + limit)
+	}
+	if offset > 0 {
+		prev = link(max(min(offset, total)-limit, 0))
+	}
+	return next, prev
+}
+
+func getRecommendationsFromOrders(userOrders []Order, catalog []Product, limit int) []Product {
+	byID := make(map[string]Product, len(catalog))
+	for _, product := range catalog {
+		byID[product.ID] = product
+	}
+
+	// Simple recommendation based on categories from orders
+	categoryCount := make(map[string]int)
+	purchased := make(map[string]bool)
+	for _, order := range userOrders {
+		for _, item := range order.Items {
+			purchased[item.ProductID] = true
+			if product, exists := byID[item.ProductID]; exists {
+				categoryCount[product.Category]++
+			}
+		}
+	}
+
+	// Find products from preferred categories the user doesn't own yet, best
+	// rated first
+	var recommendations []Product
+	for _, product := range catalog {
+		if categoryCount[product.Category] > 0 && !purchased[product.ID] {
+			recommendations = append(recommendations, product)
+		}
+	}
+	sort.SliceStable(recommendations, func(i, j int) bool {
+		return recommendations[i].Rating > recommendations[j].Rating
+	})
+	return limitRecommendations(recommendations, limit)
+}
+
+// getRecommendationsFromCoPurchases recommends the products most often bought
+// by the same users as the products in userOrders, leaving out anything the
+// user already bought. Ties go to the better rated product.
+func getRecommendationsFromCoPurchases(userOrders, allOrders []Order, catalog []Product, limit int) []Product {
+	// Every product each user has ordered
+	baskets := make(map[string]map[string]bool)
+	for _, order := range allOrders {
+		if baskets[order.UserID] == nil {
+			baskets[order.UserID] = make(map[string]bool)
+		}
+		for _, item := range order.Items {
+			baskets[order.UserID][item.ProductID] = true
+		}
+	}
+
+	// How many users bought both of each pair of products
+	coPurchases := make(map[string]map[string]int)
+	for _, basket := range baskets {
+		for x := range basket {
+			for y := range basket {
+				if x == y {
+					continue
+				}
+				if coPurchases[x] == nil {
+					coPurchases[x] = make(map[string]int)
+				}
+				coPurchases[x][y]++
+			}
+		}
+	}
+
+	purchased := make(map[string]bool)
+	for _, order := range userOrders {
+		for _, item := range order.Items {
+			purchased[item.ProductID] = true
+		}
+	}
+	scores := make(map[string]int)
+	for x := range purchased {
+		for y, count := range coPurchases[x] {
+			if !purchased[y] {
+				scores[y] += count
+			}
+		}
+	}
+
+	var recommendations []Product
+	for _, product := range catalog {
+		if scores[product.ID] > 0 {
+			recommendations = append(recommendations, product)
+		}
+	}
+	sort.SliceStable(recommendations, func(i, j int) bool {
+		if scores[recommendations[i].ID] != scores[recommendations[j].ID] {
+			return scores[recommendations[i].ID] > scores[recommendations[j].ID]
+		}
+		return recommendations[i].Rating > recommendations[j].Rating
+	})
+	return limitRecommendations(recommendations, limit)
+}
+
+func getRecommendationsFromSearches(userSearches []SearchHistory, catalog []Product, limit int) []Product {
+	// Simple recommendation based on search terms. A product matching
+	// several searches is only recommended once.
+	var recommendations []Product
+	for _, search := range userSearches {
+		for _, product := range catalog {
+			if contains(product.Name, search.Query) || contains(product.Description, search.Query) {
+				recommendations = append(recommendations, product)
+			}
+		}
+	}
+	return limitRecommendations(recommendations, limit)
+}
+
+// getRecommendationsFromVisits suggests the products that share a category
+// with the ones the user viewed, most recent view first, leaving out the
+// viewed products themselves
+func getRecommendationsFromVisits(visits []ProductVisit, catalog []Product, limit int) []Product {
+	viewed := make(map[string]bool, len(visits))
+	for _, visit := range visits {
+		viewed[visit.ProductID] = true
+	}
+	byID := make(map[string]Product, len(catalog))
+	for _, product := range catalog {
+		byID[product.ID] = product
+	}
+
+	var recommendations []Product
+	for _, visit := range visits {
+		seen, exists := byID[visit.ProductID]
+		if !exists {
+			continue
+		}
+		for _, product := range catalog {
+			if !viewed[product.ID] && strings.EqualFold(product.Category, seen.Category) {
+				recommendations = append(recommendations, product)
+			}
+		}
+	}
+	return limitRecommendations(recommendations, limit)
+}
+
+func getPopularProducts(catalog []Product, limit int) []Product {
+	// Return products with highest ratings
+	productList := append([]Product(nil), catalog...)
+
+	// Simple sorting by rating (in production, use proper sorting)
+	return limitRecommendations(productList, limit)
+}
+
+// limitRecommendations drops repeated products, keeping the first
+// occurrence of each, then cuts the list down to limit
+func limitRecommendations(recommendations []Product, limit int) []Product {
+	seen := make(map[string]bool, len(recommendations))
+	unique := make([]Product, 0, len(recommendations))
+	for _, product := range recommendations {
+		if !seen[product.ID] {
+			seen[product.ID] = true
+			unique = append(unique, product)
+		}
+	}
+	if len(unique) > limit {
+		unique = unique[:limit]
+	}
+	return unique
+}
+
+// maxSuggestions caps the number of search suggestions returned
+const maxSuggestions = 10
+
+// suggestionIndex returns the search suggestion index, building it from the
+// catalog if products changed since it was last used
+func (a *API) suggestionIndex() (map[string][]string, error) {
+	a.suggestMu.Lock()
+	defer a.suggestMu.Unlock()
+
+	if a.suggestions == nil {
+		productList, err := a.store.ListProducts()
+		if err != nil {
+			return nil, err
+		}
+		a.suggestions = buildSuggestionIndex(productList)
+	}
+	return a.suggestions, nil
+}
+
+// invalidateSuggestions drops the search suggestion index so the next
+// suggestion request rebuilds it
+func (a *API) invalidateSuggestions() {
+	a.suggestMu.Lock()
+	defer a.suggestMu.Unlock()
+
+	a.suggestions = nil
+}
+
+// buildSuggestionIndex maps every lowercase prefix of every product name,
+// starting at any of its words, to at most maxSuggestions names already in
+// suggestion order: names that start with the prefix before names where only
+// a later word does, then highest rated first, then by name
+func buildSuggestionIndex(productList []Product) map[string][]string {
+	type candidate struct {
+		product   Product
+		nameStart bool
+	}
+	// prefix -> product ID -> best match for that product
+	candidates := make(map[string]map[string]candidate)
+	for _, product := range productList {
+		// Index every prefix of the name from each word onwards, so
+		// multi-word queries like "macbook p" match too
+		words := strings.Fields(strings.ToLower(product.Name))
+		for i := range words {
+			tail := []rune(strings.Join(words[i:], " "))
+			for n := 1; n <= len(tail); n++ {
+				prefix := string(tail[:n])
+				if candidates[prefix] == nil {
+					candidates[prefix] = make(map[string]candidate)
+				}
+				if existing, seen := candidates[prefix][product.ID]; !seen || (i == 0 && !existing.nameStart) {
+					candidates[prefix][product.ID] = candidate{product: product, nameStart: i == 0}
+				}
+			}
+		}
+	}
+
+	index := make(map[string][]string, len(candidates))
+	for prefix, byProduct := range candidates {
+		matches := make([]candidate, 0, len(byProduct))
+		for _, match := range byProduct {
+			matches = append(matches, match)
+		}
+		sort.Slice(matches, func(i, j int) bool {
+			if matches[i].nameStart != matches[j].nameStart {
+				return matches[i].nameStart
+			}
+			if matches[i].product.Rating != matches[j].product.Rating {
+				return matches[i].product.Rating > matches[j].product.Rating
+			}
+			if matches[i].product.Name != matches[j].product.Name {
+				return matches[i].product.Name < matches[j].product.Name
+			}
+			return matches[i].product.ID < matches[j].product.ID
+		})
+		if len(matches) > maxSuggestions {
+			matches = matches[:maxSuggestions]
+		}
+		names := make([]string, 0, len(matches))
+		for _, match := range matches {
+			names = append(names, match.product.Name)
+		}
+		index[prefix] = names
+	}
+	return index
+}
 
-	// Check stock
-	if product.Stock < item.Quantity {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient stock"})
-		return
-	}
+// recordStockMovement appends an entry to the stock ledger
+func (a *API) recordStockMovement(productID string, delta int, reason, orderID string) error {
+	return a.store.AddStockMovement(StockMovement{
+		ProductID: productID,
+		Delta:     delta,
+		Reason:    reason,
+		Timestamp: now(),
+		OrderID:   orderID,
+	})
+}
 
-	// Get or create cart
-	cartID, exists := userCarts[userID]
-	if !exists {
-		cartID = uuid.New().String()
-		userCarts[userID] = cartID
-		carts[cartID] = Cart{
-			ID:      cartID,
-			UserID:  userID,
-			Items:   []CartItem{},
-			Total:   0,
-			Updated: time.Now(),
+// hasPurchased reports whether any delivered order in orders contains
+// productID
+func hasPurchased(orders []Order, productID string) bool {
+	for _, order := range orders {
+		if order.Status != orderStatusDelivered {
+			continue
+		}
+		for _, item := range order.Items {
+			if item.ProductID == productID {
+				return true
+			}
 		}
 	}
+	return false
+}
 
-	cart := carts[cartID]
-
-	// Check if product already in cart
-	found := false
-	for i, existingItem := range cart.Items {
-		if existingItem.ProductID == item.ProductID {
-			cart.Items[i].Quantity += item.Quantity
-			found = true
-			break
-		}
+// averageRating is the mean rating of reviews, rounded to one decimal place
+// like the seeded catalog ratings
+func averageRating(reviews []Review) float64 {
+	if len(reviews) == 0 {
+		return 0
 	}
+	sum := 0
+	for _, review := range reviews {
+		sum += review.Rating
+	}
+	return math.Round(float64(sum)/float64(len(reviews))*10) / 10
+}
 
-	if !found {
-		cart.Items = append(cart.Items, item)
+// unitsSold counts how many units of each product have been ordered
+func (a *API) unitsSold() (map[string]int, error) {
+	orderList, err := a.store.ListOrders()
+	if err != nil {
+		return nil, err
 	}
 
-	// Recalculate total
-	cart.Total = 0
-	for _, cartItem := range cart.Items {
-		if product, exists := products[cartItem.ProductID]; exists {
-			cart.Total += product.Price * float64(cartItem.Quantity)
+	sold := make(map[string]int)
+	for _, order := range orderList {
+		for _, item := range order.Items {
+			sold[item.ProductID] += item.Quantity
 		}
 	}
+	return sold, nil
+}
 
-	cart.Updated = time.Now()
-	carts[cartID] = cart
-
-	c.JSON(http.StatusOK, cart)
+// cartCatalog loads the products referenced by a set of cart items
+func (a *API) cartCatalog(items []CartItem) (map[string]Product, error) {
+	ids := make([]string, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.ProductID)
+	}
+	return a.store.GetProducts(ids)
 }
 
-// @Summary Remove item from cart
-// @Description Remove a product from the user's shopping cart
-// @Tags cart
-// @Accept json
-// @Produce json
-// @Param request body CartItem true "Cart item to remove"
-// @Param user_id query string true "User ID"
-// @Success 200 {object} Cart
-// @Failure 400 {object} map[string]interface{}
-// @Router /cart/remove [delete]
-func removeFromCart(c *gin.Context) {
-	userID := c.Query("user_id")
-	if userID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
-		return
+// orderProductIDs lists the product IDs of an order's lines
+func orderProductIDs(items []OrderItem) []string {
+	ids := make([]string, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.ProductID)
 	}
+	return ids
+}
 
-	var item CartItem
-	if err := c.ShouldBindJSON(&item); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
-		return
+// defaultProductSort is the listing order when no sort is requested, and the
+// order Store.ListProducts returns products in
+const defaultProductSort = "name_asc"
+
+// productSorts maps the supported sort keys to a comparison of two products
+var productSorts = map[string]func(a, b Product) int{
+	"price_asc":   func(a, b Product) int { return cmp.Compare(a.Price, b.Price) },
+	"price_desc":  func(a, b Product) int { return cmp.Compare(b.Price, a.Price) },
+	"rating_desc": func(a, b Product) int { return cmp.Compare(b.Rating, a.Rating) },
+	"name_asc":    func(a, b Product) int { return cmp.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name)) },
+	"name_desc":   func(a, b Product) int { return cmp.Compare(strings.ToLower(b.Name), strings.ToLower(a.Name)) },
+}
+
+// compareDefaultOrder compares two products in the default listing order
+func compareDefaultOrder(a, b Product) int {
+	if result := productSorts[defaultProductSort](a, b); result != 0 {
+		return result
 	}
+	return cmp.Compare(a.ID, b.ID)
+}
 
-	cartID, exists := userCarts[userID]
-	if !exists {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Cart not found"})
+// sortProducts orders products by one of the productSorts keys or "best",
+// breaking ties on ID so pages are stable between requests. sold is only
+// needed by "best".
+func sortProducts(productList []Product, sortKey string, sold map[string]int) {
+	if sortKey == "best" {
+		sortByBestScore(productList, sold)
 		return
 	}
 
-	cart := carts[cartID]
+	compare := productSorts[sortKey]
+	sort.Slice(productList, func(i, j int) bool {
+		if result := compare(productList[i], productList[j]); result != 0 {
+			return result < 0
+		}
+		return productList[i].ID < productList[j].ID
+	})
+}
 
-	// Remove item from cart
-	for i, existingItem := range cart.Items {
-		if existingItem.ProductID == item.ProductID {
-			if item.Quantity >= existingItem.Quantity {
-				// Remove completely
-				cart.Items = append(cart.Items[:i], cart.Items[i+1:]...)
-			} else {
-				// Reduce quantity
-				cart.Items[i].Quantity -= item.Quantity
-			}
-			break
+// sortByBestScore orders products by a blend of rating and popularity. Both
+// inputs are normalized to 0..1 (rating out of 5, sales relative to the best
+// seller) and weighted by the configured sort weights.
+func sortByBestScore(productList []Product, sold map[string]int) {
+	maxSold := 0
+	for _, count := range sold {
+		if count > maxSold {
+			maxSold = count
 		}
 	}
 
-	// Recalculate total
-	cart.Total = 0
-	for _, cartItem := range cart.Items {
-		if product, exists := products[cartItem.ProductID]; exists {
-			cart.Total += product.Price * float64(cartItem.Quantity)
+	score := func(product Product) float64 {
+		normalizedSales := 0.0
+		if maxSold > 0 {
+			normalizedSales = float64(sold[product.ID]) / float64(maxSold)
 		}
+		return config.SortRatingWeight*product.Rating/5 + config.SortSalesWeight*normalizedSales
 	}
 
-	cart.Updated = time.Now()
-	carts[cartID] = cart
-
-	c.JSON(http.StatusOK, cart)
+	sort.SliceStable(productList, func(i, j int) bool {
+		si, sj := score(productList[i]), score(productList[j])
+		if si != sj {
+			return si > sj
+		}
+		return productList[i].ID < productList[j].ID
+	})
 }
 
-// @Summary Get user's cart
-// @Description Retrieve the user's shopping cart
-// @Tags cart
-// @Accept json
-// @Produce json
-// @Param userID path string true "User ID"
-// @Success 200 {object} Cart
-// @Failure 404 {object} map[string]interface{}
-// @Router /cart/{userID} [get]
-func getCart(c *gin.Context) {
-	userID := c.Param("userID")
-	cartID, exists := userCarts[userID]
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
-		return
+// onSale reports whether the product's flash sale window is open
+func onSale(product Product) bool {
+	if product.SalePrice <= 0 {
+		return false
+	}
+	current := now()
+	if product.SaleStart != nil && current.Before(*product.SaleStart) {
+		return false
 	}
+	if product.SaleEnd != nil && !current.Before(*product.SaleEnd) {
+		return false
+	}
+	return true
+}
 
-	cart, exists := carts[cartID]
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
-		return
+// effectivePrice is the price a customer pays for the product right now
+func effectivePrice(product Product) float64 {
+	if onSale(product) {
+		return product.SalePrice
 	}
+	return product.Price
+}
 
-	c.JSON(http.StatusOK, cart)
+// presentProduct builds the serialized form of a product
+func presentProduct(product Product) ProductView {
+	view := ProductView{Product: product}
+	if onSale(product) {
+		view.OnSale = true
+		view.OriginalPrice = product.Price
+		view.Price = product.SalePrice
+	}
+	if product.ImageURL == "" && config.PlaceholderImageURL != "" {
+		view.ImageURL = config.PlaceholderImageURL
+		view.ImagePlaceholder = true
+	}
+	view.Deleted = product.DeletedAt != nil
+	view.Availability = availability(product.Stock)
+	return view
 }
 
-// @Summary Checkout
-// @Description Complete the checkout process and create an order
-// @Tags checkout
-// @Accept json
-// @Produce json
-// @Param user_id query string true "User ID"
-// @Success 200 {object} Order
-// @Failure 400 {object} map[string]interface{}
-// @Router /checkout [post]
-func checkout(c *gin.Context) {
-	userID := c.Query("user_id")
-	if userID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
-		return
+// availability maps a stock level to its band: out of stock below
+// config.InStockMinimum, low at or below config.LowStockThreshold, in stock
+// above it
+func availability(stock int) string {
+	switch {
+	case stock < config.InStockMinimum:
+		return availabilityOutOfStock
+	case stock <= config.LowStockThreshold:
+		return availabilityLowStock
+	default:
+		return availabilityInStock
 	}
+}
 
-	cartID, exists := userCarts[userID]
-	if !exists {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Cart not found"})
-		return
+// presentProducts builds the serialized form of a product list, which is
+// always a JSON array, even when empty
+func presentProducts(productList []Product) []ProductView {
+	views := make([]ProductView, 0, len(productList))
+	for _, product := range productList {
+		views = append(views, presentProduct(product))
 	}
+	return views
+}
 
-	cart := carts[cartID]
-	if len(cart.Items) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Cart is empty"})
-		return
+// presentCart builds the serialized form of a cart with line prices derived
+// from the current product prices in catalog. requestID tags its log lines.
+func presentCart(requestID string, cart Cart, catalog map[string]Product) CartView {
+	view := CartView{
+		Cart:  cart,
+		Items: make([]CartLineView, 0, len(cart.Items)),
+	}
+	view.Total = roundCents(cart.Total)
+	for _, item := range cart.Items {
+		line := CartLineView{CartItem: item}
+		if until, held := cart.Reservations[item.ProductID]; held {
+			line.ReservedUntil = &until
+		} else if config.CartReservationTTL > 0 {
+			line.Unreserved = true
+		}
+		product, exists := catalog[item.ProductID]
+		if !exists {
+			requestLogf(requestID, "Cart %s references deleted product %s", cart.ID, item.ProductID)
+			line.Unavailable = true
+			view.Items = append(view.Items, line)
+			continue
+		}
+		line.UnitPrice = effectivePrice(product)
+		line.Subtotal = roundCents(line.UnitPrice * float64(item.Quantity))
+		view.Items = append(view.Items, line)
+		view.ItemCount += item.Quantity
 	}
+	return view
+}
 
-	// Create order
-	order := Order{
-		ID:        uuid.New().String(),
-		UserID:    userID,
-		Items:     cart.Items,
-		Total:     cart.Total,
-		Status:    "completed",
-		Created:   time.Now(),
-		Completed: time.Now(),
+// cartTotal sums the current price of every item in a cart, skipping items
+// whose product isn't in catalog. The sum is rounded to cents so float error
+// never reaches a stored or serialized total.
+func cartTotal(items []CartItem, catalog map[string]Product) float64 {
+	total := 0.0
+	for _, item := range items {
+		if product, exists := catalog[item.ProductID]; exists {
+			total += effectivePrice(product) * float64(item.Quantity)
+		}
 	}
+	return roundCents(total)
+}
 
-	orders[order.ID] = order
+// cartWeight sums the weight of every item in a cart, skipping items whose
+// product isn't in catalog
+func cartWeight(items []CartItem, catalog map[string]Product) float64 {
+	weight := 0.0
+	for _, item := range items {
+		if product, exists := catalog[item.ProductID]; exists {
+			weight += product.Weight * float64(item.Quantity)
+		}
+	}
+	return weight
+}
 
-	// Clear cart
-	cart.Items = []CartItem{}
-	cart.Total = 0
-	cart.Updated = time.Now()
-	carts[cartID] = cart
+// heldUnits is how many units of item its cart holds out of stock
+func heldUnits(cart Cart, item CartItem) int {
+	if _, held := cart.Reservations[item.ProductID]; held {
+		return item.Quantity
+	}
+	return 0
+}
 
-	c.JSON(http.StatusOK, order)
+// holdCartLine has the cart hold every unit of line through reservation, held
+// being how many it held before the line changed, and restarts the line's
+// hold. It does nothing unless CART_RESERVATION_TTL is set.
+func holdCartLine(reservation *stockReservation, cart *Cart, line CartItem, held int) error {
+	if config.CartReservationTTL <= 0 {
+		return nil
+	}
+	if missing := line.Quantity - held; missing > 0 {
+		if err := reservation.reserve(line.ProductID, missing); err != nil {
+			return err
+		}
+	}
+	if cart.Reservations == nil {
+		cart.Reservations = map[string]time.Time{}
+	}
+	cart.Reservations[line.ProductID] = now().Add(config.CartReservationTTL)
+	return nil
 }
 
-// @Summary Get order history
-// @Description Retrieve the user's order history
-// @Tags orders
-// @Accept json
-// @Produce json
-// @Param userID path string true "User ID"
-// @Success 200 {array} Order
-// @Router /orders/{userID} [get]
-func getOrderHistory(c *gin.Context) {
-	userID := c.Param("userID")
-	var userOrders []Order
+// releaseHeldUnits puts quantity units of item back in stock if its cart
+// holds them, ending the hold once none of the line is left
+func (a *API) releaseHeldUnits(cart *Cart, item CartItem, quantity int) error {
+	if heldUnits(*cart, item) == 0 {
+		return nil
+	}
+	if err := a.store.ReleaseStock(item.ProductID, quantity); err != nil {
+		return err
+	}
+	if quantity >= item.Quantity {
+		delete(cart.Reservations, item.ProductID)
+	}
+	return nil
+}
 
-	for _, order := range orders {
-		if order.UserID == userID {
-			userOrders = append(userOrders, order)
+// releaseCartHolds puts every unit the cart holds back in stock
+func (a *API) releaseCartHolds(cart *Cart) error {
+	for _, item := range cart.Items {
+		if err := a.releaseHeldUnits(cart, item, item.Quantity); err != nil {
+			return err
 		}
 	}
-
-	c.JSON(http.StatusOK, userOrders)
+	cart.Reservations = nil
+	return nil
 }
 
-// @Summary Get product recommendations
-// @Description Get personalized product recommendations based on order history, search history, or popular products
-// @Tags recommendations
-// @Accept json
-// @Produce json
-// @Param userID path string true "User ID"
-// @Param limit query int false "Number of recommendations" default(5)
-// @Success 200 {array} Product
-// @Router /recommendations/{userID} [get]
-func getRecommendations(c *gin.Context) {
-	userID := c.Param("userID")
-	limit := 5
-	if limitStr := c.Query("limit"); limitStr != "" {
-		if parsed, err := parseLimit(limitStr); err == nil {
-			limit = parsed
+// deriveOrderStatus computes the order status from the fulfillment state of
+// its lines, keeping the current status while nothing has shipped
+func deriveOrderStatus(order Order) string {
+	shipped := 0
+	for _, item := range order.Items {
+		if item.FulfillmentStatus == fulfillmentShipped {
+			shipped++
 		}
 	}
 
-	var recommendations []Product
+	switch {
+	case shipped == 0:
+		return order.Status
+	case shipped < len(order.Items):
+		return orderStatusPartiallyShipped
+	default:
+		return orderStatusShipped
+	}
+}
 
-	// Strategy 1: Based on order history
-	userOrders := getOrdersByUser(userID)
-	if len(userOrders) > 0 {
-		recommendations = getRecommendationsFromOrders(userOrders, limit)
-		if len(recommendations) > 0 {
-			c.JSON(http.StatusOK, recommendations)
-			return
-		}
+// estimateCart computes the money breakdown for a cart. Discounts come off
+// the subtotal and tax is charged on the discounted amount.
+func estimateCart(cart Cart, applied []Coupon, shipping ShippingMethod, catalog map[string]Product) CartEstimate {
+	estimate := CartEstimate{
+		CartID:         cart.ID,
+		Discounts:      []DiscountLine{},
+		ShippingMethod: shipping.Name,
+		EstimatedDays:  shipping.Days,
 	}
 
-	// Strategy 2: Based on search history
-	userSearches := getSearchesByUser(userID)
-	if len(userSearches) > 0 {
-		recommendations = getRecommendationsFromSearches(userSearches, limit)
-		if len(recommendations) > 0 {
-			c.JSON(http.StatusOK, recommendations)
-			return
+	for _, item := range cart.Items {
+		if product, exists := catalog[item.ProductID]; exists {
+			estimate.Subtotal += effectivePrice(product) * float64(item.Quantity)
 		}
 	}
 
-	// Strategy 3: Popular products (fallback)
-	recommendations = getPopularProducts(limit)
-	c.JSON(http.StatusOK, recommendations)
+	discounted, lines := applyCoupons(estimate.Subtotal, applied)
+	estimate.Discounts = append(estimate.Discounts, lines...)
+
+	if len(cart.Items) > 0 {
+		estimate.Shipping = shippingCost(shipping, estimate.Subtotal)
+	}
+
+	estimate.Tax = roundCents(discounted * taxRate)
+	estimate.Total = roundCents(discounted + estimate.Tax + estimate.Shipping)
+	estimate.Subtotal = roundCents(estimate.Subtotal)
+
+	return estimate
 }
 
-// @Summary Search products
-// @Description Search for products and record search history
-// @Tags search
-// @Accept json
-// @Produce json
-// @Param q query string true "Search query"
-// @Param user_id query string false "User ID for tracking search history"
-// @Success 200 {array} Product
-// @Router /search [get]
-func searchProducts(c *gin.Context) {
-	query := c.Query("q")
-	userID := c.Query("user_id")
+// orderSubtotal is what an order's goods cost before discounts, worked back
+// from its total
+func orderSubtotal(order Order) float64 {
+	return roundCents(order.Total - order.ShippingCost - order.Tax + order.Discount)
+}
 
-	if query == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Search query is required"})
-		return
+// orderLinesTotal rebuilds an order's total from the prices its lines were
+// bought at. It reports false if any line predates recording the price.
+func orderLinesTotal(order Order) (float64, bool) {
+	goods := 0.0
+	for _, item := range order.Items {
+		if item.UnitPrice == 0 {
+			return 0, false
+		}
+		goods += item.UnitPrice * float64(item.Quantity)
 	}
+	return roundCents(goods - order.Discount + order.Tax + order.ShippingCost), true
+}
 
-	// Record search history if user_id provided
-	if userID != "" {
-		search := SearchHistory{
-			ID:        uuid.New().String(),
-			UserID:    userID,
-			Query:     query,
-			Timestamp: time.Now(),
+// applyCoupons takes coupons off subtotal one after another, each applying to
+// what the ones before it left. It returns the discounted amount and what
+// each coupon took off.
+func applyCoupons(subtotal float64, coupons []Coupon) (float64, []DiscountLine) {
+	discounted := subtotal
+	lines := make([]DiscountLine, 0, len(coupons))
+	for _, coupon := range coupons {
+		amount := coupon.AmountOff + discounted*coupon.PercentOff/100
+		if amount > discounted {
+			amount = discounted
 		}
-		searchHistory[userID] = append(searchHistory[userID], search)
+		discounted -= amount
+		lines = append(lines, DiscountLine{Code: coupon.Code, Amount: roundCents(amount)})
 	}
+	return discounted, lines
+}
 
-	// Simple search implementation (in production, use proper search engine)
-	var results []Product
-	for _, product := range products {
-		if contains(product.Name, query) || contains(product.Description, query) || contains(product.Category, query) {
-			results = append(results, product)
+// cartCoupons looks up the coupons applied to a cart, skipping codes that no
+// longer exist
+func (a *API) cartCoupons(cart Cart) ([]Coupon, error) {
+	var applied []Coupon
+	for _, code := range cart.Coupons {
+		coupon, err := a.store.GetCoupon(code)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
 		}
+		applied = append(applied, coupon)
 	}
+	return applied, nil
+}
 
-	c.JSON(http.StatusOK, results)
+// lookupShippingMethod resolves a shipping method name, defaulting to
+// standard shipping when none is given
+func lookupShippingMethod(name string) (ShippingMethod, error) {
+	if name == "" {
+		name = defaultShippingMethod
+	}
+	method, exists := config.ShippingMethods[strings.ToLower(name)]
+	if !exists {
+		return ShippingMethod{}, errors.New("unsupported shipping method: " + name)
+	}
+	return method, nil
 }
 
-// Helper functions
-func parseLimit(limitStr string) (int, error) {
-	// Simple implementation - in production, use strconv.Atoi
-	return 5, nil
+// shippingCost is the cost of a shipping method for a given subtotal
+func shippingCost(method ShippingMethod, subtotal float64) float64 {
+	if method.Name == defaultShippingMethod && subtotal >= freeShippingThreshold {
+		return 0
+	}
+	return method.Cost
 }
 
-func getOrdersByUser(userID string) []Order {
-	var userOrders []Order
-	for _, order := range orders {
-		if order.UserID == userID {
-			userOrders = append(userOrders, order)
+// containsString reports whether value is present in values
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
 		}
 	}
-	return userOrders
+	return false
 }
 
-func getSearchesByUser(userID string) []SearchHistory {
-	return searchHistory[userID]
+// buildReceipt itemizes an order. Lines from orders placed before checkout
+// recorded the name and price fall back to the product, deleted or not, at
+// today's price. Callers hold a.mu.
+func (a *API) buildReceipt(order Order) (Receipt, error) {
+	receipt := Receipt{
+		OrderID:        order.ID,
+		OrderNumber:    order.Number,
+		Placed:         order.Created,
+		Status:         order.Status,
+		Lines:          make([]ReceiptLine, 0, len(order.Items)),
+		Subtotal:       orderSubtotal(order),
+		DiscountCode:   order.DiscountCode,
+		Discount:       order.Discount,
+		Tax:            order.Tax,
+		ShippingMethod: order.ShippingMethod,
+		Shipping:       order.ShippingCost,
+		Total:          order.Total,
+	}
+	for _, item := range order.Items {
+		name, price := item.Name, item.UnitPrice
+		if name == "" {
+			product, err := a.store.GetProductIncludingDeleted(item.ProductID)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return Receipt{}, err
+			}
+			name, price = product.Name, effectivePrice(product)
+			if name == "" {
+				name = item.ProductID
+			}
+		}
+		receipt.Lines = append(receipt.Lines, ReceiptLine{
+			ProductID: item.ProductID,
+			Name:      name,
+			Quantity:  item.Quantity,
+			UnitPrice: price,
+			Amount:    roundCents(price * float64(item.Quantity)),
+		})
+	}
+	return receipt, nil
 }
 
-func getRecommendationsFromOrders(userOrders []Order, limit int) []Product {
-	// Simple recommendation based on categories from orders
-	categoryCount := make(map[string]int)
-	for _, order := range userOrders {
-		for _, item := range order.Items {
-			if product, exists := products[item.ProductID]; exists {
-				categoryCount[product.Category]++
-			}
+// formatReceiptText renders a receipt as fixed-width plain text
+func formatReceiptText(receipt Receipt) string {
+	var b strings.Builder
+	if receipt.OrderNumber != "" {
+		fmt.Fprintf(&b, "Receipt for order %s (%s)\n", receipt.OrderNumber, receipt.OrderID)
+	} else {
+		fmt.Fprintf(&b, "Receipt for order %s\n", receipt.OrderID)
+	}
+	fmt.Fprintf(&b, "Placed: %s\n", receipt.Placed.UTC().Format("2 Jan 2006 15:04 MST"))
+	fmt.Fprintf(&b, "Status: %s\n\n", receipt.Status)
+
+	fmt.Fprintf(&b, "%5s  %-32s %10s %10s\n", "Qty", "Item", "Price", "Amount")
+	for _, line := range receipt.Lines {
+		fmt.Fprintf(&b, "%5d  %-32s %10.2f %10.2f\n", line.Quantity, line.Name, line.UnitPrice, line.Amount)
+	}
+	b.WriteString("\n")
+
+	total := func(label string, amount float64) {
+		fmt.Fprintf(&b, "%-50s %10.2f\n", label, amount)
+	}
+	total("Subtotal", receipt.Subtotal)
+	if receipt.Discount > 0 {
+		label := "Discount"
+		if receipt.DiscountCode != "" {
+			label += " (" + receipt.DiscountCode + ")"
 		}
+		total(label, -receipt.Discount)
+	}
+	total("Tax", receipt.Tax)
+	if receipt.ShippingMethod != "" {
+		total("Shipping ("+receipt.ShippingMethod+")", receipt.Shipping)
+	} else {
+		total("Shipping", receipt.Shipping)
 	}
+	total("Total", receipt.Total)
+	return b.String()
+}
 
-	// Find products from preferred categories
-	var recommendations []Product
-	for _, product := range products {
-		if categoryCount[product.Category] > 0 && len(recommendations) < limit {
-			recommendations = append(recommendations, product)
+// normalizeTags lowercases and trims tags, dropping blank and repeated ones.
+// It returns nil when no tag is left.
+func normalizeTags(tags []string) []string {
+	var normalized []string
+	for _, tag := range tags {
+		tag = normalizeQuery(tag)
+		if tag != "" && !containsString(normalized, tag) {
+			normalized = append(normalized, tag)
 		}
 	}
+	return normalized
+}
 
-	return recommendations
+// formatOrderNumber turns an order sequence number into its display form,
+// e.g. ORD-000123
+func formatOrderNumber(sequence int64) string {
+	return fmt.Sprintf("ORD-%06d", sequence)
 }
 
-func getRecommendationsFromSearches(userSearches []SearchHistory, limit int) []Product {
-	// Simple recommendation based on search terms
-	var recommendations []Product
-	for _, search := range userSearches {
-		for _, product := range products {
-			if contains(product.Name, search.Query) || contains(product.Description, search.Query) {
-				if len(recommendations) < limit {
-					recommendations = append(recommendations, product)
-				}
-			}
+// roundCents rounds a monetary amount to two decimal places
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// Relevance weights of the product fields a search looks at. Tags count
+// once, for the best matching tag.
+const (
+	searchWeightName        = 3
+	searchWeightCategory    = 2
+	searchWeightTags        = 2
+	searchWeightDescription = 1
+)
+
+// Relevance of each kind of field match. Typo matches score below any exact
+// match so they always rank after them.
+const (
+	searchMatchExact     = 3
+	searchMatchPrefix    = 2
+	searchMatchSubstring = 1
+	searchMatchFuzzy     = 0.1
+)
+
+// searchScore rates how well product matches query, or 0 when it doesn't.
+// Each field contributes its weight times the quality of its match;
+// products that only match with a typo get a fraction of the name,
+// category or tag weight.
+func searchScore(product Product, query string) float64 {
+	tagQuality := 0
+	for _, tag := range product.Tags {
+		tagQuality = max(tagQuality, matchQuality(tag, query))
+	}
+	score := float64(searchWeightName*matchQuality(product.Name, query) +
+		searchWeightCategory*matchQuality(product.Category, query) +
+		searchWeightTags*tagQuality +
+		searchWeightDescription*matchQuality(product.Description, query))
+	if score > 0 {
+		return score
+	}
+	if fuzzyMatches(product.Name, query) {
+		return searchWeightName * searchMatchFuzzy
+	}
+	if fuzzyMatches(product.Category, query) {
+		return searchWeightCategory * searchMatchFuzzy
+	}
+	for _, tag := range product.Tags {
+		if fuzzyMatches(tag, query) {
+			return searchWeightTags * searchMatchFuzzy
 		}
 	}
-	return recommendations
+	return 0
 }
 
-func getPopularProducts(limit int) []Product {
-	// Return products with highest ratings
-	var productList []Product
-	for _, product := range products {
-		productList = append(productList, product)
+// matchQuality grades how query occurs in field, ignoring case and
+// surrounding whitespace: the whole field, the start of the field or one of
+// its words, anywhere, or not at all
+func matchQuality(field, query string) int {
+	field, query = normalizeQuery(field), normalizeQuery(query)
+	if query == "" {
+		return 0
+	}
+	switch {
+	case field == query:
+		return searchMatchExact
+	case strings.HasPrefix(field, query) || strings.Contains(field, " "+query):
+		return searchMatchPrefix
+	case strings.Contains(field, query):
+		return searchMatchSubstring
 	}
+	return 0
+}
 
-	// Simple sorting by rating (in production, use proper sorting)
-	if len(productList) > limit {
-		productList = productList[:limit]
+// contains reports whether substr appears anywhere in s, ignoring case
+func contains(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// fuzzyMatches reports whether query is within fuzzyThreshold edits of any
+// word in s, ignoring case
+func fuzzyMatches(s, query string) bool {
+	query = normalizeQuery(query)
+	maxEdits := fuzzyThreshold(query)
+	if maxEdits == 0 {
+		return false
+	}
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		if levenshtein(word, query) <= maxEdits {
+			return true
+		}
 	}
+	return false
+}
 
-	return productList
+// fuzzyThreshold is the number of typos tolerated in a query: none for very
+// short queries, where a single edit matches almost anything, then one more
+// for every four characters
+func fuzzyThreshold(query string) int {
+	return utf8.RuneCountInString(query) / 4
 }
 
-func contains(s, substr string) bool {
-	// Simple case-insensitive contains check
-	return len(s) >= len(substr) && (s == substr || 
-		(len(s) > len(substr) && (s[:len(substr)] == substr || 
-		s[len(s)-len(substr):] == substr)))
+// levenshtein returns the minimum number of single-rune insertions,
+// deletions and substitutions that turn a into b
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
 }
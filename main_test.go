@@ -0,0 +1,3447 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const testJWTSecret = "test-secret"
+
+// newTestServer returns the API's router over an empty in-memory store. The
+// configuration is the default one with a known JWT secret and no rate
+// limit; tests may change config further before sending requests.
+func newTestServer(t *testing.T) (*gin.Engine, *API) {
+	t.Helper()
+	return newTestServerWithStore(t, newInMemoryStore())
+}
+
+// newTestServerWithStore is newTestServer over the given store
+func newTestServerWithStore(t *testing.T, store Store) (*gin.Engine, *API) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config = defaultConfig()
+	config.JWTSecret = testJWTSecret
+	config.RateLimit = 0
+
+	app := newAPI(store)
+	return newRouter(app), app
+}
+
+// testToken signs a bearer token for userID with the test secret, carrying
+// role unless it is empty
+func testToken(t *testing.T, userID, role string) string {
+	t.Helper()
+	claims := tokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   userID,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		Role: role,
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testJWTSecret))
+	if err != nil {
+		t.Fatalf("signing token: %v", err)
+	}
+	return token
+}
+
+// doRequest sends a request to handler, JSON-encoding body unless it is nil
+// and authenticating with token unless it is empty
+func doRequest(t *testing.T, handler http.Handler, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	if body == nil {
+		return doRawRequest(t, handler, method, path, token, "", "")
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("encoding body: %v", err)
+	}
+	return doRawRequest(t, handler, method, path, token, "application/json", string(payload))
+}
+
+// doRawRequest is doRequest with a body sent as is, of the given content type
+func doRawRequest(t *testing.T, handler http.Handler, method, path, token, contentType, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// decodeResponse decodes a JSON response body into v, failing the test on
+// an unexpected status
+func decodeResponse(t *testing.T, w *httptest.ResponseRecorder, status int, v interface{}) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("status = %d, want %d; body %s", w.Code, status, w.Body.String())
+	}
+	if v == nil {
+		return
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body.String(), err)
+	}
+}
+
+// saveTestProduct stores a product with the given ID, price and stock
+func saveTestProduct(t *testing.T, app *API, id string, price float64, stock int) Product {
+	t.Helper()
+	product := Product{ID: id, Name: "Product " + id, Category: "Testing", Price: price, Stock: stock}
+	if err := app.store.SaveProduct(product); err != nil {
+		t.Fatalf("saving product %s: %v", id, err)
+	}
+	return product
+}
+
+func TestAvailabilityBufferBoundary(t *testing.T) {
+	defer func(saved Config) { config = saved }(config)
+	config.InStockMinimum = 3
+	config.LowStockThreshold = 10
+
+	for stock, want := range map[int]string{
+		0:  availabilityOutOfStock,
+		2:  availabilityOutOfStock,
+		3:  availabilityLowStock,
+		10: availabilityLowStock,
+		11: availabilityInStock,
+	} {
+		if got := presentProduct(Product{Stock: stock}).Availability; got != want {
+			t.Errorf("availability at stock %d = %q, want %q", stock, got, want)
+		}
+	}
+}
+
+func TestListCartsPaginatesNewestFirst(t *testing.T) {
+	r, app := newTestServer(t)
+	base := time.Date(2023, 12, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		cart := Cart{
+			ID:      fmt.Sprintf("cart-%d", i),
+			UserID:  fmt.Sprintf("user-%d", i),
+			Items:   []CartItem{},
+			Updated: base.Add(time.Duration(i) * time.Hour),
+		}
+		if err := app.store.SaveCart(cart); err != nil {
+			t.Fatalf("saving cart: %v", err)
+		}
+	}
+	admin := testToken(t, "admin", roleAdmin)
+
+	var page CartPage
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/admin/carts?limit=2", admin, nil), http.StatusOK, &page)
+	if page.Total != 5 || len(page.Data) != 2 {
+		t.Fatalf("got %d of %d carts, want 2 of 5", len(page.Data), page.Total)
+	}
+	if page.Data[0].UserID != "user-4" || page.Data[1].UserID != "user-3" {
+		t.Errorf("first page = %s, %s; want user-4, user-3", page.Data[0].UserID, page.Data[1].UserID)
+	}
+
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/admin/carts?limit=2&offset=4", admin, nil), http.StatusOK, &page)
+	if len(page.Data) != 1 || page.Data[0].UserID != "user-0" {
+		t.Errorf("last page = %+v, want only user-0", page.Data)
+	}
+}
+
+func TestAdminRoutesRequireAdminRole(t *testing.T) {
+	r, _ := newTestServer(t)
+
+	routes := []struct{ method, path string }{
+		{http.MethodPost, "/api/v1/admin/recompute-totals?confirm=true"},
+		{http.MethodPost, "/api/v1/admin/orders/cancel"},
+		{http.MethodGet, "/api/v1/admin/carts"},
+		{http.MethodGet, "/api/v1/admin/abandoned-carts?idle_minutes=60"},
+		{http.MethodGet, "/api/v1/admin/analytics/sales"},
+		{http.MethodGet, "/api/v1/admin/analytics/categories"},
+		{http.MethodGet, "/api/v1/admin/webhooks"},
+		{http.MethodPost, "/api/v1/admin/webhooks"},
+		{http.MethodDelete, "/api/v1/admin/webhooks/00000000-0000-0000-0000-000000000000"},
+	}
+	shopper := testToken(t, "user123", "")
+	for _, route := range routes {
+		if w := doRequest(t, r, route.method, route.path, "", nil); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s without a token = %d, want 401", route.method, route.path, w.Code)
+		}
+		if w := doRequest(t, r, route.method, route.path, shopper, nil); w.Code != http.StatusForbidden {
+			t.Errorf("%s %s as a shopper = %d, want 403", route.method, route.path, w.Code)
+		}
+	}
+
+	if w := doRequest(t, r, http.MethodGet, "/api/v1/admin/carts", testToken(t, "admin", roleAdmin), nil); w.Code != http.StatusOK {
+		t.Errorf("GET /admin/carts as an admin = %d, want 200", w.Code)
+	}
+}
+
+// saveTestOrder stores a pending order of one unit of each product for
+// userID and returns it
+func saveTestOrder(t *testing.T, app *API, userID string, productIDs ...string) Order {
+	t.Helper()
+	order := Order{
+		ID:      uuid.New().String(),
+		UserID:  userID,
+		Status:  orderStatusPending,
+		Created: time.Now(),
+	}
+	for _, id := range productIDs {
+		order.Items = append(order.Items, OrderItem{ProductID: id, Quantity: 1, FulfillmentStatus: fulfillmentPending})
+	}
+	if err := app.store.SaveOrder(order); err != nil {
+		t.Fatalf("saving order: %v", err)
+	}
+	return order
+}
+
+func TestUpdateOrderStatusAllowsLegalTransition(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	order := saveTestOrder(t, app, "user123", "p1")
+
+	var updated Order
+	w := doRequest(t, r, http.MethodPost, "/api/v1/orders/"+order.ID+"/status", testToken(t, "admin", roleAdmin), OrderStatusRequest{Status: orderStatusPaid})
+	decodeResponse(t, w, http.StatusOK, &updated)
+	if updated.Status != orderStatusPaid {
+		t.Errorf("status = %q, want %q", updated.Status, orderStatusPaid)
+	}
+}
+
+func TestUpdateOrderStatusRejectsIllegalTransition(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	order := saveTestOrder(t, app, "user123", "p1")
+	order.Status = orderStatusDelivered
+	if err := app.store.SaveOrder(order); err != nil {
+		t.Fatal(err)
+	}
+
+	w := doRequest(t, r, http.MethodPost, "/api/v1/orders/"+order.ID+"/status", testToken(t, "admin", roleAdmin), OrderStatusRequest{Status: orderStatusPending})
+	if w.Code != http.StatusConflict {
+		t.Errorf("delivered -> pending = %d, want 409", w.Code)
+	}
+}
+
+func TestOrderFulfillmentRequiresAdmin(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	order := saveTestOrder(t, app, "user123", "p1")
+	owner := testToken(t, "user123", "")
+
+	if w := doRequest(t, r, http.MethodPost, "/api/v1/orders/"+order.ID+"/status", owner, OrderStatusRequest{Status: orderStatusPaid}); w.Code != http.StatusForbidden {
+		t.Errorf("status change by the owner = %d, want 403", w.Code)
+	}
+	if w := doRequest(t, r, http.MethodPost, "/api/v1/orders/"+order.ID+"/ship", owner, ShipItemsRequest{ProductIDs: []string{"p1"}}); w.Code != http.StatusForbidden {
+		t.Errorf("shipping by the owner = %d, want 403", w.Code)
+	}
+}
+
+func TestCancelOrderRestocks(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	order := saveTestOrder(t, app, "user123", "p1")
+
+	var cancelled Order
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/orders/"+order.ID+"/cancel", testToken(t, "user123", ""), nil), http.StatusOK, &cancelled)
+	if cancelled.Status != orderStatusCancelled {
+		t.Errorf("status = %q, want %q", cancelled.Status, orderStatusCancelled)
+	}
+	product, err := app.store.GetProduct("p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product.Stock != 6 {
+		t.Errorf("stock = %d, want 6 after the cancelled unit is returned", product.Stock)
+	}
+}
+
+func TestCancelOrderOwnerOrAdminOnly(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	first := saveTestOrder(t, app, "user123", "p1")
+	second := saveTestOrder(t, app, "user123", "p1")
+
+	if w := doRequest(t, r, http.MethodPost, "/api/v1/orders/"+first.ID+"/cancel", testToken(t, "someone-else", ""), nil); w.Code != http.StatusForbidden {
+		t.Errorf("cancel by another user = %d, want 403", w.Code)
+	}
+	if w := doRequest(t, r, http.MethodPost, "/api/v1/orders/"+second.ID+"/cancel", testToken(t, "admin", roleAdmin), nil); w.Code != http.StatusOK {
+		t.Errorf("cancel by an admin = %d, want 200", w.Code)
+	}
+}
+
+// addToTestCart adds quantity units of a product to the token's cart
+func addToTestCart(t *testing.T, handler http.Handler, token, productID string, quantity int) {
+	t.Helper()
+	w := doRequest(t, handler, http.MethodPost, "/api/v1/cart/add", token, CartItem{ProductID: productID, Quantity: quantity})
+	decodeResponse(t, w, http.StatusOK, nil)
+}
+
+func TestUpdateProductChangesPrice(t *testing.T) {
+	r, app := newTestServer(t)
+	product := saveTestProduct(t, app, "p1", 10, 5)
+	product.Price = 12.5
+
+	var updated ProductView
+	decodeResponse(t, doRequest(t, r, http.MethodPut, "/api/v1/products/p1", testToken(t, "admin", roleAdmin), product), http.StatusOK, &updated)
+	if updated.Price != 12.5 {
+		t.Errorf("price in response = %v, want 12.5", updated.Price)
+	}
+	stored, err := app.store.GetProduct("p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Price != 12.5 {
+		t.Errorf("stored price = %v, want 12.5", stored.Price)
+	}
+}
+
+func TestUpdateProductUnknownProduct(t *testing.T) {
+	r, _ := newTestServer(t)
+	product := Product{Name: "Ghost", Category: "Testing", Price: 10, Stock: 1}
+
+	w := doRequest(t, r, http.MethodPut, "/api/v1/products/missing", testToken(t, "admin", roleAdmin), product)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", w.Code)
+	}
+}
+
+func TestUpdateProductRejectsInvalidPrice(t *testing.T) {
+	r, app := newTestServer(t)
+	product := saveTestProduct(t, app, "p1", 10, 5)
+	product.Price = -1
+
+	w := doRequest(t, r, http.MethodPut, "/api/v1/products/p1", testToken(t, "admin", roleAdmin), product)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", w.Code)
+	}
+	if stored, _ := app.store.GetProduct("p1"); stored.Price != 10 {
+		t.Errorf("stored price = %v, want it unchanged at 10", stored.Price)
+	}
+}
+
+func TestUpdateProductRequiresAdmin(t *testing.T) {
+	r, app := newTestServer(t)
+	product := saveTestProduct(t, app, "p1", 10, 5)
+
+	if w := doRequest(t, r, http.MethodPut, "/api/v1/products/p1", "", product); w.Code != http.StatusUnauthorized {
+		t.Errorf("without a token = %d, want 401", w.Code)
+	}
+	if w := doRequest(t, r, http.MethodPut, "/api/v1/products/p1", testToken(t, "user123", ""), product); w.Code != http.StatusForbidden {
+		t.Errorf("as a shopper = %d, want 403", w.Code)
+	}
+}
+
+func TestPatchProductPriceOnly(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+
+	var patched ProductView
+	w := doRequest(t, r, http.MethodPatch, "/api/v1/products/p1", testToken(t, "admin", roleAdmin), map[string]interface{}{"price": 15})
+	decodeResponse(t, w, http.StatusOK, &patched)
+	if patched.Price != 15 {
+		t.Errorf("price = %v, want 15", patched.Price)
+	}
+	if patched.Name != "Product p1" || patched.Category != "Testing" || patched.Stock != 5 {
+		t.Errorf("other fields changed: %+v", patched.Product)
+	}
+}
+
+func TestPatchProductStockToZero(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+
+	w := doRequest(t, r, http.MethodPatch, "/api/v1/products/p1", testToken(t, "admin", roleAdmin), map[string]interface{}{"stock": 0})
+	decodeResponse(t, w, http.StatusOK, nil)
+	if stored, _ := app.store.GetProduct("p1"); stored.Stock != 0 || stored.Price != 10 {
+		t.Errorf("stored stock and price = %d, %v; want 0, 10", stored.Stock, stored.Price)
+	}
+}
+
+func TestPatchProductRequiresAdmin(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+
+	w := doRequest(t, r, http.MethodPatch, "/api/v1/products/p1", testToken(t, "user123", ""), map[string]interface{}{"price": 1})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("as a shopper = %d, want 403", w.Code)
+	}
+}
+
+func TestDeleteProductRemovesItFromEveryCart(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	saveTestProduct(t, app, "p2", 4, 5)
+	alice, bob := testToken(t, "alice", ""), testToken(t, "bob", "")
+	for _, token := range []string{alice, bob} {
+		addToTestCart(t, r, token, "p1", 1)
+		addToTestCart(t, r, token, "p2", 2)
+	}
+
+	w := doRequest(t, r, http.MethodDelete, "/api/v1/products/p1", testToken(t, "admin", roleAdmin), nil)
+	decodeResponse(t, w, http.StatusNoContent, nil)
+
+	for _, user := range []string{"alice", "bob"} {
+		cart, err := app.store.GetCart(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cart.Items) != 1 || cart.Items[0].ProductID != "p2" {
+			t.Errorf("%s's cart = %+v, want only p2", user, cart.Items)
+		}
+		if cart.Total != 8 {
+			t.Errorf("%s's total = %v, want 8", user, cart.Total)
+		}
+	}
+}
+
+func TestDeleteProductRequiresAdmin(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+
+	if w := doRequest(t, r, http.MethodDelete, "/api/v1/products/p1", testToken(t, "user123", ""), nil); w.Code != http.StatusForbidden {
+		t.Errorf("as a shopper = %d, want 403", w.Code)
+	}
+	if _, err := app.store.GetProduct("p1"); err != nil {
+		t.Errorf("product deleted by a shopper: %v", err)
+	}
+}
+
+func TestImportProductsCleanFile(t *testing.T) {
+	r, app := newTestServer(t)
+	csv := "name,description,price,category,stock,rating,image_url\n" +
+		"Desk Lamp,LED lamp,24.99,Home,12,4.1,https://example.com/lamp.jpg\n" +
+		"Notebook,A5 dotted,3.5,Office,40,4.6,\n"
+
+	var summary ImportSummary
+	w := doRawRequest(t, r, http.MethodPost, "/api/v1/products/import", testToken(t, "admin", roleAdmin), "text/csv", csv)
+	decodeResponse(t, w, http.StatusOK, &summary)
+	if summary.Imported != 2 || len(summary.Errors) != 0 {
+		t.Errorf("summary = %+v, want 2 imported and no errors", summary)
+	}
+	if products, _ := app.store.ListProducts(); len(products) != 2 {
+		t.Errorf("catalog has %d products, want 2", len(products))
+	}
+}
+
+func TestImportProductsSkipsInvalidRow(t *testing.T) {
+	r, app := newTestServer(t)
+	csv := "name,description,price,category,stock,rating,image_url\n" +
+		"Desk Lamp,LED lamp,24.99,Home,12,4.1,\n" +
+		"Broken,Bad price,free,Home,1,4,\n" +
+		"Notebook,A5 dotted,3.5,Office,40,4.6,\n"
+
+	var summary ImportSummary
+	w := doRawRequest(t, r, http.MethodPost, "/api/v1/products/import", testToken(t, "admin", roleAdmin), "text/csv", csv)
+	decodeResponse(t, w, http.StatusOK, &summary)
+	if summary.Imported != 2 {
+		t.Errorf("imported = %d, want 2", summary.Imported)
+	}
+	if len(summary.Errors) != 1 || summary.Errors[0].Line != 3 {
+		t.Errorf("errors = %+v, want one for line 3", summary.Errors)
+	}
+	if products, _ := app.store.ListProducts(); len(products) != 2 {
+		t.Errorf("catalog has %d products, want 2", len(products))
+	}
+}
+
+func TestImportProductsRequiresAdmin(t *testing.T) {
+	r, _ := newTestServer(t)
+	csv := "name,description,price,category,stock,rating,image_url\nLamp,,1,Home,1,4,\n"
+
+	w := doRawRequest(t, r, http.MethodPost, "/api/v1/products/import", testToken(t, "user123", ""), "text/csv", csv)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("as a shopper = %d, want 403", w.Code)
+	}
+}
+
+func TestExportProductsFiltersByCategory(t *testing.T) {
+	r, app := newTestServer(t)
+	for _, product := range []Product{
+		{ID: "lamp", Name: "Desk Lamp", Category: "Home", Price: 24.99, Stock: 12},
+		{ID: "pen", Name: "Pen", Category: "Office", Price: 1.5, Stock: 100},
+	} {
+		if err := app.store.SaveProduct(product); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := doRequest(t, r, http.MethodGet, "/api/v1/products/export?category=office", testToken(t, "admin", roleAdmin), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("reading CSV: %v", err)
+	}
+	if want := append([]string{"id"}, importColumns...); strings.Join(records[0], ",") != strings.Join(want, ",") {
+		t.Errorf("header = %v, want %v", records[0], want)
+	}
+	if len(records) != 2 || records[1][0] != "pen" {
+		t.Errorf("rows = %v, want only pen", records[1:])
+	}
+}
+
+func TestExportProductsRequiresAdmin(t *testing.T) {
+	r, _ := newTestServer(t)
+
+	if w := doRequest(t, r, http.MethodGet, "/api/v1/products/export", testToken(t, "user123", ""), nil); w.Code != http.StatusForbidden {
+		t.Errorf("as a shopper = %d, want 403", w.Code)
+	}
+}
+
+func TestRestockProductAddsUnits(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+
+	var restocked ProductView
+	w := doRequest(t, r, http.MethodPost, "/api/v1/products/p1/restock", testToken(t, "admin", roleAdmin), RestockRequest{Quantity: 25})
+	decodeResponse(t, w, http.StatusOK, &restocked)
+	if restocked.Stock != 30 {
+		t.Errorf("stock = %d, want 30", restocked.Stock)
+	}
+}
+
+func TestRestockProductValidation(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	admin := testToken(t, "admin", roleAdmin)
+
+	tests := []struct {
+		name, path string
+		body       interface{}
+		want       int
+	}{
+		{"zero quantity", "/api/v1/products/p1/restock", RestockRequest{Quantity: 0}, http.StatusBadRequest},
+		{"negative quantity", "/api/v1/products/p1/restock", RestockRequest{Quantity: -3}, http.StatusBadRequest},
+		{"malformed body", "/api/v1/products/p1/restock", "not an object", http.StatusBadRequest},
+		{"unknown product", "/api/v1/products/missing/restock", RestockRequest{Quantity: 1}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := doRequest(t, r, http.MethodPost, tt.path, admin, tt.body); w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+	if stored, _ := app.store.GetProduct("p1"); stored.Stock != 5 {
+		t.Errorf("stock = %d, want it unchanged at 5", stored.Stock)
+	}
+}
+
+func TestRestockProductRequiresAdmin(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+
+	w := doRequest(t, r, http.MethodPost, "/api/v1/products/p1/restock", testToken(t, "user123", ""), RestockRequest{Quantity: 1})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("as a shopper = %d, want 403", w.Code)
+	}
+}
+
+// bulkStockResponse is the body of a bulk stock update
+type bulkStockResponse struct {
+	Results []StockUpdateResult `json:"results"`
+	Updated int                 `json:"updated"`
+}
+
+// stockUpdate is a StockUpdate setting productID's stock
+func stockUpdate(productID string, stock int) StockUpdate {
+	return StockUpdate{ProductID: productID, Stock: &stock}
+}
+
+func TestBulkUpdateStock(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	saveTestProduct(t, app, "p2", 10, 5)
+
+	var resp bulkStockResponse
+	w := doRequest(t, r, http.MethodPut, "/api/v1/products/stock", testToken(t, "admin", roleAdmin),
+		[]StockUpdate{stockUpdate("p1", 40), stockUpdate("p2", 0)})
+	decodeResponse(t, w, http.StatusOK, &resp)
+	if resp.Updated != 2 {
+		t.Errorf("updated = %d, want 2", resp.Updated)
+	}
+	for id, want := range map[string]int{"p1": 40, "p2": 0} {
+		if stored, _ := app.store.GetProduct(id); stored.Stock != want {
+			t.Errorf("%s stock = %d, want %d", id, stored.Stock, want)
+		}
+	}
+}
+
+func TestBulkUpdateStockMixedBatchLenient(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+
+	var resp bulkStockResponse
+	w := doRequest(t, r, http.MethodPut, "/api/v1/products/stock", testToken(t, "admin", roleAdmin),
+		[]StockUpdate{stockUpdate("p1", 40), stockUpdate("missing", 5)})
+	decodeResponse(t, w, http.StatusOK, &resp)
+	if resp.Updated != 1 || len(resp.Results) != 2 {
+		t.Fatalf("response = %+v, want one of two updated", resp)
+	}
+	if resp.Results[1].Updated || resp.Results[1].Error == "" {
+		t.Errorf("unknown product result = %+v, want an error", resp.Results[1])
+	}
+	if stored, _ := app.store.GetProduct("p1"); stored.Stock != 40 {
+		t.Errorf("p1 stock = %d, want 40", stored.Stock)
+	}
+}
+
+func TestBulkUpdateStockMixedBatchStrict(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+
+	var resp ErrorResponse
+	w := doRequest(t, r, http.MethodPut, "/api/v1/products/stock?strict=true", testToken(t, "admin", roleAdmin),
+		[]StockUpdate{stockUpdate("p1", 40), stockUpdate("missing", 5)})
+	decodeResponse(t, w, http.StatusBadRequest, &resp)
+	if resp.Error.Code != errCodeProductNotFound {
+		t.Errorf("code = %s, want %s", resp.Error.Code, errCodeProductNotFound)
+	}
+	if details, _ := resp.Error.Details.(map[string]interface{}); details["index"] != float64(1) {
+		t.Errorf("details = %v, want index 1", resp.Error.Details)
+	}
+	if stored, _ := app.store.GetProduct("p1"); stored.Stock != 5 {
+		t.Errorf("p1 stock = %d, want it unchanged at 5", stored.Stock)
+	}
+}
+
+func TestBulkUpdateStockRequiresAdmin(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+
+	w := doRequest(t, r, http.MethodPut, "/api/v1/products/stock", testToken(t, "user123", ""), []StockUpdate{stockUpdate("p1", 1)})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("as a shopper = %d, want 403", w.Code)
+	}
+}
+
+func TestApplyCouponRejectsDuplicate(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	if err := app.store.SaveCoupon(Coupon{Code: "SAVE10", PercentOff: 10}); err != nil {
+		t.Fatal(err)
+	}
+	token := testToken(t, "user123", "")
+	addToTestCart(t, r, token, "p1", 1)
+
+	w := doRequest(t, r, http.MethodPost, "/api/v1/cart/user123/coupons", token, ApplyCouponRequest{Code: "SAVE10"})
+	decodeResponse(t, w, http.StatusOK, nil)
+
+	var resp ErrorResponse
+	w = doRequest(t, r, http.MethodPost, "/api/v1/cart/user123/coupons", token, ApplyCouponRequest{Code: "save10"})
+	decodeResponse(t, w, http.StatusConflict, &resp)
+	if resp.Error.Code != errCodeCouponAlreadyApplied {
+		t.Errorf("code = %s, want %s", resp.Error.Code, errCodeCouponAlreadyApplied)
+	}
+	if details, _ := resp.Error.Details.(map[string]interface{}); fmt.Sprint(details["coupons"]) != "[SAVE10]" {
+		t.Errorf("details = %v, want coupons [SAVE10]", resp.Error.Details)
+	}
+}
+
+func TestCheckoutAppliesCartCoupons(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 50, 5)
+	if err := app.store.SaveCoupon(Coupon{Code: "SAVE10", PercentOff: 10}); err != nil {
+		t.Fatal(err)
+	}
+	token := testToken(t, "user123", "")
+	addToTestCart(t, r, token, "p1", 1)
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/cart/user123/coupons", token, ApplyCouponRequest{Code: "SAVE10"}), http.StatusOK, nil)
+
+	var estimate CartEstimate
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/cart/user123/estimate", token, nil), http.StatusOK, &estimate)
+	var order Order
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/checkout", token, nil), http.StatusOK, &order)
+
+	if len(estimate.Discounts) != 1 || order.Discount != estimate.Discounts[0].Amount {
+		t.Errorf("order discount = %v, estimate discounts = %+v", order.Discount, estimate.Discounts)
+	}
+	if order.Discount != 5 {
+		t.Errorf("order discount = %v, want 5", order.Discount)
+	}
+	if cart, _ := app.store.GetCart("user123"); len(cart.Coupons) != 0 {
+		t.Errorf("coupons left on the cart after checkout: %v", cart.Coupons)
+	}
+}
+
+func TestCartEstimateBreakdown(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 30, 5)
+	saveTestProduct(t, app, "p2", 15, 5)
+	if err := app.store.SaveCoupon(Coupon{Code: "SAVE10", PercentOff: 10}); err != nil {
+		t.Fatal(err)
+	}
+	token := testToken(t, "user123", "")
+	addToTestCart(t, r, token, "p1", 2)
+	addToTestCart(t, r, token, "p2", 1)
+
+	var estimate CartEstimate
+	w := doRequest(t, r, http.MethodGet, "/api/v1/cart/user123/estimate?coupon=SAVE10", token, nil)
+	decodeResponse(t, w, http.StatusOK, &estimate)
+
+	// 75 of goods, 10% off leaves 67.50, 8% tax on that is 5.40, and
+	// standard shipping is charged below 100
+	if estimate.Subtotal != 75 {
+		t.Errorf("subtotal = %v, want 75", estimate.Subtotal)
+	}
+	if len(estimate.Discounts) != 1 || estimate.Discounts[0] != (DiscountLine{Code: "SAVE10", Amount: 7.5}) {
+		t.Errorf("discounts = %+v, want SAVE10 taking 7.50", estimate.Discounts)
+	}
+	if estimate.Tax != 5.4 {
+		t.Errorf("tax = %v, want 5.40", estimate.Tax)
+	}
+	if estimate.Shipping != 9.99 {
+		t.Errorf("shipping = %v, want 9.99", estimate.Shipping)
+	}
+	if estimate.Total != 82.89 {
+		t.Errorf("total = %v, want 82.89", estimate.Total)
+	}
+}
+
+func TestCheckoutChargesEstimatedTax(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 30, 5)
+	saveTestProduct(t, app, "p2", 15, 5)
+	if err := app.store.SaveCoupon(Coupon{Code: "SAVE10", PercentOff: 10}); err != nil {
+		t.Fatal(err)
+	}
+	token := testToken(t, "user123", "")
+	addToTestCart(t, r, token, "p1", 2)
+	addToTestCart(t, r, token, "p2", 1)
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/cart/user123/coupons", token, ApplyCouponRequest{Code: "SAVE10"}), http.StatusOK, nil)
+
+	var estimate CartEstimate
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/cart/user123/estimate", token, nil), http.StatusOK, &estimate)
+	var order Order
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/checkout", token, nil), http.StatusOK, &order)
+
+	if order.Tax != estimate.Tax || order.Total != estimate.Total {
+		t.Errorf("order tax and total = %v, %v; estimate = %v, %v", order.Tax, order.Total, estimate.Tax, estimate.Total)
+	}
+
+	var detail OrderDetail
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/orders/detail/"+order.ID, token, nil), http.StatusOK, &detail)
+	if detail.Subtotal != estimate.Subtotal {
+		t.Errorf("order subtotal = %v, want %v", detail.Subtotal, estimate.Subtotal)
+	}
+}
+
+func TestHistoryOfDeletedProduct(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	admin := testToken(t, "admin", roleAdmin)
+	decodeResponse(t, doRequest(t, r, http.MethodPatch, "/api/v1/products/p1", admin, map[string]interface{}{"price": 12}), http.StatusOK, nil)
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/products/p1/restock", admin, RestockRequest{Quantity: 3}), http.StatusOK, nil)
+	if w := doRequest(t, r, http.MethodDelete, "/api/v1/products/p1", admin, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("deleting p1 = %d, want 204", w.Code)
+	}
+
+	var movements []StockMovement
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products/p1/stock-history", "", nil), http.StatusOK, &movements)
+	if len(movements) == 0 || movements[0].Delta != 3 {
+		t.Errorf("stock history = %+v, want the restock of 3 first", movements)
+	}
+	var changes []PriceChange
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products/p1/price-history", "", nil), http.StatusOK, &changes)
+	if len(changes) != 1 || changes[0].NewPrice != 12 {
+		t.Errorf("price history = %+v, want the change to 12", changes)
+	}
+
+	for _, path := range []string{"/api/v1/products/missing/stock-history", "/api/v1/products/missing/price-history"} {
+		if w := doRequest(t, r, http.MethodGet, path, "", nil); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", path, w.Code)
+		}
+	}
+}
+
+// productStock reads a product's stock straight from the store
+func productStock(t *testing.T, app *API, id string) int {
+	t.Helper()
+	product, err := app.store.GetProductIncludingDeleted(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return product.Stock
+}
+
+func TestLapsedCartReservationIsFlaggedNotRemoved(t *testing.T) {
+	r, app := newTestServer(t)
+	config.CartReservationTTL = 15 * time.Minute
+	current := time.Now()
+	now = func() time.Time { return current }
+	t.Cleanup(func() { now = time.Now })
+
+	product := saveTestProduct(t, app, "p1", 10, 5)
+	token := testToken(t, "user123", "")
+	addToTestCart(t, r, token, "p1", 2)
+	if stock := productStock(t, app, "p1"); stock != 3 {
+		t.Errorf("stock while the cart holds 2 = %d, want 3", stock)
+	}
+
+	current = current.Add(16 * time.Minute)
+	app.sweepCarts(config.CartTTL)
+	if stock := productStock(t, app, "p1"); stock != 5 {
+		t.Errorf("stock after the hold lapsed = %d, want 5", stock)
+	}
+	var cart CartView
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/cart/user123", token, nil), http.StatusOK, &cart)
+	if len(cart.Items) != 1 || cart.Items[0].Quantity != 2 || !cart.Items[0].Unreserved {
+		t.Fatalf("cart after the hold lapsed = %+v, want the line of 2 flagged unreserved", cart.Items)
+	}
+
+	// Checkout has to find stock for the unreserved line again
+	product.Stock = 1
+	if err := app.store.SaveProduct(product); err != nil {
+		t.Fatal(err)
+	}
+	if w := doRequest(t, r, http.MethodPost, "/api/v1/checkout", token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("checkout with too little stock for the unreserved line = %d, want 400", w.Code)
+	}
+	product.Stock = 5
+	if err := app.store.SaveProduct(product); err != nil {
+		t.Fatal(err)
+	}
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/checkout", token, nil), http.StatusOK, nil)
+	if stock := productStock(t, app, "p1"); stock != 3 {
+		t.Errorf("stock after checkout = %d, want 3", stock)
+	}
+}
+
+// flakyReleaseStore fails every ReleaseStock call for one product
+type flakyReleaseStore struct {
+	*InMemoryStore
+	failing string
+}
+
+func (s *flakyReleaseStore) ReleaseStock(productID string, quantity int) error {
+	if productID == s.failing {
+		return errors.New("connection reset")
+	}
+	return s.InMemoryStore.ReleaseStock(productID, quantity)
+}
+
+func TestLapsedHoldsReleasedBeforeAFailureAreSaved(t *testing.T) {
+	store := &flakyReleaseStore{InMemoryStore: newInMemoryStore()}
+	r, app := newTestServerWithStore(t, store)
+	config.CartReservationTTL = 15 * time.Minute
+	current := time.Now()
+	now = func() time.Time { return current }
+	t.Cleanup(func() { now = time.Now })
+
+	saveTestProduct(t, app, "p1", 10, 5)
+	saveTestProduct(t, app, "p2", 10, 5)
+	token := testToken(t, "user123", "")
+	addToTestCart(t, r, token, "p1", 2)
+	addToTestCart(t, r, token, "p2", 2)
+
+	current = current.Add(16 * time.Minute)
+	store.failing = "p2"
+	app.sweepCarts(config.CartTTL)
+	cart, err := app.store.GetCart("user123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, held := cart.Reservations["p1"]; held {
+		t.Errorf("reservations after p2 failed to release = %v, want p1's released hold saved", cart.Reservations)
+	}
+
+	// Only p2 is left to release, so p1's units don't go back twice
+	store.failing = ""
+	app.sweepCarts(config.CartTTL)
+	if stock := productStock(t, app, "p1"); stock != 5 {
+		t.Errorf("p1 stock after both sweeps = %d, want 5", stock)
+	}
+	if stock := productStock(t, app, "p2"); stock != 5 {
+		t.Errorf("p2 stock after both sweeps = %d, want 5", stock)
+	}
+}
+
+func TestCartReservationIsReleased(t *testing.T) {
+	r, app := newTestServer(t)
+	config.CartReservationTTL = 15 * time.Minute
+	saveTestProduct(t, app, "p1", 10, 5)
+	token := testToken(t, "user123", "")
+
+	addToTestCart(t, r, token, "p1", 4)
+	if w := doRequest(t, r, http.MethodPost, "/api/v1/cart/add", testToken(t, "user456", ""), CartItem{ProductID: "p1", Quantity: 2}); w.Code != http.StatusBadRequest {
+		t.Errorf("adding more than the unheld stock = %d, want 400", w.Code)
+	}
+
+	decodeResponse(t, doRequest(t, r, http.MethodDelete, "/api/v1/cart/remove", token, CartItem{ProductID: "p1", Quantity: 1}), http.StatusOK, nil)
+	if stock := productStock(t, app, "p1"); stock != 2 {
+		t.Errorf("stock after removing 1 of 4 held = %d, want 2", stock)
+	}
+	decodeResponse(t, doRequest(t, r, http.MethodDelete, "/api/v1/cart/user123/clear", token, nil), http.StatusOK, nil)
+	if stock := productStock(t, app, "p1"); stock != 5 {
+		t.Errorf("stock after clearing the cart = %d, want 5", stock)
+	}
+}
+
+func TestOrderKeepsPriceAndNameAfterProductChanges(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	token := testToken(t, "user123", "")
+	addToTestCart(t, r, token, "p1", 2)
+	var order Order
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/checkout", token, nil), http.StatusOK, &order)
+
+	admin := testToken(t, "admin", roleAdmin)
+	decodeResponse(t, doRequest(t, r, http.MethodPatch, "/api/v1/products/p1", admin, map[string]interface{}{"price": 25, "name": "Renamed"}), http.StatusOK, nil)
+
+	var history []Order
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/orders/user123", token, nil), http.StatusOK, &history)
+	if len(history) != 1 || len(history[0].Items) != 1 {
+		t.Fatalf("order history = %+v, want the one order", history)
+	}
+	if line := history[0].Items[0]; line.UnitPrice != 10 || line.Name != "Product p1" {
+		t.Errorf("order line after the product changed = %+v, want unit price 10 and name Product p1", line)
+	}
+
+	var detail OrderDetail
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/orders/detail/"+order.ID, token, nil), http.StatusOK, &detail)
+	if detail.Subtotal != 20 || detail.Items[0].UnitPrice != 10 {
+		t.Errorf("order detail after the product changed = %+v, want subtotal 20 at 10 each", detail)
+	}
+}
+
+func TestRecomputeTotalsRepairsCorruptTotals(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	cart := Cart{ID: "c1", UserID: "user123", Items: []CartItem{{ProductID: "p1", Quantity: 2}}, Total: 999, Updated: time.Now()}
+	if err := app.store.SaveCart(cart); err != nil {
+		t.Fatal(err)
+	}
+	order := saveTestOrder(t, app, "user123", "p1")
+	order.Total = 12.3456
+	if err := app.store.SaveOrder(order); err != nil {
+		t.Fatal(err)
+	}
+	// 2 x 10 + 5 - 2.50 discount + 1.75 tax + 4.99 shipping is 29.24
+	priced := Order{
+		ID:      "priced",
+		UserID:  "user123",
+		Status:  orderStatusPending,
+		Created: time.Now(),
+		Items: []OrderItem{
+			{ProductID: "p1", Quantity: 2, FulfillmentStatus: fulfillmentPending, UnitPrice: 10},
+			{ProductID: "p2", Quantity: 1, FulfillmentStatus: fulfillmentPending, UnitPrice: 5},
+		},
+		Discount:     2.5,
+		Tax:          1.75,
+		ShippingCost: 4.99,
+		Total:        999,
+	}
+	if err := app.store.SaveOrder(priced); err != nil {
+		t.Fatal(err)
+	}
+	admin := testToken(t, "admin", roleAdmin)
+
+	if w := doRequest(t, r, http.MethodPost, "/api/v1/admin/recompute-totals", admin, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("recomputing without confirm=true = %d, want 400", w.Code)
+	}
+
+	var report map[string]int
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/admin/recompute-totals?confirm=true", admin, nil), http.StatusOK, &report)
+	if report["carts_corrected"] != 1 || report["orders_corrected"] != 2 {
+		t.Errorf("report = %v, want one cart and two orders corrected", report)
+	}
+	if repaired, _ := app.store.GetCart("user123"); repaired.Total != 20 {
+		t.Errorf("cart total = %v, want 20", repaired.Total)
+	}
+	if repaired, _ := app.store.GetOrder(order.ID); repaired.Total != 12.35 {
+		t.Errorf("order total = %v, want 12.35", repaired.Total)
+	}
+	if repaired, _ := app.store.GetOrder(priced.ID); repaired.Total != 29.24 {
+		t.Errorf("priced order total = %v, want 29.24 rebuilt from its lines", repaired.Total)
+	}
+
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/admin/recompute-totals?confirm=true", admin, nil), http.StatusOK, &report)
+	if report["carts_corrected"] != 0 || report["orders_corrected"] != 0 {
+		t.Errorf("second run = %v, want nothing left to correct", report)
+	}
+}
+
+func TestBulkCancelOrdersRestocksInAggregate(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	saveTestProduct(t, app, "p2", 20, 5)
+	first := saveTestOrder(t, app, "user123", "p1", "p2")
+	second := saveTestOrder(t, app, "user456", "p1")
+	shipped := saveTestOrder(t, app, "user789", "p2")
+	shipped.Status = orderStatusShipped
+	if err := app.store.SaveOrder(shipped); err != nil {
+		t.Fatal(err)
+	}
+
+	var report struct {
+		Results         []BulkCancelResult `json:"results"`
+		OrdersCancelled int                `json:"orders_cancelled"`
+		UnitsRestocked  int                `json:"units_restocked"`
+	}
+	body := BulkCancelRequest{OrderIDs: []string{first.ID, second.ID, shipped.ID, "missing"}}
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/admin/orders/cancel", testToken(t, "admin", roleAdmin), body), http.StatusOK, &report)
+
+	if report.OrdersCancelled != 2 || report.UnitsRestocked != 3 {
+		t.Errorf("cancelled %d orders restocking %d units, want 2 and 3", report.OrdersCancelled, report.UnitsRestocked)
+	}
+	if len(report.Results) != 4 || report.Results[2].Cancelled || report.Results[3].Cancelled {
+		t.Errorf("results = %+v, want the shipped and missing orders refused", report.Results)
+	}
+	if stock := productStock(t, app, "p1"); stock != 7 {
+		t.Errorf("p1 stock = %d, want 7", stock)
+	}
+	if stock := productStock(t, app, "p2"); stock != 6 {
+		t.Errorf("p2 stock = %d, want 6", stock)
+	}
+}
+
+// saveTestSale stores an order placed at created with the given status, total
+// and lines
+func saveTestSale(t *testing.T, app *API, created time.Time, status string, total float64, items ...OrderItem) Order {
+	t.Helper()
+	order := Order{ID: uuid.New().String(), UserID: "user123", Status: status, Created: created, Total: total, Items: items}
+	if err := app.store.SaveOrder(order); err != nil {
+		t.Fatalf("saving order: %v", err)
+	}
+	return order
+}
+
+func TestSalesSummaryAggregatesRange(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	saveTestProduct(t, app, "p2", 20, 5)
+	day := func(d int) time.Time { return time.Date(2023, 12, d, 12, 0, 0, 0, time.UTC) }
+	saveTestSale(t, app, day(1), orderStatusPending, 100, OrderItem{ProductID: "p1", Quantity: 3})
+	saveTestSale(t, app, day(5), orderStatusDelivered, 50, OrderItem{ProductID: "p2", Quantity: 1})
+	saveTestSale(t, app, day(5), orderStatusCancelled, 500, OrderItem{ProductID: "p2", Quantity: 9})
+	saveTestSale(t, app, day(6), orderStatusPaid, 999, OrderItem{ProductID: "p2", Quantity: 10})
+	admin := testToken(t, "admin", roleAdmin)
+
+	var summary SalesSummary
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/admin/analytics/sales?from=2023-12-01&to=2023-12-05", admin, nil), http.StatusOK, &summary)
+	if summary.Revenue != 150 || summary.OrderCount != 2 || summary.AverageOrderValue != 75 {
+		t.Errorf("summary = %+v, want revenue 150 over 2 orders averaging 75", summary)
+	}
+	want := []ProductSales{{ProductID: "p1", Name: "Product p1", Quantity: 3}, {ProductID: "p2", Name: "Product p2", Quantity: 1}}
+	if !reflect.DeepEqual(summary.TopProducts, want) {
+		t.Errorf("top products = %+v, want %+v", summary.TopProducts, want)
+	}
+
+	for _, query := range []string{"from=yesterday", "to=2023-13-01", "from=2023-12-05&to=2023-12-01"} {
+		if w := doRequest(t, r, http.MethodGet, "/api/v1/admin/analytics/sales?"+query, admin, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("sales summary with %s = %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestSalesSummaryDefaultsToLast30Days(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	saveTestSale(t, app, time.Now().Add(-time.Hour), orderStatusPaid, 40, OrderItem{ProductID: "p1", Quantity: 4})
+	saveTestSale(t, app, time.Now().AddDate(0, 0, -40), orderStatusPaid, 90, OrderItem{ProductID: "p1", Quantity: 9})
+
+	var summary SalesSummary
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/admin/analytics/sales", testToken(t, "admin", roleAdmin), nil), http.StatusOK, &summary)
+	if summary.OrderCount != 1 || summary.Revenue != 40 {
+		t.Errorf("default summary = %+v, want only the order of the last 30 days", summary)
+	}
+}
+
+func TestCategorySalesBreakdown(t *testing.T) {
+	r, app := newTestServer(t)
+	admin := testToken(t, "admin", roleAdmin)
+	books := saveTestProduct(t, app, "p3", 5, 5)
+	books.Category = "Books"
+	if err := app.store.SaveProduct(books); err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2023, 12, 1, 12, 0, 0, 0, time.UTC)
+	saveTestSale(t, app, day, orderStatusPaid, 50,
+		OrderItem{ProductID: "p1", Quantity: 2, Category: "Kitchen", UnitPrice: 10},
+		OrderItem{ProductID: "p2", Quantity: 1, Category: "Garden", UnitPrice: 30})
+	// An order from before lines recorded their category, for a product
+	// deleted since
+	saveTestSale(t, app, day, orderStatusDelivered, 20, OrderItem{ProductID: "p3", Quantity: 4})
+	saveTestSale(t, app, day, orderStatusCancelled, 100, OrderItem{ProductID: "p2", Quantity: 5, Category: "Garden", UnitPrice: 20})
+	if w := doRequest(t, r, http.MethodDelete, "/api/v1/products/p3", admin, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("deleting p3 = %d, want 204", w.Code)
+	}
+
+	var breakdown CategoryBreakdown
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/admin/analytics/categories?from=2023-12-01&to=2023-12-01", admin, nil), http.StatusOK, &breakdown)
+	want := []CategorySales{
+		{Category: "Garden", Units: 1, Revenue: 30},
+		{Category: "Books", Units: 4, Revenue: 20},
+		{Category: "Kitchen", Units: 2, Revenue: 20},
+	}
+	if !reflect.DeepEqual(breakdown.Categories, want) {
+		t.Errorf("categories = %+v, want %+v", breakdown.Categories, want)
+	}
+}
+
+func TestAbandonedCartsListsOnlyStaleNonEmptyCarts(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	line := []CartItem{{ProductID: "p1", Quantity: 1}}
+	for _, cart := range []Cart{
+		{ID: "stale", UserID: "user1", Items: line, Total: 10, Updated: time.Now().Add(-3 * time.Hour)},
+		{ID: "staler", UserID: "user2", Items: line, Total: 10, Updated: time.Now().Add(-5 * time.Hour)},
+		{ID: "fresh", UserID: "user3", Items: line, Total: 10, Updated: time.Now().Add(-10 * time.Minute)},
+		{ID: "empty", UserID: "user4", Items: []CartItem{}, Updated: time.Now().Add(-5 * time.Hour)},
+	} {
+		if err := app.store.SaveCart(cart); err != nil {
+			t.Fatal(err)
+		}
+	}
+	admin := testToken(t, "admin", roleAdmin)
+
+	var abandoned []AbandonedCart
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/admin/abandoned-carts?idle_minutes=60", admin, nil), http.StatusOK, &abandoned)
+	var ids []string
+	for _, cart := range abandoned {
+		ids = append(ids, cart.CartID)
+	}
+	if want := []string{"staler", "stale"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("abandoned carts = %v, want %v", ids, want)
+	}
+	if len(abandoned) > 0 && (abandoned[0].UserID != "user2" || abandoned[0].Total != 10 || abandoned[0].ItemCount != 1) {
+		t.Errorf("abandoned cart = %+v", abandoned[0])
+	}
+
+	for _, query := range []string{"", "?idle_minutes=0", "?idle_minutes=-5", "?idle_minutes=soon"} {
+		if w := doRequest(t, r, http.MethodGet, "/api/v1/admin/abandoned-carts"+query, admin, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("abandoned carts with %q = %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestCheckoutDecrementsStock(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	saveTestProduct(t, app, "p2", 20, 3)
+	token := testToken(t, "user123", "")
+	addToTestCart(t, r, token, "p1", 2)
+	addToTestCart(t, r, token, "p2", 3)
+
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/checkout", token, nil), http.StatusOK, nil)
+
+	if stock := productStock(t, app, "p1"); stock != 3 {
+		t.Errorf("p1 stock = %d, want 3", stock)
+	}
+	if stock := productStock(t, app, "p2"); stock != 0 {
+		t.Errorf("p2 stock = %d, want 0", stock)
+	}
+}
+
+func TestCheckoutFailsWhenStockRanOut(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	saveTestProduct(t, app, "p2", 20, 5)
+	token := testToken(t, "user123", "")
+	addToTestCart(t, r, token, "p1", 2)
+	addToTestCart(t, r, token, "p2", 4)
+
+	// Someone else buys most of p2 after it went into the cart
+	saveTestProduct(t, app, "p2", 20, 1)
+
+	var resp ErrorResponse
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/checkout", token, nil), http.StatusBadRequest, &resp)
+	if resp.Error.Code != errCodeInsufficientStock {
+		t.Errorf("code = %s, want %s", resp.Error.Code, errCodeInsufficientStock)
+	}
+
+	// The whole checkout is rejected, so p1 keeps its units too
+	if stock := productStock(t, app, "p1"); stock != 5 {
+		t.Errorf("p1 stock = %d, want 5", stock)
+	}
+	if stock := productStock(t, app, "p2"); stock != 1 {
+		t.Errorf("p2 stock = %d, want 1", stock)
+	}
+	if orders, _ := app.store.ListOrdersByUser("user123"); len(orders) != 0 {
+		t.Errorf("orders = %+v, want none", orders)
+	}
+	if cart, _ := app.store.GetCart("user123"); len(cart.Items) != 2 {
+		t.Errorf("cart items = %+v, want both lines kept", cart.Items)
+	}
+}
+
+func TestShipOrderItemsDerivesStatus(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	saveTestProduct(t, app, "p2", 20, 5)
+	order := saveTestOrder(t, app, "user123", "p1", "p2")
+	order.Status = orderStatusPaid
+	if err := app.store.SaveOrder(order); err != nil {
+		t.Fatal(err)
+	}
+	admin := testToken(t, "admin", roleAdmin)
+	path := "/api/v1/orders/" + order.ID + "/ship"
+
+	var updated Order
+	decodeResponse(t, doRequest(t, r, http.MethodPost, path, admin, ShipItemsRequest{ProductIDs: []string{"p1"}}), http.StatusOK, &updated)
+	if updated.Status != orderStatusPartiallyShipped {
+		t.Errorf("status after shipping p1 = %q, want %q", updated.Status, orderStatusPartiallyShipped)
+	}
+	if updated.Items[0].FulfillmentStatus != fulfillmentShipped || updated.Items[1].FulfillmentStatus != fulfillmentPending {
+		t.Errorf("lines after shipping p1 = %+v", updated.Items)
+	}
+
+	decodeResponse(t, doRequest(t, r, http.MethodPost, path, admin, ShipItemsRequest{ProductIDs: []string{"p2"}}), http.StatusOK, &updated)
+	if updated.Status != orderStatusShipped {
+		t.Errorf("status after shipping p2 = %q, want %q", updated.Status, orderStatusShipped)
+	}
+	if stored, _ := app.store.GetOrder(order.ID); stored.Status != orderStatusShipped {
+		t.Errorf("stored status = %q, want %q", stored.Status, orderStatusShipped)
+	}
+}
+
+func TestShipOrderItemsRejectsUnknownLine(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	order := saveTestOrder(t, app, "user123", "p1")
+	order.Status = orderStatusPaid
+	if err := app.store.SaveOrder(order); err != nil {
+		t.Fatal(err)
+	}
+
+	w := doRequest(t, r, http.MethodPost, "/api/v1/orders/"+order.ID+"/ship", testToken(t, "admin", roleAdmin), ShipItemsRequest{ProductIDs: []string{"p1", "p9"}})
+	decodeResponse(t, w, http.StatusBadRequest, nil)
+	if stored, _ := app.store.GetOrder(order.ID); stored.Status != orderStatusPaid || stored.Items[0].FulfillmentStatus != fulfillmentPending {
+		t.Errorf("order after the rejected request = %+v, want it untouched", stored)
+	}
+}
+
+// pageIDs lists the IDs of the products on a listing page, in order
+func pageIDs(page ProductPage) []string {
+	ids := make([]string, 0, len(page.Data))
+	for _, product := range page.Data {
+		ids = append(ids, product.ID)
+	}
+	return ids
+}
+
+func TestBestSortBlendsRatingAndSales(t *testing.T) {
+	r, app := newTestServer(t)
+	for id, rating := range map[string]float64{"a": 5, "b": 3, "c": 4, "d": 1} {
+		product := saveTestProduct(t, app, id, 10, 100)
+		product.Rating = rating
+		if err := app.store.SaveProduct(product); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saveTestSale(t, app, time.Now(), orderStatusDelivered, 1500,
+		OrderItem{ProductID: "b", Quantity: 100}, OrderItem{ProductID: "c", Quantity: 50})
+
+	// With the default 0.7 rating and 0.3 sales weights the scores are
+	// b 0.72, c 0.71, a 0.70 and d 0.14
+	var page ProductPage
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products?sort=best", "", nil), http.StatusOK, &page)
+	if got, want := pageIDs(page), []string{"b", "c", "a", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("best order = %v, want %v", got, want)
+	}
+
+	// Weighting rating only ranks by rating
+	config.SortRatingWeight, config.SortSalesWeight = 1, 0
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products?sort=best", "", nil), http.StatusOK, &page)
+	if got, want := pageIDs(page), []string{"a", "c", "b", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("rating-only best order = %v, want %v", got, want)
+	}
+}
+
+func TestVersionReportsBuildInfo(t *testing.T) {
+	r, _ := newTestServer(t)
+
+	var info map[string]string
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/version", "", nil), http.StatusOK, &info)
+	want := map[string]string{"version": "dev", "git_commit": "dev", "build_time": "dev", "go_version": runtime.Version()}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("version info = %v, want %v", info, want)
+	}
+}
+
+// saveTestCatalog stores n products p00, p01, ... whose names sort in ID order
+func saveTestCatalog(t *testing.T, app *API, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		saveTestProduct(t, app, fmt.Sprintf("p%02d", i), 10, 5)
+	}
+}
+
+func TestGetProductsPaginates(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestCatalog(t, app, 25)
+
+	var page ProductPage
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products", "", nil), http.StatusOK, &page)
+	if page.Total != 25 || page.Limit != 20 || page.Offset != 0 || len(page.Data) != 20 || page.Data[0].ID != "p00" {
+		t.Errorf("first page = %v of %d, limit %d offset %d", pageIDs(page), page.Total, page.Limit, page.Offset)
+	}
+
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products?limit=5&offset=10", "", nil), http.StatusOK, &page)
+	if got, want := pageIDs(page), []string{"p10", "p11", "p12", "p13", "p14"}; !reflect.DeepEqual(got, want) || page.Total != 25 {
+		t.Errorf("middle page = %v of %d, want %v of 25", got, page.Total, want)
+	}
+
+	w := doRequest(t, r, http.MethodGet, "/api/v1/products?offset=100", "", nil)
+	decodeResponse(t, w, http.StatusOK, &page)
+	if len(page.Data) != 0 || page.Total != 25 || !strings.Contains(w.Body.String(), `"data":[]`) {
+		t.Errorf("page past the end = %s, want an empty data array and total 25", w.Body.String())
+	}
+}
+
+func TestGetProductsRejectsBadPageParams(t *testing.T) {
+	r, _ := newTestServer(t)
+	for _, query := range []string{"limit=-1", "limit=ten", "offset=-5", "offset=1.5"} {
+		if w := doRequest(t, r, http.MethodGet, "/api/v1/products?"+query, "", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("GET /products?%s = %d, want 400", query, w.Code)
+		}
+	}
+}
+
+// saveFilterCatalog stores products of two categories across a price range
+func saveFilterCatalog(t *testing.T, app *API) {
+	t.Helper()
+	for _, product := range []Product{
+		{ID: "p1", Name: "Kettle", Category: "Kitchen", Price: 25},
+		{ID: "p2", Name: "Toaster", Category: "kitchen", Price: 60},
+		{ID: "p3", Name: "Headphones", Category: "Electronics", Price: 60},
+		{ID: "p4", Name: "Laptop", Category: "Electronics", Price: 999},
+	} {
+		if err := app.store.SaveProduct(product); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGetProductsFilters(t *testing.T) {
+	r, app := newTestServer(t)
+	saveFilterCatalog(t, app)
+
+	for query, want := range map[string][]string{
+		"category=KITCHEN":                           {"p1", "p2"},
+		"min_price=25&max_price=60":                  {"p3", "p1", "p2"},
+		"min_price=61":                               {"p4"},
+		"category=electronics&max_price=60":          {"p3"},
+		"category=kitchen&min_price=30":              {"p2"},
+		"category=garden":                            {},
+		"category=Kitchen&min_price=60&max_price=60": {"p2"},
+	} {
+		var page ProductPage
+		decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products?"+query, "", nil), http.StatusOK, &page)
+		if got := pageIDs(page); !reflect.DeepEqual(got, want) || page.Total != len(want) {
+			t.Errorf("GET /products?%s = %v of %d, want %v", query, got, page.Total, want)
+		}
+	}
+}
+
+func TestGetProductsRejectsBadPriceRange(t *testing.T) {
+	r, _ := newTestServer(t)
+	for _, query := range []string{"min_price=100&max_price=10", "min_price=cheap", "max_price=1e"} {
+		if w := doRequest(t, r, http.MethodGet, "/api/v1/products?"+query, "", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("GET /products?%s = %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestGetProductsSorts(t *testing.T) {
+	r, app := newTestServer(t)
+	for _, product := range []Product{
+		{ID: "p1", Name: "kettle", Price: 25, Rating: 4.5},
+		{ID: "p2", Name: "Toaster", Price: 60, Rating: 3.9},
+		{ID: "p3", Name: "Headphones", Price: 60, Rating: 4.8},
+		{ID: "p4", Name: "Laptop", Price: 999, Rating: 4.1},
+	} {
+		if err := app.store.SaveProduct(product); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Equal prices fall back to ID order
+	for query, want := range map[string][]string{
+		"":                                {"p3", "p1", "p4", "p2"},
+		"sort=name_asc":                   {"p3", "p1", "p4", "p2"},
+		"sort=name_desc":                  {"p2", "p4", "p1", "p3"},
+		"sort=price_asc":                  {"p1", "p2", "p3", "p4"},
+		"sort=price_desc":                 {"p4", "p2", "p3", "p1"},
+		"sort=rating_desc":                {"p3", "p1", "p4", "p2"},
+		"sort=price_asc&limit=2&offset=1": {"p2", "p3"},
+	} {
+		var page ProductPage
+		decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products?"+query, "", nil), http.StatusOK, &page)
+		if got := pageIDs(page); !reflect.DeepEqual(got, want) {
+			t.Errorf("GET /products?%s = %v, want %v", query, got, want)
+		}
+	}
+}
+
+func TestGetProductsRejectsUnknownSort(t *testing.T) {
+	r, _ := newTestServer(t)
+	var resp ErrorResponse
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products?sort=cheapest", "", nil), http.StatusBadRequest, &resp)
+	if resp.Error.Code != errCodeInvalidRequest {
+		t.Errorf("code = %s, want %s", resp.Error.Code, errCodeInvalidRequest)
+	}
+}
+
+func TestRelatedSearchesFromCoSearches(t *testing.T) {
+	r, app := newTestServer(t)
+	for userID, queries := range map[string][]string{
+		"u1": {"iphone", "airpods", "iphone case"},
+		"u2": {"IPhone", "airpods"},
+		"u3": {"iphone", "charger"},
+		"u4": {"airpods", "laptop"},
+	} {
+		for _, query := range queries {
+			search := SearchHistory{ID: uuid.New().String(), UserID: userID, Query: query, Timestamp: time.Now()}
+			if err := app.store.AddSearch(search); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// laptop was only searched by someone who never searched for iphone
+	var related []RelatedSearch
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/search/related?q=iPhone", "", nil), http.StatusOK, &related)
+	want := []RelatedSearch{{Query: "airpods", Users: 2}, {Query: "charger", Users: 1}, {Query: "iphone case", Users: 1}}
+	if !reflect.DeepEqual(related, want) {
+		t.Errorf("related searches = %+v, want %+v", related, want)
+	}
+
+	if w := doRequest(t, r, http.MethodGet, "/api/v1/search/related", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("related searches without a query = %d, want 400", w.Code)
+	}
+}
+
+func TestCheckoutRecordsStockMovement(t *testing.T) {
+	r, app := newTestServer(t)
+	current := time.Now()
+	now = func() time.Time { return current }
+	t.Cleanup(func() { now = time.Now })
+
+	saveTestProduct(t, app, "p1", 10, 5)
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/products/p1/restock", testToken(t, "admin", roleAdmin), RestockRequest{Quantity: 3}), http.StatusOK, nil)
+
+	current = current.Add(time.Minute)
+	token := testToken(t, "user123", "")
+	addToTestCart(t, r, token, "p1", 2)
+	var order Order
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/checkout", token, nil), http.StatusOK, &order)
+
+	var movements []StockMovement
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products/p1/stock-history", "", nil), http.StatusOK, &movements)
+	if len(movements) != 2 {
+		t.Fatalf("stock history = %+v, want the checkout and the restock", movements)
+	}
+	checkout := movements[0]
+	if checkout.Delta != -2 || checkout.Reason != stockReasonCheckout || checkout.OrderID != order.ID || checkout.ProductID != "p1" {
+		t.Errorf("newest movement = %+v, want -2 for checkout of order %s", checkout, order.ID)
+	}
+	if movements[1].Reason != stockReasonRestock || movements[1].OrderID != "" {
+		t.Errorf("oldest movement = %+v, want the restock without an order", movements[1])
+	}
+}
+
+func TestCartRejectsNonPositiveQuantity(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	token := testToken(t, "user123", "")
+
+	for _, quantity := range []int{0, -3} {
+		var resp ErrorResponse
+		w := doRequest(t, r, http.MethodPost, "/api/v1/cart/add", token, CartItem{ProductID: "p1", Quantity: quantity})
+		decodeResponse(t, w, http.StatusBadRequest, &resp)
+		if resp.Error.Message != "quantity must be positive" {
+			t.Errorf("adding %d: message = %q", quantity, resp.Error.Message)
+		}
+	}
+	if _, err := app.store.GetCart("user123"); err == nil {
+		t.Error("rejected adds created a cart")
+	}
+
+	var cart CartView
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/cart/add", token, CartItem{ProductID: "p1", Quantity: 2}), http.StatusOK, &cart)
+	if cart.Total != 20 || cart.ItemCount != 2 {
+		t.Errorf("cart after a valid add = total %v, %d items; want 20 and 2", cart.Total, cart.ItemCount)
+	}
+
+	w := doRequest(t, r, http.MethodDelete, "/api/v1/cart/remove", token, CartItem{ProductID: "p1", Quantity: -1})
+	decodeResponse(t, w, http.StatusBadRequest, nil)
+	if stored, _ := app.store.GetCart("user123"); len(stored.Items) != 1 || stored.Items[0].Quantity != 2 {
+		t.Errorf("cart after a negative removal = %+v, want 2 of p1", stored.Items)
+	}
+}
+
+func TestFlashSaleWindow(t *testing.T) {
+	r, app := newTestServer(t)
+	saleStart := time.Date(2023, 12, 1, 9, 0, 0, 0, time.UTC)
+	saleEnd := saleStart.Add(2 * time.Hour)
+	product := saveTestProduct(t, app, "p1", 100, 5)
+	product.SalePrice = 80
+	product.SaleStart, product.SaleEnd = &saleStart, &saleEnd
+	if err := app.store.SaveProduct(product); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { now = time.Now })
+
+	for name, tc := range map[string]struct {
+		at     time.Time
+		onSale bool
+		price  float64
+	}{
+		"before": {saleStart.Add(-time.Minute), false, 100},
+		"during": {saleStart.Add(time.Hour), true, 80},
+		"at end": {saleEnd, false, 100},
+		"after":  {saleEnd.Add(time.Hour), false, 100},
+	} {
+		t.Run(name, func(t *testing.T) {
+			now = func() time.Time { return tc.at }
+
+			var view ProductView
+			decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products/p1", "", nil), http.StatusOK, &view)
+			if view.OnSale != tc.onSale || view.Price != tc.price {
+				t.Errorf("product = on sale %v at %v, want %v at %v", view.OnSale, view.Price, tc.onSale, tc.price)
+			}
+			if tc.onSale && view.OriginalPrice != 100 {
+				t.Errorf("original price = %v, want 100", view.OriginalPrice)
+			}
+
+			token := testToken(t, "shopper-"+name, "")
+			var cart CartView
+			decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/cart/add", token, CartItem{ProductID: "p1", Quantity: 1}), http.StatusOK, &cart)
+			if cart.Total != tc.price || cart.Items[0].UnitPrice != tc.price {
+				t.Errorf("cart = total %v, unit price %v; want %v", cart.Total, cart.Items[0].UnitPrice, tc.price)
+			}
+			var order Order
+			decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/checkout", token, nil), http.StatusOK, &order)
+			if order.Items[0].UnitPrice != tc.price {
+				t.Errorf("order unit price = %v, want %v", order.Items[0].UnitPrice, tc.price)
+			}
+		})
+	}
+}
+
+func TestAddToCartEnforcesStockOnTotal(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 50)
+	token := testToken(t, "user123", "")
+	addToTestCart(t, r, token, "p1", 30)
+
+	var resp ErrorResponse
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/cart/add", token, CartItem{ProductID: "p1", Quantity: 30}), http.StatusBadRequest, &resp)
+	if resp.Error.Code != errCodeInsufficientStock {
+		t.Errorf("code = %s, want %s", resp.Error.Code, errCodeInsufficientStock)
+	}
+	if cart, _ := app.store.GetCart("user123"); len(cart.Items) != 1 || cart.Items[0].Quantity != 30 {
+		t.Errorf("cart after the rejected add = %+v, want 30 of p1", cart.Items)
+	}
+
+	// Topping up to exactly the stock is fine
+	addToTestCart(t, r, token, "p1", 20)
+}
+
+func TestRemoveFromCart(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	saveTestProduct(t, app, "p2", 20, 5)
+	token := testToken(t, "user123", "")
+	addToTestCart(t, r, token, "p1", 2)
+
+	var resp ErrorResponse
+	decodeResponse(t, doRequest(t, r, http.MethodDelete, "/api/v1/cart/remove", token, CartItem{ProductID: "p2", Quantity: 1}), http.StatusNotFound, &resp)
+	if resp.Error.Code != errCodeItemNotInCart {
+		t.Errorf("code = %s, want %s", resp.Error.Code, errCodeItemNotInCart)
+	}
+
+	var cart CartView
+	decodeResponse(t, doRequest(t, r, http.MethodDelete, "/api/v1/cart/remove", token, CartItem{ProductID: "p1", Quantity: 1}), http.StatusOK, &cart)
+	if cart.Total != 10 || len(cart.Items) != 1 || cart.Items[0].Quantity != 1 {
+		t.Errorf("cart after removing one = %+v", cart)
+	}
+	decodeResponse(t, doRequest(t, r, http.MethodDelete, "/api/v1/cart/remove", token, CartItem{ProductID: "p1", Quantity: 5}), http.StatusOK, &cart)
+	if cart.Total != 0 || len(cart.Items) != 0 {
+		t.Errorf("cart after removing the rest = %+v, want it empty", cart)
+	}
+}
+
+func TestClearCart(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	saveTestProduct(t, app, "p2", 20, 5)
+	token := testToken(t, "user123", "")
+	addToTestCart(t, r, token, "p1", 2)
+	addToTestCart(t, r, token, "p2", 1)
+
+	var cart Cart
+	w := doRequest(t, r, http.MethodDelete, "/api/v1/cart/user123/clear", token, nil)
+	decodeResponse(t, w, http.StatusOK, &cart)
+	if len(cart.Items) != 0 || cart.Total != 0 || !strings.Contains(w.Body.String(), `"items":[]`) {
+		t.Errorf("cleared cart = %s, want no items and a zero total", w.Body.String())
+	}
+	if stored, _ := app.store.GetCart("user123"); len(stored.Items) != 0 {
+		t.Errorf("stored cart still holds %+v", stored.Items)
+	}
+}
+
+func TestClearCartMissing(t *testing.T) {
+	r, _ := newTestServer(t)
+	var resp ErrorResponse
+	decodeResponse(t, doRequest(t, r, http.MethodDelete, "/api/v1/cart/user123/clear", testToken(t, "user123", ""), nil), http.StatusNotFound, &resp)
+	if resp.Error.Code != errCodeCartNotFound {
+		t.Errorf("code = %s, want %s", resp.Error.Code, errCodeCartNotFound)
+	}
+}
+
+func TestCheckoutShippingMethods(t *testing.T) {
+	r, app := newTestServer(t)
+	created := time.Date(2023, 12, 1, 10, 0, 0, 0, time.UTC)
+	now = func() time.Time { return created }
+	t.Cleanup(func() { now = time.Now })
+	saveTestProduct(t, app, "p1", 50, 10)
+
+	// 50 of goods carry 4 of tax
+	for method, want := range map[string]struct {
+		cost float64
+		days int
+	}{
+		"":          {9.99, 5},
+		"standard":  {9.99, 5},
+		"Express":   {19.99, 2},
+		"overnight": {39.99, 1},
+	} {
+		token := testToken(t, "shopper-"+method, "")
+		addToTestCart(t, r, token, "p1", 1)
+
+		var order Order
+		decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/checkout", token, CheckoutRequest{ShippingMethod: method}), http.StatusOK, &order)
+		if order.ShippingCost != want.cost || order.Total != roundCents(54+want.cost) {
+			t.Errorf("%q: shipping %v, total %v; want %v and %v", method, order.ShippingCost, order.Total, want.cost, roundCents(54+want.cost))
+		}
+		if eta := created.AddDate(0, 0, want.days); !order.EstimatedDelivery.Equal(eta) {
+			t.Errorf("%q: estimated delivery %v, want %v", method, order.EstimatedDelivery, eta)
+		}
+	}
+}
+
+func TestCheckoutRejectsUnknownShippingMethod(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 50, 10)
+	token := testToken(t, "user123", "")
+	addToTestCart(t, r, token, "p1", 1)
+
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/checkout", token, CheckoutRequest{ShippingMethod: "drone"}), http.StatusBadRequest, nil)
+	if stock := productStock(t, app, "p1"); stock != 10 {
+		t.Errorf("stock after the rejected checkout = %d, want 10", stock)
+	}
+}
+
+func TestGetCartLineSubtotals(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 12.5, 10)
+	saveTestProduct(t, app, "p2", 3, 10)
+	token := testToken(t, "user123", "")
+	addToTestCart(t, r, token, "p1", 2)
+	addToTestCart(t, r, token, "p2", 3)
+
+	var cart CartView
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/cart/user123", token, nil), http.StatusOK, &cart)
+	if cart.ItemCount != 5 {
+		t.Errorf("item_count = %d, want 5", cart.ItemCount)
+	}
+	if len(cart.Items) != 2 {
+		t.Fatalf("cart lines = %+v, want 2", cart.Items)
+	}
+	for i, want := range []struct{ unitPrice, subtotal float64 }{{12.5, 25}, {3, 9}} {
+		if line := cart.Items[i]; line.UnitPrice != want.unitPrice || line.Subtotal != want.subtotal {
+			t.Errorf("line %s = unit price %v, subtotal %v; want %v and %v", line.ProductID, line.UnitPrice, line.Subtotal, want.unitPrice, want.subtotal)
+		}
+	}
+	if cart.Total != 34 {
+		t.Errorf("total = %v, want 34", cart.Total)
+	}
+
+	// The stored lines stay lean
+	if stored, _ := app.store.GetCart("user123"); !reflect.DeepEqual(stored.Items, []CartItem{{ProductID: "p1", Quantity: 2}, {ProductID: "p2", Quantity: 3}}) {
+		t.Errorf("stored lines = %+v", stored.Items)
+	}
+}
+
+func TestPlaceholderImage(t *testing.T) {
+	r, app := newTestServer(t)
+	config.PlaceholderImageURL = "https://cdn.example.com/placeholder.png"
+	saveTestProduct(t, app, "p1", 10, 5)
+	withImage := saveTestProduct(t, app, "p2", 10, 5)
+	withImage.ImageURL = "https://cdn.example.com/p2.jpg"
+	if err := app.store.SaveProduct(withImage); err != nil {
+		t.Fatal(err)
+	}
+
+	var view ProductView
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products/p1", "", nil), http.StatusOK, &view)
+	if view.ImageURL != config.PlaceholderImageURL || !view.ImagePlaceholder {
+		t.Errorf("product without an image = %q, placeholder %v", view.ImageURL, view.ImagePlaceholder)
+	}
+	if stored, _ := app.store.GetProduct("p1"); stored.ImageURL != "" {
+		t.Errorf("stored image URL = %q, want it left empty", stored.ImageURL)
+	}
+
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products/p2", "", nil), http.StatusOK, &view)
+	if view.ImageURL != withImage.ImageURL || view.ImagePlaceholder {
+		t.Errorf("product with an image = %q, placeholder %v", view.ImageURL, view.ImagePlaceholder)
+	}
+
+	// An empty placeholder turns the substitution off
+	config.PlaceholderImageURL = ""
+	view = ProductView{}
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products/p1", "", nil), http.StatusOK, &view)
+	if view.ImageURL != "" || view.ImagePlaceholder {
+		t.Errorf("without a placeholder configured = %q, placeholder %v", view.ImageURL, view.ImagePlaceholder)
+	}
+}
+
+func TestServeUntilDrainsOnSignal(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	served := make(chan error, 1)
+	go func() { served <- serveUntil(ctx, srv, listener) }()
+
+	// A request is in flight when the signal arrives
+	responded := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			responded <- 0
+			return
+		}
+		resp.Body.Close()
+		responded <- resp.StatusCode
+	}()
+	<-started
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Signal(os.Interrupt); err != nil {
+		t.Skipf("cannot signal the test process: %v", err)
+	}
+	<-ctx.Done()
+
+	select {
+	case err := <-served:
+		t.Fatalf("serveUntil returned %v before the in-flight request finished", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("serveUntil = %v, want a clean shutdown", err)
+		}
+	case <-time.After(shutdownTimeout):
+		t.Fatal("shutdown did not finish within the timeout")
+	}
+	if code := <-responded; code != http.StatusOK {
+		t.Errorf("in-flight request = %d, want 200", code)
+	}
+}
+
+func TestOrderCompletedOnlyOnceDelivered(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	token := testToken(t, "user123", "")
+	addToTestCart(t, r, token, "p1", 1)
+
+	w := doRequest(t, r, http.MethodPost, "/api/v1/checkout", token, nil)
+	var order Order
+	decodeResponse(t, w, http.StatusOK, &order)
+	if strings.Contains(w.Body.String(), `"completed"`) {
+		t.Errorf("new order JSON %s has a completed field", w.Body.String())
+	}
+
+	delivered := time.Date(2023, 12, 4, 10, 0, 0, 0, time.UTC)
+	now = func() time.Time { return delivered }
+	t.Cleanup(func() { now = time.Now })
+	admin := testToken(t, "admin", roleAdmin)
+	for _, status := range []string{orderStatusPaid, orderStatusShipped} {
+		w = doRequest(t, r, http.MethodPost, "/api/v1/orders/"+order.ID+"/status", admin, OrderStatusRequest{Status: status})
+		decodeResponse(t, w, http.StatusOK, nil)
+		if strings.Contains(w.Body.String(), `"completed"`) {
+			t.Errorf("%s order JSON %s has a completed field", status, w.Body.String())
+		}
+	}
+
+	var updated Order
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/orders/"+order.ID+"/status", admin, OrderStatusRequest{Status: orderStatusDelivered}), http.StatusOK, &updated)
+	if updated.Completed == nil || !updated.Completed.Equal(delivered) {
+		t.Errorf("delivered order completed = %v, want %v", updated.Completed, delivered)
+	}
+}
+
+func TestOrderHistoryNewestFirst(t *testing.T) {
+	r, app := newTestServer(t)
+	created := time.Date(2023, 12, 1, 10, 0, 0, 0, time.UTC)
+	saveTestSale(t, app, created.Add(time.Hour), orderStatusPending, 10)
+	saveTestSale(t, app, created, orderStatusPending, 20)
+	saveTestSale(t, app, created.Add(2*time.Hour), orderStatusPending, 30)
+	// Orders placed at the same time come in ID order
+	for _, order := range []Order{
+		{ID: "tie-b", UserID: "user123", Status: orderStatusPending, Created: created.Add(-time.Hour), Total: 50},
+		{ID: "tie-a", UserID: "user123", Status: orderStatusPending, Created: created.Add(-time.Hour), Total: 40},
+		{ID: "elsewhere", UserID: "someone-else", Status: orderStatusPending, Created: created, Total: 60},
+	} {
+		if err := app.store.SaveOrder(order); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var orders []Order
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/orders/user123", testToken(t, "user123", ""), nil), http.StatusOK, &orders)
+	var totals []float64
+	for _, order := range orders {
+		totals = append(totals, order.Total)
+	}
+	if want := []float64{30, 10, 20, 40, 50}; !reflect.DeepEqual(totals, want) {
+		t.Errorf("order totals newest first = %v, want %v", totals, want)
+	}
+}
+
+func TestEmptyCollectionsAreArrays(t *testing.T) {
+	r, _ := newTestServer(t)
+	token := testToken(t, "user123", "")
+
+	// Listings with an envelope carry the empty array in data
+	for _, path := range []string{"/api/v1/products", "/api/v1/products?category=none", "/api/v1/search?q=nothing"} {
+		w := doRequest(t, r, http.MethodGet, path, token, nil)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"data":[]`) {
+			t.Errorf("GET %s = %d %s, want an empty data array", path, w.Code, w.Body.String())
+		}
+	}
+	for _, path := range []string{"/api/v1/products/top", "/api/v1/orders/user123", "/api/v1/recommendations/user123", "/api/v1/search/related?q=nothing"} {
+		w := doRequest(t, r, http.MethodGet, path, token, nil)
+		if body := strings.TrimSpace(w.Body.String()); w.Code != http.StatusOK || body != "[]" {
+			t.Errorf("GET %s = %d %s, want []", path, w.Code, body)
+		}
+	}
+}
+
+func TestCheckoutDiscountCodes(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 200, 10)
+	for _, code := range []DiscountCode{
+		{Code: "TENPERCENT", PercentOff: 10, MaxUses: 5},
+		{Code: "TWENTYFIVE", AmountOff: 25},
+		{Code: "EXPIRED", PercentOff: 50, ExpiresAt: time.Now().Add(-time.Hour)},
+		{Code: "USEDUP", PercentOff: 50, MaxUses: 2, Uses: 2},
+	} {
+		if err := app.store.SaveDiscountCode(code); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 200 of goods ship for free; tax is 8% of the discounted amount
+	for code, want := range map[string]struct{ discount, total float64 }{
+		"tenpercent": {20, 194.4},
+		"TWENTYFIVE": {25, 189},
+	} {
+		token := testToken(t, "shopper-"+code, "")
+		addToTestCart(t, r, token, "p1", 1)
+		var order Order
+		decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/checkout?discount_code="+code, token, nil), http.StatusOK, &order)
+		if order.DiscountCode != strings.ToUpper(code) || order.Discount != want.discount || order.Total != want.total {
+			t.Errorf("%s: order code %q, discount %v, total %v; want %v and %v", code, order.DiscountCode, order.Discount, order.Total, want.discount, want.total)
+		}
+	}
+	if stored, _ := app.store.GetDiscountCode("TENPERCENT"); stored.Uses != 1 {
+		t.Errorf("TENPERCENT uses = %d, want 1", stored.Uses)
+	}
+
+	for _, code := range []string{"EXPIRED", "USEDUP", "UNKNOWN"} {
+		token := testToken(t, "shopper-"+code, "")
+		addToTestCart(t, r, token, "p1", 1)
+		var resp ErrorResponse
+		decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/checkout?discount_code="+code, token, nil), http.StatusBadRequest, &resp)
+		if resp.Error.Code != errCodeInvalidDiscountCode {
+			t.Errorf("%s: code = %s, want %s", code, resp.Error.Code, errCodeInvalidDiscountCode)
+		}
+	}
+	if stored, _ := app.store.GetDiscountCode("USEDUP"); stored.Uses != 2 {
+		t.Errorf("USEDUP uses = %d, want 2", stored.Uses)
+	}
+	if stock := productStock(t, app, "p1"); stock != 8 {
+		t.Errorf("stock = %d, want 8 after two orders", stock)
+	}
+}
+
+// shippingOption finds a shipping option of a quote by name
+func shippingOption(quote ShippingQuote, name string) (ShippingMethod, bool) {
+	for _, option := range quote.Options {
+		if option.Name == name {
+			return option, true
+		}
+	}
+	return ShippingMethod{}, false
+}
+
+func TestQuoteShippingByWeight(t *testing.T) {
+	r, app := newTestServer(t)
+	for id, weight := range map[string]float64{"p1": 1.5, "p2": 0.5} {
+		product := saveTestProduct(t, app, id, 10, 5)
+		product.Weight = weight
+		if err := app.store.SaveProduct(product); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token := testToken(t, "user123", "")
+	addToTestCart(t, r, token, "p1", 2)
+	addToTestCart(t, r, token, "p2", 1)
+
+	// The cart weighs 3.5kg
+	var quote ShippingQuote
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/cart/user123/shipping", token, ShippingQuoteRequest{Country: "us", PostalCode: "94105"}), http.StatusOK, &quote)
+	if !quote.Domestic || quote.Weight != 3.5 {
+		t.Errorf("domestic quote = %+v, want domestic at 3.5kg", quote)
+	}
+	if option, ok := shippingOption(quote, "standard"); !ok || option.Cost != 8.49 || option.Days != 5 {
+		t.Errorf("domestic standard = %+v, want 8.49 in 5 days", option)
+	}
+
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/cart/user123/shipping", token, ShippingQuoteRequest{Country: "DE"}), http.StatusOK, &quote)
+	if quote.Domestic {
+		t.Errorf("quote to DE = %+v, want international", quote)
+	}
+	if option, ok := shippingOption(quote, "express"); !ok || option.Cost != 71.49 || option.Days != 4 {
+		t.Errorf("international express = %+v, want 71.49 in 4 days", option)
+	}
+}
+
+func TestQuoteShippingWithoutItems(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	token := testToken(t, "user123", "")
+
+	if w := doRequest(t, r, http.MethodPost, "/api/v1/cart/user123/shipping", token, ShippingQuoteRequest{Country: "US"}); w.Code != http.StatusNotFound {
+		t.Errorf("quote without a cart = %d, want 404", w.Code)
+	}
+	addToTestCart(t, r, token, "p1", 1)
+	decodeResponse(t, doRequest(t, r, http.MethodDelete, "/api/v1/cart/user123/clear", token, nil), http.StatusOK, nil)
+	if w := doRequest(t, r, http.MethodPost, "/api/v1/cart/user123/shipping", token, ShippingQuoteRequest{Country: "US"}); w.Code != http.StatusNotFound {
+		t.Errorf("quote for an empty cart = %d, want 404", w.Code)
+	}
+}
+
+// moneyFields matches the monetary fields of a serialized cart or order
+var moneyFields = regexp.MustCompile(`"(total|subtotal|unit_price|tax|shipping_cost|discount)":(-?[0-9.e+-]+)`)
+
+// assertCents fails the test if any monetary field of body has more than
+// two decimals
+func assertCents(t *testing.T, what, body string) {
+	t.Helper()
+	for _, match := range moneyFields.FindAllStringSubmatch(body, -1) {
+		if whole, decimals, found := strings.Cut(match[2], "."); strings.ContainsAny(whole, "e") || (found && len(decimals) > 2) {
+			t.Errorf("%s %s = %s, want at most 2 decimals", what, match[1], match[2])
+		}
+	}
+}
+
+func TestMoneyIsRoundedToCents(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 999.99, 10)
+	saveTestProduct(t, app, "p2", 0.1, 10)
+	token := testToken(t, "user123", "")
+
+	addToTestCart(t, r, token, "p1", 2)
+	w := doRequest(t, r, http.MethodPost, "/api/v1/cart/add", token, CartItem{ProductID: "p1", Quantity: 1})
+	assertCents(t, "cart after adding", w.Body.String())
+	if !strings.Contains(w.Body.String(), `"total":2999.97`) {
+		t.Errorf("cart = %s, want a total of 2999.97", w.Body.String())
+	}
+	addToTestCart(t, r, token, "p2", 3)
+	w = doRequest(t, r, http.MethodDelete, "/api/v1/cart/remove", token, CartItem{ProductID: "p1", Quantity: 1})
+	assertCents(t, "cart after removing", w.Body.String())
+	if !strings.Contains(w.Body.String(), `"total":2000.28`) {
+		t.Errorf("cart = %s, want a total of 2000.28", w.Body.String())
+	}
+
+	assertCents(t, "cart", doRequest(t, r, http.MethodGet, "/api/v1/cart/user123", token, nil).Body.String())
+	assertCents(t, "order", doRequest(t, r, http.MethodPost, "/api/v1/checkout", token, nil).Body.String())
+}
+
+func TestReviewsUpdateAggregateRating(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+
+	for user, rating := range map[string]int{"alice": 4, "bob": 5} {
+		w := doRequest(t, r, http.MethodPost, "/api/v1/products/p1/reviews", testToken(t, user, ""), ReviewRequest{Rating: rating, Comment: "Fine"})
+		decodeResponse(t, w, http.StatusCreated, nil)
+	}
+
+	if product, _ := app.store.GetProduct("p1"); product.Rating != 4.5 {
+		t.Errorf("product rating = %v, want 4.5", product.Rating)
+	}
+	var reviews []Review
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products/p1/reviews", "", nil), http.StatusOK, &reviews)
+	if len(reviews) != 2 {
+		t.Errorf("reviews = %+v, want 2", reviews)
+	}
+}
+
+func TestReviewValidation(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	token := testToken(t, "user123", "")
+
+	for name, req := range map[string]ReviewRequest{
+		"rating 0":     {Rating: 0},
+		"rating 6":     {Rating: 6},
+		"long comment": {Rating: 3, Comment: strings.Repeat("a", maxReviewCommentLength+1)},
+	} {
+		if w := doRequest(t, r, http.MethodPost, "/api/v1/products/p1/reviews", token, req); w.Code != http.StatusBadRequest {
+			t.Errorf("%s = %d, want 400", name, w.Code)
+		}
+	}
+	if w := doRequest(t, r, http.MethodPost, "/api/v1/products/missing/reviews", token, ReviewRequest{Rating: 3}); w.Code != http.StatusNotFound {
+		t.Errorf("reviewing an unknown product = %d, want 404", w.Code)
+	}
+	if product, _ := app.store.GetProduct("p1"); product.Rating != 0 {
+		t.Errorf("rating after rejected reviews = %v, want 0", product.Rating)
+	}
+}
+
+func TestVerifiedPurchaseReviews(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	bought := saveTestOrder(t, app, "buyer", "p1")
+	bought.Status = orderStatusDelivered
+	if err := app.store.SaveOrder(bought); err != nil {
+		t.Fatal(err)
+	}
+	// An order that never arrived doesn't count as a purchase
+	saveTestOrder(t, app, "waiting", "p1")
+
+	config.VerifiedPurchaseOnly = true
+	var review Review
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/products/p1/reviews", testToken(t, "buyer", ""), ReviewRequest{Rating: 5}), http.StatusCreated, &review)
+	if !review.Verified {
+		t.Error("review by a buyer isn't marked verified")
+	}
+	for _, user := range []string{"stranger", "waiting"} {
+		var resp ErrorResponse
+		decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/products/p1/reviews", testToken(t, user, ""), ReviewRequest{Rating: 1}), http.StatusForbidden, &resp)
+		if resp.Error.Code != errCodeReviewNotAllowed {
+			t.Errorf("%s: code = %s, want %s", user, resp.Error.Code, errCodeReviewNotAllowed)
+		}
+	}
+
+	config.VerifiedPurchaseOnly = false
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/products/p1/reviews", testToken(t, "stranger", ""), ReviewRequest{Rating: 1}), http.StatusCreated, &review)
+	if review.Verified {
+		t.Error("review by a non-buyer is marked verified")
+	}
+}
+
+// saveSearchCatalog stores a small catalog for the search tests
+func saveSearchCatalog(t *testing.T, app *API) {
+	t.Helper()
+	for _, product := range []Product{
+		{ID: "p1", Name: "iPhone 15 Pro", Description: "A phone", Category: "Smartphones", Price: 999},
+		{ID: "p2", Name: "Phone Case", Description: "Protects an iPhone", Category: "Accessories", Price: 29},
+		{ID: "p3", Name: "MacBook Air", Description: "A thin laptop", Category: "Laptops", Price: 1199},
+		{ID: "p4", Name: "AirPods Pro", Description: "Wireless earbuds", Category: "Audio", Price: 249},
+	} {
+		if err := app.store.SaveProduct(product); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// searchIDs runs a search and returns the IDs of the results in order
+func searchIDs(t *testing.T, handler http.Handler, query string) []string {
+	t.Helper()
+	var page ProductPage
+	decodeResponse(t, doRequest(t, handler, http.MethodGet, "/api/v1/search?"+query, "", nil), http.StatusOK, &page)
+	return pageIDs(page)
+}
+
+func TestSearchToleratesTypos(t *testing.T) {
+	r, app := newTestServer(t)
+	saveSearchCatalog(t, app)
+
+	if ids := searchIDs(t, r, "q=ipone"); len(ids) == 0 || ids[0] != "p1" {
+		t.Errorf("search for ipone = %v, want iPhone 15 Pro first", ids)
+	}
+	if ids := searchIDs(t, r, "q=xylophone"); len(ids) != 0 {
+		t.Errorf("search for xylophone = %v, want nothing", ids)
+	}
+
+	// A real match outranks one that is only a typo away
+	if err := app.store.SaveProduct(Product{ID: "p5", Name: "Airpads Mat", Category: "Audio"}); err != nil {
+		t.Fatal(err)
+	}
+	if ids, want := searchIDs(t, r, "q=airpods"), []string{"p4", "p5"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("search for airpods = %v, want %v", ids, want)
+	}
+}
+
+func TestSearchRanksNameAboveDescription(t *testing.T) {
+	r, app := newTestServer(t)
+	saveSearchCatalog(t, app)
+
+	// p2 only mentions an iPhone in its description
+	if ids, want := searchIDs(t, r, "q=iphone"), []string{"p1", "p2"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("search for iphone = %v, want %v", ids, want)
+	}
+
+	var page SearchResultPage
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/search?q=iphone&debug=true", "", nil), http.StatusOK, &page)
+	if len(page.Data) != 2 || page.Data[0].Score <= page.Data[1].Score || page.Data[1].Score <= 0 {
+		t.Errorf("debug results = %+v, want descending positive scores", page.Data)
+	}
+
+	w := doRequest(t, r, http.MethodGet, "/api/v1/search?q=iphone", "", nil)
+	if strings.Contains(w.Body.String(), `"score"`) {
+		t.Errorf("results without debug = %s, want no scores", w.Body.String())
+	}
+}
+
+func TestSearchSuggestions(t *testing.T) {
+	r, app := newTestServer(t)
+	for _, product := range []Product{
+		{ID: "p1", Name: "Pro Stand", Rating: 3, Price: 10},
+		{ID: "p2", Name: "Pro Display", Rating: 4.5, Price: 10},
+		{ID: "p3", Name: "MacBook Pro", Rating: 5, Price: 10},
+		{ID: "p4", Name: "Projector", Rating: 2, Price: 10},
+		{ID: "p5", Name: "iPad", Rating: 5, Price: 10},
+	} {
+		if err := app.store.SaveProduct(product); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Names starting with the prefix come first, each group highest rated
+	// first
+	var suggestions []string
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/search/suggest?q=PRO", "", nil), http.StatusOK, &suggestions)
+	if want := []string{"Pro Display", "Pro Stand", "Projector", "MacBook Pro"}; !reflect.DeepEqual(suggestions, want) {
+		t.Errorf("suggestions for PRO = %v, want %v", suggestions, want)
+	}
+
+	w := doRequest(t, r, http.MethodGet, "/api/v1/search/suggest?q=", "", nil)
+	if body := strings.TrimSpace(w.Body.String()); w.Code != http.StatusOK || body != "[]" {
+		t.Errorf("suggestions for an empty query = %d %s, want []", w.Code, body)
+	}
+
+	// Renaming a product rebuilds the index
+	decodeResponse(t, doRequest(t, r, http.MethodPatch, "/api/v1/products/p5", testToken(t, "admin", roleAdmin), map[string]interface{}{"name": "Pro Pencil"}), http.StatusOK, nil)
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/search/suggest?q=pro+p", "", nil), http.StatusOK, &suggestions)
+	if want := []string{"Pro Pencil"}; !reflect.DeepEqual(suggestions, want) {
+		t.Errorf("suggestions after the rename = %v, want %v", suggestions, want)
+	}
+}
+
+func TestSearchPagesAndFilters(t *testing.T) {
+	r, app := newTestServer(t)
+	saveSearchCatalog(t, app)
+
+	// pro is in two names and p2's description
+	var page ProductPage
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/search?q=pro&limit=1&offset=1", "", nil), http.StatusOK, &page)
+	if page.Total != 3 || page.Limit != 1 || page.Offset != 1 || len(page.Data) != 1 {
+		t.Errorf("second page for pro = %v of %d, limit %d offset %d; want one of 3", pageIDs(page), page.Total, page.Limit, page.Offset)
+	}
+	first := searchIDs(t, r, "q=pro&limit=1")
+	if len(first) != 1 || first[0] == page.Data[0].ID {
+		t.Errorf("first page = %v, second page = %v; want different products", first, pageIDs(page))
+	}
+
+	if ids := searchIDs(t, r, "q=pro&category=audio"); !reflect.DeepEqual(ids, []string{"p4"}) {
+		t.Errorf("search for pro in audio = %v, want [p4]", ids)
+	}
+	if ids := searchIDs(t, r, "q=macbook&category=audio"); len(ids) != 0 {
+		t.Errorf("search for macbook in audio = %v, want nothing", ids)
+	}
+}
+
+// overlappingListStore holds each ListProducts call until the test
+// releases it, reporting every arrival, so a test can see two at once
+type overlappingListStore struct {
+	*InMemoryStore
+	arrived chan struct{}
+	release chan struct{}
+}
+
+func (s *overlappingListStore) ListProducts() ([]Product, error) {
+	if s.arrived != nil {
+		s.arrived <- struct{}{}
+		<-s.release
+	}
+	return s.InMemoryStore.ListProducts()
+}
+
+func TestSearchesRunConcurrently(t *testing.T) {
+	store := &overlappingListStore{InMemoryStore: newInMemoryStore()}
+	r, app := newTestServerWithStore(t, store)
+	saveTestProduct(t, app, "p1", 10, 5)
+	store.arrived = make(chan struct{}, 2)
+	store.release = make(chan struct{})
+
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			codes <- doRequest(t, r, http.MethodGet, "/api/v1/search?q=product", "", nil).Code
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-store.arrived:
+		case <-time.After(time.Second):
+			close(store.release)
+			t.Fatalf("only %d of 2 searches reached the store at once", i)
+		}
+	}
+	close(store.release)
+	for i := 0; i < 2; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("search status = %d, want %d", code, http.StatusOK)
+		}
+	}
+}
+
+func TestTrendingSearches(t *testing.T) {
+	r, app := newTestServer(t)
+	current := time.Now()
+	for i, search := range []struct {
+		query string
+		age   time.Duration
+	}{
+		{"iPhone", time.Hour},
+		{"  iphone ", 2 * time.Hour},
+		{"IPHONE", 3 * time.Hour},
+		{"airpods", time.Hour},
+		{"airpods", 5 * time.Hour},
+		// Outside the default 24h window
+		{"macbook", 25 * time.Hour},
+		{"macbook", 26 * time.Hour},
+		{"macbook", 27 * time.Hour},
+		{"macbook", 28 * time.Hour},
+	} {
+		record := SearchHistory{ID: fmt.Sprint(i), UserID: fmt.Sprintf("u%d", i), Query: search.query, Timestamp: current.Add(-search.age)}
+		if err := app.store.AddSearch(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var trending []TrendingSearch
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/search/trending", "", nil), http.StatusOK, &trending)
+	if want := []TrendingSearch{{Query: "iphone", Count: 3}, {Query: "airpods", Count: 2}}; !reflect.DeepEqual(trending, want) {
+		t.Errorf("trending = %+v, want %+v", trending, want)
+	}
+
+	config.TrendingWindow = 48 * time.Hour
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/search/trending?limit=1", "", nil), http.StatusOK, &trending)
+	if want := []TrendingSearch{{Query: "macbook", Count: 4}}; !reflect.DeepEqual(trending, want) {
+		t.Errorf("trending over 48h = %+v, want %+v", trending, want)
+	}
+}
+
+// recommendationIDs fetches a user's recommendations and returns their IDs
+func recommendationIDs(t *testing.T, handler http.Handler, userID string) []string {
+	t.Helper()
+	var products []ProductView
+	decodeResponse(t, doRequest(t, handler, http.MethodGet, "/api/v1/recommendations/"+userID, testToken(t, userID, ""), nil), http.StatusOK, &products)
+	ids := make([]string, 0, len(products))
+	for _, product := range products {
+		ids = append(ids, product.ID)
+	}
+	return ids
+}
+
+func TestOrderRecommendationsSkipPurchasedProducts(t *testing.T) {
+	r, app := newTestServer(t)
+	for _, product := range []Product{
+		{ID: "p1", Name: "Phone", Category: "Phones", Rating: 5},
+		{ID: "p2", Name: "Budget Phone", Category: "Phones", Rating: 4},
+		{ID: "p3", Name: "Flagship Phone", Category: "Phones", Rating: 4.8},
+		{ID: "p4", Name: "Laptop", Category: "Laptops", Rating: 5},
+	} {
+		if err := app.store.SaveProduct(product); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saveTestOrder(t, app, "user123", "p1")
+
+	if ids, want := recommendationIDs(t, r, "user123"), []string{"p3", "p2"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("recommendations = %v, want %v", ids, want)
+	}
+}
+
+func TestCoPurchaseRecommendations(t *testing.T) {
+	r, app := newTestServer(t)
+	for _, product := range []Product{
+		{ID: "p1", Name: "Phone", Category: "Phones", Rating: 4},
+		{ID: "p2", Name: "Phone Case", Category: "Accessories", Rating: 3},
+		{ID: "p3", Name: "Charger", Category: "Accessories", Rating: 5},
+		{ID: "p4", Name: "Other Phone", Category: "Phones", Rating: 5},
+	} {
+		if err := app.store.SaveProduct(product); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saveTestOrder(t, app, "alice", "p1")
+	saveTestOrder(t, app, "bob", "p1", "p2")
+	saveTestOrder(t, app, "carol", "p1", "p2", "p3")
+	saveTestOrder(t, app, "dave", "p4")
+
+	// p2 was bought with p1 twice and p3 once; p4, though in alice's
+	// category, was never bought with p1
+	if ids, want := recommendationIDs(t, r, "alice"), []string{"p2", "p3"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("recommendations = %v, want %v", ids, want)
+	}
+}
+
+func TestSearchRecommendationsAreDeduplicated(t *testing.T) {
+	r, app := newTestServer(t)
+	saveSearchCatalog(t, app)
+	for i, query := range []string{"iphone", "pro", "iPhone", "macbook"} {
+		search := SearchHistory{ID: fmt.Sprint(i), UserID: "user123", Query: query, Timestamp: time.Now()}
+		if err := app.store.AddSearch(search); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// iphone matches p1 and p2, pro matches p1, p2 and p4 again, and so on;
+	// each shows up once, where it was first found
+	if ids, want := recommendationIDs(t, r, "user123"), []string{"p1", "p2", "p4", "p3"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("recommendations = %v, want %v", ids, want)
+	}
+}
+
+func TestRelatedProducts(t *testing.T) {
+	r, app := newTestServer(t)
+	for _, product := range []Product{
+		{ID: "p1", Name: "Phone", Category: "Phones", Rating: 4},
+		{ID: "p2", Name: "Budget Phone", Category: "phones", Rating: 3.5},
+		{ID: "p3", Name: "Flagship Phone", Category: "Phones", Rating: 4.9},
+		{ID: "p4", Name: "Old Phone", Category: "Phones", Rating: 2},
+		{ID: "p5", Name: "Laptop", Category: "Laptops", Rating: 5},
+	} {
+		if err := app.store.SaveProduct(product); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var related []ProductView
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products/p1/related?limit=2", "", nil), http.StatusOK, &related)
+	var ids []string
+	for _, product := range related {
+		ids = append(ids, product.ID)
+	}
+	if want := []string{"p3", "p2"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("related to p1 = %v, want %v", ids, want)
+	}
+
+	var resp ErrorResponse
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products/missing/related", "", nil), http.StatusNotFound, &resp)
+	if resp.Error.Code != errCodeProductNotFound {
+		t.Errorf("code = %s, want %s", resp.Error.Code, errCodeProductNotFound)
+	}
+}
+
+// checkoutWithKey checks out the token's cart under an idempotency key
+func checkoutWithKey(t *testing.T, handler http.Handler, token, key string) Order {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/checkout", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set(idempotencyKeyHeader, key)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	var order Order
+	decodeResponse(t, w, http.StatusOK, &order)
+	return order
+}
+
+func TestCheckoutIdempotencyKey(t *testing.T) {
+	r, app := newTestServer(t)
+	current := time.Now()
+	now = func() time.Time { return current }
+	t.Cleanup(func() { now = time.Now })
+	saveTestProduct(t, app, "p1", 10, 10)
+	token := testToken(t, "user123", "")
+
+	addToTestCart(t, r, token, "p1", 1)
+	first := checkoutWithKey(t, r, token, "key-1")
+	if retry := checkoutWithKey(t, r, token, "key-1"); retry.ID != first.ID {
+		t.Errorf("retry with the same key created order %s, want %s", retry.ID, first.ID)
+	}
+
+	addToTestCart(t, r, token, "p1", 1)
+	second := checkoutWithKey(t, r, token, "key-2")
+	if second.ID == first.ID {
+		t.Error("a different key returned the first order")
+	}
+	if orders, _ := app.store.ListOrdersByUser("user123"); len(orders) != 2 {
+		t.Errorf("orders = %d, want 2", len(orders))
+	}
+
+	// Once the key expires it is just a new checkout
+	current = current.Add(config.IdempotencyKeyTTL + time.Minute)
+	addToTestCart(t, r, token, "p1", 1)
+	if third := checkoutWithKey(t, r, token, "key-1"); third.ID == first.ID {
+		t.Error("an expired key returned the original order")
+	}
+	if stock := productStock(t, app, "p1"); stock != 7 {
+		t.Errorf("stock = %d, want 7 after three orders", stock)
+	}
+}
+
+func TestBatchAddToCart(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	saveTestProduct(t, app, "p2", 20, 5)
+	token := testToken(t, "user123", "")
+
+	var cart CartView
+	items := []CartItem{{ProductID: "p1", Quantity: 2}, {ProductID: "p2", Quantity: 1}, {ProductID: "p1", Quantity: 1}}
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/cart/user123/batch", token, items), http.StatusOK, &cart)
+	if cart.Total != 50 || cart.ItemCount != 4 || len(cart.Items) != 2 {
+		t.Errorf("cart after the batch = %+v, want 3 of p1 and 1 of p2 for 50", cart)
+	}
+}
+
+func TestBatchAddToCartRollsBack(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	saveTestProduct(t, app, "p2", 20, 5)
+	token := testToken(t, "user123", "")
+	addToTestCart(t, r, token, "p1", 1)
+
+	for name, third := range map[string]CartItem{
+		"unknown product": {ProductID: "missing", Quantity: 1},
+		"short of stock":  {ProductID: "p2", Quantity: 5},
+	} {
+		items := []CartItem{{ProductID: "p1", Quantity: 2}, {ProductID: "p2", Quantity: 1}, third}
+		var resp ErrorResponse
+		decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/cart/user123/batch", token, items), http.StatusBadRequest, &resp)
+		if details, _ := resp.Error.Details.(map[string]interface{}); details["index"] != float64(2) {
+			t.Errorf("%s: details = %v, want index 2", name, resp.Error.Details)
+		}
+		if stored, _ := app.store.GetCart("user123"); !reflect.DeepEqual(stored.Items, []CartItem{{ProductID: "p1", Quantity: 1}}) || stored.Total != 10 {
+			t.Errorf("%s: cart after the failed batch = %+v, want it untouched", name, stored)
+		}
+	}
+}
+
+// unreachableStore is an in-memory store whose health check always fails, as
+// a database would when the connection drops
+type unreachableStore struct {
+	*InMemoryStore
+}
+
+func (unreachableStore) Ping() error {
+	return errors.New("connection refused")
+}
+
+func TestReadinessReportsStoreHealth(t *testing.T) {
+	r, app := newTestServer(t)
+	app.seeded.Store(true)
+
+	var health HealthResponse
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/health/ready", "", nil), http.StatusOK, &health)
+	if health.Status != "healthy" || health.Components["store"].Status != "healthy" || health.Components["data"].Status != "healthy" {
+		t.Errorf("healthy readiness = %+v", health)
+	}
+	if health.Service == "" || health.Version == "" || health.Timestamp == "" {
+		t.Errorf("readiness dropped the service fields: %+v", health)
+	}
+
+	r, app = newTestServerWithStore(t, unreachableStore{newInMemoryStore()})
+	app.seeded.Store(true)
+	health = HealthResponse{}
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/health/ready", "", nil), http.StatusServiceUnavailable, &health)
+	if health.Status != "unhealthy" {
+		t.Errorf("status with the store down = %q, want unhealthy", health.Status)
+	}
+	if store := health.Components["store"]; store.Status != "unhealthy" || store.Error != "connection refused" {
+		t.Errorf("store component = %+v, want it unhealthy with the ping error", store)
+	}
+	if health.Components["data"].Status != "healthy" {
+		t.Errorf("data component = %+v, want it unaffected", health.Components["data"])
+	}
+}
+
+func TestReadinessWaitsForSeeding(t *testing.T) {
+	r, app := newTestServer(t)
+
+	var health HealthResponse
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/health/ready", "", nil), http.StatusServiceUnavailable, &health)
+	if data := health.Components["data"]; data.Status != "unhealthy" || data.Error == "" {
+		t.Errorf("data component before seeding = %+v, want it unhealthy", data)
+	}
+	for _, path := range []string{"/health", "/health/live"} {
+		if w := doRequest(t, r, http.MethodGet, path, "", nil); w.Code != http.StatusOK {
+			t.Errorf("GET %s before seeding = %d, want 200", path, w.Code)
+		}
+	}
+
+	if err := app.seed(); err != nil {
+		t.Fatal(err)
+	}
+	health = HealthResponse{}
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/health/ready", "", nil), http.StatusOK, &health)
+	if health.Status != "healthy" {
+		t.Errorf("readiness after seeding = %+v, want healthy", health)
+	}
+}
+
+// lowStockIDs lists the IDs returned by the low-stock endpoint for query
+func lowStockIDs(t *testing.T, h http.Handler, query string) []string {
+	t.Helper()
+	var products []ProductView
+	decodeResponse(t, doRequest(t, h, http.MethodGet, "/api/v1/products/low-stock"+query, "", nil), http.StatusOK, &products)
+	ids := []string{}
+	for _, product := range products {
+		ids = append(ids, product.ID)
+	}
+	return ids
+}
+
+func TestLowStockProducts(t *testing.T) {
+	r, app := newTestServer(t)
+	for id, stock := range map[string]int{"a": 7, "b": 0, "c": 50, "d": 3, "e": 10, "f": 3} {
+		saveTestProduct(t, app, id, 10, stock)
+	}
+
+	if got, want := lowStockIDs(t, r, ""), []string{"b", "d", "f", "a", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("low stock at the default threshold = %v, want %v", got, want)
+	}
+	if got, want := lowStockIDs(t, r, "?threshold=3"), []string{"b", "d", "f"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("low stock at 3 = %v, want %v", got, want)
+	}
+	if got, want := lowStockIDs(t, r, "?threshold=0"), []string{"b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("low stock at 0 = %v, want %v", got, want)
+	}
+
+	for _, threshold := range []string{"-1", "ten", "2.5"} {
+		w := doRequest(t, r, http.MethodGet, "/api/v1/products/low-stock?threshold="+threshold, "", nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("threshold=%s = %d, want 400", threshold, w.Code)
+		}
+	}
+}
+
+func TestCartSweeperReapsOnlyStaleCarts(t *testing.T) {
+	_, app := newTestServer(t)
+	for userID, updated := range map[string]time.Time{
+		"stale": time.Now().Add(-time.Hour),
+		"fresh": time.Now(),
+	} {
+		if err := app.store.SaveCart(Cart{ID: "cart-" + userID, UserID: userID, Items: []CartItem{}, Updated: updated}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stop := app.startCartSweeper(time.Minute, 5*time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := app.store.GetCart("stale"); errors.Is(err, ErrNotFound) {
+			break
+		}
+		if time.Now().After(deadline) {
+			stop()
+			t.Fatal("the sweeper never reaped the stale cart")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// stop waits for the sweeper goroutine to exit
+	stop()
+
+	if _, err := app.store.GetCart("fresh"); err != nil {
+		t.Errorf("fresh cart after the sweep: %v", err)
+	}
+}
+
+func TestCartFlagsDeletedProduct(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	saveTestProduct(t, app, "p2", 25, 5)
+	token := testToken(t, "user123", "")
+	addToTestCart(t, r, token, "p1", 2)
+	addToTestCart(t, r, token, "p2", 1)
+
+	// Delete p2 in the store directly: deleteProduct would strip it from the
+	// cart, but a product can also vanish from a shared database
+	if err := app.store.DeleteProduct("p2", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	var cart CartView
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/cart/user123", token, nil), http.StatusOK, &cart)
+	if len(cart.Items) != 2 {
+		t.Fatalf("cart lines = %+v, want both kept", cart.Items)
+	}
+	for _, line := range cart.Items {
+		if deleted := line.ProductID == "p2"; line.Unavailable != deleted {
+			t.Errorf("line %s unavailable = %v, want %v", line.ProductID, line.Unavailable, deleted)
+		}
+		if line.ProductID == "p2" && line.Subtotal != 0 {
+			t.Errorf("deleted line subtotal = %v, want 0", line.Subtotal)
+		}
+	}
+	if cart.Total != 20 || cart.ItemCount != 2 {
+		t.Errorf("cart total = %v for %d items, want 20 for 2 without the deleted product", cart.Total, cart.ItemCount)
+	}
+}
+
+// getWithETag fetches path sending ifNoneMatch as If-None-Match, if set
+func getWithETag(h http.Handler, path, ifNoneMatch string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestProductConditionalGet(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+
+	first := getWithETag(r, "/api/v1/products/p1", "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("first fetch = %d with ETag %q, want 200 with an ETag", first.Code, etag)
+	}
+
+	for _, ifNoneMatch := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		w := getWithETag(r, "/api/v1/products/p1", ifNoneMatch)
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s = %d with %d bytes, want an empty 304", ifNoneMatch, w.Code, w.Body.Len())
+		}
+		if got := w.Header().Get("ETag"); got != etag {
+			t.Errorf("304 ETag = %q, want %q", got, etag)
+		}
+	}
+
+	w := doRequest(t, r, http.MethodPatch, "/api/v1/products/p1", testToken(t, "admin", roleAdmin), map[string]interface{}{"price": 12})
+	if w.Code != http.StatusOK {
+		t.Fatalf("updating the price = %d: %s", w.Code, w.Body)
+	}
+	updated := getWithETag(r, "/api/v1/products/p1", etag)
+	if updated.Code != http.StatusOK {
+		t.Errorf("stale If-None-Match after an update = %d, want 200", updated.Code)
+	}
+	if got := updated.Header().Get("ETag"); got == "" || got == etag {
+		t.Errorf("ETag after an update = %q, want a new one", got)
+	}
+}
+
+func TestCategoriesCountedAlphabetically(t *testing.T) {
+	r, app := newTestServer(t)
+	for id, category := range map[string]string{"p1": "Kitchen", "p2": "Electronics", "p3": "Kitchen", "p4": "Books", "p5": "Kitchen", "p6": ""} {
+		product := saveTestProduct(t, app, id, 10, 5)
+		product.Category = category
+		if err := app.store.SaveProduct(product); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var categories []CategoryCount
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/categories", "", nil), http.StatusOK, &categories)
+	want := []CategoryCount{{"Books", 1}, {"Electronics", 1}, {"Kitchen", 3}}
+	if !reflect.DeepEqual(categories, want) {
+		t.Errorf("categories = %+v, want %+v", categories, want)
+	}
+
+	// The listing follows the catalog as it changes
+	if err := app.store.DeleteProduct("p2", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	saveTestProduct(t, app, "p7", 10, 5)
+	categories = nil
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/categories", "", nil), http.StatusOK, &categories)
+	want = []CategoryCount{{"Books", 1}, {"Kitchen", 3}, {"Testing", 1}}
+	if !reflect.DeepEqual(categories, want) {
+		t.Errorf("categories after a change = %+v, want %+v", categories, want)
+	}
+}
+
+// Run with -race to also check the reservation path for data races
+func TestConcurrentCheckoutsOfTheLastUnit(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 1)
+	const buyers = 10
+	tokens := make([]string, buyers)
+	for i := range tokens {
+		tokens[i] = testToken(t, fmt.Sprintf("buyer%d", i), "")
+		addToTestCart(t, r, tokens[i], "p1", 1)
+	}
+
+	codes := make([]int, buyers)
+	var wg sync.WaitGroup
+	for i, token := range tokens {
+		wg.Add(1)
+		go func(i int, token string) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/checkout", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			codes[i] = w.Code
+		}(i, token)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for i, code := range codes {
+		switch code {
+		case http.StatusOK:
+			succeeded++
+		case http.StatusBadRequest:
+		default:
+			t.Errorf("buyer%d checkout = %d, want 200 or 400 for insufficient stock", i, code)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("%d checkouts succeeded, want exactly 1", succeeded)
+	}
+	if stock := productStock(t, app, "p1"); stock != 0 {
+		t.Errorf("stock after the race = %d, want 0", stock)
+	}
+	if orders, _ := app.store.ListOrders(); len(orders) != 1 {
+		t.Errorf("%d orders saved, want 1", len(orders))
+	}
+}
+
+func TestSeedingSkipped(t *testing.T) {
+	r, app := newTestServer(t)
+	config.SeedData = false
+	if err := app.seed(); err != nil {
+		t.Fatal(err)
+	}
+	if products, _ := app.store.ListProducts(); len(products) != 0 {
+		t.Errorf("seeding with SEED_DATA off stored %d products, want none", len(products))
+	}
+	if w := doRequest(t, r, http.MethodGet, "/health/ready", "", nil); w.Code != http.StatusOK {
+		t.Errorf("readiness with seeding off = %d, want 200", w.Code)
+	}
+
+	_, app = newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	if err := app.seed(); err != nil {
+		t.Fatal(err)
+	}
+	if products, _ := app.store.ListProducts(); len(products) != 1 || products[0].ID != "p1" {
+		t.Errorf("seeding a store with products left %+v, want only p1", products)
+	}
+
+	_, app = newTestServer(t)
+	if err := app.seed(); err != nil {
+		t.Fatal(err)
+	}
+	if products, _ := app.store.ListProducts(); len(products) == 0 {
+		t.Error("seeding an empty store stored no products")
+	}
+}
+
+func TestOrderIDFormatValidated(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	order := saveTestOrder(t, app, "user123", "p1")
+	token := testToken(t, "user123", "")
+
+	for _, path := range []string{
+		"/api/v1/orders/detail/not-a-uuid",
+		"/api/v1/orders/detail/" + order.ID + "x",
+		"/api/v1/orders/detail/12345",
+	} {
+		var resp ErrorResponse
+		decodeResponse(t, doRequest(t, r, http.MethodGet, path, token, nil), http.StatusBadRequest, &resp)
+		if resp.Error.Message != "Invalid ID format" {
+			t.Errorf("GET %s message = %q, want Invalid ID format", path, resp.Error.Message)
+		}
+	}
+	if w := doRequest(t, r, http.MethodPost, "/api/v1/orders/not-a-uuid/cancel", token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("cancelling a malformed order ID = %d, want 400", w.Code)
+	}
+
+	var resp ErrorResponse
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/orders/detail/"+uuid.New().String(), token, nil), http.StatusNotFound, &resp)
+	if resp.Error.Code != errCodeOrderNotFound {
+		t.Errorf("absent order code = %s, want %s", resp.Error.Code, errCodeOrderNotFound)
+	}
+
+	// IDs are normalized, so an uppercase UUID finds the order
+	if w := doRequest(t, r, http.MethodGet, "/api/v1/orders/detail/"+strings.ToUpper(order.ID), token, nil); w.Code != http.StatusOK {
+		t.Errorf("uppercase order ID = %d, want 200", w.Code)
+	}
+}
+
+func TestGetOrderDetail(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	order := saveTestOrder(t, app, "user123", "p1")
+	order.Total, order.Tax, order.ShippingCost, order.Discount = 17.49, 0.5, 9.99, 3
+	if err := app.store.SaveOrder(order); err != nil {
+		t.Fatal(err)
+	}
+
+	var detail OrderDetail
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/orders/detail/"+order.ID, testToken(t, "user123", ""), nil), http.StatusOK, &detail)
+	if detail.ID != order.ID || len(detail.Items) != 1 || detail.Items[0].ProductID != "p1" {
+		t.Errorf("order detail = %+v, want order %s with p1", detail, order.ID)
+	}
+	if detail.Subtotal != 10 || detail.Tax != 0.5 || detail.Total != 17.49 {
+		t.Errorf("subtotal, tax, total = %v, %v, %v; want 10, 0.5, 17.49", detail.Subtotal, detail.Tax, detail.Total)
+	}
+
+	var resp ErrorResponse
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/orders/detail/"+uuid.New().String(), testToken(t, "user123", ""), nil), http.StatusNotFound, &resp)
+	if resp.Error.Code != errCodeOrderNotFound {
+		t.Errorf("missing order code = %s, want %s", resp.Error.Code, errCodeOrderNotFound)
+	}
+
+	resp = ErrorResponse{}
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/orders/detail/"+order.ID, testToken(t, "user456", ""), nil), http.StatusForbidden, &resp)
+	if resp.Error.Code != errCodeForbidden {
+		t.Errorf("another user's order code = %s, want %s", resp.Error.Code, errCodeForbidden)
+	}
+	if w := doRequest(t, r, http.MethodGet, "/api/v1/orders/detail/"+order.ID, "", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("order detail without a token = %d, want 401", w.Code)
+	}
+}
+
+func TestSaveForLaterAndBack(t *testing.T) {
+	r, app := newTestServer(t)
+	config.CartReservationTTL = 15 * time.Minute
+	saveTestProduct(t, app, "p1", 10, 5)
+	saveTestProduct(t, app, "p2", 25, 5)
+	token := testToken(t, "user123", "")
+	addToTestCart(t, r, token, "p1", 2)
+	addToTestCart(t, r, token, "p2", 1)
+
+	var cart CartView
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/cart/user123/save/p2", token, nil), http.StatusOK, &cart)
+	if len(cart.Items) != 1 || cart.Items[0].ProductID != "p1" || cart.Total != 20 {
+		t.Errorf("cart after saving p2 = %+v with total %v, want only p1 at 20", cart.Items, cart.Total)
+	}
+	if len(cart.Saved) != 1 || cart.Saved[0] != (CartItem{ProductID: "p2", Quantity: 1}) {
+		t.Errorf("saved list = %+v, want 1 of p2", cart.Saved)
+	}
+	if stock := productStock(t, app, "p2"); stock != 5 {
+		t.Errorf("p2 stock while saved = %d, want 5: saved items hold none", stock)
+	}
+
+	cart = CartView{}
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/cart/user123/unsave/p2", token, nil), http.StatusOK, &cart)
+	if len(cart.Items) != 2 || cart.Total != 45 || len(cart.Saved) != 0 {
+		t.Errorf("cart after unsaving p2 = %+v with total %v and saved %+v, want both lines at 45", cart.Items, cart.Total, cart.Saved)
+	}
+	if stock := productStock(t, app, "p2"); stock != 4 {
+		t.Errorf("p2 stock back in the cart = %d, want 4", stock)
+	}
+
+	var resp ErrorResponse
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/cart/user123/unsave/p2", token, nil), http.StatusNotFound, &resp)
+	if resp.Error.Code != errCodeItemNotSaved {
+		t.Errorf("unsaving an item that isn't saved = %s, want %s", resp.Error.Code, errCodeItemNotSaved)
+	}
+	resp = ErrorResponse{}
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/cart/user123/save/missing", token, nil), http.StatusNotFound, &resp)
+	if resp.Error.Code != errCodeItemNotInCart {
+		t.Errorf("saving an item not in the cart = %s, want %s", resp.Error.Code, errCodeItemNotInCart)
+	}
+}
+
+func TestPriceHistoryRecordsEachChange(t *testing.T) {
+	r, app := newTestServer(t)
+	current := time.Date(2023, 12, 1, 10, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+	t.Cleanup(func() { now = time.Now })
+	product := saveTestProduct(t, app, "p1", 10, 5)
+	admin := testToken(t, "admin", roleAdmin)
+
+	product.Price = 12
+	decodeResponse(t, doRequest(t, r, http.MethodPut, "/api/v1/products/p1", admin, product), http.StatusOK, nil)
+	current = current.Add(time.Hour)
+	decodeResponse(t, doRequest(t, r, http.MethodPatch, "/api/v1/products/p1", admin, map[string]interface{}{"price": 15}), http.StatusOK, nil)
+	// Neither a stock change nor the same price again is a price change
+	current = current.Add(time.Hour)
+	decodeResponse(t, doRequest(t, r, http.MethodPatch, "/api/v1/products/p1", admin, map[string]interface{}{"stock": 8}), http.StatusOK, nil)
+	decodeResponse(t, doRequest(t, r, http.MethodPatch, "/api/v1/products/p1", admin, map[string]interface{}{"price": 15}), http.StatusOK, nil)
+
+	var changes []PriceChange
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products/p1/price-history", "", nil), http.StatusOK, &changes)
+	start := time.Date(2023, 12, 1, 10, 0, 0, 0, time.UTC)
+	want := []PriceChange{
+		{ProductID: "p1", OldPrice: 10, NewPrice: 12, Timestamp: start},
+		{ProductID: "p1", OldPrice: 12, NewPrice: 15, Timestamp: start.Add(time.Hour)},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("price history = %+v, want %+v", changes, want)
+	}
+	for i := range want {
+		if got := changes[i]; got.ProductID != want[i].ProductID || got.OldPrice != want[i].OldPrice ||
+			got.NewPrice != want[i].NewPrice || !got.Timestamp.Equal(want[i].Timestamp) {
+			t.Errorf("price change %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+}
+
+// guestRequest sends a JSON request carrying the guest cookie, if set, and
+// token, if set
+func guestRequest(t *testing.T, handler http.Handler, method, path string, cookie *http.Cookie, token string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			t.Fatalf("encoding body: %v", err)
+		}
+	}
+	req := httptest.NewRequest(method, path, strings.NewReader(string(payload)))
+	req.Header.Set("Content-Type", "application/json")
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// responseCookie returns the named cookie a response sets, or nil
+func responseCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestGuestCartByCookie(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	saveTestProduct(t, app, "p2", 25, 5)
+
+	w := guestRequest(t, r, http.MethodPost, "/api/v1/cart/add", nil, "", CartItem{ProductID: "p1", Quantity: 2})
+	decodeResponse(t, w, http.StatusOK, nil)
+	cookie := responseCookie(w, guestCookie)
+	if cookie == nil || cookie.Value == "" || !cookie.HttpOnly {
+		t.Fatalf("first guest add set cookie %+v, want an HttpOnly guest cookie", cookie)
+	}
+
+	w = guestRequest(t, r, http.MethodPost, "/api/v1/cart/add", cookie, "", CartItem{ProductID: "p2", Quantity: 1})
+	decodeResponse(t, w, http.StatusOK, nil)
+	if renewed := responseCookie(w, guestCookie); renewed == nil || renewed.Value != cookie.Value {
+		t.Errorf("returning guest got cookie %+v, want the same session %s", renewed, cookie.Value)
+	}
+
+	var cart CartView
+	decodeResponse(t, guestRequest(t, r, http.MethodGet, "/api/v1/cart", cookie, "", nil), http.StatusOK, &cart)
+	if len(cart.Items) != 2 || cart.Total != 45 {
+		t.Errorf("guest cart = %+v with total %v, want p1 and p2 at 45", cart.Items, cart.Total)
+	}
+
+	// Another browser without the cookie gets a separate, empty session
+	if w := guestRequest(t, r, http.MethodGet, "/api/v1/cart", nil, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("cart of a new guest = %d, want 404", w.Code)
+	}
+}
+
+func TestMergeGuestCartSumsCappedAtStock(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	saveTestProduct(t, app, "p2", 25, 5)
+	saveTestProduct(t, app, "p3", 4, 5)
+	token := testToken(t, "user123", "")
+	addToTestCart(t, r, token, "p1", 3)
+	addToTestCart(t, r, token, "p3", 1)
+
+	w := guestRequest(t, r, http.MethodPost, "/api/v1/cart/add", nil, "", CartItem{ProductID: "p1", Quantity: 4})
+	decodeResponse(t, w, http.StatusOK, nil)
+	cookie := responseCookie(w, guestCookie)
+	decodeResponse(t, guestRequest(t, r, http.MethodPost, "/api/v1/cart/add", cookie, "", CartItem{ProductID: "p2", Quantity: 2}), http.StatusOK, nil)
+
+	var cart CartView
+	w = guestRequest(t, r, http.MethodPost, "/api/v1/cart/merge", cookie, token, nil)
+	decodeResponse(t, w, http.StatusOK, &cart)
+	quantities := map[string]int{}
+	for _, line := range cart.Items {
+		quantities[line.ProductID] = line.Quantity
+	}
+	if want := map[string]int{"p1": 5, "p2": 2, "p3": 1}; !reflect.DeepEqual(quantities, want) {
+		t.Errorf("merged quantities = %v, want %v: p1 summed and capped at its stock of 5", quantities, want)
+	}
+	if cart.UserID != "user123" || cart.Total != 104 {
+		t.Errorf("merged cart belongs to %s with total %v, want user123 at 104", cart.UserID, cart.Total)
+	}
+	if cleared := responseCookie(w, guestCookie); cleared == nil || cleared.MaxAge >= 0 {
+		t.Errorf("merge set guest cookie %+v, want it cleared", cleared)
+	}
+
+	if w := guestRequest(t, r, http.MethodGet, "/api/v1/cart", cookie, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("guest cart after the merge = %d, want 404", w.Code)
+	}
+	if w := guestRequest(t, r, http.MethodPost, "/api/v1/cart/merge", cookie, token, nil); w.Code != http.StatusNotFound {
+		t.Errorf("merging again = %d, want 404", w.Code)
+	}
+}
+
+// putImageURL replaces product's image URL through the admin API
+func putImageURL(t *testing.T, h http.Handler, product Product, imageURL string) *httptest.ResponseRecorder {
+	t.Helper()
+	product.ImageURL = imageURL
+	return doRequest(t, h, http.MethodPut, "/api/v1/products/"+product.ID, testToken(t, "admin", roleAdmin), product)
+}
+
+func TestImageURLValidation(t *testing.T) {
+	r, app := newTestServer(t)
+	product := saveTestProduct(t, app, "p1", 10, 5)
+
+	if w := putImageURL(t, r, product, "https://example.com/kettle.jpg"); w.Code != http.StatusOK {
+		t.Errorf("valid image URL = %d: %s", w.Code, w.Body)
+	}
+	for _, imageURL := range []string{"javascript:alert(1)", "ftp://example.com/kettle.jpg", "/kettle.jpg", "https://"} {
+		var resp ErrorResponse
+		decodeResponse(t, putImageURL(t, r, product, imageURL), http.StatusBadRequest, &resp)
+		if !strings.Contains(resp.Error.Message, "image_url") {
+			t.Errorf("image URL %q rejected with %q, want it to name image_url", imageURL, resp.Error.Message)
+		}
+	}
+	if stored, _ := app.store.GetProduct("p1"); stored.ImageURL != "https://example.com/kettle.jpg" {
+		t.Errorf("stored image URL = %q, want the valid one kept", stored.ImageURL)
+	}
+}
+
+func TestImageURLVerifiedWhenStrict(t *testing.T) {
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/kettle.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+		case "/kettle.html":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer images.Close()
+
+	r, app := newTestServer(t)
+	config.VerifyImageURLs = true
+	product := saveTestProduct(t, app, "p1", 10, 5)
+
+	if w := putImageURL(t, r, product, images.URL+"/kettle.jpg"); w.Code != http.StatusOK {
+		t.Errorf("image URL serving an image = %d: %s", w.Code, w.Body)
+	}
+	for path, message := range map[string]string{
+		"/kettle.html": "image_url does not point to an image",
+		"/missing.jpg": "image_url answered with status 404",
+	} {
+		var resp ErrorResponse
+		decodeResponse(t, putImageURL(t, r, product, images.URL+path), http.StatusBadRequest, &resp)
+		if resp.Error.Message != message {
+			t.Errorf("image URL %s rejected with %q, want %q", path, resp.Error.Message, message)
+		}
+	}
+
+	// Without strict mode the same page is only checked for its form
+	config.VerifyImageURLs = false
+	if w := putImageURL(t, r, product, images.URL+"/kettle.html"); w.Code != http.StatusOK {
+		t.Errorf("non-image URL without verification = %d, want 200", w.Code)
+	}
+}
+
+func TestCheckoutMinimumOrderAmount(t *testing.T) {
+	r, app := newTestServer(t)
+	config.MinOrderAmount = 50
+	saveTestProduct(t, app, "p1", 10, 10)
+	if err := app.store.SaveCoupon(Coupon{Code: "SAVE10", PercentOff: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	below := testToken(t, "user123", "")
+	addToTestCart(t, r, below, "p1", 4)
+	var resp ErrorResponse
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/checkout", below, nil), http.StatusBadRequest, &resp)
+	if resp.Error.Code != errCodeBelowMinimumOrder || resp.Error.Message != "order below minimum of 50.00" {
+		t.Errorf("checkout of 40 = %s %q, want %s %q", resp.Error.Code, resp.Error.Message, errCodeBelowMinimumOrder, "order below minimum of 50.00")
+	}
+	if stock := productStock(t, app, "p1"); stock != 10 {
+		t.Errorf("stock after a rejected checkout = %d, want 10", stock)
+	}
+
+	// 50 of goods meets the minimum even though the coupon takes it to 45
+	above := testToken(t, "user456", "")
+	addToTestCart(t, r, above, "p1", 5)
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/cart/user456/coupons", above, ApplyCouponRequest{Code: "SAVE10"}), http.StatusOK, nil)
+	var order Order
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/checkout", above, nil), http.StatusOK, &order)
+	if order.Discount != 5 {
+		t.Errorf("order discount = %v, want 5", order.Discount)
+	}
+}
+
+func TestOrderReceipt(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	saveTestProduct(t, app, "p2", 25, 5)
+	token := testToken(t, "user123", "")
+	addToTestCart(t, r, token, "p1", 2)
+	addToTestCart(t, r, token, "p2", 1)
+	var order Order
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/checkout", token, nil), http.StatusOK, &order)
+	receiptPath := "/api/v1/orders/detail/" + order.ID + "/receipt"
+
+	var receipt Receipt
+	decodeResponse(t, doRequest(t, r, http.MethodGet, receiptPath, token, nil), http.StatusOK, &receipt)
+	if len(receipt.Lines) != 2 || receipt.Subtotal != 45 || receipt.Total != order.Total || receipt.Tax != order.Tax {
+		t.Errorf("JSON receipt = %+v, want 2 lines, subtotal 45 and the order's tax and total", receipt)
+	}
+
+	w := doRequest(t, r, http.MethodGet, receiptPath+"?format=text", token, nil)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("text receipt = %d %s, want 200 text/plain", w.Code, w.Header().Get("Content-Type"))
+	}
+	text := w.Body.String()
+	for _, line := range []string{
+		`(?m)^\s+2\s+Product p1\s+10\.00\s+20\.00$`,
+		`(?m)^\s+1\s+Product p2\s+25\.00\s+25\.00$`,
+		`(?m)^Subtotal\s+45\.00$`,
+		fmt.Sprintf(`(?m)^Tax\s+%.2f$`, order.Tax),
+		fmt.Sprintf(`(?m)^Shipping \(standard\)\s+%.2f$`, order.ShippingCost),
+		fmt.Sprintf(`(?m)^Total\s+%.2f$`, order.Total),
+	} {
+		if !regexp.MustCompile(line).MatchString(text) {
+			t.Errorf("text receipt has no line matching %s:\n%s", line, text)
+		}
+	}
+
+	var resp ErrorResponse
+	decodeResponse(t, doRequest(t, r, http.MethodGet, receiptPath+"?format=pdf", token, nil), http.StatusBadRequest, &resp)
+	if resp.Error.Message != "format must be json or text" {
+		t.Errorf("invalid format message = %q", resp.Error.Message)
+	}
+	if w := doRequest(t, r, http.MethodGet, "/api/v1/orders/detail/"+uuid.New().String()+"/receipt", token, nil); w.Code != http.StatusNotFound {
+		t.Errorf("receipt of a missing order = %d, want 404", w.Code)
+	}
+}
+
+func TestAvailabilityInEveryProductListing(t *testing.T) {
+	r, app := newTestServer(t)
+	want := map[string]string{"a": availabilityOutOfStock, "b": availabilityLowStock, "c": availabilityInStock}
+	for id, stock := range map[string]int{"a": 0, "b": 5, "c": 50} {
+		saveTestProduct(t, app, id, 10, stock)
+	}
+
+	check := func(source string, products []ProductView) {
+		t.Helper()
+		if len(products) != len(want) {
+			t.Errorf("%s returned %d products, want %d", source, len(products), len(want))
+		}
+		for _, product := range products {
+			if product.Availability != want[product.ID] {
+				t.Errorf("%s: availability of %s = %q, want %q", source, product.ID, product.Availability, want[product.ID])
+			}
+		}
+	}
+
+	var page ProductPage
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products", "", nil), http.StatusOK, &page)
+	check("product listing", page.Data)
+	page = ProductPage{}
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/search?q=product", "", nil), http.StatusOK, &page)
+	check("search", page.Data)
+	var products []ProductView
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products/top", "", nil), http.StatusOK, &products)
+	check("top products", products)
+	products = nil
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products/low-stock?threshold=100", "", nil), http.StatusOK, &products)
+	check("low stock", products)
+}
+
+func TestSearchTrimsAndIgnoresCase(t *testing.T) {
+	r, app := newTestServer(t)
+	saveSearchCatalog(t, app)
+
+	padded := searchIDs(t, r, "q=%20%20iphone%20%20")
+	if want := searchIDs(t, r, "q=iphone"); len(padded) == 0 || !reflect.DeepEqual(padded, want) {
+		t.Errorf("search for \"  iphone  \" = %v, want the results for iphone, %v", padded, want)
+	}
+	if ids := searchIDs(t, r, "q=IPHONE"); !reflect.DeepEqual(ids, padded) {
+		t.Errorf("search for IPHONE = %v, want %v", ids, padded)
+	}
+
+	// Only the category of these products matches
+	if ids := searchIDs(t, r, "q=Smartphones"); !reflect.DeepEqual(ids, []string{"p1"}) {
+		t.Errorf("search for Smartphones = %v, want [p1]", ids)
+	}
+	if ids := searchIDs(t, r, "q=%20audio"); !reflect.DeepEqual(ids, []string{"p4"}) {
+		t.Errorf("search for \" audio\" = %v, want [p4]", ids)
+	}
+
+	product, err := app.store.GetProduct("p3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	product.Tags = []string{"ultrabook"}
+	if err := app.store.SaveProduct(product); err != nil {
+		t.Fatal(err)
+	}
+	if ids := searchIDs(t, r, "q=UltraBook%20"); !reflect.DeepEqual(ids, []string{"p3"}) {
+		t.Errorf("search for a tag = %v, want [p3]", ids)
+	}
+}
+
+func TestProductTags(t *testing.T) {
+	r, app := newTestServer(t)
+	admin := testToken(t, "admin", roleAdmin)
+	kettle := saveTestProduct(t, app, "p1", 25, 5)
+	saveTestProduct(t, app, "p2", 60, 5)
+	saveTestProduct(t, app, "p3", 15, 5)
+
+	kettle.Tags = []string{" Tea ", "KITCHEN", "tea", ""}
+	var view ProductView
+	decodeResponse(t, doRequest(t, r, http.MethodPut, "/api/v1/products/p1", admin, kettle), http.StatusOK, &view)
+	if want := []string{"tea", "kitchen"}; !reflect.DeepEqual(view.Tags, want) {
+		t.Errorf("tags after an update = %v, want %v", view.Tags, want)
+	}
+	decodeResponse(t, doRequest(t, r, http.MethodPatch, "/api/v1/products/p2", admin, map[string]interface{}{"tags": []string{"Kitchen", "Breakfast"}}), http.StatusOK, nil)
+	if stored, _ := app.store.GetProduct("p2"); !reflect.DeepEqual(stored.Tags, []string{"kitchen", "breakfast"}) {
+		t.Errorf("stored tags after a patch = %v, want [kitchen breakfast]", stored.Tags)
+	}
+
+	for tag, want := range map[string][]string{
+		"kitchen":  {"p1", "p2"},
+		"%20TEA":   {"p1"},
+		"coffee":   {},
+		"breakfas": {},
+	} {
+		var page ProductPage
+		decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products?tag="+tag, "", nil), http.StatusOK, &page)
+		if got := pageIDs(page); !reflect.DeepEqual(got, want) {
+			t.Errorf("products with tag %q = %v, want %v", tag, got, want)
+		}
+	}
+
+	if ids := searchIDs(t, r, "q=breakfast"); !reflect.DeepEqual(ids, []string{"p2"}) {
+		t.Errorf("search for a tag = %v, want [p2]", ids)
+	}
+}
+
+// recentlyViewedIDs lists the IDs of userID's recently viewed products
+func recentlyViewedIDs(t *testing.T, handler http.Handler, userID string) []string {
+	t.Helper()
+	var products []ProductView
+	decodeResponse(t, doRequest(t, handler, http.MethodGet, "/api/v1/users/"+userID+"/recently-viewed", testToken(t, userID, ""), nil), http.StatusOK, &products)
+	ids := make([]string, 0, len(products))
+	for _, product := range products {
+		ids = append(ids, product.ID)
+	}
+	return ids
+}
+
+func TestRecentlyViewedNewestFirstAndCapped(t *testing.T) {
+	r, app := newTestServer(t)
+	config.RecentlyViewedLimit = 3
+	current := time.Date(2023, 12, 1, 10, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+	t.Cleanup(func() { now = time.Now })
+	view := func(id string) {
+		t.Helper()
+		current = current.Add(time.Minute)
+		decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products/"+id+"?user_id=user123", "", nil), http.StatusOK, nil)
+	}
+	for _, id := range []string{"p1", "p2", "p3", "p4"} {
+		saveTestProduct(t, app, id, 10, 5)
+	}
+
+	for _, id := range []string{"p1", "p2", "p3"} {
+		view(id)
+	}
+	if got, want := recentlyViewedIDs(t, r, "user123"), []string{"p3", "p2", "p1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("recently viewed = %v, want %v", got, want)
+	}
+
+	// Viewing a product again moves it to the front instead of repeating it
+	view("p1")
+	if got, want := recentlyViewedIDs(t, r, "user123"), []string{"p1", "p3", "p2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after viewing p1 again = %v, want %v", got, want)
+	}
+	view("p4")
+	if got, want := recentlyViewedIDs(t, r, "user123"), []string{"p4", "p1", "p3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("past the limit of 3 = %v, want %v", got, want)
+	}
+
+	// Fetching a product without user_id records nothing
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products/p2", "", nil), http.StatusOK, nil)
+	if got := recentlyViewedIDs(t, r, "user456"); len(got) != 0 {
+		t.Errorf("recently viewed of a user who viewed nothing = %v", got)
+	}
+	if w := doRequest(t, r, http.MethodGet, "/api/v1/users/user123/recently-viewed", testToken(t, "user456", ""), nil); w.Code != http.StatusForbidden {
+		t.Errorf("another user's recently viewed = %d, want 403", w.Code)
+	}
+}
+
+func TestRecommendationsFromRecentlyViewed(t *testing.T) {
+	r, app := newTestServer(t)
+	for id, category := range map[string]string{"k1": "Kitchen", "k2": "Kitchen", "a1": "Audio", "a2": "Audio"} {
+		product := saveTestProduct(t, app, id, 10, 5)
+		product.Category = category
+		if err := app.store.SaveProduct(product); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products/k1?user_id=user123", "", nil), http.StatusOK, nil)
+	if got := recommendationIDs(t, r, "user123"); !reflect.DeepEqual(got, []string{"k2"}) {
+		t.Errorf("recommendations after viewing k1 = %v, want the other kitchen product, [k2]", got)
+	}
+}
+
+func TestConcurrentCheckoutsGetDistinctOrderNumbers(t *testing.T) {
+	r, app := newTestServer(t)
+	const buyers = 10
+	saveTestProduct(t, app, "p1", 10, buyers)
+	tokens := make([]string, buyers)
+	for i := range tokens {
+		tokens[i] = testToken(t, fmt.Sprintf("buyer%d", i), "")
+		addToTestCart(t, r, tokens[i], "p1", 1)
+	}
+
+	responses := make([]*httptest.ResponseRecorder, buyers)
+	var wg sync.WaitGroup
+	for i, token := range tokens {
+		wg.Add(1)
+		go func(i int, token string) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/checkout", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			responses[i] = httptest.NewRecorder()
+			r.ServeHTTP(responses[i], req)
+		}(i, token)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool, buyers)
+	for _, w := range responses {
+		var order Order
+		decodeResponse(t, w, http.StatusOK, &order)
+		if !regexp.MustCompile(`^ORD-\d{6}$`).MatchString(order.Number) || seen[order.Number] {
+			t.Errorf("order number %q is malformed or repeated", order.Number)
+		}
+		seen[order.Number] = true
+	}
+	for i := 1; i <= buyers; i++ {
+		if number := formatOrderNumber(int64(i)); !seen[number] {
+			t.Errorf("no order got %s; numbers = %v", number, seen)
+		}
+	}
+}
+
+func TestPageLinksWalkTheListing(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestCatalog(t, app, 5)
+	if err := app.store.SaveProduct(Product{ID: "other", Name: "Other product", Category: "Other", Price: 10, Stock: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	var first ProductPage
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products?category=Testing&sort=name_desc&limit=2", "", nil), http.StatusOK, &first)
+	if first.Prev != nil {
+		t.Errorf("first page prev = %q, want null", *first.Prev)
+	}
+	if want := "/api/v1/products?category=Testing&limit=2&offset=2&sort=name_desc"; first.Next == nil || *first.Next != want {
+		t.Fatalf("first page next = %v, want %s", first.Next, want)
+	}
+
+	// Following next keeps the filter and sort until the last page
+	ids := pageIDs(first)
+	page := first
+	for page.Next != nil {
+		next := *page.Next
+		page = ProductPage{}
+		decodeResponse(t, doRequest(t, r, http.MethodGet, next, "", nil), http.StatusOK, &page)
+		ids = append(ids, pageIDs(page)...)
+	}
+	if want := []string{"p04", "p03", "p02", "p01", "p00"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("products following next links = %v, want %v", ids, want)
+	}
+	if want := "/api/v1/products?category=Testing&limit=2&offset=2&sort=name_desc"; page.Offset != 4 || page.Prev == nil || *page.Prev != want {
+		t.Errorf("last page at offset %d has prev %v, want offset 4 with prev %s", page.Offset, page.Prev, want)
+	}
+
+	var search ProductPage
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/search?q=product&limit=10", "", nil), http.StatusOK, &search)
+	if search.Next != nil || search.Prev != nil {
+		t.Errorf("single search page links = %v, %v; want both null", search.Next, search.Prev)
+	}
+}
+
+func TestPageSizeDefaultAndClamp(t *testing.T) {
+	r, app := newTestServer(t)
+	config.DefaultPageSize = 3
+	config.MaxPageSize = 5
+	saveTestCatalog(t, app, 8)
+
+	var page ProductPage
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/products", "", nil), http.StatusOK, &page)
+	if page.Limit != 3 || len(page.Data) != 3 {
+		t.Errorf("page without a limit = %d products with limit %d, want the default of 3", len(page.Data), page.Limit)
+	}
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	for _, path := range []string{"/api/v1/products?limit=50", "/api/v1/search?q=product&limit=50"} {
+		page = ProductPage{}
+		decodeResponse(t, doRequest(t, r, http.MethodGet, path, "", nil), http.StatusOK, &page)
+		if page.Limit != 5 || len(page.Data) != 5 {
+			t.Errorf("GET %s = %d products with limit %d, want it clamped to 5", path, len(page.Data), page.Limit)
+		}
+	}
+	if got := strings.Count(logged.String(), "Clamping limit 50 to 5"); got != 2 {
+		t.Errorf("logged %d clamping lines, want 2:\n%s", got, logged.String())
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// metricsRegistry holds every collector served on /metrics
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests handled, by route and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency, by route and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequestsTotal,
+		httpRequestDuration,
+	)
+}
+
+// registerStoreMetrics adds gauges to registry that read their values from
+// the store on every scrape
+func registerStoreMetrics(registry *prometheus.Registry, store Store) {
+	registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "shitty_carts",
+			Help: "Carts currently held in the store.",
+		}, func() float64 {
+			cartList, err := store.ListCarts()
+			if err != nil {
+				return math.NaN()
+			}
+			return float64(len(cartList))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "shitty_products",
+			Help: "Products in the catalog.",
+		}, func() float64 {
+			productList, err := store.ListProducts()
+			if err != nil {
+				return math.NaN()
+			}
+			return float64(len(productList))
+		}),
+	)
+}
+
+// metricsMiddleware records a request count and latency sample per request.
+// Routes are labelled by their pattern (e.g. /api/v1/cart/:userID) so user
+// IDs don't blow up label cardinality.
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		labels := prometheus.Labels{
+			"method": c.Request.Method,
+			"route":  route,
+			"status": strconv.Itoa(c.Writer.Status()),
+		}
+		httpRequestsTotal.With(labels).Inc()
+		httpRequestDuration.With(labels).Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricValue scrapes handler and returns the value of the sample whose name
+// and labels are exactly series, or 0 when there is none
+func metricValue(t *testing.T, handler http.Handler, series string) float64 {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("scraping /metrics = %d", w.Code)
+	}
+
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		if value, found := strings.CutPrefix(scanner.Text(), series+" "); found {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("sample %q: %v", scanner.Text(), err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+func TestMetricsCountRequestsByRoute(t *testing.T) {
+	r, app := newTestServer(t)
+	saveTestProduct(t, app, "p1", 10, 5)
+	okSeries := `http_requests_total{method="GET",route="/api/v1/products/:id",status="200"}`
+	notFoundSeries := `http_requests_total{method="GET",route="/api/v1/products/:id",status="404"}`
+	latencySeries := `http_request_duration_seconds_count{method="GET",route="/api/v1/products/:id",status="200"}`
+	okBefore, notFoundBefore, latencyBefore := metricValue(t, r, okSeries), metricValue(t, r, notFoundSeries), metricValue(t, r, latencySeries)
+
+	doRequest(t, r, http.MethodGet, "/api/v1/products/p1", "", nil)
+	doRequest(t, r, http.MethodGet, "/api/v1/products/p1", "", nil)
+	doRequest(t, r, http.MethodGet, "/api/v1/products/missing", "", nil)
+
+	if got := metricValue(t, r, okSeries) - okBefore; got != 2 {
+		t.Errorf("200 count went up by %v, want 2", got)
+	}
+	if got := metricValue(t, r, notFoundSeries) - notFoundBefore; got != 1 {
+		t.Errorf("404 count went up by %v, want 1", got)
+	}
+	if got := metricValue(t, r, latencySeries) - latencyBefore; got != 2 {
+		t.Errorf("latency samples went up by %v, want 2", got)
+	}
+}
+
+func TestStoreMetricsGauges(t *testing.T) {
+	r, app := newTestServer(t)
+	registry := prometheus.NewRegistry()
+	registerStoreMetrics(registry, app.store)
+	handler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+
+	saveTestProduct(t, app, "p1", 10, 5)
+	saveTestProduct(t, app, "p2", 10, 5)
+	addToTestCart(t, r, testToken(t, "user123", ""), "p1", 1)
+
+	if got := metricValue(t, handler, "shitty_products"); got != 2 {
+		t.Errorf("shitty_products = %v, want 2", got)
+	}
+	if got := metricValue(t, handler, "shitty_carts"); got != 1 {
+		t.Errorf("shitty_carts = %v, want 1", got)
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// requestIDHeader carries the request ID in both directions
+const requestIDHeader = "X-Request-ID"
+
+// requestIDKey is the gin context key holding the request ID
+const requestIDKey = "requestID"
+
+// requestID reuses the caller's X-Request-ID or generates one, stores it in
+// the context and echoes it back on the response. It runs before jsonLogger
+// so the log line carries the ID.
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if id == "" {
+			id = uuid.New().String()
+		}
+		c.Set(requestIDKey, id)
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+// requestLogf logs a line tagged with the ID of the request it belongs to, so
+// it can be matched with that request's access log entry
+func requestLogf(requestID, format string, args ...interface{}) {
+	log.Printf("[%s] "+format, append([]interface{}{requestID}, args...)...)
+}
+
+// Methods and request headers browsers may use on cross-origin requests, and
+// the response headers their scripts may read
+const (
+	corsAllowMethods  = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+	corsAllowHeaders  = "Authorization, Content-Type, If-None-Match, " + requestIDHeader + ", " + idempotencyKeyHeader
+	corsExposeHeaders = "ETag, " + requestIDHeader
+)
+
+// cors lets browsers on the allowed origins call the API. Requests from any
+// other origin get a 403, and preflight OPTIONS requests are answered
+// directly. With no allowed origins no CORS headers are set at all and
+// requests pass through untouched. An allowed origin of "*" matches every
+// origin, but only origins listed by name may send credentials such as the
+// guest cart cookie; the rest get a plain "*" answer.
+func cors(allowedOrigins []string) gin.HandlerFunc {
+	allowed := make(map[string]bool, len(allowedOrigins))
+	for _, origin := range allowedOrigins {
+		allowed[origin] = true
+	}
+
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if len(allowed) == 0 || origin == "" {
+			c.Next()
+			return
+		}
+		if !allowed[origin] && !allowed["*"] {
+			abortWithError(c, http.StatusForbidden, errCodeOriginNotAllowed, "Origin not allowed")
+			return
+		}
+
+		if allowed[origin] {
+			c.Header("Access-Control-Allow-Origin", origin)
+			// Lets browsers send the guest cart cookie along
+			c.Header("Access-Control-Allow-Credentials", "true")
+			c.Writer.Header().Add("Vary", "Origin")
+		} else {
+			c.Header("Access-Control-Allow-Origin", "*")
+		}
+		c.Header("Access-Control-Expose-Headers", corsExposeHeaders)
+
+		if c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+			c.Header("Access-Control-Allow-Methods", corsAllowMethods)
+			c.Header("Access-Control-Allow-Headers", corsAllowHeaders)
+			c.Header("Access-Control-Max-Age", "600")
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
+
+// tokenBucket is one client's rate limit state
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimit allows each client IP rate requests per second on average with
+// bursts of up to burst requests, answering 429 with a Retry-After header
+// once a client's bucket is empty. The client IP comes from forwarding
+// headers only when the engine trusts the proxy that sent them, so clients
+// can't dodge the limit by sending their own. Requests for the exempt paths
+// are never limited. A bucket left alone long enough to refill completely is
+// no different from a new one, so idle buckets are dropped to keep memory
+// bounded. A non-positive rate disables the limit.
+func rateLimit(rate float64, burst int, exempt ...string) gin.HandlerFunc {
+	if rate <= 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	exemptPaths := make(map[string]bool, len(exempt))
+	for _, path := range exempt {
+		exemptPaths[path] = true
+	}
+	refill := time.Duration(float64(burst) / rate * float64(time.Second))
+	sweepEvery := max(refill, time.Minute)
+
+	var mu sync.Mutex
+	buckets := make(map[string]*tokenBucket)
+	lastSweep := now()
+
+	return func(c *gin.Context) {
+		if exemptPaths[c.Request.URL.Path] {
+			c.Next()
+			return
+		}
+
+		mu.Lock()
+		current := now()
+		if current.Sub(lastSweep) >= sweepEvery {
+			for ip, bucket := range buckets {
+				if current.Sub(bucket.last) >= refill {
+					delete(buckets, ip)
+				}
+			}
+			lastSweep = current
+		}
+
+		ip := c.ClientIP()
+		bucket, exists := buckets[ip]
+		if !exists {
+			bucket = &tokenBucket{tokens: float64(burst), last: current}
+			buckets[ip] = bucket
+		}
+		bucket.tokens = math.Min(float64(burst), bucket.tokens+current.Sub(bucket.last).Seconds()*rate)
+		bucket.last = current
+
+		if bucket.tokens < 1 {
+			wait := math.Ceil((1 - bucket.tokens) / rate)
+			mu.Unlock()
+			c.Header("Retry-After", strconv.Itoa(int(wait)))
+			abortWithError(c, http.StatusTooManyRequests, errCodeRateLimited, "Rate limit exceeded, try again later")
+			return
+		}
+		bucket.tokens--
+		mu.Unlock()
+
+		c.Next()
+	}
+}
+
+// methodNotAllowed answers requests for a known path with an unsupported
+// method, listing the methods the path does support in the Allow header.
+// gin only calls it when HandleMethodNotAllowed is on.
+func methodNotAllowed(engine *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var allowed []string
+		for _, route := range engine.Routes() {
+			if routeMatches(route.Path, c.Request.URL.Path) && !containsString(allowed, route.Method) {
+				allowed = append(allowed, route.Method)
+			}
+		}
+		sort.Strings(allowed)
+
+		c.Header("Allow", strings.Join(allowed, ", "))
+		abortWithError(c, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// routeMatches reports whether path is served by the gin route pattern, where
+// a :name segment matches any one segment and a *name segment matches the
+// rest of the path
+func routeMatches(pattern, path string) bool {
+	patternParts := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathParts := strings.Split(strings.Trim(path, "/"), "/")
+	for i, part := range patternParts {
+		if strings.HasPrefix(part, "*") {
+			return true
+		}
+		if i >= len(pathParts) {
+			return false
+		}
+		if !strings.HasPrefix(part, ":") && part != pathParts[i] {
+			return false
+		}
+	}
+	return len(patternParts) == len(pathParts)
+}
+
+// requestLogEntry is the JSON line written for every request. ClientIP
+// follows forwarding headers only from trusted proxies, like rate limiting.
+type requestLogEntry struct {
+	Timestamp string  `json:"timestamp"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Status    int     `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	ClientIP  string  `json:"client_ip"`
+	RequestID string  `json:"request_id"`
+}
+
+// jsonLogger writes one JSON line per request to out once the request has
+// been handled, so log pipelines don't have to parse gin's text format.
+func jsonLogger(out io.Writer) gin.HandlerFunc {
+	encoder := json.NewEncoder(out)
+	var writeMu sync.Mutex
+
+	return func(c *gin.Context) {
+		start := now()
+		c.Next()
+
+		entry := requestLogEntry{
+			Timestamp: start.UTC().Format(time.RFC3339Nano),
+			Method:    c.Request.Method,
+			Path:      c.Request.URL.Path,
+			Status:    c.Writer.Status(),
+			LatencyMS: float64(now().Sub(start).Microseconds()) / 1000,
+			ClientIP:  c.ClientIP(),
+			RequestID: c.GetString(requestIDKey),
+		}
+
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		if err := encoder.Encode(entry); err != nil {
+			log.Printf("request log: %v", err)
+		}
+	}
+}
+
+// gzipResponses compresses response bodies of at least minSize bytes for
+// clients that accept gzip. Smaller bodies aren't worth the overhead, and
+// responses that already carry a Content-Encoding (the Prometheus handler
+// compresses its own) or an already-compressed media type pass through.
+func gzipResponses(minSize int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Whether or not this response is compressed, the body depends on
+		// Accept-Encoding, so caches must key on it
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+		if c.Request.Method == http.MethodHead || !acceptsGzip(c.GetHeader("Accept-Encoding")) {
+			c.Next()
+			return
+		}
+
+		writer := &gzipWriter{ResponseWriter: c.Writer, minSize: minSize}
+		c.Writer = writer
+		c.Next()
+		writer.finish()
+		c.Writer = writer.ResponseWriter
+	}
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip
+func acceptsGzip(acceptEncoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.TrimSpace(coding)
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipWriter holds back the body until minSize bytes have been written, then
+// commits to gzip. A body that ends, or is flushed, before that goes out as
+// is.
+type gzipWriter struct {
+	gin.ResponseWriter
+	minSize int
+
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer // nil unless compressing
+}
+
+func (w *gzipWriter) Write(data []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, data...)
+		if len(w.buf) < w.minSize {
+			return len(data), nil
+		}
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+	if w.gz != nil {
+		return w.gz.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *gzipWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *gzipWriter) Flush() {
+	if !w.decided {
+		if err := w.decide(false); err != nil {
+			return
+		}
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// decide settles on gzip or plain, when compress allows it, and writes out
+// whatever was held back
+func (w *gzipWriter) decide(compress bool) error {
+	w.decided = true
+	if compress && w.compressible() {
+		header := w.Header()
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		// The compressed bytes differ from what a strong ETag promises
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+
+	held := w.buf
+	w.buf = nil
+	if len(held) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(held)
+	} else {
+		_, err = w.ResponseWriter.Write(held)
+	}
+	return err
+}
+
+// compressible reports whether the response can still be switched to gzip
+func (w *gzipWriter) compressible() bool {
+	if w.ResponseWriter.Written() {
+		return false
+	}
+	header := w.Header()
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	switch w.Status() {
+	case http.StatusNoContent, http.StatusNotModified:
+		return false
+	}
+	return !precompressedType(header.Get("Content-Type"))
+}
+
+// finish writes out a body that stayed below minSize and terminates the gzip
+// stream
+func (w *gzipWriter) finish() {
+	if !w.decided {
+		if err := w.decide(false); err != nil {
+			log.Printf("Writing response: %v", err)
+		}
+	}
+	if w.gz != nil {
+		if err := w.gz.Close(); err != nil {
+			log.Printf("Writing compressed response: %v", err)
+		}
+	}
+}
+
+// precompressedType reports media types that gzip can't shrink further
+func precompressedType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	switch mediaType {
+	case "image/svg+xml":
+		return false
+	case "application/gzip", "application/x-gzip", "application/zip":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "image/") ||
+		strings.HasPrefix(mediaType, "video/") ||
+		strings.HasPrefix(mediaType, "audio/")
+}
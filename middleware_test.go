@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newRateLimitedServer is newTestServer with a rate limit of one request per
+// second in bursts of two
+func newRateLimitedServer(t *testing.T, trustedProxies ...string) *gin.Engine {
+	t.Helper()
+	_, app := newTestServer(t)
+	config.RateLimit = 1
+	config.RateLimitBurst = 2
+	config.TrustedProxies = trustedProxies
+	return newRouter(app)
+}
+
+// requestFrom sends a GET for path from the given peer address, with an
+// X-Forwarded-For header unless forwardedFor is empty
+func requestFrom(handler http.Handler, path, remoteAddr, forwardedFor string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = remoteAddr
+	if forwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestRateLimitRejectsExcessRequests(t *testing.T) {
+	r := newRateLimitedServer(t)
+
+	for i := 0; i < 2; i++ {
+		if w := requestFrom(r, "/api/v1/categories", "192.0.2.1:1234", ""); w.Code != http.StatusOK {
+			t.Fatalf("request %d = %d, want 200", i+1, w.Code)
+		}
+	}
+	w := requestFrom(r, "/api/v1/categories", "192.0.2.1:1234", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over the burst = %d, want 429", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("429 without a Retry-After header")
+	}
+
+	if w := requestFrom(r, "/api/v1/categories", "192.0.2.2:1234", ""); w.Code != http.StatusOK {
+		t.Errorf("another IP = %d, want 200", w.Code)
+	}
+	if w := requestFrom(r, "/health", "192.0.2.1:1234", ""); w.Code != http.StatusOK {
+		t.Errorf("/health = %d, want 200 since it is exempt", w.Code)
+	}
+}
+
+func TestRateLimitIgnoresForwardedForFromUntrustedPeers(t *testing.T) {
+	r := newRateLimitedServer(t)
+
+	for i, spoofed := range []string{"198.51.100.1", "198.51.100.2", "198.51.100.3"} {
+		w := requestFrom(r, "/api/v1/categories", "192.0.2.1:1234", spoofed)
+		if i < 2 && w.Code != http.StatusOK {
+			t.Fatalf("request %d = %d, want 200", i+1, w.Code)
+		}
+		if i == 2 && w.Code != http.StatusTooManyRequests {
+			t.Errorf("third request with a fresh X-Forwarded-For = %d, want 429", w.Code)
+		}
+	}
+}
+
+func TestRateLimitUsesForwardedForFromTrustedProxy(t *testing.T) {
+	r := newRateLimitedServer(t, "10.0.0.0/8")
+
+	for i := 0; i < 2; i++ {
+		requestFrom(r, "/api/v1/categories", "10.0.0.5:1234", "198.51.100.1")
+	}
+	if w := requestFrom(r, "/api/v1/categories", "10.0.0.5:1234", "198.51.100.1"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("third request for the same client = %d, want 429", w.Code)
+	}
+	if w := requestFrom(r, "/api/v1/categories", "10.0.0.5:1234", "198.51.100.2"); w.Code != http.StatusOK {
+		t.Errorf("another client behind the proxy = %d, want 200", w.Code)
+	}
+}
+
+// newCORSServer is newTestServer with CORS enabled for the given origins
+func newCORSServer(t *testing.T, origins ...string) *gin.Engine {
+	t.Helper()
+	_, app := newTestServer(t)
+	config.CORSAllowedOrigins = origins
+	return newRouter(app)
+}
+
+// corsRequest sends a request from origin, as a preflight for a POST when
+// method is OPTIONS
+func corsRequest(handler http.Handler, method, path, origin string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Origin", origin)
+	if method == http.MethodOptions {
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestCORSAllowedOrigin(t *testing.T) {
+	r := newCORSServer(t, "https://shop.example.com")
+
+	w := corsRequest(r, http.MethodGet, "/api/v1/categories", "https://shop.example.com")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://shop.example.com" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want the origin", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("Access-Control-Allow-Credentials = %q, want true", got)
+	}
+}
+
+func TestCORSDisallowedOrigin(t *testing.T) {
+	r := newCORSServer(t, "https://shop.example.com")
+
+	w := corsRequest(r, http.MethodGet, "/api/v1/categories", "https://evil.example.com")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want 403", w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want none", got)
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	r := newCORSServer(t, "https://shop.example.com")
+
+	w := corsRequest(r, http.MethodOptions, "/api/v1/checkout", "https://shop.example.com")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want 204", w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Methods"); got != corsAllowMethods {
+		t.Errorf("Access-Control-Allow-Methods = %q, want %q", got, corsAllowMethods)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Headers"); got != corsAllowHeaders {
+		t.Errorf("Access-Control-Allow-Headers = %q, want %q", got, corsAllowHeaders)
+	}
+}
+
+func TestCORSWildcardWithoutCredentials(t *testing.T) {
+	r := newCORSServer(t, "*", "https://shop.example.com")
+
+	w := corsRequest(r, http.MethodGet, "/api/v1/categories", "https://anywhere.example.com")
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want *", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("Access-Control-Allow-Credentials = %q for a wildcard match, want none", got)
+	}
+
+	w = corsRequest(r, http.MethodGet, "/api/v1/categories", "https://shop.example.com")
+	if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("Access-Control-Allow-Credentials = %q for a listed origin, want true", got)
+	}
+}
+
+func TestRequestIDEchoedOrGenerated(t *testing.T) {
+	r, _ := newTestServer(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/categories", nil)
+	req.Header.Set(requestIDHeader, "caller-id")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if got := w.Header().Get(requestIDHeader); got != "caller-id" {
+		t.Errorf("%s = %q, want the caller's caller-id", requestIDHeader, got)
+	}
+
+	w = doRequest(t, r, http.MethodGet, "/api/v1/categories", "", nil)
+	if got := w.Header().Get(requestIDHeader); got == "" {
+		t.Errorf("no %s generated", requestIDHeader)
+	}
+}
+
+func TestHandlerLogLinesCarryRequestID(t *testing.T) {
+	r, _ := newTestServer(t)
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/products?limit=100000", nil)
+	req.Header.Set(requestIDHeader, "caller-id")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !strings.Contains(logged.String(), "[caller-id] Clamping limit") {
+		t.Errorf("log output %q has no clamping line tagged with the request ID", logged.String())
+	}
+}
+
+// newBlockingServer serves /slow behind a concurrencyLimit, holding each
+// request until release is closed. started receives once per request that
+// got a slot.
+func newBlockingServer(max int, queueTimeout time.Duration) (r *gin.Engine, started chan struct{}, release chan struct{}) {
+	gin.SetMode(gin.TestMode)
+	started, release = make(chan struct{}, 10), make(chan struct{})
+	r = gin.New()
+	r.GET("/slow", concurrencyLimit(max, queueTimeout), func(c *gin.Context) {
+		started <- struct{}{}
+		<-release
+		c.Status(http.StatusOK)
+	})
+	return r, started, release
+}
+
+func TestConcurrencyLimitShedsExcess(t *testing.T) {
+	r, started, release := newBlockingServer(1, 10*time.Millisecond)
+
+	done := make(chan int)
+	go func() { done <- requestFrom(r, "/slow", "192.0.2.1:1234", "").Code }()
+	<-started
+
+	w := requestFrom(r, "/slow", "192.0.2.2:1234", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("request over the limit = %d, want 429", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("shed request has no Retry-After header")
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("request holding the slot = %d, want 200", code)
+	}
+	if w := requestFrom(r, "/slow", "192.0.2.2:1234", ""); w.Code != http.StatusOK {
+		t.Errorf("request after the slot freed = %d, want 200", w.Code)
+	}
+}
+
+func TestConcurrencyLimitQueuesWithinTimeout(t *testing.T) {
+	r, started, release := newBlockingServer(1, 5*time.Second)
+
+	done := make(chan int, 2)
+	go func() { done <- requestFrom(r, "/slow", "192.0.2.1:1234", "").Code }()
+	<-started
+	go func() { done <- requestFrom(r, "/slow", "192.0.2.2:1234", "").Code }()
+
+	// The queued request only starts once the first one finishes
+	select {
+	case <-started:
+		t.Fatal("the second request ran while the first held the only slot")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("queued requests = %d, want 200", code)
+		}
+	}
+}
+
+func TestJSONLoggerWritesOneLinePerRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var logged bytes.Buffer
+	r := gin.New()
+	r.Use(requestID(), jsonLogger(&logged))
+	r.GET("/items/:id", func(c *gin.Context) { c.Status(http.StatusTeapot) })
+
+	req := httptest.NewRequest(http.MethodGet, "/items/42?verbose=1", nil)
+	req.RemoteAddr = "192.0.2.7:1234"
+	req.Header.Set(requestIDHeader, "caller-id")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	lines := strings.Split(strings.TrimSpace(logged.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("log output = %q, want one line", logged.String())
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("log line %q is not JSON: %v", lines[0], err)
+	}
+	for field, want := range map[string]interface{}{
+		"method":     "GET",
+		"path":       "/items/42",
+		"status":     float64(http.StatusTeapot),
+		"client_ip":  "192.0.2.7",
+		"request_id": "caller-id",
+	} {
+		if entry[field] != want {
+			t.Errorf("%s = %v, want %v", field, entry[field], want)
+		}
+	}
+	if _, err := time.Parse(time.RFC3339Nano, fmt.Sprint(entry["timestamp"])); err != nil {
+		t.Errorf("timestamp %v: %v", entry["timestamp"], err)
+	}
+	if _, ok := entry["latency_ms"].(float64); !ok {
+		t.Errorf("latency_ms = %v, want a number", entry["latency_ms"])
+	}
+}
+
+func TestUnsupportedMethodGets405(t *testing.T) {
+	r, _ := newTestServer(t)
+
+	for _, tc := range []struct{ method, path, allow string }{
+		{http.MethodPost, "/api/v1/products/p1", "DELETE, GET, PATCH, PUT"},
+		{http.MethodGet, "/api/v1/checkout", "POST"},
+		{http.MethodPut, "/api/v1/cart/user123", "GET"},
+	} {
+		var resp ErrorResponse
+		w := doRequest(t, r, tc.method, tc.path, "", nil)
+		decodeResponse(t, w, http.StatusMethodNotAllowed, &resp)
+		if got := w.Header().Get("Allow"); got != tc.allow {
+			t.Errorf("%s %s: Allow = %q, want %q", tc.method, tc.path, got, tc.allow)
+		}
+		if resp.Error.Code != errCodeMethodNotAllowed {
+			t.Errorf("%s %s: code = %s, want %s", tc.method, tc.path, resp.Error.Code, errCodeMethodNotAllowed)
+		}
+	}
+
+	if w := doRequest(t, r, http.MethodPost, "/api/v1/nowhere", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("POST to an unknown path = %d, want 404", w.Code)
+	}
+}
+
+// newGzipServer serves a large and a small text body and a large image
+// behind gzipResponses with a 64-byte threshold
+func newGzipServer() (*gin.Engine, string) {
+	gin.SetMode(gin.TestMode)
+	large := strings.Repeat("compress me ", 100)
+	r := gin.New()
+	r.Use(gzipResponses(64))
+	r.GET("/large", func(c *gin.Context) { c.String(http.StatusOK, large) })
+	r.GET("/small", func(c *gin.Context) { c.String(http.StatusOK, "tiny") })
+	r.GET("/image", func(c *gin.Context) { c.Data(http.StatusOK, "image/png", []byte(large)) })
+	return r, large
+}
+
+// gzipRequest fetches path sending acceptEncoding as Accept-Encoding, if set
+func gzipRequest(handler http.Handler, path, acceptEncoding string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestGzipForAcceptingClients(t *testing.T) {
+	r, large := newGzipServer()
+
+	w := gzipRequest(r, "/large", "br, gzip")
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	if w.Body.Len() >= len(large) {
+		t.Errorf("compressed body is %d bytes, no smaller than the %d-byte original", w.Body.Len(), len(large))
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != large {
+		t.Errorf("decompressed body differs from the original")
+	}
+	if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", got)
+	}
+}
+
+func TestGzipSkipped(t *testing.T) {
+	r, large := newGzipServer()
+
+	for _, tc := range []struct {
+		name, path, acceptEncoding, body string
+	}{
+		{"no Accept-Encoding", "/large", "", large},
+		{"gzip refused", "/large", "gzip;q=0, identity", large},
+		{"below the threshold", "/small", "gzip", "tiny"},
+		{"already compressed", "/image", "gzip", large},
+	} {
+		w := gzipRequest(r, tc.path, tc.acceptEncoding)
+		if got := w.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("%s: Content-Encoding = %q, want none", tc.name, got)
+		}
+		if w.Body.String() != tc.body {
+			t.Errorf("%s: body changed: %.40q", tc.name, w.Body.String())
+		}
+	}
+}
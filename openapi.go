@@ -0,0 +1,794 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openAPIParam is a query or header parameter of an operation. Path
+// parameters are taken from the route itself.
+type openAPIParam struct {
+	In          string
+	Name        string
+	Type        string
+	Required    bool
+	Description string
+}
+
+// operationDoc holds what the router can't tell about a route. Body and
+// Response are zero values of the request and response types; their schemas
+// are derived from the json and example struct tags.
+type operationDoc struct {
+	Summary     string
+	Description string
+	Tag         string
+	Auth        bool
+	Params      []openAPIParam
+	Body        interface{}
+	Consumes    string // defaults to application/json
+	Produces    string // defaults to application/json
+	Status      int    // success status, defaults to 200
+	Response    interface{}
+
+	// GuestAllowed makes the bearer token optional; without one the guest
+	// cookie identifies the caller
+	GuestAllowed bool
+}
+
+// guestCookieParam documents the cookie of routes that serve guests
+var guestCookieParam = openAPIParam{In: "cookie", Name: guestCookie, Type: "string", Description: "Guest session, set by the server on a guest's first cart request"}
+
+// operationDocs describes the registered routes, keyed by method and gin path.
+// A route missing from here still appears in the spec, just without a summary
+// or schemas.
+var operationDocs = map[string]operationDoc{
+	"GET /health": {
+		Summary:     "Health check",
+		Description: "Alias of /health/live, kept for existing probes",
+		Tag:         "system",
+		Response:    HealthResponse{},
+	},
+	"GET /health/live": {
+		Summary:     "Liveness probe",
+		Description: "Answers 200 whenever the process is up",
+		Tag:         "system",
+		Response:    HealthResponse{},
+	},
+	"GET /health/ready": {
+		Summary:     "Readiness probe",
+		Description: "Answers 200 once sample data is loaded and storage responds; 503 with the failing components otherwise",
+		Tag:         "system",
+		Response:    HealthResponse{},
+	},
+	"GET /version": {
+		Summary:     "Build information",
+		Description: "Version, git commit, build time and Go version of the running binary",
+		Tag:         "system",
+		Response:    gin.H{},
+	},
+	"GET /metrics": {
+		Summary:  "Prometheus metrics",
+		Tag:      "system",
+		Produces: "text/plain",
+	},
+	"GET /openapi.json": {
+		Summary:  "OpenAPI specification",
+		Tag:      "system",
+		Response: gin.H{},
+	},
+	"GET /swagger/*any": {
+		Summary:     "Swagger UI",
+		Description: "Interactive API documentation; open /swagger/index.html in a browser",
+		Tag:         "system",
+		Produces:    "text/html",
+	},
+	"GET /api/v1/products": {
+		Summary:     "Get all products",
+		Description: "Retrieve a list of all available products",
+		Tag:         "products",
+		Params: []openAPIParam{
+			{In: "query", Name: "category", Type: "string", Description: "Only products in this category (case-insensitive)"},
+			{In: "query", Name: "min_price", Type: "number", Description: "Minimum price (inclusive)"},
+			{In: "query", Name: "max_price", Type: "number", Description: "Maximum price (inclusive)"},
+			{In: "query", Name: "tag", Type: "string", Description: "Only products with this tag (case-insensitive)"},
+			{In: "query", Name: "sort", Type: "string", Description: "Sort order: price_asc, price_desc, rating_desc, name_asc, name_desc or best"},
+			{In: "query", Name: "limit", Type: "integer", Description: "Page size; defaults to DEFAULT_PAGE_SIZE and is capped at MAX_PAGE_SIZE"},
+			{In: "query", Name: "offset", Type: "integer", Description: "Number of products to skip"},
+		},
+		Response: ProductPage{},
+	},
+	"GET /api/v1/products/:id": {
+		Summary:     "Get a single product",
+		Description: "Retrieve a specific product by ID",
+		Tag:         "products",
+		Params: []openAPIParam{
+			{In: "query", Name: "user_id", Type: "string", Description: "User ID to record the view under for recently viewed products"},
+			{In: "header", Name: "If-None-Match", Type: "string", Description: "ETag from an earlier response; answered with 304 when the product is unchanged"},
+		},
+		Response: ProductView{},
+	},
+	"GET /api/v1/products/top": {
+		Summary:     "Get top products",
+		Description: "Retrieve top-rated products",
+		Tag:         "products",
+		Params: []openAPIParam{
+			{In: "query", Name: "limit", Type: "integer", Description: "Number of products to return"},
+		},
+		Response: []ProductView{},
+	},
+	"GET /api/v1/products/low-stock": {
+		Summary:     "Get low-stock products",
+		Description: "Products whose stock is at or below the threshold, lowest stock first, for reordering",
+		Tag:         "products",
+		Params: []openAPIParam{
+			{In: "query", Name: "threshold", Type: "integer", Description: "Highest stock level to include; defaults to LOW_STOCK_THRESHOLD"},
+		},
+		Response: []ProductView{},
+	},
+	"GET /api/v1/categories": {
+		Summary:     "List categories",
+		Description: "Every category in the current catalog with its number of products, alphabetical",
+		Tag:         "products",
+		Response:    []CategoryCount{},
+	},
+	"PUT /api/v1/products/:id": {
+		Summary:     "Update a product",
+		Description: "Replace an existing product's details",
+		Tag:         "products",
+		Auth:        true,
+		Body:        Product{},
+		Response:    ProductView{},
+	},
+	"PATCH /api/v1/products/:id": {
+		Summary:     "Partially update a product",
+		Description: "Change only the fields present in the body; omitted fields keep their values. The resulting product is validated like a full update.",
+		Tag:         "products",
+		Auth:        true,
+		Body:        ProductPatch{},
+		Response:    ProductView{},
+	},
+	"POST /api/v1/products/import": {
+		Summary:     "Import products from CSV",
+		Description: "Create products from a text/csv body whose header row names the columns name, description, price, category, stock, rating and image_url. Every row is validated on its own: bad rows are reported with their line number and skipped while the rest are imported.",
+		Tag:         "products",
+		Auth:        true,
+		Consumes:    "text/csv",
+		Response:    ImportSummary{},
+	},
+	"GET /api/v1/products/export": {
+		Summary:     "Export products as CSV",
+		Description: "Download every product matching the optional filters as products.csv, with the same columns a product import reads plus id",
+		Tag:         "products",
+		Auth:        true,
+		Params: []openAPIParam{
+			{In: "query", Name: "category", Type: "string", Description: "Only products in this category (case-insensitive)"},
+			{In: "query", Name: "min_price", Type: "number", Description: "Minimum price (inclusive)"},
+			{In: "query", Name: "max_price", Type: "number", Description: "Maximum price (inclusive)"},
+			{In: "query", Name: "tag", Type: "string", Description: "Only products with this tag (case-insensitive)"},
+		},
+		Produces: "text/csv",
+	},
+	"DELETE /api/v1/products/:id": {
+		Summary:     "Delete a product",
+		Description: "Delete a product and remove it from every cart that contains it. The product disappears from listings and search but is kept for order history: GET /products/{id} still returns it, marked deleted.",
+		Tag:         "products",
+		Auth:        true,
+		Status:      204,
+	},
+	"GET /api/v1/products/:id/stock-history": {
+		Summary:     "Get stock history",
+		Description: "Retrieve the stock movements of a product, newest first",
+		Tag:         "products",
+		Response:    []StockMovement{},
+	},
+	"GET /api/v1/products/:id/price-history": {
+		Summary:     "Get price history",
+		Description: "Retrieve the changes to a product's regular price, oldest first",
+		Tag:         "products",
+		Response:    []PriceChange{},
+	},
+	"POST /api/v1/products/:id/restock": {
+		Summary:     "Restock a product",
+		Description: "Increase a product's stock and record the movement in the stock ledger",
+		Tag:         "products",
+		Auth:        true,
+		Body:        RestockRequest{},
+		Response:    ProductView{},
+	},
+	"PUT /api/v1/products/stock": {
+		Summary:     "Update stock in bulk",
+		Description: "Set the stock of several products in one call, recording each change in the stock ledger as bulk-adjust. Unknown products are reported per entry and skipped, or reject the whole batch when strict is true.",
+		Tag:         "products",
+		Auth:        true,
+		Params: []openAPIParam{
+			{In: "query", Name: "strict", Type: "boolean", Description: "Reject the whole batch if any product is unknown"},
+		},
+		Body:     []StockUpdate{},
+		Response: map[string]interface{}{},
+	},
+	"GET /api/v1/products/:id/reviews": {
+		Summary:     "Get product reviews",
+		Description: "Retrieve the reviews of a product, newest first",
+		Tag:         "products",
+		Response:    []Review{},
+	},
+	"GET /api/v1/products/:id/related": {
+		Summary:     "Get related products",
+		Description: "\"You might also like\": other products in the same category as the given product, highest rated first",
+		Tag:         "products",
+		Params: []openAPIParam{
+			{In: "query", Name: "limit", Type: "integer", Description: "Number of related products"},
+		},
+		Response: []ProductView{},
+	},
+	"POST /api/v1/products/:id/reviews": {
+		Summary:     "Review a product",
+		Description: "Rate a product from 1 to 5 with an optional comment. The product's rating becomes the average of all its reviews.",
+		Tag:         "products",
+		Auth:        true,
+		Body:        ReviewRequest{},
+		Status:      201,
+		Response:    Review{},
+	},
+	"GET /api/v1/cart": {
+		Summary:      "Get your cart",
+		Description:  "Retrieve the caller's shopping cart: the token user's, or without a token the guest cart named by the guest_cart cookie",
+		Tag:          "cart",
+		GuestAllowed: true,
+		Params:       []openAPIParam{guestCookieParam},
+		Response:     CartView{},
+	},
+	"POST /api/v1/cart/add": {
+		Summary:      "Add product to cart",
+		Description:  "Add a product to the caller's shopping cart. Without a token the item goes into a guest cart identified by the guest_cart cookie, which is set if missing.",
+		Tag:          "cart",
+		GuestAllowed: true,
+		Params:       []openAPIParam{guestCookieParam},
+		Body:         CartItem{},
+		Response:     CartView{},
+	},
+	"POST /api/v1/cart/merge": {
+		Summary:     "Merge the guest cart into the user's cart",
+		Description: "On login, fold the cart of the guest_cart cookie into the authenticated user's cart. Quantities of products in both are summed and capped at the available stock; products that no longer exist are dropped. The guest cart and cookie are removed.",
+		Tag:         "cart",
+		Auth:        true,
+		Params:      []openAPIParam{guestCookieParam},
+		Response:    CartView{},
+	},
+	"POST /api/v1/cart/:userID/batch": {
+		Summary:     "Add several products to cart",
+		Description: "Add a list of products to the user's cart in one step. The items are all applied or none are: if any item is invalid the cart is left untouched and the error names the offending index.",
+		Tag:         "cart",
+		Auth:        true,
+		Body:        []CartItem{},
+		Response:    CartView{},
+	},
+	"DELETE /api/v1/cart/remove": {
+		Summary:      "Remove item from cart",
+		Description:  "Remove a product from the caller's shopping cart, a guest's included",
+		Tag:          "cart",
+		GuestAllowed: true,
+		Params:       []openAPIParam{guestCookieParam},
+		Body:         CartItem{},
+		Response:     CartView{},
+	},
+	"GET /api/v1/cart/:userID": {
+		Summary:     "Get user's cart",
+		Description: "Retrieve the user's shopping cart, with the total recomputed from current prices",
+		Tag:         "cart",
+		Auth:        true,
+		Response:    CartView{},
+	},
+	"DELETE /api/v1/cart/:userID/clear": {
+		Summary:     "Clear cart",
+		Description: "Remove every item from the user's shopping cart",
+		Tag:         "cart",
+		Auth:        true,
+		Response:    Cart{},
+	},
+	"POST /api/v1/cart/:userID/save/:productID": {
+		Summary:     "Save a cart item for later",
+		Description: "Move a product from the cart to the saved list and recalculate the cart total. Saved items don't hold stock.",
+		Tag:         "cart",
+		Auth:        true,
+		Response:    CartView{},
+	},
+	"POST /api/v1/cart/:userID/unsave/:productID": {
+		Summary:     "Move a saved item back to the cart",
+		Description: "Move a product from the saved list back into the cart and recalculate the cart total. The product must still exist and have enough stock.",
+		Tag:         "cart",
+		Auth:        true,
+		Response:    CartView{},
+	},
+	"GET /api/v1/cart/:userID/estimate": {
+		Summary:     "Estimate cart total",
+		Description: "Preview subtotal, tax, shipping, discounts and grand total for the user's cart without creating an order",
+		Tag:         "cart",
+		Auth:        true,
+		Params: []openAPIParam{
+			{In: "query", Name: "coupon", Type: "string", Description: "Coupon code to apply"},
+			{In: "query", Name: "shipping_method", Type: "string", Description: "Shipping method: standard, express or overnight"},
+		},
+		Response: CartEstimate{},
+	},
+	"POST /api/v1/cart/:userID/shipping": {
+		Summary:     "Quote shipping for the cart",
+		Description: "List shipping options with costs and delivery estimates for sending the user's cart to a destination, priced by cart weight",
+		Tag:         "cart",
+		Auth:        true,
+		Body:        ShippingQuoteRequest{},
+		Response:    ShippingQuote{},
+	},
+	"POST /api/v1/cart/:userID/coupons": {
+		Summary:     "Apply a coupon to the cart",
+		Description: "Apply a coupon code to the user's cart. Applying a coupon that is already on the cart is rejected unless coupon stacking is enabled.",
+		Tag:         "cart",
+		Auth:        true,
+		Body:        ApplyCouponRequest{},
+		Response:    Cart{},
+	},
+	"POST /api/v1/checkout": {
+		Summary:     "Checkout",
+		Description: "Complete the checkout process and create an order",
+		Tag:         "checkout",
+		Auth:        true,
+		Params: []openAPIParam{
+			{In: "query", Name: "discount_code", Type: "string", Description: "Discount code to redeem"},
+			{In: "header", Name: "Idempotency-Key", Type: "string", Description: "Retrying with the same key returns the original order instead of creating another"},
+		},
+		Body:     CheckoutRequest{},
+		Response: Order{},
+	},
+	"GET /api/v1/orders/:userID": {
+		Summary:     "Get order history",
+		Description: "Retrieve the user's order history, newest first",
+		Tag:         "orders",
+		Auth:        true,
+		Response:    []Order{},
+	},
+	"GET /api/v1/orders/detail/:orderID": {
+		Summary:     "Get an order",
+		Description: "Retrieve one of the caller's orders with its subtotal, tax and total",
+		Tag:         "orders",
+		Auth:        true,
+		Response:    OrderDetail{},
+	},
+	"GET /api/v1/orders/detail/:orderID/receipt": {
+		Summary:     "Download an order receipt",
+		Description: "Download an itemized receipt of one of the caller's orders with its subtotal, discount, tax, shipping and total. format=text returns the same receipt as plain text suitable for email.",
+		Tag:         "orders",
+		Auth:        true,
+		Params: []openAPIParam{
+			{In: "query", Name: "format", Type: "string", Description: "json (default) or text"},
+		},
+		Response: Receipt{},
+	},
+	"POST /api/v1/orders/:orderID/ship": {
+		Summary:     "Mark order lines shipped",
+		Description: "Mark one or more lines of an order as shipped and update the derived order status. Requires the admin role.",
+		Tag:         "orders",
+		Auth:        true,
+		Body:        ShipItemsRequest{},
+		Response:    Order{},
+	},
+	"POST /api/v1/orders/:orderID/status": {
+		Summary:     "Change order status",
+		Description: "Move an order along pending -> paid -> shipped -> delivered, or cancel it before it ships. Shipping marks every line shipped and cancelling returns the items to stock. Requires the admin role.",
+		Tag:         "orders",
+		Auth:        true,
+		Body:        OrderStatusRequest{},
+		Response:    Order{},
+	},
+	"POST /api/v1/orders/:orderID/cancel": {
+		Summary:     "Cancel an order",
+		Description: "Cancel one of the caller's orders that hasn't shipped yet and return its items to stock. Admins may cancel any order.",
+		Tag:         "orders",
+		Auth:        true,
+		Response:    Order{},
+	},
+	"GET /api/v1/recommendations/:userID": {
+		Summary:     "Get product recommendations",
+		Description: "Get personalized product recommendations based on order history, recently viewed products, search history, or popular products",
+		Tag:         "recommendations",
+		Auth:        true,
+		Params: []openAPIParam{
+			{In: "query", Name: "limit", Type: "integer", Description: "Number of recommendations"},
+		},
+		Response: []ProductView{},
+	},
+	"GET /api/v1/users/:userID/recently-viewed": {
+		Summary:     "Get recently viewed products",
+		Description: "Products the user viewed through GET /products/{id}?user_id=, most recent first, without repeats",
+		Tag:         "recommendations",
+		Auth:        true,
+		Response:    []ProductView{},
+	},
+
+	"GET /api/v1/search": {
+		Summary:     "Search products",
+		Description: "Search for products, most relevant first, and record search history",
+		Tag:         "search",
+		Params: []openAPIParam{
+			{In: "query", Name: "q", Type: "string", Required: true, Description: "Search query"},
+			{In: "query", Name: "user_id", Type: "string", Description: "User ID for tracking search history"},
+			{In: "query", Name: "category", Type: "string", Description: "Only products in this category (case-insensitive)"},
+			{In: "query", Name: "limit", Type: "integer", Description: "Page size; defaults to DEFAULT_PAGE_SIZE and is capped at MAX_PAGE_SIZE"},
+			{In: "query", Name: "offset", Type: "integer", Description: "Number of results to skip"},
+			{In: "query", Name: "debug", Type: "boolean", Description: "Return each result's relevance score"},
+		},
+		Response: ProductPage{},
+	},
+	"GET /api/v1/search/related": {
+		Summary:     "Get related searches",
+		Description: "Get queries frequently made by users who also searched for the given query",
+		Tag:         "search",
+		Params: []openAPIParam{
+			{In: "query", Name: "q", Type: "string", Required: true, Description: "Search query"},
+			{In: "query", Name: "limit", Type: "integer", Description: "Number of related searches"},
+		},
+		Response: []RelatedSearch{},
+	},
+	"GET /api/v1/search/trending": {
+		Summary:     "Get trending searches",
+		Description: "Get the queries searched most often across all users within the trending window (TRENDING_WINDOW, 24h by default)",
+		Tag:         "search",
+		Params: []openAPIParam{
+			{In: "query", Name: "limit", Type: "integer", Description: "Number of trending searches"},
+		},
+		Response: []TrendingSearch{},
+	},
+	"GET /api/v1/search/suggest": {
+		Summary:     "Suggest product names",
+		Description: "Type-ahead suggestions for a partial query: product names starting with the query, then names with a later word starting with it, each group ordered by rating",
+		Tag:         "search",
+		Params: []openAPIParam{
+			{In: "query", Name: "q", Type: "string", Description: "Partial query"},
+		},
+		Response: []string{},
+	},
+	"POST /api/v1/admin/recompute-totals": {
+		Summary:     "Recompute cart and order totals",
+		Description: "Recompute every cart total from current product prices and round every order total to cents, reporting how many were corrected. Requires confirm=true.",
+		Tag:         "admin",
+		Auth:        true,
+		Params: []openAPIParam{
+			{In: "query", Name: "confirm", Type: "boolean", Required: true, Description: "Must be true to run the maintenance task"},
+		},
+		Response: map[string]interface{}{},
+	},
+	"POST /api/v1/admin/orders/cancel": {
+		Summary:     "Cancel orders in bulk",
+		Description: "Cancel a batch of orders, returning their items to stock and reporting the outcome per order",
+		Tag:         "admin",
+		Auth:        true,
+		Body:        BulkCancelRequest{},
+		Response:    map[string]interface{}{},
+	},
+	"GET /api/v1/admin/carts": {
+		Summary:     "List carts",
+		Description: "List every user's cart, most recently updated first, for support and debugging",
+		Tag:         "admin",
+		Auth:        true,
+		Params: []openAPIParam{
+			{In: "query", Name: "limit", Type: "integer", Description: "Page size; defaults to DEFAULT_PAGE_SIZE and is capped at MAX_PAGE_SIZE"},
+			{In: "query", Name: "offset", Type: "integer", Description: "Number of carts to skip"},
+		},
+		Response: CartPage{},
+	},
+	"GET /api/v1/admin/abandoned-carts": {
+		Summary:     "List abandoned carts",
+		Description: "Non-empty carts left unchanged for at least idle_minutes, longest idle first, for follow-up marketing",
+		Tag:         "admin",
+		Auth:        true,
+		Params: []openAPIParam{
+			{In: "query", Name: "idle_minutes", Type: "integer", Required: true, Description: "Minutes a cart must have gone without changes"},
+		},
+		Response: []AbandonedCart{},
+	},
+	"GET /api/v1/admin/analytics/sales": {
+		Summary:     "Get a sales summary",
+		Description: "Total revenue, order count, average order value and best-selling products for orders placed in a date range, cancelled orders excluded",
+		Tag:         "admin",
+		Auth:        true,
+		Params: []openAPIParam{
+			{In: "query", Name: "from", Type: "string", Description: "Start of the range, an RFC 3339 time or a YYYY-MM-DD date; defaults to 30 days before to"},
+			{In: "query", Name: "to", Type: "string", Description: "End of the range, an RFC 3339 time or a YYYY-MM-DD date (which includes the whole day); defaults to now"},
+		},
+		Response: SalesSummary{},
+	},
+	"GET /api/v1/admin/analytics/categories": {
+		Summary:     "Get revenue by category",
+		Description: "Units sold and revenue per product category for orders placed in a date range, cancelled orders excluded. Revenue is line price times quantity, before discounts and shipping.",
+		Tag:         "admin",
+		Auth:        true,
+		Params: []openAPIParam{
+			{In: "query", Name: "from", Type: "string", Description: "Start of the range, an RFC 3339 time or a YYYY-MM-DD date; defaults to 30 days before to"},
+			{In: "query", Name: "to", Type: "string", Description: "End of the range, an RFC 3339 time or a YYYY-MM-DD date (which includes the whole day); defaults to now"},
+		},
+		Response: CategoryBreakdown{},
+	},
+	"GET /api/v1/admin/webhooks": {
+		Summary:     "List webhooks",
+		Description: "List the URLs that receive order events",
+		Tag:         "admin",
+		Auth:        true,
+		Response:    []Webhook{},
+	},
+	"POST /api/v1/admin/webhooks": {
+		Summary:     "Register a webhook",
+		Description: "Register a URL to receive order.created and order.status_changed events. Each delivery is a JSON POST signed with an X-Webhook-Signature header (sha256= followed by the hex HMAC-SHA256 of the body keyed with WEBHOOK_SECRET) and is retried with backoff until it gets a 2xx answer.",
+		Tag:         "admin",
+		Auth:        true,
+		Body:        WebhookRequest{},
+		Status:      201,
+		Response:    Webhook{},
+	},
+	"DELETE /api/v1/admin/webhooks/:id": {
+		Summary:     "Delete a webhook",
+		Description: "Stop sending order events to a webhook",
+		Tag:         "admin",
+		Auth:        true,
+		Status:      204,
+	},
+}
+
+// openAPIHandler serves the OpenAPI document for every route registered on
+// engine. The document is built on the first request, once all routes exist.
+func openAPIHandler(engine *gin.Engine, serverURL string) gin.HandlerFunc {
+	var once sync.Once
+	var spec gin.H
+	return func(c *gin.Context) {
+		once.Do(func() {
+			spec = buildOpenAPISpec(engine.Routes(), serverURL)
+		})
+		c.JSON(http.StatusOK, spec)
+	}
+}
+
+// buildOpenAPISpec turns the route table into an OpenAPI 3.0 document
+func buildOpenAPISpec(routes gin.RoutesInfo, serverURL string) gin.H {
+	schemas := gin.H{}
+	paths := gin.H{}
+	for _, route := range routes {
+		path, pathParams := openAPIPath(route.Path)
+		doc := operationDocs[route.Method+" "+route.Path]
+
+		op := gin.H{
+			"operationId": strings.ToLower(route.Method) + strings.NewReplacer("/", "_", "{", "", "}", "", "-", "_").Replace(path),
+			"responses":   openAPIResponses(doc, schemas),
+		}
+		if doc.Summary != "" {
+			op["summary"] = doc.Summary
+		}
+		if doc.Description != "" {
+			op["description"] = doc.Description
+		}
+		if doc.Tag != "" {
+			op["tags"] = []string{doc.Tag}
+		}
+		if doc.Auth {
+			op["security"] = []gin.H{{"BearerAuth": []string{}}}
+		}
+		if doc.GuestAllowed {
+			op["security"] = []gin.H{{"BearerAuth": []string{}}, {}}
+		}
+
+		var params []gin.H
+		for _, name := range pathParams {
+			params = append(params, gin.H{
+				"name":     name,
+				"in":       "path",
+				"required": true,
+				"schema":   gin.H{"type": "string"},
+			})
+		}
+		for _, p := range doc.Params {
+			param := gin.H{
+				"name":   p.Name,
+				"in":     p.In,
+				"schema": gin.H{"type": p.Type},
+			}
+			if p.Required {
+				param["required"] = true
+			}
+			if p.Description != "" {
+				param["description"] = p.Description
+			}
+			params = append(params, param)
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+
+		if doc.Body != nil {
+			op["requestBody"] = gin.H{
+				"required": true,
+				"content":  gin.H{contentType(doc.Consumes): gin.H{"schema": schemaFor(reflect.TypeOf(doc.Body), schemas)}},
+			}
+		} else if doc.Consumes != "" {
+			op["requestBody"] = gin.H{
+				"required": true,
+				"content":  gin.H{doc.Consumes: gin.H{"schema": gin.H{"type": "string"}}},
+			}
+		}
+
+		item, ok := paths[path].(gin.H)
+		if !ok {
+			item = gin.H{}
+			paths[path] = item
+		}
+		item[strings.ToLower(route.Method)] = op
+	}
+
+	// Referenced by every operation's error response
+	schemaFor(reflect.TypeOf(ErrorResponse{}), schemas)
+
+	return gin.H{
+		"openapi": "3.0.3",
+		"info": gin.H{
+			"title":       "SHITty E-commerce API",
+			"description": "A comprehensive e-commerce API with product management, shopping cart, orders, and recommendations",
+			"version":     "1.0.0",
+		},
+		"servers": []gin.H{{"url": serverURL}},
+		"paths":   paths,
+		"components": gin.H{
+			"schemas": schemas,
+			"securitySchemes": gin.H{
+				"BearerAuth": gin.H{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+	}
+}
+
+// openAPIPath converts a gin path such as /cart/:userID or /swagger/*any to
+// OpenAPI's /cart/{userID}, returning the parameter names in order
+func openAPIPath(ginPath string) (string, []string) {
+	segments := strings.Split(ginPath, "/")
+	var params []string
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			params = append(params, segment[1:])
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/"), params
+}
+
+// openAPIResponses describes the success response of doc plus the shared
+// error envelope
+func openAPIResponses(doc operationDoc, schemas gin.H) gin.H {
+	status := doc.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := gin.H{"description": http.StatusText(status)}
+	if doc.Response != nil {
+		success["content"] = gin.H{contentType(doc.Produces): gin.H{"schema": schemaFor(reflect.TypeOf(doc.Response), schemas)}}
+	} else if doc.Produces != "" {
+		success["content"] = gin.H{doc.Produces: gin.H{"schema": gin.H{"type": "string"}}}
+	}
+
+	return gin.H{
+		strconv.Itoa(status): success,
+		"default": gin.H{
+			"description": "Error",
+			"content":     gin.H{"application/json": gin.H{"schema": gin.H{"$ref": "#/components/schemas/ErrorResponse"}}},
+		},
+	}
+}
+
+func contentType(mediaType string) string {
+	if mediaType == "" {
+		return "application/json"
+	}
+	return mediaType
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaFor returns the JSON schema of t as encoding/json would serialize it.
+// Named structs are added to schemas once and referenced by $ref.
+func schemaFor(t reflect.Type, schemas gin.H) gin.H {
+	if t == timeType {
+		return gin.H{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaFor(t.Elem(), schemas)
+	case reflect.Bool:
+		return gin.H{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return gin.H{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return gin.H{"type": "number"}
+	case reflect.String:
+		return gin.H{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return gin.H{"type": "string", "format": "byte"}
+		}
+		return gin.H{"type": "array", "items": schemaFor(t.Elem(), schemas)}
+	case reflect.Map:
+		return gin.H{"type": "object", "additionalProperties": schemaFor(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, schemas)
+		}
+		if _, ok := schemas[t.Name()]; !ok {
+			// Placeholder first so self-referencing types terminate
+			schemas[t.Name()] = gin.H{}
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return gin.H{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	// interface{} and anything else: any value
+	return gin.H{}
+}
+
+// structSchema lists the JSON properties of a struct, flattening embedded
+// structs the way encoding/json does
+func structSchema(t reflect.Type, schemas gin.H) gin.H {
+	properties := gin.H{}
+	addStructProperties(t, properties, schemas)
+	return gin.H{"type": "object", "properties": properties}
+}
+
+func addStructProperties(t reflect.Type, properties, schemas gin.H) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			addStructProperties(field.Type, properties, schemas)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema := schemaFor(field.Type, schemas)
+		if example, ok := exampleValue(field.Type, field.Tag.Get("example")); ok && schema["$ref"] == nil {
+			schema["example"] = example
+		}
+		properties[name] = schema
+	}
+}
+
+// exampleValue parses an example struct tag into a value of the field's kind
+func exampleValue(t reflect.Type, raw string) (interface{}, bool) {
+	if raw == "" {
+		return nil, false
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		v, err := strconv.ParseBool(raw)
+		return v, err == nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v, err := strconv.ParseInt(raw, 10, 64)
+		return v, err == nil
+	case reflect.Float32, reflect.Float64:
+		v, err := strconv.ParseFloat(raw, 64)
+		return v, err == nil
+	case reflect.String, reflect.Struct:
+		return raw, true
+	}
+	return nil, false
+}
@@ -0,0 +1,1013 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema is applied on every start; each statement is idempotent. It
+// creates missing tables in their latest shape, while sqliteMigrations bring
+// tables written by older builds up to date.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS products (
+	id          TEXT PRIMARY KEY,
+	name        TEXT NOT NULL,
+	description TEXT NOT NULL,
+	price       REAL NOT NULL,
+	category    TEXT NOT NULL,
+	stock       INTEGER NOT NULL,
+	rating      REAL NOT NULL,
+	image_url   TEXT NOT NULL,
+	weight      REAL NOT NULL DEFAULT 0,
+	tags        TEXT NOT NULL DEFAULT '[]',
+	sale_price  REAL NOT NULL DEFAULT 0,
+	sale_start  TEXT,
+	sale_end    TEXT,
+	deleted_at  TEXT,
+	sort_name   TEXT NOT NULL DEFAULT '' -- lowercased name, for the default listing order
+);
+
+CREATE TABLE IF NOT EXISTS carts (
+	id           TEXT PRIMARY KEY,
+	user_id      TEXT NOT NULL UNIQUE,
+	items        TEXT NOT NULL,
+	saved        TEXT NOT NULL DEFAULT '[]',
+	total        REAL NOT NULL,
+	coupons      TEXT NOT NULL,
+	updated      TEXT NOT NULL,
+	reservations TEXT NOT NULL DEFAULT '{}' -- product ID -> when the line's hold on stock lapses
+);
+
+CREATE TABLE IF NOT EXISTS orders (
+	id                 TEXT PRIMARY KEY,
+	user_id            TEXT NOT NULL,
+	items              TEXT NOT NULL,
+	total              REAL NOT NULL,
+	status             TEXT NOT NULL,
+	created            TEXT NOT NULL,
+	completed          TEXT,
+	shipping_method    TEXT NOT NULL,
+	shipping_cost      REAL NOT NULL,
+	estimated_delivery TEXT NOT NULL,
+	discount_code      TEXT NOT NULL DEFAULT '',
+	discount           REAL NOT NULL DEFAULT 0,
+	order_number       TEXT NOT NULL DEFAULT '',
+	tax                REAL NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS orders_user_id ON orders (user_id);
+
+CREATE TABLE IF NOT EXISTS search_history (
+	id        TEXT PRIMARY KEY,
+	user_id   TEXT NOT NULL,
+	query     TEXT NOT NULL,
+	timestamp TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS search_history_user_id ON search_history (user_id);
+
+CREATE TABLE IF NOT EXISTS product_visits (
+	user_id    TEXT NOT NULL,
+	product_id TEXT NOT NULL,
+	viewed     INTEGER NOT NULL, -- Unix nanoseconds, so visits sort by time
+	PRIMARY KEY (user_id, product_id)
+);
+
+CREATE TABLE IF NOT EXISTS coupons (
+	code        TEXT PRIMARY KEY,
+	percent_off REAL NOT NULL,
+	amount_off  REAL NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS discount_codes (
+	code        TEXT PRIMARY KEY,
+	percent_off REAL NOT NULL,
+	amount_off  REAL NOT NULL,
+	expires_at  TEXT NOT NULL,
+	max_uses    INTEGER NOT NULL,
+	uses        INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS stock_movements (
+	seq        INTEGER PRIMARY KEY AUTOINCREMENT,
+	product_id TEXT NOT NULL,
+	delta      INTEGER NOT NULL,
+	reason     TEXT NOT NULL,
+	timestamp  TEXT NOT NULL,
+	order_id   TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS stock_movements_product_id ON stock_movements (product_id);
+
+CREATE TABLE IF NOT EXISTS price_changes (
+	seq        INTEGER PRIMARY KEY AUTOINCREMENT,
+	product_id TEXT NOT NULL,
+	old_price  REAL NOT NULL,
+	new_price  REAL NOT NULL,
+	timestamp  TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS price_changes_product_id ON price_changes (product_id);
+
+-- Named counters, such as the order number sequence
+CREATE TABLE IF NOT EXISTS sequences (
+	name  TEXT PRIMARY KEY,
+	value INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	user_id  TEXT NOT NULL,
+	key      TEXT NOT NULL,
+	order_id TEXT NOT NULL,
+	created  INTEGER NOT NULL, -- Unix nanoseconds, so pruning can compare
+	PRIMARY KEY (user_id, key)
+);
+
+CREATE TABLE IF NOT EXISTS webhooks (
+	seq     INTEGER PRIMARY KEY AUTOINCREMENT,
+	id      TEXT NOT NULL UNIQUE,
+	url     TEXT NOT NULL,
+	created TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS reviews (
+	seq        INTEGER PRIMARY KEY AUTOINCREMENT,
+	id         TEXT NOT NULL UNIQUE,
+	product_id TEXT NOT NULL,
+	user_id    TEXT NOT NULL,
+	rating     INTEGER NOT NULL,
+	comment    TEXT NOT NULL,
+	verified   INTEGER NOT NULL DEFAULT 0,
+	timestamp  TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS reviews_product_id ON reviews (product_id);
+`
+
+// sqliteMigration moves a database up one schema version. It runs after
+// sqliteSchema, so it must leave alone a table that schema just created.
+type sqliteMigration func(tx *sql.Tx) error
+
+// sqliteMigrations upgrade databases written by older builds, in the order
+// the changes were made. The database's user_version counts how many have
+// been applied, so only ever append to this list.
+var sqliteMigrations = []sqliteMigration{
+	addColumn("carts", "reservations", "TEXT NOT NULL DEFAULT '{}'"),
+	makeOrderCompletedNullable,
+	addColumn("orders", "discount_code", "TEXT NOT NULL DEFAULT ''"),
+	addColumn("orders", "discount", "REAL NOT NULL DEFAULT 0"),
+	addColumn("products", "weight", "REAL NOT NULL DEFAULT 0"),
+	addColumn("reviews", "verified", "INTEGER NOT NULL DEFAULT 0"),
+	addColumn("carts", "saved", "TEXT NOT NULL DEFAULT '[]'"),
+	addColumn("products", "deleted_at", "TEXT"),
+	addColumn("products", "tags", "TEXT NOT NULL DEFAULT '[]'"),
+	addColumn("orders", "order_number", "TEXT NOT NULL DEFAULT ''"),
+	addColumn("orders", "tax", "REAL NOT NULL DEFAULT 0"),
+	addProductSortName,
+}
+
+// migrateSQLite applies the migrations the database hasn't seen yet, each in
+// its own transaction together with the user_version bump
+func migrateSQLite(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	for ; version < len(sqliteMigrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := sqliteMigrations[version](tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrating database to version %d: %w", version+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumn adds a column unless the table already has it
+func addColumn(table, column, definition string) sqliteMigration {
+	return func(tx *sql.Tx) error {
+		columns, err := tableColumns(tx, table)
+		if err != nil {
+			return err
+		}
+		if _, exists := columns[column]; exists {
+			return nil
+		}
+		_, err = tx.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition)
+		return err
+	}
+}
+
+// makeOrderCompletedNullable rebuilds the orders table, since SQLite can't
+// drop a NOT NULL constraint in place. Orders used to get a completed time
+// at checkout; only delivered orders keep it.
+func makeOrderCompletedNullable(tx *sql.Tx) error {
+	columns, err := tableColumns(tx, "orders")
+	if err != nil {
+		return err
+	}
+	if notNull := columns["completed"]; !notNull {
+		return nil
+	}
+
+	_, err = tx.Exec(`
+CREATE TABLE orders_migrated (
+	id                 TEXT PRIMARY KEY,
+	user_id            TEXT NOT NULL,
+	items              TEXT NOT NULL,
+	total              REAL NOT NULL,
+	status             TEXT NOT NULL,
+	created            TEXT NOT NULL,
+	completed          TEXT,
+	shipping_method    TEXT NOT NULL,
+	shipping_cost      REAL NOT NULL,
+	estimated_delivery TEXT NOT NULL
+);
+INSERT INTO orders_migrated
+	SELECT id, user_id, items, total, status, created,
+		CASE WHEN status = '` + orderStatusDelivered + `' THEN completed END,
+		shipping_method, shipping_cost, estimated_delivery
+	FROM orders;
+DROP TABLE orders;
+ALTER TABLE orders_migrated RENAME TO orders;
+CREATE INDEX orders_user_id ON orders (user_id);
+`)
+	return err
+}
+
+// addProductSortName adds and fills in products.sort_name, and indexes the
+// default listing order on it. The names are lowercased in Go, as
+// productSorts does, since SQLite's lower() only folds ASCII.
+func addProductSortName(tx *sql.Tx) error {
+	columns, err := tableColumns(tx, "products")
+	if err != nil {
+		return err
+	}
+	if _, exists := columns["sort_name"]; !exists {
+		if _, err := tx.Exec(`ALTER TABLE products ADD COLUMN sort_name TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+		rows, err := tx.Query(`SELECT id, name FROM products`)
+		if err != nil {
+			return err
+		}
+		names := map[string]string{}
+		for rows.Next() {
+			var id, name string
+			if err := rows.Scan(&id, &name); err != nil {
+				rows.Close()
+				return err
+			}
+			names[id] = name
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for id, name := range names {
+			if _, err := tx.Exec(`UPDATE products SET sort_name = ? WHERE id = ?`, strings.ToLower(name), id); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS products_sort_name ON products (sort_name, id)`)
+	return err
+}
+
+// tableColumns maps each column of table to whether it is NOT NULL
+func tableColumns(tx *sql.Tx, table string) (map[string]bool, error) {
+	rows, err := tx.Query(`PRAGMA table_info(` + table + `)`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := map[string]bool{}
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, typ        string
+			defaultValue     sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &defaultValue, &pk); err != nil {
+			return nil, err
+		}
+		columns[name] = notNull == 1
+	}
+	return columns, rows.Err()
+}
+
+// SQLiteStore persists everything in a SQLite database. Cart and order lines
+// are stored as JSON columns since they are always read and written with
+// their parent row.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// newSQLiteStore opens (or creates) the database at path, applies the schema
+// and migrates tables left by older builds. ":memory:" gives a throwaway
+// database.
+func newSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// A single connection keeps writes serialized and lets ":memory:"
+	// databases survive between calls
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+// Close releases the database
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// Ping runs a trivial query against the products table, so it fails when the
+// database can't be read rather than only when the handle is closed
+func (s *SQLiteStore) Ping() error {
+	var exists bool
+	return s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM products)`).Scan(&exists)
+}
+
+const productColumns = `id, name, description, price, category, stock, rating, image_url, weight, tags, sale_price, sale_start, sale_end, deleted_at`
+
+func (s *SQLiteStore) GetProduct(id string) (Product, error) {
+	row := s.db.QueryRow(`SELECT `+productColumns+` FROM products WHERE id = ? AND deleted_at IS NULL`, id)
+	product, err := scanProduct(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Product{}, ErrNotFound
+	}
+	return product, err
+}
+
+func (s *SQLiteStore) GetProductIncludingDeleted(id string) (Product, error) {
+	row := s.db.QueryRow(`SELECT `+productColumns+` FROM products WHERE id = ?`, id)
+	product, err := scanProduct(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Product{}, ErrNotFound
+	}
+	return product, err
+}
+
+func (s *SQLiteStore) GetProducts(ids []string) (map[string]Product, error) {
+	found := make(map[string]Product, len(ids))
+	if len(ids) == 0 {
+		return found, nil
+	}
+
+	args := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	rows, err := s.db.Query(`SELECT `+productColumns+` FROM products WHERE id IN (`+placeholders+`) AND deleted_at IS NULL`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		product, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		found[product.ID] = product
+	}
+	return found, rows.Err()
+}
+
+// productListingOrder is the default listing order. sort_name holds the name
+// lowercased in Go and compares bytewise, so this matches
+// compareDefaultOrder exactly, non-ASCII names included.
+const productListingOrder = `ORDER BY sort_name, id`
+
+func (s *SQLiteStore) ListProducts() ([]Product, error) {
+	return s.queryProducts(`SELECT ` + productColumns + ` FROM products WHERE deleted_at IS NULL ` + productListingOrder)
+}
+
+func (s *SQLiteStore) ListProductsPage(offset, limit int) ([]Product, int, error) {
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM products WHERE deleted_at IS NULL`).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	window, err := s.queryProducts(`SELECT `+productColumns+` FROM products WHERE deleted_at IS NULL `+productListingOrder+` LIMIT ? OFFSET ?`, limit, offset)
+	return window, total, err
+}
+
+// queryProducts runs a query selecting productColumns
+func (s *SQLiteStore) queryProducts(query string, args ...interface{}) ([]Product, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	productList := []Product{}
+	for rows.Next() {
+		product, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		productList = append(productList, product)
+	}
+	return productList, rows.Err()
+}
+
+func (s *SQLiteStore) SaveProduct(product Product) error {
+	tags, err := json.Marshal(product.Tags)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO products (`+productColumns+`, sort_name) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		product.ID, product.Name, product.Description, product.Price, product.Category,
+		product.Stock, product.Rating, product.ImageURL, product.Weight, string(tags), product.SalePrice,
+		formatOptionalTime(product.SaleStart), formatOptionalTime(product.SaleEnd), formatOptionalTime(product.DeletedAt),
+		strings.ToLower(product.Name))
+	return err
+}
+
+func (s *SQLiteStore) DeleteProduct(id string, at time.Time) error {
+	result, err := s.db.Exec(`UPDATE products SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL`, formatTime(at), id)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ReserveStock relies on the conditional UPDATE being atomic, so concurrent
+// reservations from any number of connections or processes serialize on it
+func (s *SQLiteStore) ReserveStock(productID string, quantity int) error {
+	result, err := s.db.Exec(`UPDATE products SET stock = stock - ? WHERE id = ? AND stock >= ? AND deleted_at IS NULL`, quantity, productID, quantity)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 1 {
+		return nil
+	}
+
+	if _, err := s.GetProduct(productID); err != nil {
+		return err
+	}
+	return ErrInsufficientStock
+}
+
+func (s *SQLiteStore) ReleaseStock(productID string, quantity int) error {
+	result, err := s.db.Exec(`UPDATE products SET stock = stock + ? WHERE id = ?`, quantity, productID)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+const cartColumns = `id, user_id, items, saved, total, coupons, updated, reservations`
+
+func (s *SQLiteStore) GetCart(userID string) (Cart, error) {
+	row := s.db.QueryRow(`SELECT `+cartColumns+` FROM carts WHERE user_id = ?`, userID)
+	cart, err := scanCart(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Cart{}, ErrNotFound
+	}
+	return cart, err
+}
+
+func (s *SQLiteStore) SaveCart(cart Cart) error {
+	items, err := json.Marshal(cart.Items)
+	if err != nil {
+		return err
+	}
+	saved, err := json.Marshal(cart.Saved)
+	if err != nil {
+		return err
+	}
+	coupons, err := json.Marshal(cart.Coupons)
+	if err != nil {
+		return err
+	}
+	reservations, err := json.Marshal(cart.Reservations)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO carts (`+cartColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		cart.ID, cart.UserID, string(items), string(saved), cart.Total, string(coupons), formatTime(cart.Updated),
+		string(reservations))
+	return err
+}
+
+func (s *SQLiteStore) ListCarts() ([]Cart, error) {
+	rows, err := s.db.Query(`SELECT ` + cartColumns + ` FROM carts`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cartList := []Cart{}
+	for rows.Next() {
+		cart, err := scanCart(rows)
+		if err != nil {
+			return nil, err
+		}
+		cartList = append(cartList, cart)
+	}
+	return cartList, rows.Err()
+}
+
+func (s *SQLiteStore) DeleteCart(userID string) error {
+	result, err := s.db.Exec(`DELETE FROM carts WHERE user_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// PruneCarts compares timestamps in Go because updated is stored as RFC 3339
+// text, which doesn't sort reliably as a string. Matching on updated as well
+// as id leaves a cart alone if it was saved again in the meantime.
+func (s *SQLiteStore) PruneCarts(before time.Time) (int, error) {
+	cartList, err := s.ListCarts()
+	if err != nil {
+		return 0, err
+	}
+
+	pruned := 0
+	for _, cart := range cartList {
+		if !cart.Updated.Before(before) {
+			continue
+		}
+		result, err := s.db.Exec(`DELETE FROM carts WHERE id = ? AND updated = ?`, cart.ID, formatTime(cart.Updated))
+		if err != nil {
+			return pruned, err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return pruned, err
+		}
+		pruned += int(affected)
+	}
+	return pruned, nil
+}
+
+const orderColumns = `id, user_id, items, total, status, created, completed, shipping_method, shipping_cost, estimated_delivery, discount_code, discount, order_number, tax`
+
+func (s *SQLiteStore) GetOrder(id string) (Order, error) {
+	row := s.db.QueryRow(`SELECT `+orderColumns+` FROM orders WHERE id = ?`, id)
+	order, err := scanOrder(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Order{}, ErrNotFound
+	}
+	return order, err
+}
+
+func (s *SQLiteStore) SaveOrder(order Order) error {
+	items, err := json.Marshal(order.Items)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO orders (`+orderColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		order.ID, order.UserID, string(items), order.Total, order.Status,
+		formatTime(order.Created), formatOptionalTime(order.Completed),
+		order.ShippingMethod, order.ShippingCost, formatTime(order.EstimatedDelivery),
+		order.DiscountCode, order.Discount, order.Number, order.Tax)
+	return err
+}
+
+// NextOrderNumber bumps the counter in a single statement, so SQLite's
+// write lock keeps concurrent callers from getting the same value
+func (s *SQLiteStore) NextOrderNumber() (int64, error) {
+	var value int64
+	err := s.db.QueryRow(`INSERT INTO sequences (name, value) VALUES ('order_number', 1)
+		ON CONFLICT (name) DO UPDATE SET value = value + 1 RETURNING value`).Scan(&value)
+	return value, err
+}
+
+func (s *SQLiteStore) ListOrders() ([]Order, error) {
+	return s.queryOrders(`SELECT ` + orderColumns + ` FROM orders ORDER BY created, id`)
+}
+
+func (s *SQLiteStore) ListOrdersByUser(userID string) ([]Order, error) {
+	return s.queryOrders(`SELECT `+orderColumns+` FROM orders WHERE user_id = ? ORDER BY created, id`, userID)
+}
+
+func (s *SQLiteStore) queryOrders(query string, args ...interface{}) ([]Order, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orderList := []Order{}
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orderList = append(orderList, order)
+	}
+	return orderList, rows.Err()
+}
+
+func (s *SQLiteStore) AddSearch(search SearchHistory) error {
+	_, err := s.db.Exec(`INSERT INTO search_history (id, user_id, query, timestamp) VALUES (?, ?, ?, ?)`,
+		search.ID, search.UserID, search.Query, formatTime(search.Timestamp))
+	return err
+}
+
+func (s *SQLiteStore) ListSearches() ([]SearchHistory, error) {
+	return s.querySearches(`SELECT id, user_id, query, timestamp FROM search_history ORDER BY rowid`)
+}
+
+func (s *SQLiteStore) ListSearchesByUser(userID string) ([]SearchHistory, error) {
+	return s.querySearches(`SELECT id, user_id, query, timestamp FROM search_history WHERE user_id = ? ORDER BY rowid`, userID)
+}
+
+func (s *SQLiteStore) RecordProductVisit(visit ProductVisit, keep int) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO product_visits (user_id, product_id, viewed) VALUES (?, ?, ?)`,
+		visit.UserID, visit.ProductID, visit.Viewed.UnixNano())
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`DELETE FROM product_visits WHERE user_id = ? AND product_id NOT IN (
+		SELECT product_id FROM product_visits WHERE user_id = ? ORDER BY viewed DESC, rowid DESC LIMIT ?)`,
+		visit.UserID, visit.UserID, keep)
+	return err
+}
+
+func (s *SQLiteStore) ListProductVisits(userID string) ([]ProductVisit, error) {
+	rows, err := s.db.Query(`SELECT user_id, product_id, viewed FROM product_visits WHERE user_id = ? ORDER BY viewed DESC, rowid DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var visits []ProductVisit
+	for rows.Next() {
+		var visit ProductVisit
+		var viewed int64
+		if err := rows.Scan(&visit.UserID, &visit.ProductID, &viewed); err != nil {
+			return nil, err
+		}
+		visit.Viewed = time.Unix(0, viewed)
+		visits = append(visits, visit)
+	}
+	return visits, rows.Err()
+}
+
+func (s *SQLiteStore) querySearches(query string, args ...interface{}) ([]SearchHistory, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var searches []SearchHistory
+	for rows.Next() {
+		var search SearchHistory
+		var timestamp string
+		if err := rows.Scan(&search.ID, &search.UserID, &search.Query, &timestamp); err != nil {
+			return nil, err
+		}
+		if search.Timestamp, err = parseTime(timestamp); err != nil {
+			return nil, err
+		}
+		searches = append(searches, search)
+	}
+	return searches, rows.Err()
+}
+
+func (s *SQLiteStore) GetCoupon(code string) (Coupon, error) {
+	var coupon Coupon
+	err := s.db.QueryRow(`SELECT code, percent_off, amount_off FROM coupons WHERE code = ?`, code).
+		Scan(&coupon.Code, &coupon.PercentOff, &coupon.AmountOff)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Coupon{}, ErrNotFound
+	}
+	return coupon, err
+}
+
+func (s *SQLiteStore) SaveCoupon(coupon Coupon) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO coupons (code, percent_off, amount_off) VALUES (?, ?, ?)`,
+		coupon.Code, coupon.PercentOff, coupon.AmountOff)
+	return err
+}
+
+func (s *SQLiteStore) GetDiscountCode(code string) (DiscountCode, error) {
+	var discount DiscountCode
+	var expiresAt string
+	err := s.db.QueryRow(`SELECT code, percent_off, amount_off, expires_at, max_uses, uses FROM discount_codes WHERE code = ?`, code).
+		Scan(&discount.Code, &discount.PercentOff, &discount.AmountOff, &expiresAt, &discount.MaxUses, &discount.Uses)
+	if errors.Is(err, sql.ErrNoRows) {
+		return DiscountCode{}, ErrNotFound
+	}
+	if err != nil {
+		return DiscountCode{}, err
+	}
+	if discount.ExpiresAt, err = parseTime(expiresAt); err != nil {
+		return DiscountCode{}, err
+	}
+	return discount, nil
+}
+
+func (s *SQLiteStore) SaveDiscountCode(code DiscountCode) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO discount_codes (code, percent_off, amount_off, expires_at, max_uses, uses) VALUES (?, ?, ?, ?, ?, ?)`,
+		code.Code, code.PercentOff, code.AmountOff, formatTime(code.ExpiresAt), code.MaxUses, code.Uses)
+	return err
+}
+
+func (s *SQLiteStore) AddStockMovement(movement StockMovement) error {
+	_, err := s.db.Exec(`INSERT INTO stock_movements (product_id, delta, reason, timestamp, order_id) VALUES (?, ?, ?, ?, ?)`,
+		movement.ProductID, movement.Delta, movement.Reason, formatTime(movement.Timestamp), movement.OrderID)
+	return err
+}
+
+func (s *SQLiteStore) ListStockMovements(productID string) ([]StockMovement, error) {
+	rows, err := s.db.Query(`SELECT product_id, delta, reason, timestamp, order_id FROM stock_movements WHERE product_id = ? ORDER BY seq`, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var movements []StockMovement
+	for rows.Next() {
+		var movement StockMovement
+		var timestamp string
+		if err := rows.Scan(&movement.ProductID, &movement.Delta, &movement.Reason, &timestamp, &movement.OrderID); err != nil {
+			return nil, err
+		}
+		if movement.Timestamp, err = parseTime(timestamp); err != nil {
+			return nil, err
+		}
+		movements = append(movements, movement)
+	}
+	return movements, rows.Err()
+}
+
+func (s *SQLiteStore) AddPriceChange(change PriceChange) error {
+	_, err := s.db.Exec(`INSERT INTO price_changes (product_id, old_price, new_price, timestamp) VALUES (?, ?, ?, ?)`,
+		change.ProductID, change.OldPrice, change.NewPrice, formatTime(change.Timestamp))
+	return err
+}
+
+func (s *SQLiteStore) ListPriceChanges(productID string) ([]PriceChange, error) {
+	rows, err := s.db.Query(`SELECT product_id, old_price, new_price, timestamp FROM price_changes WHERE product_id = ? ORDER BY seq`, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []PriceChange
+	for rows.Next() {
+		var change PriceChange
+		var timestamp string
+		if err := rows.Scan(&change.ProductID, &change.OldPrice, &change.NewPrice, &timestamp); err != nil {
+			return nil, err
+		}
+		if change.Timestamp, err = parseTime(timestamp); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+func (s *SQLiteStore) GetIdempotencyKey(userID, key string) (IdempotencyKey, error) {
+	var record IdempotencyKey
+	var created int64
+	err := s.db.QueryRow(`SELECT user_id, key, order_id, created FROM idempotency_keys WHERE user_id = ? AND key = ?`, userID, key).
+		Scan(&record.UserID, &record.Key, &record.OrderID, &created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return IdempotencyKey{}, ErrNotFound
+	}
+	if err != nil {
+		return IdempotencyKey{}, err
+	}
+	record.Created = time.Unix(0, created)
+	return record, nil
+}
+
+func (s *SQLiteStore) SaveIdempotencyKey(record IdempotencyKey) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO idempotency_keys (user_id, key, order_id, created) VALUES (?, ?, ?, ?)`,
+		record.UserID, record.Key, record.OrderID, record.Created.UnixNano())
+	return err
+}
+
+func (s *SQLiteStore) PruneIdempotencyKeys(before time.Time) error {
+	_, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE created < ?`, before.UnixNano())
+	return err
+}
+
+func (s *SQLiteStore) ListWebhooks() ([]Webhook, error) {
+	rows, err := s.db.Query(`SELECT id, url, created FROM webhooks ORDER BY seq`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var webhook Webhook
+		var created string
+		if err := rows.Scan(&webhook.ID, &webhook.URL, &created); err != nil {
+			return nil, err
+		}
+		if webhook.Created, err = parseTime(created); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+func (s *SQLiteStore) SaveWebhook(webhook Webhook) error {
+	_, err := s.db.Exec(`INSERT INTO webhooks (id, url, created) VALUES (?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET url = excluded.url, created = excluded.created`,
+		webhook.ID, webhook.URL, formatTime(webhook.Created))
+	return err
+}
+
+func (s *SQLiteStore) DeleteWebhook(id string) error {
+	result, err := s.db.Exec(`DELETE FROM webhooks WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteStore) AddReview(review Review) error {
+	_, err := s.db.Exec(`INSERT INTO reviews (id, product_id, user_id, rating, comment, verified, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		review.ID, review.ProductID, review.UserID, review.Rating, review.Comment, review.Verified, formatTime(review.Timestamp))
+	return err
+}
+
+func (s *SQLiteStore) ListReviews(productID string) ([]Review, error) {
+	rows, err := s.db.Query(`SELECT id, product_id, user_id, rating, comment, verified, timestamp FROM reviews WHERE product_id = ? ORDER BY seq`, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reviews []Review
+	for rows.Next() {
+		var review Review
+		var timestamp string
+		if err := rows.Scan(&review.ID, &review.ProductID, &review.UserID, &review.Rating, &review.Comment, &review.Verified, &timestamp); err != nil {
+			return nil, err
+		}
+		if review.Timestamp, err = parseTime(timestamp); err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, review)
+	}
+	return reviews, rows.Err()
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanProduct(row rowScanner) (Product, error) {
+	var product Product
+	var tags string
+	var saleStart, saleEnd, deletedAt sql.NullString
+	err := row.Scan(&product.ID, &product.Name, &product.Description, &product.Price, &product.Category,
+		&product.Stock, &product.Rating, &product.ImageURL, &product.Weight, &tags, &product.SalePrice, &saleStart, &saleEnd, &deletedAt)
+	if err != nil {
+		return Product{}, err
+	}
+	if err := json.Unmarshal([]byte(tags), &product.Tags); err != nil {
+		return Product{}, err
+	}
+	if product.DeletedAt, err = parseOptionalTime(deletedAt); err != nil {
+		return Product{}, err
+	}
+	if product.SaleStart, err = parseOptionalTime(saleStart); err != nil {
+		return Product{}, err
+	}
+	if product.SaleEnd, err = parseOptionalTime(saleEnd); err != nil {
+		return Product{}, err
+	}
+	return product, nil
+}
+
+func scanCart(row rowScanner) (Cart, error) {
+	var cart Cart
+	var items, saved, coupons, updated, reservations string
+	if err := row.Scan(&cart.ID, &cart.UserID, &items, &saved, &cart.Total, &coupons, &updated, &reservations); err != nil {
+		return Cart{}, err
+	}
+	if err := json.Unmarshal([]byte(items), &cart.Items); err != nil {
+		return Cart{}, err
+	}
+	if cart.Items == nil {
+		cart.Items = []CartItem{}
+	}
+	if err := json.Unmarshal([]byte(saved), &cart.Saved); err != nil {
+		return Cart{}, err
+	}
+	if err := json.Unmarshal([]byte(coupons), &cart.Coupons); err != nil {
+		return Cart{}, err
+	}
+	if err := json.Unmarshal([]byte(reservations), &cart.Reservations); err != nil {
+		return Cart{}, err
+	}
+	var err error
+	if cart.Updated, err = parseTime(updated); err != nil {
+		return Cart{}, err
+	}
+	return cart, nil
+}
+
+func scanOrder(row rowScanner) (Order, error) {
+	var order Order
+	var items, created, estimatedDelivery string
+	var completed sql.NullString
+	err := row.Scan(&order.ID, &order.UserID, &items, &order.Total, &order.Status, &created, &completed,
+		&order.ShippingMethod, &order.ShippingCost, &estimatedDelivery, &order.DiscountCode, &order.Discount, &order.Number, &order.Tax)
+	if err != nil {
+		return Order{}, err
+	}
+	if err := json.Unmarshal([]byte(items), &order.Items); err != nil {
+		return Order{}, err
+	}
+	if order.Created, err = parseTime(created); err != nil {
+		return Order{}, err
+	}
+	if order.Completed, err = parseOptionalTime(completed); err != nil {
+		return Order{}, err
+	}
+	if order.EstimatedDelivery, err = parseTime(estimatedDelivery); err != nil {
+		return Order{}, err
+	}
+	return order, nil
+}
+
+// Timestamps are stored as RFC 3339 text with nanoseconds so they round-trip
+// exactly
+
+func formatTime(t time.Time) string {
+	return t.Format(time.RFC3339Nano)
+}
+
+func parseTime(raw string) (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, raw)
+}
+
+func formatOptionalTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return formatTime(*t)
+}
+
+func parseOptionalTime(raw sql.NullString) (*time.Time, error) {
+	if !raw.Valid {
+		return nil, nil
+	}
+	t, err := parseTime(raw.String)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
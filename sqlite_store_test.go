@@ -0,0 +1,242 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// legacySQLiteSchema is the schema of the first SQLite build, before any of
+// sqliteMigrations
+const legacySQLiteSchema = `
+CREATE TABLE products (
+	id          TEXT PRIMARY KEY,
+	name        TEXT NOT NULL,
+	description TEXT NOT NULL,
+	price       REAL NOT NULL,
+	category    TEXT NOT NULL,
+	stock       INTEGER NOT NULL,
+	rating      REAL NOT NULL,
+	image_url   TEXT NOT NULL,
+	sale_price  REAL NOT NULL DEFAULT 0,
+	sale_start  TEXT,
+	sale_end    TEXT
+);
+
+CREATE TABLE carts (
+	id      TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL UNIQUE,
+	items   TEXT NOT NULL,
+	total   REAL NOT NULL,
+	coupons TEXT NOT NULL,
+	updated TEXT NOT NULL
+);
+
+CREATE TABLE orders (
+	id                 TEXT PRIMARY KEY,
+	user_id            TEXT NOT NULL,
+	items              TEXT NOT NULL,
+	total              REAL NOT NULL,
+	status             TEXT NOT NULL,
+	created            TEXT NOT NULL,
+	completed          TEXT NOT NULL,
+	shipping_method    TEXT NOT NULL,
+	shipping_cost      REAL NOT NULL,
+	estimated_delivery TEXT NOT NULL
+);
+CREATE INDEX orders_user_id ON orders (user_id);
+
+INSERT INTO products VALUES ('p1', 'Kettle', 'Boils water', 25, 'Kitchen', 4, 4.5, '', 0, NULL, NULL);
+INSERT INTO carts VALUES ('c1', 'user123', '[{"product_id":"p1","quantity":1}]', 25, '[]', '2023-12-01T10:00:00Z');
+INSERT INTO orders VALUES
+	('o1', 'user123', '[{"product_id":"p1","quantity":1}]', 34.99, 'pending', '2023-12-01T10:00:00Z', '2023-12-01T10:00:00Z', 'standard', 9.99, '2023-12-06T10:00:00Z'),
+	('o2', 'user123', '[{"product_id":"p1","quantity":1}]', 34.99, 'delivered', '2023-12-01T10:00:00Z', '2023-12-04T10:00:00Z', 'standard', 9.99, '2023-12-06T10:00:00Z');
+`
+
+func newTestSQLiteStore(t *testing.T) *SQLiteStore {
+	t.Helper()
+	store, err := newSQLiteStore(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestSQLiteProductRoundTrip(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	saleStart := time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC)
+	saleEnd := time.Date(2023, 12, 2, 0, 0, 0, 0, time.UTC)
+	product := Product{
+		ID: "p1", Name: "Kettle", Description: "Boils water", Price: 25, Category: "Kitchen",
+		Stock: 4, Rating: 4.5, ImageURL: "https://example.com/kettle.jpg", Weight: 1.2,
+		Tags: []string{"kitchen", "tea"}, SalePrice: 20, SaleStart: &saleStart, SaleEnd: &saleEnd,
+	}
+	if err := store.SaveProduct(product); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.GetProduct("p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, product) {
+		t.Errorf("GetProduct = %+v, want %+v", got, product)
+	}
+}
+
+func TestSQLiteOrderRoundTrip(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	completed := time.Date(2023, 12, 4, 10, 0, 0, 0, time.UTC)
+	order := Order{
+		ID: "o1", Number: "ORD-000001", UserID: "user123",
+		Items: []OrderItem{{
+			ProductID: "p1", Quantity: 2, FulfillmentStatus: fulfillmentPending,
+			Name: "Kettle", Category: "Kitchen", UnitPrice: 25,
+		}},
+		Total: 60.49, Status: orderStatusDelivered,
+		Created: time.Date(2023, 12, 1, 10, 0, 0, 0, time.UTC), Completed: &completed,
+		ShippingMethod: "standard", ShippingCost: 9.99,
+		EstimatedDelivery: time.Date(2023, 12, 6, 10, 0, 0, 0, time.UTC),
+		DiscountCode:      "WELCOME5", Discount: 5, Tax: 5.5,
+	}
+	if err := store.SaveOrder(order); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.GetOrder("o1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, order) {
+		t.Errorf("GetOrder = %+v, want %+v", got, order)
+	}
+}
+
+func TestSQLiteMigratesLegacyDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(legacySQLiteSchema); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	store, err := newSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("opening a legacy database: %v", err)
+	}
+
+	var version int
+	if err := store.db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(sqliteMigrations) {
+		t.Errorf("user_version = %d, want %d", version, len(sqliteMigrations))
+	}
+
+	product, err := store.GetProduct("p1")
+	if err != nil {
+		t.Fatalf("reading a legacy product: %v", err)
+	}
+	if product.Name != "Kettle" || product.Weight != 0 || len(product.Tags) != 0 || product.DeletedAt != nil {
+		t.Errorf("legacy product = %+v", product)
+	}
+	var sortName string
+	if err := store.db.QueryRow(`SELECT sort_name FROM products WHERE id = 'p1'`).Scan(&sortName); err != nil || sortName != "kettle" {
+		t.Errorf("legacy product sort_name = %q, %v; want kettle", sortName, err)
+	}
+	if _, err := store.GetCart("user123"); err != nil {
+		t.Errorf("reading a legacy cart: %v", err)
+	}
+
+	pending, err := store.GetOrder("o1")
+	if err != nil {
+		t.Fatalf("reading a legacy order: %v", err)
+	}
+	if pending.Completed != nil || pending.Tax != 0 || pending.Number != "" {
+		t.Errorf("legacy pending order = %+v, want no completed time, tax or number", pending)
+	}
+	delivered, err := store.GetOrder("o2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivered.Completed == nil {
+		t.Error("legacy delivered order lost its completed time")
+	}
+
+	pending.Tax = 2.5
+	if err := store.SaveOrder(pending); err != nil {
+		t.Errorf("saving into a migrated orders table: %v", err)
+	}
+	if err := store.AddReview(Review{ID: "r1", ProductID: "p1", UserID: "user123", Rating: 5, Verified: true, Timestamp: time.Now()}); err != nil {
+		t.Errorf("saving a review: %v", err)
+	}
+
+	// Reopening a migrated database must not run the migrations again
+	store.Close()
+	reopened, err := newSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("reopening the migrated database: %v", err)
+	}
+	reopened.Close()
+}
+
+func TestCartSurvivesRestartWithRepricedTotal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shop.db")
+	store, err := newSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, app := newTestServerWithStore(t, store)
+	saveTestProduct(t, app, "p1", 10, 5)
+	token := testToken(t, "user123", "")
+	addToTestCart(t, r, token, "p1", 3)
+	store.Close()
+
+	// The price goes up while the server is down
+	reopened, err := newSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { reopened.Close() })
+	r, app = newTestServerWithStore(t, reopened)
+	saveTestProduct(t, app, "p1", 12, 5)
+
+	var cart CartView
+	decodeResponse(t, doRequest(t, r, http.MethodGet, "/api/v1/cart/user123", token, nil), http.StatusOK, &cart)
+	if len(cart.Items) != 1 || cart.Items[0].Quantity != 3 {
+		t.Fatalf("reloaded cart lines = %+v, want 3 of p1", cart.Items)
+	}
+	if cart.Total != 36 {
+		t.Errorf("reloaded cart total = %v, want 36 at the new price", cart.Total)
+	}
+}
+
+func TestSQLiteOrderNumbersSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shop.db")
+	store, err := newSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := store.NextOrderNumber(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	reopened, err := newSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if number, err := reopened.NextOrderNumber(); err != nil || number != 4 {
+		t.Errorf("NextOrderNumber after a restart = %d, %v; want 4", number, err)
+	}
+}
@@ -0,0 +1,644 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned by Store lookups when the record doesn't exist
+var ErrNotFound = errors.New("not found")
+
+// ErrInsufficientStock is returned by ReserveStock when a product has fewer
+// units than requested
+var ErrInsufficientStock = errors.New("insufficient stock")
+
+// Store is the persistence layer behind the handlers. Every method is safe
+// for concurrent use on its own; handlers that need several calls to happen
+// atomically (checkout, for one) serialize them with their own lock.
+type Store interface {
+	// Ping reports whether the storage can currently serve requests
+	Ping() error
+
+	// GetProduct returns ErrNotFound for an unknown ID. Deleted products
+	// count as unknown here and in every other product method except
+	// GetProductIncludingDeleted.
+	GetProduct(id string) (Product, error)
+	// GetProductIncludingDeleted is GetProduct that also finds deleted
+	// products
+	GetProductIncludingDeleted(id string) (Product, error)
+	// GetProducts looks up several products at once, leaving unknown IDs
+	// out of the result
+	GetProducts(ids []string) (map[string]Product, error)
+	// ListProducts returns every product in the default listing order
+	ListProducts() ([]Product, error)
+	// ListProductsPage returns up to limit products of ListProducts starting
+	// at offset, and how many products ListProducts has in all
+	ListProductsPage(offset, limit int) ([]Product, int, error)
+	SaveProduct(product Product) error
+	// DeleteProduct marks a product deleted as of the given time; the
+	// record is kept
+	DeleteProduct(id string, at time.Time) error
+	// ReserveStock takes quantity units out of a product's stock in one
+	// step, failing with ErrInsufficientStock instead of going below zero
+	// and with ErrNotFound for an unknown ID. Even several processes sharing
+	// a database can't oversell through it.
+	ReserveStock(productID string, quantity int) error
+	// ReleaseStock puts reserved units back
+	ReleaseStock(productID string, quantity int) error
+
+	// GetCart returns the user's cart or ErrNotFound
+	GetCart(userID string) (Cart, error)
+	SaveCart(cart Cart) error
+	ListCarts() ([]Cart, error)
+	// DeleteCart removes the user's cart, returning ErrNotFound if there is
+	// none
+	DeleteCart(userID string) error
+	// PruneCarts deletes the carts last updated before the cutoff and
+	// returns how many it deleted
+	PruneCarts(before time.Time) (int, error)
+
+	// GetOrder returns ErrNotFound for an unknown ID
+	GetOrder(id string) (Order, error)
+	SaveOrder(order Order) error
+	ListOrders() ([]Order, error)
+	ListOrdersByUser(userID string) ([]Order, error)
+	// NextOrderNumber returns the next value of the order number sequence,
+	// starting at 1. Every call gets a higher value than the last, even
+	// across processes sharing a database.
+	NextOrderNumber() (int64, error)
+
+	AddSearch(search SearchHistory) error
+	ListSearches() ([]SearchHistory, error)
+	ListSearchesByUser(userID string) ([]SearchHistory, error)
+
+	// RecordProductVisit notes a product view, moving a product the user
+	// viewed before to the front, and keeps only the user's keep most
+	// recently viewed products
+	RecordProductVisit(visit ProductVisit, keep int) error
+	// ListProductVisits returns the products the user viewed, newest first
+	ListProductVisits(userID string) ([]ProductVisit, error)
+
+	// GetCoupon returns ErrNotFound for an unknown code
+	GetCoupon(code string) (Coupon, error)
+	SaveCoupon(coupon Coupon) error
+
+	// GetDiscountCode returns ErrNotFound for an unknown code
+	GetDiscountCode(code string) (DiscountCode, error)
+	SaveDiscountCode(code DiscountCode) error
+
+	AddStockMovement(movement StockMovement) error
+	// ListStockMovements returns a product's movements, oldest first
+	ListStockMovements(productID string) ([]StockMovement, error)
+
+	AddPriceChange(change PriceChange) error
+	// ListPriceChanges returns a product's price changes, oldest first
+	ListPriceChanges(productID string) ([]PriceChange, error)
+
+	// GetIdempotencyKey returns ErrNotFound for a key the user never sent
+	GetIdempotencyKey(userID, key string) (IdempotencyKey, error)
+	SaveIdempotencyKey(record IdempotencyKey) error
+	// PruneIdempotencyKeys deletes the keys created before the cutoff
+	PruneIdempotencyKeys(before time.Time) error
+
+	ListWebhooks() ([]Webhook, error)
+	SaveWebhook(webhook Webhook) error
+	// DeleteWebhook returns ErrNotFound for an unknown ID
+	DeleteWebhook(id string) error
+
+	AddReview(review Review) error
+	// ListReviews returns a product's reviews, oldest first
+	ListReviews(productID string) ([]Review, error)
+}
+
+// InMemoryStore keeps everything in maps, so data is lost on restart
+type InMemoryStore struct {
+	mu            sync.RWMutex // guards all of the maps below
+	products      map[string]Product
+	carts         map[string]Cart   // cartID -> cart
+	userCarts     map[string]string // userID -> cartID
+	orders        map[string]Order
+	searchHistory map[string][]SearchHistory // userID -> searches, oldest first
+	visits        map[string][]ProductVisit  // userID -> viewed products, newest first
+	coupons       map[string]Coupon          // code -> coupon
+	discountCodes map[string]DiscountCode    // code -> discount code
+	stockLedger   map[string][]StockMovement // productID -> movements, oldest first
+	priceHistory  map[string][]PriceChange   // productID -> price changes, oldest first
+	reviews       map[string][]Review        // productID -> reviews, oldest first
+	idempotency   map[idempotencyScope]IdempotencyKey
+	webhooks      map[string]Webhook // webhookID -> webhook
+
+	orderSequence int64 // last order number handed out
+
+	// productIndex holds the ID of every product that isn't deleted in the
+	// default listing order (compareDefaultOrder) so listings don't have to
+	// sort. Saves and deletes move single entries with indexProduct and
+	// unindexProduct.
+	productIndex []string
+}
+
+// idempotencyScope keys idempotency records, which are unique per user
+type idempotencyScope struct {
+	userID string
+	key    string
+}
+
+func newInMemoryStore() *InMemoryStore {
+	return &InMemoryStore{
+		products:      make(map[string]Product),
+		carts:         make(map[string]Cart),
+		userCarts:     make(map[string]string),
+		orders:        make(map[string]Order),
+		searchHistory: make(map[string][]SearchHistory),
+		visits:        make(map[string][]ProductVisit),
+		coupons:       make(map[string]Coupon),
+		discountCodes: make(map[string]DiscountCode),
+		stockLedger:   make(map[string][]StockMovement),
+		priceHistory:  make(map[string][]PriceChange),
+		reviews:       make(map[string][]Review),
+		idempotency:   make(map[idempotencyScope]IdempotencyKey),
+		webhooks:      make(map[string]Webhook),
+	}
+}
+
+// Ping always succeeds: the maps are in-process
+func (s *InMemoryStore) Ping() error {
+	return nil
+}
+
+func (s *InMemoryStore) GetProduct(id string) (Product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	product, exists := s.products[id]
+	if !exists || product.DeletedAt != nil {
+		return Product{}, ErrNotFound
+	}
+	return product, nil
+}
+
+func (s *InMemoryStore) GetProductIncludingDeleted(id string) (Product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	product, exists := s.products[id]
+	if !exists {
+		return Product{}, ErrNotFound
+	}
+	return product, nil
+}
+
+func (s *InMemoryStore) GetProducts(ids []string) (map[string]Product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := make(map[string]Product, len(ids))
+	for _, id := range ids {
+		if product, exists := s.products[id]; exists && product.DeletedAt == nil {
+			found[id] = product
+		}
+	}
+	return found, nil
+}
+
+func (s *InMemoryStore) ListProducts() ([]Product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	productList := make([]Product, 0, len(s.productIndex))
+	for _, id := range s.productIndex {
+		productList = append(productList, s.products[id])
+	}
+	return productList, nil
+}
+
+func (s *InMemoryStore) ListProductsPage(offset, limit int) ([]Product, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	start, end := pageBounds(len(s.productIndex), limit, offset)
+	window := make([]Product, 0, end-start)
+	for _, id := range s.productIndex[start:end] {
+		window = append(window, s.products[id])
+	}
+	return window, len(s.productIndex), nil
+}
+
+func (s *InMemoryStore) SaveProduct(product Product) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if previous, exists := s.products[product.ID]; exists && previous.DeletedAt == nil {
+		s.unindexProduct(previous)
+	}
+	s.products[product.ID] = product
+	if product.DeletedAt == nil {
+		s.indexProduct(product)
+	}
+	return nil
+}
+
+func (s *InMemoryStore) ReserveStock(productID string, quantity int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	product, exists := s.products[productID]
+	if !exists || product.DeletedAt != nil {
+		return ErrNotFound
+	}
+	if product.Stock < quantity {
+		return ErrInsufficientStock
+	}
+	product.Stock -= quantity
+	s.products[productID] = product
+	return nil
+}
+
+func (s *InMemoryStore) ReleaseStock(productID string, quantity int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	product, exists := s.products[productID]
+	if !exists {
+		return ErrNotFound
+	}
+	product.Stock += quantity
+	s.products[productID] = product
+	return nil
+}
+
+func (s *InMemoryStore) DeleteProduct(id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	product, exists := s.products[id]
+	if !exists || product.DeletedAt != nil {
+		return ErrNotFound
+	}
+	s.unindexProduct(product)
+	product.DeletedAt = &at
+	s.products[id] = product
+	return nil
+}
+
+// indexPosition binary searches productIndex for the first entry that
+// doesn't sort before product. Callers must hold the lock.
+func (s *InMemoryStore) indexPosition(product Product) int {
+	return sort.Search(len(s.productIndex), func(i int) bool {
+		return compareDefaultOrder(s.products[s.productIndex[i]], product) >= 0
+	})
+}
+
+// indexProduct inserts product into productIndex at its place in the default
+// order. Callers must hold the write lock.
+func (s *InMemoryStore) indexProduct(product Product) {
+	i := s.indexPosition(product)
+	s.productIndex = append(s.productIndex, "")
+	copy(s.productIndex[i+1:], s.productIndex[i:])
+	s.productIndex[i] = product.ID
+}
+
+// unindexProduct removes product from productIndex. It must be the version
+// of the product the index was built from, so call it before replacing the
+// product in the map. Callers must hold the write lock.
+func (s *InMemoryStore) unindexProduct(product Product) {
+	i := s.indexPosition(product)
+	if i < len(s.productIndex) && s.productIndex[i] == product.ID {
+		s.productIndex = append(s.productIndex[:i], s.productIndex[i+1:]...)
+	}
+}
+
+func (s *InMemoryStore) GetCart(userID string) (Cart, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cart, exists := s.carts[s.userCarts[userID]]
+	if !exists {
+		return Cart{}, ErrNotFound
+	}
+	return cloneCart(cart), nil
+}
+
+func (s *InMemoryStore) SaveCart(cart Cart) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.carts[cart.ID] = cloneCart(cart)
+	s.userCarts[cart.UserID] = cart.ID
+	return nil
+}
+
+func (s *InMemoryStore) ListCarts() ([]Cart, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cartList := make([]Cart, 0, len(s.carts))
+	for _, cart := range s.carts {
+		cartList = append(cartList, cloneCart(cart))
+	}
+	return cartList, nil
+}
+
+func (s *InMemoryStore) DeleteCart(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cartID, exists := s.userCarts[userID]
+	if !exists {
+		return ErrNotFound
+	}
+	delete(s.carts, cartID)
+	delete(s.userCarts, userID)
+	return nil
+}
+
+func (s *InMemoryStore) PruneCarts(before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pruned := 0
+	for cartID, cart := range s.carts {
+		if !cart.Updated.Before(before) {
+			continue
+		}
+		delete(s.carts, cartID)
+		if s.userCarts[cart.UserID] == cartID {
+			delete(s.userCarts, cart.UserID)
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+func (s *InMemoryStore) GetOrder(id string) (Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	order, exists := s.orders[id]
+	if !exists {
+		return Order{}, ErrNotFound
+	}
+	return cloneOrder(order), nil
+}
+
+func (s *InMemoryStore) SaveOrder(order Order) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.orders[order.ID] = cloneOrder(order)
+	return nil
+}
+
+func (s *InMemoryStore) ListOrders() ([]Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	orderList := make([]Order, 0, len(s.orders))
+	for _, order := range s.orders {
+		orderList = append(orderList, cloneOrder(order))
+	}
+	return orderList, nil
+}
+
+func (s *InMemoryStore) ListOrdersByUser(userID string) ([]Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	userOrders := []Order{}
+	for _, order := range s.orders {
+		if order.UserID == userID {
+			userOrders = append(userOrders, cloneOrder(order))
+		}
+	}
+	return userOrders, nil
+}
+
+func (s *InMemoryStore) NextOrderNumber() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.orderSequence++
+	return s.orderSequence, nil
+}
+
+func (s *InMemoryStore) AddSearch(search SearchHistory) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.searchHistory[search.UserID] = append(s.searchHistory[search.UserID], search)
+	return nil
+}
+
+func (s *InMemoryStore) ListSearches() ([]SearchHistory, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var searches []SearchHistory
+	for _, userSearches := range s.searchHistory {
+		searches = append(searches, userSearches...)
+	}
+	return searches, nil
+}
+
+func (s *InMemoryStore) ListSearchesByUser(userID string) ([]SearchHistory, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]SearchHistory(nil), s.searchHistory[userID]...), nil
+}
+
+func (s *InMemoryStore) RecordProductVisit(visit ProductVisit, keep int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	visits := []ProductVisit{visit}
+	for _, earlier := range s.visits[visit.UserID] {
+		if earlier.ProductID != visit.ProductID && len(visits) < keep {
+			visits = append(visits, earlier)
+		}
+	}
+	s.visits[visit.UserID] = visits
+	return nil
+}
+
+func (s *InMemoryStore) ListProductVisits(userID string) ([]ProductVisit, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]ProductVisit(nil), s.visits[userID]...), nil
+}
+
+func (s *InMemoryStore) GetCoupon(code string) (Coupon, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	coupon, exists := s.coupons[code]
+	if !exists {
+		return Coupon{}, ErrNotFound
+	}
+	return coupon, nil
+}
+
+func (s *InMemoryStore) SaveCoupon(coupon Coupon) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.coupons[coupon.Code] = coupon
+	return nil
+}
+
+func (s *InMemoryStore) GetDiscountCode(code string) (DiscountCode, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	discount, exists := s.discountCodes[code]
+	if !exists {
+		return DiscountCode{}, ErrNotFound
+	}
+	return discount, nil
+}
+
+func (s *InMemoryStore) SaveDiscountCode(code DiscountCode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.discountCodes[code.Code] = code
+	return nil
+}
+
+func (s *InMemoryStore) AddStockMovement(movement StockMovement) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stockLedger[movement.ProductID] = append(s.stockLedger[movement.ProductID], movement)
+	return nil
+}
+
+func (s *InMemoryStore) ListStockMovements(productID string) ([]StockMovement, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]StockMovement(nil), s.stockLedger[productID]...), nil
+}
+
+func (s *InMemoryStore) AddPriceChange(change PriceChange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.priceHistory[change.ProductID] = append(s.priceHistory[change.ProductID], change)
+	return nil
+}
+
+func (s *InMemoryStore) ListPriceChanges(productID string) ([]PriceChange, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]PriceChange(nil), s.priceHistory[productID]...), nil
+}
+
+func (s *InMemoryStore) GetIdempotencyKey(userID, key string) (IdempotencyKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	record, exists := s.idempotency[idempotencyScope{userID: userID, key: key}]
+	if !exists {
+		return IdempotencyKey{}, ErrNotFound
+	}
+	return record, nil
+}
+
+func (s *InMemoryStore) SaveIdempotencyKey(record IdempotencyKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.idempotency[idempotencyScope{userID: record.UserID, key: record.Key}] = record
+	return nil
+}
+
+func (s *InMemoryStore) PruneIdempotencyKeys(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for scope, record := range s.idempotency {
+		if record.Created.Before(before) {
+			delete(s.idempotency, scope)
+		}
+	}
+	return nil
+}
+
+func (s *InMemoryStore) ListWebhooks() ([]Webhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	webhookList := make([]Webhook, 0, len(s.webhooks))
+	for _, webhook := range s.webhooks {
+		webhookList = append(webhookList, webhook)
+	}
+	sort.Slice(webhookList, func(i, j int) bool {
+		return webhookList[i].Created.Before(webhookList[j].Created)
+	})
+	return webhookList, nil
+}
+
+func (s *InMemoryStore) SaveWebhook(webhook Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.webhooks[webhook.ID] = webhook
+	return nil
+}
+
+func (s *InMemoryStore) DeleteWebhook(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.webhooks[id]; !exists {
+		return ErrNotFound
+	}
+	delete(s.webhooks, id)
+	return nil
+}
+
+func (s *InMemoryStore) AddReview(review Review) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reviews[review.ProductID] = append(s.reviews[review.ProductID], review)
+	return nil
+}
+
+func (s *InMemoryStore) ListReviews(productID string) ([]Review, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]Review(nil), s.reviews[productID]...), nil
+}
+
+// cloneCart copies a cart's slices so callers can't modify the stored cart
+// in place
+func cloneCart(cart Cart) Cart {
+	cart.Items = append([]CartItem{}, cart.Items...)
+	if cart.Saved != nil {
+		cart.Saved = append([]CartItem(nil), cart.Saved...)
+	}
+	if cart.Coupons != nil {
+		cart.Coupons = append([]string(nil), cart.Coupons...)
+	}
+	if cart.Reservations != nil {
+		reservations := make(map[string]time.Time, len(cart.Reservations))
+		for productID, until := range cart.Reservations {
+			reservations[productID] = until
+		}
+		cart.Reservations = reservations
+	}
+	return cart
+}
+
+// cloneOrder copies an order's lines so callers can't modify the stored
+// order in place
+func cloneOrder(order Order) Order {
+	order.Items = append([]OrderItem(nil), order.Items...)
+	return order
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sortedProductIDs lists the IDs of the store's products that aren't deleted,
+// sorted from scratch in the default order
+func sortedProductIDs(s *InMemoryStore) []string {
+	productList := make([]Product, 0, len(s.products))
+	for _, product := range s.products {
+		if product.DeletedAt == nil {
+			productList = append(productList, product)
+		}
+	}
+	sortProducts(productList, defaultProductSort, nil)
+
+	ids := make([]string, 0, len(productList))
+	for _, product := range productList {
+		ids = append(ids, product.ID)
+	}
+	return ids
+}
+
+func TestProductIndexStaysSorted(t *testing.T) {
+	store := newInMemoryStore()
+	rng := rand.New(rand.NewSource(1))
+	names := []string{"apple", "Apple", "banana", "Äpfel", "cherry", "Zebra", "éclair"}
+
+	for step := 0; step < 500; step++ {
+		id := fmt.Sprintf("p%d", rng.Intn(40))
+		if rng.Intn(4) == 0 {
+			store.DeleteProduct(id, time.Now())
+		} else {
+			product := Product{ID: id, Name: names[rng.Intn(len(names))], Stock: step}
+			if err := store.SaveProduct(product); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if want := sortedProductIDs(store); !reflect.DeepEqual(store.productIndex, want) {
+			t.Fatalf("after step %d the index is %v, want %v", step, store.productIndex, want)
+		}
+	}
+}
+
+func TestListProductsPage(t *testing.T) {
+	for name, store := range contractStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for i, productName := range []string{"Zebra", "éclair", "apple", "Äpfel", "Banana"} {
+				if err := store.SaveProduct(Product{ID: fmt.Sprintf("p%d", i), Name: productName}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := store.DeleteProduct("p4", time.Now()); err != nil {
+				t.Fatal(err)
+			}
+
+			all, err := store.ListProducts()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, product := range all {
+				ids = append(ids, product.ID)
+			}
+			if want := []string{"p2", "p0", "p3", "p1"}; !reflect.DeepEqual(ids, want) {
+				t.Errorf("ListProducts order = %v, want %v", ids, want)
+			}
+
+			window, total, err := store.ListProductsPage(1, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != 4 || len(window) != 2 || window[0].ID != "p0" || window[1].ID != "p3" {
+				t.Errorf("ListProductsPage(1, 2) = %v of %d, want p0 and p3 of 4", window, total)
+			}
+			if window, _, _ := store.ListProductsPage(10, 2); len(window) != 0 {
+				t.Errorf("ListProductsPage past the end = %v, want none", window)
+			}
+		})
+	}
+}
+
+var (
+	_ Store = (*InMemoryStore)(nil)
+	_ Store = (*SQLiteStore)(nil)
+)
+
+// contractStores returns a fresh instance of every Store implementation
+func contractStores(t *testing.T) map[string]Store {
+	return map[string]Store{"memory": newInMemoryStore(), "sqlite": newTestSQLiteStore(t)}
+}
+
+func TestStoreProducts(t *testing.T) {
+	for name, store := range contractStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := store.GetProduct("p1"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetProduct of an unknown ID = %v, want ErrNotFound", err)
+			}
+			for _, id := range []string{"p1", "p2"} {
+				if err := store.SaveProduct(Product{ID: id, Name: "Product " + id, Price: 10, Stock: 3}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if product, err := store.GetProduct("p1"); err != nil || product.Name != "Product p1" {
+				t.Errorf("GetProduct = %+v, %v", product, err)
+			}
+
+			found, err := store.GetProducts([]string{"p1", "missing"})
+			if err != nil || len(found) != 1 || found["p1"].ID != "p1" {
+				t.Errorf("GetProducts = %v, %v; want only p1", found, err)
+			}
+
+			if err := store.DeleteProduct("p2", time.Now()); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.GetProduct("p2"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetProduct of a deleted product = %v, want ErrNotFound", err)
+			}
+			if product, err := store.GetProductIncludingDeleted("p2"); err != nil || product.DeletedAt == nil {
+				t.Errorf("GetProductIncludingDeleted = %+v, %v; want it marked deleted", product, err)
+			}
+			if all, _ := store.ListProducts(); len(all) != 1 {
+				t.Errorf("ListProducts = %+v, want only p1", all)
+			}
+		})
+	}
+}
+
+func TestStoreReserveStock(t *testing.T) {
+	for name, store := range contractStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := store.SaveProduct(Product{ID: "p1", Name: "Kettle", Stock: 3}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.ReserveStock("p1", 2); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.ReserveStock("p1", 2); !errors.Is(err, ErrInsufficientStock) {
+				t.Errorf("reserving past the stock = %v, want ErrInsufficientStock", err)
+			}
+			if err := store.ReserveStock("missing", 1); !errors.Is(err, ErrNotFound) {
+				t.Errorf("reserving an unknown product = %v, want ErrNotFound", err)
+			}
+			if err := store.ReleaseStock("p1", 1); err != nil {
+				t.Fatal(err)
+			}
+			if product, _ := store.GetProduct("p1"); product.Stock != 2 {
+				t.Errorf("stock = %d, want 2", product.Stock)
+			}
+		})
+	}
+}
+
+func TestStoreCarts(t *testing.T) {
+	for name, store := range contractStores(t) {
+		t.Run(name, func(t *testing.T) {
+			updated := time.Date(2023, 12, 1, 10, 0, 0, 0, time.UTC)
+			if _, err := store.GetCart("user123"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetCart without a cart = %v, want ErrNotFound", err)
+			}
+			cart := Cart{ID: "c1", UserID: "user123", Items: []CartItem{{ProductID: "p1", Quantity: 2}}, Total: 20, Updated: updated}
+			if err := store.SaveCart(cart); err != nil {
+				t.Fatal(err)
+			}
+			got, err := store.GetCart("user123")
+			if err != nil || got.ID != "c1" || !reflect.DeepEqual(got.Items, cart.Items) || got.Total != 20 || !got.Updated.Equal(updated) {
+				t.Errorf("GetCart = %+v, %v; want %+v", got, err, cart)
+			}
+
+			// Changing the returned cart doesn't change the stored one
+			got.Items[0].Quantity = 9
+			if again, _ := store.GetCart("user123"); again.Items[0].Quantity != 2 {
+				t.Errorf("stored cart changed through a returned copy: %+v", again.Items)
+			}
+
+			if pruned, err := store.PruneCarts(updated); err != nil || pruned != 0 {
+				t.Errorf("PruneCarts at the update time = %d, %v; want none pruned", pruned, err)
+			}
+			if err := store.DeleteCart("user123"); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.DeleteCart("user123"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("deleting a missing cart = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestStoreOrders(t *testing.T) {
+	for name, store := range contractStores(t) {
+		t.Run(name, func(t *testing.T) {
+			created := time.Date(2023, 12, 1, 10, 0, 0, 0, time.UTC)
+			for i, userID := range []string{"alice", "bob", "alice"} {
+				order := Order{ID: fmt.Sprintf("o%d", i), UserID: userID, Status: orderStatusPending, Created: created.Add(time.Duration(i) * time.Hour)}
+				if err := store.SaveOrder(order); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := store.GetOrder("missing"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetOrder of an unknown ID = %v, want ErrNotFound", err)
+			}
+			if orders, err := store.ListOrdersByUser("alice"); err != nil || len(orders) != 2 {
+				t.Errorf("ListOrdersByUser(alice) = %+v, %v; want 2 orders", orders, err)
+			}
+			if orders, err := store.ListOrders(); err != nil || len(orders) != 3 {
+				t.Errorf("ListOrders = %d orders, %v; want 3", len(orders), err)
+			}
+
+			first, err := store.NextOrderNumber()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if second, _ := store.NextOrderNumber(); first != 1 || second != 2 {
+				t.Errorf("order numbers = %d, %d; want 1, 2", first, second)
+			}
+		})
+	}
+}
+
+func TestStoreOrderNumbersUniqueUnderConcurrency(t *testing.T) {
+	for name, store := range contractStores(t) {
+		t.Run(name, func(t *testing.T) {
+			const workers, perWorker = 8, 25
+			numbers := make([][]int64, workers)
+			var wg sync.WaitGroup
+			for w := range numbers {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < perWorker; i++ {
+						number, err := store.NextOrderNumber()
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						numbers[w] = append(numbers[w], number)
+					}
+				}(w)
+			}
+			wg.Wait()
+
+			var all []int64
+			for w, drawn := range numbers {
+				for i := 1; i < len(drawn); i++ {
+					if drawn[i] <= drawn[i-1] {
+						t.Errorf("worker %d drew %d after %d, want strictly increasing", w, drawn[i], drawn[i-1])
+					}
+				}
+				all = append(all, drawn...)
+			}
+			sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+			for i, number := range all {
+				if number != int64(i+1) {
+					t.Fatalf("numbers drawn = %v, want each of 1 to %d once", all, workers*perWorker)
+				}
+			}
+		})
+	}
+}
+
+// newBenchmarkStore fills an in-memory store with n products
+func newBenchmarkStore(b *testing.B, n int) *InMemoryStore {
+	store := newInMemoryStore()
+	for i := 0; i < n; i++ {
+		if err := store.SaveProduct(Product{ID: fmt.Sprintf("p%d", i), Name: fmt.Sprintf("Product %d", i)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return store
+}
+
+func BenchmarkSaveProduct(b *testing.B) {
+	store := newBenchmarkStore(b, 10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.SaveProduct(Product{ID: "p5000", Name: fmt.Sprintf("Renamed %d", i)})
+	}
+}
+
+func BenchmarkListProductsPage(b *testing.B) {
+	store := newBenchmarkStore(b, 10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.ListProductsPage(5000, 20)
+	}
+}
+
+// BenchmarkSortProductsPerRequest is the baseline the sorted index replaced:
+// every listing sorted the whole catalog before cutting out its page.
+// ListProducts now comes back sorted, so it is shuffled into the map order
+// the sort used to start from.
+func BenchmarkSortProductsPerRequest(b *testing.B) {
+	store := newBenchmarkStore(b, 10000)
+	rng := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		productList, _ := store.ListProducts()
+		rng.Shuffle(len(productList), func(i, j int) { productList[i], productList[j] = productList[j], productList[i] })
+		sortProducts(productList, defaultProductSort, nil)
+		_ = productList[5000:5020]
+	}
+}
@@ -6,6 +6,26 @@
 BASE_URL="http://localhost:3001/api/v1"
 USER_ID="test_user_123"
 
+# Cart, checkout, order and recommendation endpoints need a bearer token for
+# $USER_ID, and the admin endpoints one with the admin role. Pass them in
+# TOKEN and ADMIN_TOKEN, or export the server's JWT_SECRET to have them
+# signed here.
+sign() {
+  b64url() { openssl base64 -A | tr '+/' '-_' | tr -d '='; }
+  HEADER=$(printf '{"alg":"HS256","typ":"JWT"}' | b64url)
+  PAYLOAD=$(printf '%s' "$1" | b64url)
+  SIGNATURE=$(printf '%s.%s' "$HEADER" "$PAYLOAD" | openssl dgst -sha256 -hmac "$JWT_SECRET" -binary | b64url)
+  echo "$HEADER.$PAYLOAD.$SIGNATURE"
+}
+if [ -z "$TOKEN" ] && [ -n "$JWT_SECRET" ]; then
+  TOKEN=$(sign "$(printf '{"sub":"%s","exp":%d}' "$USER_ID" $(( $(date +%s) + 3600 )))")
+fi
+if [ -z "$ADMIN_TOKEN" ] && [ -n "$JWT_SECRET" ]; then
+  ADMIN_TOKEN=$(sign "$(printf '{"sub":"admin","role":"admin","exp":%d}' $(( $(date +%s) + 3600 )))")
+fi
+AUTH="Authorization: Bearer $TOKEN"
+ADMIN_AUTH="Authorization: Bearer $ADMIN_TOKEN"
+
 echo "🧪 Testing SHITty E-commerce API"
 echo "=================================="
 echo ""
@@ -36,9 +56,9 @@ echo ""
 
 # Test 5: Add product to cart
 echo "5️⃣ Testing POST /cart/add"
-curl -s -X POST "$BASE_URL/cart/add?user_id=$USER_ID" \
+curl -s -X POST "$BASE_URL/cart/add" -H "$AUTH" \
   -H "Content-Type: application/json" \
-  -d '{"product_id": "1", "quantity": 2}' | jq '.' 2>/dev/null || curl -s -X POST "$BASE_URL/cart/add?user_id=$USER_ID" \
+  -d '{"product_id": "1", "quantity": 2}' | jq '.' 2>/dev/null || curl -s -X POST "$BASE_URL/cart/add" -H "$AUTH" \
   -H "Content-Type: application/json" \
   -d '{"product_id": "1", "quantity": 2}'
 echo ""
@@ -46,9 +66,9 @@ echo ""
 
 # Test 6: Add another product to cart
 echo "6️⃣ Testing POST /cart/add (second product)"
-curl -s -X POST "$BASE_URL/cart/add?user_id=$USER_ID" \
+curl -s -X POST "$BASE_URL/cart/add" -H "$AUTH" \
   -H "Content-Type: application/json" \
-  -d '{"product_id": "3", "quantity": 1}' | jq '.' 2>/dev/null || curl -s -X POST "$BASE_URL/cart/add?user_id=$USER_ID" \
+  -d '{"product_id": "3", "quantity": 1}' | jq '.' 2>/dev/null || curl -s -X POST "$BASE_URL/cart/add" -H "$AUTH" \
   -H "Content-Type: application/json" \
   -d '{"product_id": "3", "quantity": 1}'
 echo ""
@@ -56,38 +76,121 @@ echo ""
 
 # Test 7: View cart
 echo "7️⃣ Testing GET /cart/$USER_ID"
-curl -s "$BASE_URL/cart/$USER_ID" | jq '.' 2>/dev/null || curl -s "$BASE_URL/cart/$USER_ID"
+curl -s -H "$AUTH" "$BASE_URL/cart/$USER_ID" | jq '.' 2>/dev/null || curl -s -H "$AUTH" "$BASE_URL/cart/$USER_ID"
 echo ""
 echo ""
 
 # Test 8: Get recommendations
 echo "8️⃣ Testing GET /recommendations/$USER_ID"
-curl -s "$BASE_URL/recommendations/$USER_ID" | jq '.' 2>/dev/null || curl -s "$BASE_URL/recommendations/$USER_ID"
+curl -s -H "$AUTH" "$BASE_URL/recommendations/$USER_ID" | jq '.' 2>/dev/null || curl -s -H "$AUTH" "$BASE_URL/recommendations/$USER_ID"
 echo ""
 echo ""
 
 # Test 9: Checkout
 echo "9️⃣ Testing POST /checkout"
-curl -s -X POST "$BASE_URL/checkout?user_id=$USER_ID" | jq '.' 2>/dev/null || curl -s -X POST "$BASE_URL/checkout?user_id=$USER_ID"
+curl -s -X POST -H "$AUTH" "$BASE_URL/checkout" | jq '.' 2>/dev/null || curl -s -X POST -H "$AUTH" "$BASE_URL/checkout"
 echo ""
 echo ""
 
 # Test 10: View order history
 echo "🔟 Testing GET /orders/$USER_ID"
-curl -s "$BASE_URL/orders/$USER_ID" | jq '.' 2>/dev/null || curl -s "$BASE_URL/orders/$USER_ID"
+curl -s -H "$AUTH" "$BASE_URL/orders/$USER_ID" | jq '.' 2>/dev/null || curl -s -H "$AUTH" "$BASE_URL/orders/$USER_ID"
 echo ""
 echo ""
 
 # Test 11: View empty cart after checkout
 echo "1️⃣1️⃣ Testing GET /cart/$USER_ID (should be empty after checkout)"
-curl -s "$BASE_URL/cart/$USER_ID" | jq '.' 2>/dev/null || curl -s "$BASE_URL/cart/$USER_ID"
+curl -s -H "$AUTH" "$BASE_URL/cart/$USER_ID" | jq '.' 2>/dev/null || curl -s -H "$AUTH" "$BASE_URL/cart/$USER_ID"
 echo ""
 echo ""
 
 # Test 12: Get recommendations after order
 echo "1️⃣2️⃣ Testing GET /recommendations/$USER_ID (after order)"
-curl -s "$BASE_URL/recommendations/$USER_ID" | jq '.' 2>/dev/null || curl -s "$BASE_URL/recommendations/$USER_ID"
+curl -s -H "$AUTH" "$BASE_URL/recommendations/$USER_ID" | jq '.' 2>/dev/null || curl -s -H "$AUTH" "$BASE_URL/recommendations/$USER_ID"
+echo ""
+echo ""
+
+# Test 13: Readiness reports storage and sample data status
+echo "1️⃣3️⃣ Testing GET /health/ready (should be 200 with healthy store and data components)"
+curl -s -w "\n%{http_code}\n" "http://localhost:3001/health/ready"
+echo ""
+
+# Test 14: Swagger UI is served
+echo "1️⃣4️⃣ Testing GET /swagger/index.html (should be 200)"
+curl -s -o /dev/null -w "%{http_code}\n" "http://localhost:3001/swagger/index.html"
+echo ""
+
+# Test 15: Malformed and unknown order IDs are told apart
+echo "1️⃣5️⃣ Testing POST /orders/not-a-uuid/cancel (should be 400)"
+curl -s -o /dev/null -w "%{http_code}\n" -X POST -H "$AUTH" "$BASE_URL/orders/not-a-uuid/cancel"
+echo "1️⃣5️⃣ Testing POST /orders/00000000-0000-0000-0000-000000000000/cancel (should be 404)"
+curl -s -o /dev/null -w "%{http_code}\n" -X POST -H "$AUTH" "$BASE_URL/orders/00000000-0000-0000-0000-000000000000/cancel"
+echo ""
+
+# Test 16: Bulk stock update, lenient and strict
+echo "1️⃣6️⃣ Testing PUT /products/stock (unknown product skipped)"
+curl -s -X PUT -H "$ADMIN_AUTH" "$BASE_URL/products/stock" -H "Content-Type: application/json" \
+  -d '[{"product_id": "1", "stock": 40}, {"product_id": "missing", "stock": 5}]' | jq '.' 2>/dev/null || curl -s -X PUT -H "$ADMIN_AUTH" "$BASE_URL/products/stock" -H "Content-Type: application/json" \
+  -d '[{"product_id": "1", "stock": 40}, {"product_id": "missing", "stock": 5}]'
+echo "1️⃣6️⃣ Testing PUT /products/stock?strict=true (should be 400)"
+curl -s -o /dev/null -w "%{http_code}\n" -X PUT -H "$ADMIN_AUTH" "$BASE_URL/products/stock?strict=true" -H "Content-Type: application/json" \
+  -d '[{"product_id": "1", "stock": 40}, {"product_id": "missing", "stock": 5}]'
+echo ""
+
+# Test 17: Receipt of the order placed above
+ORDER_ID=$(curl -s -H "$AUTH" "$BASE_URL/orders/$USER_ID" | jq -r '.[0].id' 2>/dev/null)
+echo "1️⃣7️⃣ Testing GET /orders/detail/$ORDER_ID/receipt?format=text"
+curl -s -H "$AUTH" "$BASE_URL/orders/detail/$ORDER_ID/receipt?format=text"
+echo "1️⃣7️⃣ Testing GET /orders/detail/$ORDER_ID/receipt?format=pdf (should be 400)"
+curl -s -o /dev/null -w "%{http_code}\n" -H "$AUTH" "$BASE_URL/orders/detail/$ORDER_ID/receipt?format=pdf"
 echo ""
+
+# Test 18: Search ignores surrounding spaces and matches categories alone
+echo "1️⃣8️⃣ Testing GET /search?q=%20%20iphone%20%20 (should find iPhone 15 Pro)"
+curl -s "$BASE_URL/search?q=%20%20iphone%20%20" | jq '.data[].name' 2>/dev/null || curl -s "$BASE_URL/search?q=%20%20iphone%20%20"
+echo "1️⃣8️⃣ Testing GET /search?q=electronics (category-only matches)"
+curl -s "$BASE_URL/search?q=electronics" | jq '.data[].name' 2>/dev/null || curl -s "$BASE_URL/search?q=electronics"
+echo ""
+
+# Test 19: Tags are normalized, filterable and searchable
+echo "1️⃣9️⃣ Testing PATCH /products/2 with tags [\"  Workstation \", \"LAPTOP\"]"
+curl -s -X PATCH -H "$ADMIN_AUTH" "$BASE_URL/products/2" -H "Content-Type: application/json" \
+  -d '{"tags": ["  Workstation ", "LAPTOP"]}' | jq '.tags' 2>/dev/null || curl -s -X PATCH -H "$ADMIN_AUTH" "$BASE_URL/products/2" -H "Content-Type: application/json" \
+  -d '{"tags": ["  Workstation ", "LAPTOP"]}'
+echo "1️⃣9️⃣ Testing GET /products?tag=Workstation (should list MacBook Pro M3)"
+curl -s "$BASE_URL/products?tag=Workstation" | jq '.data[].name' 2>/dev/null || curl -s "$BASE_URL/products?tag=Workstation"
+echo "1️⃣9️⃣ Testing GET /search?q=workstation (should find MacBook Pro M3)"
+curl -s "$BASE_URL/search?q=workstation" | jq '.data[].name' 2>/dev/null || curl -s "$BASE_URL/search?q=workstation"
+echo ""
+
+# Test 20: Recently viewed products, newest first
+echo "2️⃣0️⃣ Viewing products 1, 3 and 4 as $USER_ID"
+for id in 1 3 4; do
+  curl -s -o /dev/null "$BASE_URL/products/$id?user_id=$USER_ID"
+done
+echo "2️⃣0️⃣ Testing GET /users/$USER_ID/recently-viewed (should be 4, 3, 1)"
+curl -s -H "$AUTH" "$BASE_URL/users/$USER_ID/recently-viewed" | jq '.[].id' 2>/dev/null || curl -s -H "$AUTH" "$BASE_URL/users/$USER_ID/recently-viewed"
+echo ""
+
+# Test 21: Abandoned carts
+echo "2️⃣1️⃣ Testing GET /admin/abandoned-carts?idle_minutes=0 (should be 400)"
+curl -s -H "$ADMIN_AUTH" -o /dev/null -w "%{http_code}\n" "$BASE_URL/admin/abandoned-carts?idle_minutes=0"
+echo "2️⃣1️⃣ Testing GET /admin/abandoned-carts?idle_minutes=60"
+curl -s -H "$ADMIN_AUTH" "$BASE_URL/admin/abandoned-carts?idle_minutes=60" | jq '.' 2>/dev/null || curl -s -H "$ADMIN_AUTH" "$BASE_URL/admin/abandoned-carts?idle_minutes=60"
+echo ""
+
+# Test 22: Pagination links
+echo "2️⃣2️⃣ Testing GET /products?limit=2&sort=price_asc (prev should be null, next offset=2)"
+curl -s "$BASE_URL/products?limit=2&sort=price_asc" | jq '{next, prev}' 2>/dev/null || curl -s "$BASE_URL/products?limit=2&sort=price_asc"
+echo "2️⃣2️⃣ Testing GET /products?limit=2&offset=4&sort=price_asc (next should be null)"
+curl -s "$BASE_URL/products?limit=2&offset=4&sort=price_asc" | jq '{next, prev}' 2>/dev/null || curl -s "$BASE_URL/products?limit=2&offset=4&sort=price_asc"
+echo ""
+
+# Test 23: Page size default and cap
+echo "2️⃣3️⃣ Testing GET /products (limit should be the default page size, 20)"
+curl -s "$BASE_URL/products" | jq '.limit' 2>/dev/null || curl -s "$BASE_URL/products"
+echo "2️⃣3️⃣ Testing GET /products?limit=100000 (limit should be clamped to the max page size, 100)"
+curl -s "$BASE_URL/products?limit=100000" | jq '.limit' 2>/dev/null || curl -s "$BASE_URL/products?limit=100000"
 echo ""
 
 echo "✅ API testing completed!"
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Order events delivered to webhooks
+const (
+	webhookOrderCreated       = "order.created"
+	webhookOrderStatusChanged = "order.status_changed"
+)
+
+// Headers set on every webhook delivery. The signature is the hex HMAC-SHA256
+// of the request body keyed with WEBHOOK_SECRET, prefixed with "sha256=".
+const (
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// webhookTimeout bounds a single delivery attempt
+const webhookTimeout = 5 * time.Second
+
+// webhookDispatcher delivers events to every registered webhook in the
+// background so handlers never wait on a receiver. A delivery that fails or
+// gets a non-2xx answer is retried with exponential backoff.
+type webhookDispatcher struct {
+	store       Store
+	secret      string
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+
+	// mu guards closed, so that once Close is waiting on wg no publish can
+	// start another delivery
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+	stop   chan struct{}
+}
+
+func newWebhookDispatcher(store Store, secret string, maxAttempts int, backoff time.Duration) *webhookDispatcher {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &webhookDispatcher{
+		store:       store,
+		secret:      secret,
+		client:      &http.Client{Timeout: webhookTimeout},
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		stop:        make(chan struct{}),
+	}
+}
+
+// publish sends an order event to every registered webhook. It only starts
+// the deliveries and never blocks on them; failures are logged. Once the
+// dispatcher is closed, events are dropped. requestID is the request that
+// caused the event and tags every log line about it.
+func (d *webhookDispatcher) publish(requestID, eventType string, order Order) {
+	webhooks, err := d.store.ListWebhooks()
+	if err != nil {
+		requestLogf(requestID, "Webhook %s for order %s not sent: %v", eventType, order.ID, err)
+		return
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(WebhookEvent{
+		ID:        uuid.New().String(),
+		Event:     eventType,
+		Order:     order,
+		Timestamp: now(),
+	})
+	if err != nil {
+		requestLogf(requestID, "Webhook %s for order %s not sent: %v", eventType, order.ID, err)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		requestLogf(requestID, "Webhook %s for order %s not sent: shutting down", eventType, order.ID)
+		return
+	}
+	for _, webhook := range webhooks {
+		d.wg.Add(1)
+		go func(url string) {
+			defer d.wg.Done()
+			d.deliver(requestID, url, eventType, body)
+		}(webhook.URL)
+	}
+}
+
+// deliver POSTs body to url until it gets a 2xx answer, the attempts run out
+// or the dispatcher is closed
+func (d *webhookDispatcher) deliver(requestID, url, eventType string, body []byte) {
+	wait := d.backoff
+	for attempt := 1; ; attempt++ {
+		err := d.post(url, eventType, body)
+		if err == nil {
+			return
+		}
+		if attempt == d.maxAttempts {
+			requestLogf(requestID, "Webhook %s to %s failed after %d attempts: %v", eventType, url, attempt, err)
+			return
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-d.stop:
+			timer.Stop()
+			requestLogf(requestID, "Webhook %s to %s abandoned at shutdown: %v", eventType, url, err)
+			return
+		}
+		wait *= 2
+	}
+}
+
+// post makes a single signed delivery attempt
+func (d *webhookDispatcher) post(url, eventType string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, eventType)
+	if d.secret != "" {
+		req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(d.secret, body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close stops retrying failed deliveries and waits until in-flight attempts
+// finish or ctx is done
+func (d *webhookDispatcher) Close(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.stop)
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// signWebhook returns the hex HMAC-SHA256 of body keyed with secret
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
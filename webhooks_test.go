@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckoutDeliversSignedWebhook(t *testing.T) {
+	r, app := newTestServer(t)
+	config.WebhookSecret = "hook-secret"
+	app.webhooks = newWebhookDispatcher(app.store, config.WebhookSecret, 1, time.Millisecond)
+
+	type delivery struct {
+		event, signature string
+		body             []byte
+	}
+	received := make(chan delivery, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		received <- delivery{req.Header.Get(webhookEventHeader), req.Header.Get(webhookSignatureHeader), body}
+	}))
+	defer receiver.Close()
+
+	w := doRequest(t, r, http.MethodPost, "/api/v1/admin/webhooks", testToken(t, "admin", roleAdmin), WebhookRequest{URL: receiver.URL})
+	decodeResponse(t, w, http.StatusCreated, nil)
+
+	saveTestProduct(t, app, "p1", 10, 5)
+	token := testToken(t, "user123", "")
+	addToTestCart(t, r, token, "p1", 1)
+	var order Order
+	decodeResponse(t, doRequest(t, r, http.MethodPost, "/api/v1/checkout", token, nil), http.StatusOK, &order)
+
+	select {
+	case got := <-received:
+		if got.event != webhookOrderCreated {
+			t.Errorf("event header = %q, want %q", got.event, webhookOrderCreated)
+		}
+		if want := "sha256=" + signWebhook("hook-secret", got.body); got.signature != want {
+			t.Errorf("signature = %q, want %q", got.signature, want)
+		}
+		var event WebhookEvent
+		if err := json.Unmarshal(got.body, &event); err != nil {
+			t.Fatalf("decoding event: %v", err)
+		}
+		if event.Order.ID != order.ID {
+			t.Errorf("event order = %s, want %s", event.Order.ID, order.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook delivered")
+	}
+}
+
+func TestWebhookPublishAfterCloseIsDropped(t *testing.T) {
+	store := newInMemoryStore()
+	delivered := make(chan struct{}, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		delivered <- struct{}{}
+	}))
+	defer receiver.Close()
+	if err := store.SaveWebhook(Webhook{ID: "hook", URL: receiver.URL}); err != nil {
+		t.Fatal(err)
+	}
+
+	dispatcher := newWebhookDispatcher(store, "", 1, time.Millisecond)
+	if err := dispatcher.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	dispatcher.publish("request", webhookOrderCreated, Order{ID: "order"})
+
+	select {
+	case <-delivered:
+		t.Error("event published after Close was delivered")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRegisterWebhookRejectsNonHTTPURLs(t *testing.T) {
+	r, _ := newTestServer(t)
+	admin := testToken(t, "admin", roleAdmin)
+
+	for _, url := range []string{"/relative/path", "ftp://hooks.example.com/orders", "https://", "not a url"} {
+		w := doRequest(t, r, http.MethodPost, "/api/v1/admin/webhooks", admin, WebhookRequest{URL: url})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("registering %q = %d, want 400", url, w.Code)
+		}
+	}
+}